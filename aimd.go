@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+var (
+	sloLatency  time.Duration
+	sloErrors   float64
+	adaptWindow time.Duration
+	adaptStep   int
+)
+
+// aimdWindow is what the requests finished in one -adapt-window measured.
+type aimdWindow struct {
+	limit     int
+	requests  int
+	failed    int
+	latencies []time.Duration
+	elapsed   time.Duration
+	met       bool
+}
+
+// aimd is the adaptive loop's state on top of the run's totals.
+type aimd struct {
+	mu      sync.Mutex
+	limit   int
+	cur     *aimdWindow
+	windows []*aimdWindow
+}
+
+func (a *aimd) record(err error, latency time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err == context.Canceled {
+		return
+	}
+	a.cur.requests++
+	if err != nil {
+		a.cur.failed++
+		return
+	}
+	a.cur.latencies = append(a.cur.latencies, latency)
+}
+
+// close ends the window with the requests in flight: it checks the SLO,
+// raises the limit by -adapt-step when the window met it and halves it
+// when not, and starts the next window.
+func (a *aimd) close(w time.Duration, flight int) *aimdWindow {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	win := a.cur
+	win.elapsed = w
+	sort.Slice(win.latencies, func(i, j int) bool { return win.latencies[i] < win.latencies[j] })
+	// a window without an answer, requests in flight, is a stalled proxy
+	win.met = flight == 0
+	if win.requests > 0 {
+		win.met = float64(win.failed)*100/float64(win.requests) <= sloErrors && quantile(win.latencies, 0.95) <= sloLatency
+	}
+	if win.met {
+		a.limit = min(a.limit+adaptStep, benchMaxInFlight)
+	} else {
+		a.limit = max(a.limit/2, 1)
+	}
+	a.windows = append(a.windows, win)
+	a.cur = &aimdWindow{limit: a.limit}
+	return win
+}
+
+func (a *aimd) current() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.limit
+}
+
+// adaptive runs a closed loop whose concurrency the SLO steers, AIMD
+// like TCP's congestion window: starting at -workers in flight, every
+// -adapt-window that kept p95 latency within -slo-latency and failures
+// within -slo-errors percent adds -adapt-step, every one that did not
+// halves it. The limit saws around what the proxy sustains.
+func (r *benchRun) adaptive(ctx context.Context, client *proxyclient.Client) *aimd {
+	a := &aimd{limit: benchWorkers}
+	a.cur = &aimdWindow{limit: a.limit}
+	start := time.Now()
+	end := time.NewTimer(duration)
+	defer end.Stop()
+	tick := time.NewTicker(adaptWindow)
+	defer tick.Stop()
+	windowStart := start
+	// a finished request wakes the dispatcher to send the next one
+	freed := make(chan struct{}, 1)
+	var wg sync.WaitGroup
+	for {
+		if r.enter(a.current()) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sent := time.Now()
+				err := benchRequest(ctx, client)
+				r.record(err, time.Since(sent))
+				a.record(err, time.Since(sent))
+				select {
+				case freed <- struct{}{}:
+				default:
+				}
+			}()
+			continue
+		}
+		select {
+		case <-freed:
+			continue
+		case now := <-tick.C:
+			r.mu.Lock()
+			flight := r.flight
+			r.mu.Unlock()
+			win := a.close(now.Sub(windowStart), flight)
+			windowStart = now
+			printWindow(len(a.windows), win, a.current())
+			continue
+		case <-end.C:
+		case <-ctx.Done():
+		}
+		break
+	}
+	wg.Wait()
+	r.elapsed = time.Since(start)
+	return a
+}
+
+func printWindow(n int, win *aimdWindow, next int) {
+	verdict := fmt.Sprintf("up to %d", next)
+	if !win.met {
+		verdict = fmt.Sprintf("SLO breached, back to %d", next)
+	}
+	errs := 0.0
+	if win.requests > 0 {
+		errs = float64(win.failed) * 100 / float64(win.requests)
+	}
+	fmt.Printf("bench: window %d, %d in flight, %.1f/s, p95 %s, %.1f%% failed: %s\n", n, win.limit, win.rate(), dur(quantile(win.latencies, 0.95)), errs, verdict)
+}
+
+// report prints what the adaptive loop converged on: the best window
+// meeting the SLO since the first breach, the limit sawing around the
+// capacity from then on, or of all windows when the SLO was never
+// breached and the capacity is beyond what was reached. It returns false
+// when no window met the SLO.
+func (a *aimd) report() bool {
+	from := 0
+	for i, w := range a.windows {
+		if !w.met {
+			from = i + 1
+			break
+		}
+	}
+	breached := from > 0
+	best := func(ws []*aimdWindow) *aimdWindow {
+		var b *aimdWindow
+		for _, w := range ws {
+			if w.met && (b == nil || w.rate() > b.rate()) {
+				b = w
+			}
+		}
+		return b
+	}
+	b := best(a.windows[from:])
+	// breached in the last window, the ramp up is all there is
+	if b == nil {
+		b = best(a.windows)
+	}
+	switch {
+	case len(a.windows) == 0:
+		fmt.Printf("bench: adaptive loop, no window of %s finished, raise -duration\n", dur(adaptWindow))
+		return false
+	case b == nil:
+		fmt.Printf("bench: adaptive loop, no window met the SLO of p95 %s and %g%% failed, down to %d in flight\n", dur(sloLatency), sloErrors, a.current())
+		return false
+	case !breached:
+		fmt.Printf("bench: adaptive loop, SLO never breached, at least %.1f/s with %d in flight, raise -duration or -adapt-step\n", b.rate(), b.limit)
+	default:
+		fmt.Printf("bench: adaptive loop, sustainable %.1f/s with %d in flight, within p95 %s and %g%% failed\n", b.rate(), b.limit, dur(sloLatency), sloErrors)
+	}
+	return true
+}
+
+func (w *aimdWindow) rate() float64 {
+	return float64(w.requests) / w.elapsed.Seconds()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// forwardHeaders are request headers proxies add about the client or
+// themselves, the evidence for the anonymity level.
+var forwardHeaders = []string{
+	"Via", "X-Forwarded-For", "Forwarded", "X-Real-Ip", "Client-Ip", "X-Client-Ip",
+	"True-Client-Ip", "X-Originating-Ip", "X-Forwarded-Host", "X-Forwarded-Proto",
+	"X-Proxy-Id", "Proxy-Connection",
+}
+
+// headerEcho is what -dest answers when it echoes the request the way
+// httpbin's /get and the mock origin's /headers do.
+type headerEcho struct {
+	Origin  string            `json:"origin"`
+	Headers map[string]string `json:"headers"`
+}
+
+// ownAddresses are the client's addresses as an echo at u sees them on a
+// direct request, which tells transparent proxies apart, and the local
+// ones, which cover a failed direct request.
+func ownAddresses(cfg proxyclient.Config, u string, timeout time.Duration) []string {
+	own := fingerprint().LocalIPs
+	direct := cfg
+	direct.Proxy, direct.User, direct.Password, direct.Auth, direct.Fallback = "", "", "", "", ""
+	if dc, err := proxyclient.New(direct); err == nil {
+		if _, _, body, err := checkOnce(dc, u, timeout); err == nil {
+			var echo headerEcho
+			if json.Unmarshal(body, &echo) == nil && echo.Origin != "" {
+				own = append(own, echo.Origin)
+				fmt.Printf("anonymity: origin sees %s directly\n", echo.Origin)
+			}
+		}
+	}
+	return own
+}
+
+// anonymity grades a proxy from the echo of the request it forwarded,
+// with what gave it away; "" when body is no echo.
+func anonymity(body []byte, own []string) (string, string) {
+	var echo headerEcho
+	if json.Unmarshal(body, &echo) != nil || echo.Headers == nil {
+		return "", ""
+	}
+	h := http.Header{}
+	for k, v := range echo.Headers {
+		h.Set(k, v)
+	}
+	var seen []string
+	for _, name := range forwardHeaders {
+		v := h.Get(name)
+		if v == "" {
+			continue
+		}
+		seen = append(seen, name)
+		// Forwarded has for=IP pairs, the others comma separated addresses
+		for _, f := range strings.FieldsFunc(v, func(r rune) bool { return strings.ContainsRune(`, ;="[]`, r) }) {
+			for _, ip := range own {
+				if f == ip {
+					return "transparent", fmt.Sprintf("%s: %s", name, v)
+				}
+			}
+		}
+	}
+	// httpbin puts X-Forwarded-For before the peer in origin, the peer
+	// itself is the proxy
+	origins := strings.Split(echo.Origin, ",")
+	for _, o := range origins[:len(origins)-1] {
+		for _, ip := range own {
+			if strings.TrimSpace(o) == ip {
+				return "transparent", "origin: " + echo.Origin
+			}
+		}
+	}
+	if len(seen) > 0 {
+		return "anonymous", "sent " + strings.Join(seen, ", ")
+	}
+	return "elite", ""
+}
+
+// runAnonymityCheck implements -anonymity-check: it requests a header echo
+// through the proxy, -dest when given, otherwise /headers of the built-in
+// mock origin on -origin-listen, which the proxy has to reach at
+// -origin-url, and grades the proxy by what the origin received:
+// transparent, anonymous or elite. It returns 1 when the echo could not be
+// fetched or read.
+func runAnonymityCheck(client *proxyclient.Client, cfg proxyclient.Config) int {
+	if client.ProxyURL() == nil {
+		fmt.Println("erro: -anonymity-check needs a proxy")
+		return 2
+	}
+	echoURL := dest
+	if echoURL == "" {
+		ln, err := net.Listen("tcp", originListen)
+		if err != nil {
+			fmt.Printf("erro: %s\n", err)
+			return 1
+		}
+		defer ln.Close()
+		go http.Serve(ln, newMockOrigin())
+		if err := startOriginDNS(ln); err != nil {
+			fmt.Printf("erro: %s\n", err)
+			return 2
+		}
+		echoURL = originBase(ln) + "/headers"
+		fmt.Printf("anonymity: mock origin %s, listening on %s\n", echoURL, ln.Addr())
+	}
+	if strings.HasPrefix(echoURL, "https://") && !strings.HasPrefix(client.ProxyURL().Scheme, "socks") {
+		fmt.Println("anonymity: WARN, https goes through a CONNECT tunnel the proxy cannot add headers to, use an http echo")
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	own := ownAddresses(cfg, echoURL, timeout)
+	_, res, body, err := checkOnce(client, echoURL, timeout)
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 1
+	}
+	var echo headerEcho
+	if json.Unmarshal(body, &echo) != nil || echo.Headers == nil {
+		fmt.Printf("erro: %s answered %d without a header echo, want JSON with a headers object like httpbin's /get\n", echoURL, res.Status)
+		return 1
+	}
+	if echo.Origin != "" {
+		fmt.Printf("anonymity: origin sees %s through the proxy\n", echo.Origin)
+	}
+	h := http.Header{}
+	for k, v := range echo.Headers {
+		h.Set(k, v)
+	}
+	for _, name := range forwardHeaders {
+		if v := h.Get(name); v != "" {
+			fmt.Printf("anonymity: %s: %s\n", name, v)
+		}
+	}
+	level, detail := anonymity(body, own)
+	if detail != "" {
+		level += ", " + detail
+	}
+	fmt.Printf("anonymity: %s\n", level)
+	return 0
+}
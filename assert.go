@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// assertion is one checked expectation: term says what it wants, eval
+// whether the response has it and what it had.
+type assertion struct {
+	term string
+	eval func(resp *http.Response, body []byte, elapsed time.Duration) (bool, string)
+}
+
+// assertChecks are the -assert flags parsed, nil without any.
+var assertChecks []assertion
+
+// statusAssertion wants the status to be one of spec, codes or classes
+// like 2xx separated by commas.
+func statusAssertion(spec string) assertion {
+	var want []healthCheck
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		want = append(want, healthCheck{term: "status=" + s, field: "status", op: "=", value: s})
+	}
+	return assertion{term: "status=" + spec, eval: func(resp *http.Response, body []byte, elapsed time.Duration) (bool, string) {
+		got := ""
+		for _, c := range want {
+			var pass bool
+			if pass, got = c.eval(resp, body, elapsed); pass {
+				return true, got
+			}
+		}
+		return false, got
+	}}
+}
+
+// headerAssertion wants a name header matching the regular expression
+// expr.
+func headerAssertion(name, expr string) (assertion, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return assertion{}, fmt.Errorf("header %s: %s", name, err)
+	}
+	return assertion{term: fmt.Sprintf("header %s ~ %s", name, re), eval: func(resp *http.Response, _ []byte, _ time.Duration) (bool, string) {
+		vs := resp.Header.Values(name)
+		if len(vs) == 0 {
+			return false, "absent"
+		}
+		for _, v := range vs {
+			if re.MatchString(v) {
+				return true, v
+			}
+		}
+		return false, strings.Join(vs, ", ")
+	}}, nil
+}
+
+// bodyAssertion wants the body to contain s.
+func bodyAssertion(s string) assertion {
+	c := healthCheck{term: "body~" + s, field: "body", op: "~", value: s}
+	return assertion{term: c.term, eval: c.eval}
+}
+
+// latencyAssertion wants the response within max.
+func latencyAssertion(max time.Duration) assertion {
+	c := healthCheck{term: "latency<" + dur(max), field: "latency", op: "<", dur: max}
+	return assertion{term: c.term, eval: c.eval}
+}
+
+// parseAssertions sets assertChecks from -assert-status, -assert-header,
+// -assert-body-contains and -assert-max-latency.
+func parseAssertions() error {
+	if assertStatus != "" {
+		assertChecks = append(assertChecks, statusAssertion(assertStatus))
+	}
+	for _, h := range assertHeaders {
+		name, expr, err := splitHeader(h)
+		if err != nil {
+			return err
+		}
+		a, err := headerAssertion(name, expr)
+		if err != nil {
+			return fmt.Errorf("-assert-header: %s", err)
+		}
+		assertChecks = append(assertChecks, a)
+	}
+	if assertBody != "" {
+		assertChecks = append(assertChecks, bodyAssertion(assertBody))
+	}
+	if assertLatency > 0 {
+		assertChecks = append(assertChecks, latencyAssertion(assertLatency))
+	}
+	return nil
+}
+
+// passesAssertions evaluates the checks without printing them and
+// returns the first one unmet.
+func passesAssertions(checks []assertion, resp *http.Response, body []byte, elapsed time.Duration) (bool, string) {
+	for _, c := range checks {
+		if pass, got := c.eval(resp, body, elapsed); !pass {
+			return false, fmt.Sprintf("%s (%s)", c.term, got)
+		}
+	}
+	return true, ""
+}
+
+// reportUnmet prints how many of the total entries of a repeated or
+// batch mode, named what, did not meet -assert-*, errors included, and
+// returns 1 when any.
+func reportUnmet(mode, what string, unmet, total int) int {
+	if unmet > 0 {
+		fmt.Printf("%s: assert: FAIL, %d of %d %s unmet\n", mode, unmet, total, what)
+		return 1
+	}
+	fmt.Printf("%s: assert: OK, all %d %s\n", mode, total, what)
+	return 0
+}
+
+// checkAssertMode refuses -assert-* in the modes that do not check a
+// response of -dest: the plain request, a -dest batch, -proxy-file,
+// -soak and watch do.
+func checkAssertMode() error {
+	if assertChecks == nil {
+		return nil
+	}
+	switch m := runMode(); m {
+	case "", "-proxy-file", "-soak", "watch":
+		return nil
+	default:
+		return fmt.Errorf("-assert-* checks the responses of a request, a -dest batch, -proxy-file, -soak or watch, not of %s", m)
+	}
+}
+
+// reportAssertions prints every assertion and the verdict, and returns 1
+// when one failed.
+func reportAssertions(checks []assertion, resp *http.Response, body []byte, elapsed time.Duration) int {
+	failed := 0
+	for _, c := range checks {
+		pass, got := c.eval(resp, body, elapsed)
+		verdict := "PASS"
+		if !pass {
+			verdict = "FAIL"
+			failed++
+		}
+		fmt.Printf("assert: %s %s (%s)\n", c.term, verdict, got)
+	}
+	if failed > 0 {
+		fmt.Printf("assert: FAIL, %d of %d unmet\n", failed, len(checks))
+		return 1
+	}
+	fmt.Println("assert: OK")
+	return 0
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseAssertions(t *testing.T) {
+	defer func() {
+		assertStatus, assertHeaders, assertBody, assertLatency, assertChecks = "", nil, "", 0, nil
+	}()
+	assertStatus = "2xx, 304"
+	assertHeaders = headerList{"Content-Type: ^text/html", "Cache-Control: max-age=\\d+"}
+	assertBody = "Welcome"
+	assertLatency = 2 * time.Second
+	if err := parseAssertions(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"status=2xx, 304", "header Content-Type ~ ^text/html", `header Cache-Control ~ max-age=\d+`, "body~Welcome", "latency<2s"}
+	if len(assertChecks) != len(want) {
+		t.Fatalf("%d assertions, want %d", len(assertChecks), len(want))
+	}
+	for i, a := range assertChecks {
+		if a.term != want[i] {
+			t.Errorf("assertion %d is %q, want %q", i, a.term, want[i])
+		}
+	}
+}
+
+func TestParseAssertionsErrors(t *testing.T) {
+	defer func() { assertHeaders, assertChecks = nil, nil }()
+	for _, h := range []string{"Content-Type", "X-Id: (", ": value"} {
+		assertHeaders, assertChecks = headerList{h}, nil
+		if err := parseAssertions(); err == nil {
+			t.Errorf("-assert-header %q parsed, want an error", h)
+		}
+	}
+}
+
+func TestAssertionEval(t *testing.T) {
+	header, err := headerAssertion("Content-Type", "^text/html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &http.Response{StatusCode: 502, Header: http.Header{"Content-Type": {"text/plain", "text/html; charset=utf-8"}}}
+	tests := []struct {
+		a    assertion
+		pass bool
+		got  string
+	}{
+		{statusAssertion("2xx"), false, "502"},
+		{statusAssertion("200, 5xx"), true, "502"},
+		{statusAssertion("502"), true, "502"},
+		// any value of a repeated header may match
+		{header, true, "text/html; charset=utf-8"},
+		{bodyAssertion("Bad Gateway"), true, "found"},
+		{bodyAssertion("Welcome"), false, "not found"},
+		{latencyAssertion(time.Second), true, ""},
+		{latencyAssertion(100 * time.Millisecond), false, ""},
+	}
+	for _, tt := range tests {
+		pass, got := tt.a.eval(resp, []byte("502 Bad Gateway"), 300*time.Millisecond)
+		if pass != tt.pass || tt.got != "" && got != tt.got {
+			t.Errorf("%s = %v (%s), want %v (%s)", tt.a.term, pass, got, tt.pass, tt.got)
+		}
+	}
+	missing, _ := headerAssertion("X-Cache", "HIT")
+	if pass, got := missing.eval(resp, nil, 0); pass || got != "absent" {
+		t.Errorf("%s without the header = %v (%s), want false (absent)", missing.term, pass, got)
+	}
+}
+
+func TestPassesAssertions(t *testing.T) {
+	resp := &http.Response{StatusCode: 200, Header: http.Header{}}
+	tests := []struct {
+		checks []assertion
+		pass   bool
+		failed string
+	}{
+		{nil, true, ""},
+		{[]assertion{statusAssertion("2xx"), bodyAssertion("ok")}, true, ""},
+		// the first unmet check is the one reported
+		{[]assertion{statusAssertion("2xx"), bodyAssertion("Welcome"), statusAssertion("201")}, false, "body~Welcome (not found)"},
+		{[]assertion{latencyAssertion(time.Millisecond)}, false, "latency<1ms (50ms)"},
+	}
+	for _, tt := range tests {
+		pass, failed := passesAssertions(tt.checks, resp, []byte("ok"), 50*time.Millisecond)
+		if pass != tt.pass || failed != tt.failed {
+			t.Errorf("passesAssertions(%d checks) = %v %q, want %v %q", len(tt.checks), pass, failed, tt.pass, tt.failed)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// runAuthBypass sends the request with the configured credentials and
+// again without any, as a request and as a bare tunnel to the destination,
+// since proxies often guard one and forget the other. It returns 1 when
+// the proxy lets an unauthenticated client through or cannot be judged.
+func runAuthBypass(client *proxyclient.Client, cfg proxyclient.Config) int {
+	if client.ProxyURL() == nil {
+		fmt.Println("erro: -auth-bypass needs a proxy")
+		return 2
+	}
+	if cfg.User == "" && cfg.Password == "" && cfg.Auth != "sspi" && cfg.Auth != "gssapi" {
+		fmt.Println("erro: -auth-bypass needs the credentials the proxy should require")
+		return 2
+	}
+	destURL, err := url.Parse(dest)
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 2
+	}
+
+	with := bypassRequest(client)
+	fmt.Printf("auth-bypass with credentials: %s\n", with)
+	if with.class != "" {
+		fmt.Println("auth-bypass: the proxy refuses the credentials given, the check may not tell much")
+	}
+
+	cfg.User, cfg.Password, cfg.Auth = "", "", "basic"
+	anon, err := proxyclient.New(cfg)
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 2
+	}
+	defer anon.Transport().CloseIdleConnections()
+	results := []struct {
+		name string
+		r    bypassResult
+	}{
+		{"request", bypassRequest(anon)},
+		{"tunnel", bypassTunnel(anon, destURL)},
+	}
+	open, unknown := 0, 0
+	for _, p := range results {
+		verdict := "refused"
+		switch {
+		case p.r.err == nil && p.r.status != http.StatusProxyAuthRequired:
+			verdict = "ACCEPTED"
+			open++
+		case p.r.class != "proxy_auth" && p.r.class != "proxy_connect":
+			verdict = "unknown"
+			unknown++
+		}
+		fmt.Printf("auth-bypass without credentials, %s: %s, %s\n", p.name, p.r, verdict)
+	}
+	switch {
+	case open > 0:
+		fmt.Printf("auth-bypass: FAIL, the proxy let %d of %d unauthenticated probes through\n", open, len(results))
+		return 1
+	case unknown > 0:
+		fmt.Println("auth-bypass: UNKNOWN, an unauthenticated probe failed before the proxy judged it")
+		return 1
+	}
+	fmt.Println("auth-bypass: OK, the proxy requires credentials")
+	return 0
+}
+
+// bypassResult is how the proxy treated one probe. status is the response
+// code, or the CONNECT's when the proxy refused the tunnel.
+type bypassResult struct {
+	status int
+	class  string
+	err    error
+}
+
+func (r bypassResult) String() string {
+	switch {
+	case r.err == nil:
+		return fmt.Sprintf("code %d", r.status)
+	case r.status != 0:
+		return fmt.Sprintf("code %d (%s)", r.status, r.class)
+	}
+	return fmt.Sprintf("erro (%s): %s", r.class, r.err)
+}
+
+func bypassRequest(client *proxyclient.Client) bypassResult {
+	req, err := destRequest()
+	if err != nil {
+		return bypassResult{class: "other", err: err}
+	}
+	resp, res, err := client.Measure(req)
+	if err != nil {
+		r := bypassResult{class: res.ErrorClass, err: err}
+		if res.Proxy != nil {
+			r.status = res.Proxy.ConnectStatus
+		}
+		return r
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return bypassResult{status: resp.StatusCode, class: res.ErrorClass}
+}
+
+// bypassTunnel asks for a tunnel to the destination and sends nothing
+// through it: being let in is the finding.
+func bypassTunnel(client *proxyclient.Client, destURL *url.URL) bypassResult {
+	port := destURL.Port()
+	if port == "" {
+		port = "80"
+		if destURL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	var connectResp *http.Response
+	ctx := proxyclient.WithConnectResponse(context.Background(), &connectResp)
+	conn, err := client.Tunnel(ctx, net.JoinHostPort(destURL.Hostname(), port))
+	if err != nil {
+		r := bypassResult{class: proxyclient.ErrorClass(err, connectResp), err: err}
+		if connectResp != nil {
+			r.status = connectResp.StatusCode
+		}
+		return r
+	}
+	conn.Close()
+	return bypassResult{status: http.StatusOK}
+}
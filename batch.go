@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// batchRollupAt is the batch size past which the table is rolled up by
+// domain, thousands of rows are for the export, not the terminal.
+const batchRollupAt = 200
+
+// batchFailuresShown caps the failures a rolled up batch lists.
+const batchFailuresShown = 20
+
+// batchDone is the batch the run printed, for -json; nil when it was not
+// a batch run.
+var batchDone *batchTable
+
+// batchTable is the outcome of a batch run, -dest lists and -proxy-file,
+// one row per entry.
+type batchTable struct {
+	columns []string
+	rows    [][]string
+	failed  []bool
+	// groups are the rollup keys of the rows
+	groups []string
+}
+
+func (t *batchTable) add(group string, failed bool, cells ...string) {
+	t.rows = append(t.rows, cells)
+	t.failed = append(t.failed, failed)
+	t.groups = append(t.groups, group)
+}
+
+// batchGroup is the rollup key of an entry: its -group-by tag, "-" when
+// it has none, or else the domain of its host.
+func batchGroup(target string, tags map[string]string) string {
+	if groupBy != "" {
+		if v, ok := tags[groupBy]; ok {
+			return v
+		}
+		return "-"
+	}
+	if u, err := url.Parse(target); err == nil && u.Host != "" {
+		return hostDomain(u.Hostname())
+	}
+	return target
+}
+
+// rolledUp tells whether a batch of n entries prints the rollup rather
+// than every row.
+func rolledUp(n int) bool {
+	return summaryOnly || n > batchRollupAt
+}
+
+// batchProgress prints the per entry lines of a batch, or, rolled up, a
+// line every tenth of the way.
+type batchProgress struct {
+	what  string
+	total int
+
+	mu   sync.Mutex
+	done int
+}
+
+func (p *batchProgress) entry(line string) {
+	if !rolledUp(p.total) {
+		fmt.Printf("%s: %s\n", p.what, line)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if step := (p.total + 9) / 10; p.done%step == 0 || p.done == p.total {
+		fmt.Printf("%s: %d of %d done\n", p.what, p.done, p.total)
+	}
+}
+
+// print writes the table, or for a big batch or -summary-only the rollup
+// by group with the first failures, and exports it with -export.
+func (t *batchTable) print(what string) {
+	batchDone = t
+	if !rolledUp(len(t.rows)) {
+		printColumns(t.columns, t.rows)
+	} else {
+		t.rollup(what)
+	}
+	if batchExport != "" {
+		if err := t.export(batchExport); err != nil {
+			fmt.Printf("erro: -export: %s\n", err)
+		} else {
+			fmt.Printf("%s: all %d rows in %s\n", what, len(t.rows), batchExport)
+		}
+	}
+}
+
+func (t *batchTable) rollup(what string) {
+	code := -1
+	for i, c := range t.columns {
+		if c == "code" {
+			code = i
+		}
+	}
+	type group struct {
+		name          string
+		entries, fail int
+		codes         map[string]int
+	}
+	byName := map[string]*group{}
+	var groups []*group
+	for i, row := range t.rows {
+		g := byName[t.groups[i]]
+		if g == nil {
+			g = &group{name: t.groups[i], codes: map[string]int{}}
+			byName[g.name] = g
+			groups = append(groups, g)
+		}
+		g.entries++
+		if t.failed[i] {
+			g.fail++
+		}
+		if code >= 0 && row[code] != "-" {
+			g.codes[row[code]]++
+		}
+	}
+	// the groups with the most failures first, they need looking at
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].fail != groups[j].fail {
+			return groups[i].fail > groups[j].fail
+		}
+		return groups[i].entries > groups[j].entries
+	})
+	rows := make([][]string, 0, len(groups))
+	for _, g := range groups {
+		var codes []string
+		for c, n := range g.codes {
+			codes = append(codes, fmt.Sprintf("%s x%d", c, n))
+		}
+		sort.Strings(codes)
+		rows = append(rows, []string{g.name, fmt.Sprint(g.entries), fmt.Sprint(g.entries - g.fail), fmt.Sprint(g.fail), strings.Join(codes, ", ")})
+	}
+	by, plural := "domain", "domains"
+	if groupBy != "" {
+		by, plural = groupBy, groupBy+" groups"
+	}
+	fmt.Printf("%s: %d entries in %d %s\n", what, len(t.rows), len(groups), plural)
+	printColumns([]string{by, "entries", "ok", "failed", "codes"}, rows)
+	if summaryOnly {
+		return
+	}
+	var failures [][]string
+	total := 0
+	for i, row := range t.rows {
+		if t.failed[i] {
+			total++
+			if len(failures) < batchFailuresShown {
+				failures = append(failures, row)
+			}
+		}
+	}
+	if total == 0 {
+		return
+	}
+	fmt.Printf("%s: %d failures, the first %d:\n", what, total, len(failures))
+	printColumns(t.columns, failures)
+}
+
+// printColumns prints rows aligned under the column names.
+func printColumns(columns []string, rows [][]string) {
+	widths := make([]int, len(columns))
+	for i, c := range columns {
+		widths[i] = len(c)
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			if len(cell) > widths[i] {
+				widths[i] = len(cell)
+			}
+		}
+	}
+	line := func(cells []string) {
+		var b strings.Builder
+		for i, cell := range cells {
+			if i > 0 {
+				b.WriteString("  ")
+			}
+			fmt.Fprintf(&b, "%-*s", widths[i], cell)
+		}
+		fmt.Println(strings.TrimRight(b.String(), " "))
+	}
+	line(columns)
+	for _, row := range rows {
+		line(row)
+	}
+}
+
+// records returns the rows as column to value maps, the -json form.
+func (t *batchTable) records() []map[string]string {
+	var records []map[string]string
+	for _, row := range t.rows {
+		r := map[string]string{}
+		for i, c := range t.columns {
+			r[c] = row[i]
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// export writes every row to path, CSV for a .csv file, else JSON.
+func (t *batchTable) export(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		w := csv.NewWriter(f)
+		w.Write(t.columns)
+		w.WriteAll(t.rows)
+		err = w.Error()
+	} else {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(t.records())
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// hostDomain is the rollup key of host: its last two labels, or for an
+// IPv4 address its /24.
+func hostDomain(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		if v4 := ip.To4(); v4 != nil {
+			return fmt.Sprintf("%d.%d.%d.0/24", v4[0], v4[1], v4[2])
+		}
+		return host
+	}
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	if len(labels) > 2 {
+		labels = labels[len(labels)-2:]
+	}
+	return strings.Join(labels, ".")
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// benchMaxInFlight caps the open loop's requests in flight, a proxy that
+// stopped answering would otherwise pile them up without bound.
+const benchMaxInFlight = 1000
+
+// benchRun is what one load model measured.
+type benchRun struct {
+	model     string
+	requests  int
+	failed    int
+	dropped   int
+	latencies []time.Duration
+	elapsed   time.Duration
+	maxFlight int
+	dials     int64
+	firstErr  error
+
+	mu     sync.Mutex
+	flight int
+}
+
+// runBench implements `bench`: it loads -dest through the proxy for
+// -duration with each model -loop asks for and prints one summary row per
+// model. The open loop starts -rate requests a second whatever the
+// proxy's pace, so a slow proxy collects requests in flight and latency,
+// counted from the planned start, shows the queueing. The closed loop has
+// -workers each send the next request once the last one is done, so a
+// slow proxy gets fewer requests and the rate shows it instead. The
+// adaptive loop, on its own, finds the concurrency the proxy sustains.
+// It returns 1 when a request failed, a response of 500 or more or a 407
+// counting, in the adaptive loop when no window met the SLO, and 130
+// when interrupted.
+func runBench(client *proxyclient.Client) int {
+	var models []string
+	switch benchLoop {
+	case "both":
+		models = []string{"open", "closed"}
+	case "open", "closed", "adaptive":
+		models = []string{benchLoop}
+	default:
+		fmt.Printf("erro: -loop must be open, closed, both or adaptive, not %q\n", benchLoop)
+		return 2
+	}
+	if duration <= 0 || benchRate <= 0 || benchWorkers < 1 {
+		fmt.Println("erro: -duration and -rate must be positive, -workers at least 1")
+		return 2
+	}
+	if benchLoop == "adaptive" && (adaptWindow <= 0 || adaptStep < 1 || sloLatency <= 0 || sloErrors < 0) {
+		fmt.Println("erro: -adapt-window and -slo-latency must be positive, -adapt-step at least 1, -slo-errors not negative")
+		return 2
+	}
+	// keep a connection per concurrent request rather than redialing
+	if t := client.Transport(); t.MaxIdleConnsPerHost < benchWorkers {
+		t.MaxIdleConnsPerHost = benchWorkers
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var runs []*benchRun
+	var adapted *aimd
+	for _, m := range models {
+		r := &benchRun{model: m}
+		dials := client.Stats().Dials
+		if m == "open" {
+			fmt.Printf("bench: open loop, %g requests/s for %s\n", benchRate, dur(duration))
+			r.open(ctx, client)
+		} else if m == "adaptive" {
+			fmt.Printf("bench: adaptive loop from %d in flight for %s, SLO p95 %s and %g%% failed per %s window\n", benchWorkers, dur(duration), dur(sloLatency), sloErrors, dur(adaptWindow))
+			adapted = r.adaptive(ctx, client)
+		} else {
+			fmt.Printf("bench: closed loop, %d workers for %s\n", benchWorkers, dur(duration))
+			r.closed(ctx, client)
+		}
+		r.dials = client.Stats().Dials - dials
+		runs = append(runs, r)
+		if ctx.Err() != nil {
+			break
+		}
+		// the next model starts on the same footing
+		client.Transport().CloseIdleConnections()
+	}
+
+	fmt.Printf("%-8s  %-8s  %-6s  %-7s  %-10s  %-10s  %-10s  %-10s  %-9s  %s\n", "model", "requests", "failed", "dropped", "rate", "p50", "p90", "p99", "in flight", "dials")
+	code := 0
+	for _, r := range runs {
+		sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+		rate := float64(r.requests) / r.elapsed.Seconds()
+		row := fmt.Sprintf("%-8s  %-8d  %-6d  %-7d  %-10s  %-10s  %-10s  %-10s  %-9d  %d", r.model, r.requests, r.failed, r.dropped,
+			fmt.Sprintf("%.1f/s", rate), dur(quantile(r.latencies, 0.5)), dur(quantile(r.latencies, 0.9)), dur(quantile(r.latencies, 0.99)), r.maxFlight, r.dials)
+		fmt.Println(strings.TrimRight(row, " "))
+		// the adaptive loop fails requests on purpose, finding the limit
+		if r.model != "adaptive" && (r.failed > 0 || r.dropped > 0) {
+			code = 1
+		}
+	}
+	if adapted != nil && !adapted.report() {
+		code = 1
+	}
+	for _, r := range runs {
+		if r.firstErr != nil {
+			fmt.Printf("bench: %s loop, first failure: %s\n", r.model, r.firstErr)
+		}
+	}
+	if ctx.Err() != nil {
+		fmt.Println("bench: interrupted")
+		if code == 0 {
+			code = exitInterrupted
+		}
+	}
+	return code
+}
+
+// open starts a request every 1/-rate whether or not the earlier ones
+// are done.
+func (r *benchRun) open(ctx context.Context, client *proxyclient.Client) {
+	interval := time.Duration(float64(time.Second) / benchRate)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; ; i++ {
+		planned := start.Add(time.Duration(i) * interval)
+		if planned.Sub(start) >= duration {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Until(planned)):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if !r.enter(benchMaxInFlight) {
+			r.mu.Lock()
+			r.dropped++
+			r.mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.record(benchRequest(ctx, client), time.Since(planned))
+		}()
+	}
+	wg.Wait()
+	r.elapsed = time.Since(start)
+}
+
+// closed has -workers send one request after the other.
+func (r *benchRun) closed(ctx context.Context, client *proxyclient.Client) {
+	start := time.Now()
+	deadline := start.Add(duration)
+	var wg sync.WaitGroup
+	for w := 0; w < benchWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) && ctx.Err() == nil {
+				r.enter(benchWorkers)
+				sent := time.Now()
+				r.record(benchRequest(ctx, client), time.Since(sent))
+			}
+		}()
+	}
+	wg.Wait()
+	r.elapsed = time.Since(start)
+}
+
+// enter counts a request in flight unless max already are.
+func (r *benchRun) enter(max int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.flight >= max {
+		return false
+	}
+	r.flight++
+	if r.flight > r.maxFlight {
+		r.maxFlight = r.flight
+	}
+	return true
+}
+
+// record counts a finished request, one cut off by the interrupt aside.
+func (r *benchRun) record(err error, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flight--
+	if err == context.Canceled {
+		return
+	}
+	r.requests++
+	if err != nil {
+		r.failed++
+		if r.firstErr == nil {
+			r.firstErr = err
+		}
+		return
+	}
+	r.latencies = append(r.latencies, latency)
+}
+
+// benchRequest sends -dest once and reads the body through.
+func benchRequest(ctx context.Context, client *proxyclient.Client) error {
+	req, err := destRequest()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return context.Canceled
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		if ctx.Err() != nil {
+			return context.Canceled
+		}
+		return err
+	}
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusProxyAuthRequired {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// quantile returns the q quantile of the sorted ds, 0 for none.
+func quantile(ds []time.Duration, q float64) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	// nearest rank
+	i := int(math.Ceil(q*float64(len(ds)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return ds[i]
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// cacheRun exercises the proxy's cache against the mock origin. The origin
+// must be reachable from the proxy over plain http, otherwise the requests
+// are tunneled and the proxy never sees them.
+type cacheRun struct {
+	client *proxyclient.Client
+	origin *mockOrigin
+	base   string
+	nonce  string
+}
+
+type cacheCheck struct {
+	name string
+	rfc  string
+	run  func(c *cacheRun) (bool, string)
+}
+
+var cacheChecks = []cacheCheck{
+	{"freshness", "RFC 9111 4.2", func(c *cacheRun) (bool, string) {
+		uri := c.uri("/cache/max-age")
+		c.get(uri, nil)
+		c.get(uri, nil)
+		switch len(c.origin.requests(uri)) {
+		case 0:
+			return false, "mock origin not reached through the proxy, check -origin-url"
+		case 1:
+			return true, "second request served from the proxy cache"
+		}
+		return true, "proxy does not cache, the checks below only prove it does not misbehave"
+	}},
+	{"no-store", "RFC 9111 5.2.2.5", func(c *cacheRun) (bool, string) {
+		uri := c.uri("/cache/no-store")
+		c.get(uri, nil)
+		c.get(uri, nil)
+		if n := len(c.origin.requests(uri)); n != 2 {
+			return false, fmt.Sprintf("no-store response reused, origin saw %d of 2 requests", n)
+		}
+		return true, "both requests reached the origin"
+	}},
+	{"etag revalidation", "RFC 9111 4.2.4, 4.3", func(c *cacheRun) (bool, string) {
+		uri := c.uri("/cache/etag")
+		c.get(uri, nil)
+		code, body, err := c.get(uri, nil)
+		if err != nil {
+			return false, err.Error()
+		}
+		if code != http.StatusOK || !strings.Contains(body, "etag v1") {
+			return false, fmt.Sprintf("unconditional request answered with %d %q", code, body)
+		}
+		reqs := c.origin.requests(uri)
+		if len(reqs) == 1 {
+			return false, "stale must-revalidate response served without revalidating"
+		}
+		if reqs[len(reqs)-1].Header.Get("If-None-Match") != "" {
+			return true, "revalidated with If-None-Match"
+		}
+		return true, "forwarded unconditionally, ETag not used"
+	}},
+	{"vary", "RFC 9111 4.1", func(c *cacheRun) (bool, string) {
+		uri := c.uri("/cache/vary")
+		c.get(uri, http.Header{"Accept-Language": {"en"}})
+		_, body, err := c.get(uri, http.Header{"Accept-Language": {"de"}})
+		if err != nil {
+			return false, err.Error()
+		}
+		if !strings.Contains(body, "lang de") {
+			return false, fmt.Sprintf("Accept-Language: de answered with %q", strings.TrimSpace(body))
+		}
+		return true, "variant selected by Accept-Language"
+	}},
+}
+
+func (c *cacheRun) uri(path string) string {
+	return path + "?run=" + c.nonce
+}
+
+func (c *cacheRun) get(uri string, header http.Header) (int, string, error) {
+	req, err := newRequest(c.base + uri)
+	if err != nil {
+		return 0, "", err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body), err
+}
+
+// runCacheTest starts the mock origin, runs every cache check through the
+// proxy and returns the exit code: 1 when any check failed.
+func runCacheTest(client *proxyclient.Client) int {
+	ln, err := net.Listen("tcp", originListen)
+	if err != nil {
+		fmt.Printf("erro: %s", err)
+		return 1
+	}
+	origin := newMockOrigin()
+	go http.Serve(ln, origin)
+
+	if err := startOriginDNS(ln); err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 2
+	}
+	base := originBase(ln)
+	c := &cacheRun{
+		client: client,
+		origin: origin,
+		base:   base,
+		nonce:  fmt.Sprint(time.Now().UnixNano()),
+	}
+	fmt.Printf("cache: mock origin %s, listening on %s\n", c.base, ln.Addr())
+
+	failed := 0
+	for _, check := range cacheChecks {
+		pass, detail := check.run(c)
+		verdict := "PASS"
+		if !pass {
+			verdict = "FAIL"
+			failed++
+		}
+		fmt.Printf("cache: %-17s %s %s (%s)\n", check.name, verdict, detail, check.rfc)
+	}
+	fmt.Printf("cache: %d/%d passed\n", len(cacheChecks)-failed, len(cacheChecks))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
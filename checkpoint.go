@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// checkpointFile is -checkpoint, where a -dest batch keeps the
+// destinations it finished so an interrupted run picks up after them.
+// It is not called -resume: the same flag writes the state on the first
+// run and reads it back on the next one.
+var checkpointFile string
+
+// checkpointEvery is how often at most the state is written while the
+// batch runs, so a killed run loses at most that much; it is also written
+// when the batch ends.
+const checkpointEvery = time.Second
+
+// checkpointEntry is a finished destination, what its table row needs.
+type checkpointEntry struct {
+	Status   int           `json:"status,omitempty"`
+	Proto    string        `json:"proto,omitempty"`
+	Reused   bool          `json:"reused,omitempty"`
+	Fallback string        `json:"fallback,omitempty"`
+	Elapsed  time.Duration `json:"elapsed"`
+	Bytes    int64         `json:"bytes"`
+	Failure  string        `json:"failure,omitempty"`
+	Page     string        `json:"page,omitempty"`
+}
+
+// checkpoint is the state in -checkpoint: the destinations done, by URL.
+type checkpoint struct {
+	DestFile string                     `json:"dest_file,omitempty"`
+	Done     map[string]checkpointEntry `json:"done"`
+
+	mu    sync.Mutex
+	saved time.Time
+}
+
+// loadCheckpoint reads -checkpoint, a fresh state when the file does not
+// exist yet. A state written for another -dest-file is refused, its URLs
+// would be skipped in a batch they are not part of.
+func loadCheckpoint() (*checkpoint, error) {
+	cp := &checkpoint{DestFile: destFile, Done: map[string]checkpointEntry{}}
+	b, err := ioutil.ReadFile(checkpointFile)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved checkpoint
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return nil, fmt.Errorf("%s: %s", checkpointFile, err)
+	}
+	if saved.DestFile != destFile {
+		return nil, fmt.Errorf("%s is the checkpoint of -dest-file %q, not %q; delete it to start over", checkpointFile, saved.DestFile, destFile)
+	}
+	for u, e := range saved.Done {
+		cp.Done[u] = e
+	}
+	return cp, nil
+}
+
+// outcome returns the saved outcome of u, false when u is still to do.
+func (cp *checkpoint) outcome(u string) (destOutcome, bool) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	e, ok := cp.Done[u]
+	if !ok {
+		return destOutcome{}, false
+	}
+	return destOutcome{
+		url:     u,
+		res:     &proxyclient.Result{URL: u, Status: e.Status, Proto: e.Proto, Reused: e.Reused, Fallback: e.Fallback},
+		elapsed: e.Elapsed,
+		bytes:   e.Bytes,
+		failure: e.Failure,
+		page:    e.Page,
+	}, true
+}
+
+// record marks o done and writes the state when the last write is
+// checkpointEvery old.
+func (cp *checkpoint) record(o destOutcome) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.Done[o.url] = checkpointEntry{
+		Status:   o.res.Status,
+		Proto:    o.res.Proto,
+		Reused:   o.res.Reused,
+		Fallback: o.res.Fallback,
+		Elapsed:  o.elapsed,
+		Bytes:    o.bytes,
+		Failure:  o.failure,
+		Page:     o.page,
+	}
+	if time.Since(cp.saved) >= checkpointEvery {
+		cp.writeLocked()
+	}
+}
+
+// save writes the state.
+func (cp *checkpoint) save() {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.writeLocked()
+}
+
+// writeLocked writes the state to a temporary file renamed over
+// -checkpoint, so a kill while writing leaves the last state whole.
+func (cp *checkpoint) writeLocked() {
+	cp.saved = time.Now()
+	b, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		fmt.Printf("erro: -checkpoint: %s\n", err)
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(checkpointFile), filepath.Base(checkpointFile)+".*")
+	if err != nil {
+		fmt.Printf("erro: -checkpoint: %s\n", err)
+		return
+	}
+	_, err = tmp.Write(append(b, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), checkpointFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		fmt.Printf("erro: -checkpoint: %s\n", err)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// compareIgnored are response headers that differ between any two
+// requests, proxy or not.
+var compareIgnored = map[string]bool{"Date": true}
+
+// compareSide is one of the two requests -compare sends.
+type compareSide struct {
+	status int
+	header http.Header
+	size   int64
+	sum    string
+	ttfb   time.Duration
+	total  time.Duration
+	err    error
+}
+
+// runCompare implements -compare: it sends the request directly and then
+// through the proxy and prints what differs, the status, the headers
+// added, removed or changed, the body's size and SHA-256, and the time to
+// first byte and total. Date is left out of the headers. It returns 1 when
+// a request failed or the status or body differ; headers alone, which
+// proxies add as a matter of course, do not fail it. Proxies listed after
+// the flags are compared with each other instead, see compareProxies.
+func runCompare(client *proxyclient.Client, cfg proxyclient.Config) int {
+	if flag.NArg() > 0 {
+		return compareProxies(cfg, flag.Args())
+	}
+	if client.ProxyURL() == nil {
+		fmt.Println("erro: -compare needs a proxy")
+		return 2
+	}
+	direct := cfg
+	direct.Proxy, direct.User, direct.Password, direct.Auth, direct.Fallback = "", "", "", "", ""
+	dc, err := proxyclient.New(direct)
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 2
+	}
+	defer dc.Transport().CloseIdleConnections()
+
+	d := compareRequest(dc)
+	p := compareRequest(client)
+	if d.err != nil {
+		fmt.Printf("erro: direct: %s\n", d.err)
+	}
+	if p.err != nil {
+		fmt.Printf("erro: via proxy: %s\n", p.err)
+	}
+	if d.err != nil || p.err != nil {
+		fmt.Println("compare: FAIL, both requests have to succeed to compare them")
+		return 1
+	}
+
+	var diffs []string
+	if d.status == p.status {
+		fmt.Printf("compare: status %d both\n", d.status)
+	} else {
+		fmt.Printf("compare: status %d direct, %d via proxy\n", d.status, p.status)
+		diffs = append(diffs, "status")
+	}
+
+	added, removed, changed := headerDiff(d.header, p.header)
+	for _, h := range added {
+		fmt.Printf("compare: header added by the proxy, %s\n", h)
+	}
+	for _, h := range removed {
+		fmt.Printf("compare: header removed by the proxy, %s\n", h)
+	}
+	for _, h := range changed {
+		fmt.Printf("compare: header changed, %s\n", h)
+	}
+	differ := len(added) + len(removed) + len(changed)
+	if differ == 0 {
+		fmt.Println("compare: headers the same")
+	}
+
+	if d.sum == p.sum {
+		fmt.Printf("compare: body the same, %s sha256 %s\n", size(d.size), d.sum)
+	} else {
+		fmt.Printf("compare: body differs, %s sha256 %s direct, %s sha256 %s via proxy\n", size(d.size), d.sum, size(p.size), p.sum)
+		diffs = append(diffs, "body")
+	}
+
+	fmt.Printf("compare: ttfb %s direct, %s via proxy (%s)\n", dur(d.ttfb), dur(p.ttfb), signedDur(p.ttfb-d.ttfb))
+	fmt.Printf("compare: total %s direct, %s via proxy (%s)\n", dur(d.total), dur(p.total), signedDur(p.total-d.total))
+
+	if len(diffs) > 0 {
+		fmt.Printf("compare: DIFFERENT, the proxy changed the %s\n", strings.Join(diffs, " and "))
+		return 1
+	}
+	if differ > 0 {
+		fmt.Printf("compare: OK, status and body the same, headers differ (%d)\n", differ)
+		return 0
+	}
+	fmt.Println("compare: OK, the same response either way")
+	return 0
+}
+
+// compareProxies fetches -dest directly and through each of proxies and
+// prints a row per proxy against the direct response: status, body size
+// and hash, and the headers it added, removed or changed, listed below.
+// When the direct request fails the response most proxies agree on is the
+// baseline. A proxy whose status or body differs rewrites the response,
+// captive portals and ad injectors do, and makes it return 1.
+func compareProxies(cfg proxyclient.Config, proxies []string) int {
+	direct := cfg
+	direct.Proxy, direct.User, direct.Password, direct.Auth, direct.Fallback = "", "", "", "", ""
+	dc, err := proxyclient.New(direct)
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 2
+	}
+	base := compareRequest(dc)
+	dc.Transport().CloseIdleConnections()
+
+	names := make([]string, len(proxies))
+	sides := make([]compareSide, len(proxies))
+	for i, p := range proxies {
+		c := cfg
+		c.Proxy, c.Fallback = p, ""
+		client, err := proxyclient.New(c)
+		if err != nil {
+			fmt.Printf("erro: %s: %s\n", redactURL(p), err)
+			return 2
+		}
+		names[i] = client.ProxyURL().Redacted()
+		sides[i] = compareRequest(client)
+		client.Transport().CloseIdleConnections()
+	}
+
+	baseName := "direct"
+	if base.err != nil {
+		fmt.Printf("compare: direct: erro: %s\n", base.err)
+		// the status and body most proxies returned
+		votes := map[string]int{}
+		best := -1
+		for i, s := range sides {
+			if s.err != nil {
+				continue
+			}
+			k := fmt.Sprint(s.status, s.sum)
+			votes[k]++
+			if best < 0 || votes[k] > votes[fmt.Sprint(sides[best].status, sides[best].sum)] {
+				best = i
+			}
+		}
+		if best < 0 {
+			fmt.Println("compare: FAIL, no request succeeded, nothing to compare")
+			return 1
+		}
+		base, baseName = sides[best], "most proxies"
+	}
+	fmt.Printf("compare: baseline %s, code %d, %s sha256 %s\n", baseName, base.status, size(base.size), base.sum)
+
+	var rows [][]string
+	var details []string
+	var rewriters []string
+	for i, s := range sides {
+		if s.err != nil {
+			rows = append(rows, []string{names[i], "-", "-", "-", "-", "-", "-", "failed"})
+			details = append(details, fmt.Sprintf("compare: %s erro: %s", names[i], s.err))
+			rewriters = append(rewriters, names[i]+" (failed)")
+			continue
+		}
+		var what []string
+		if s.status != base.status {
+			what = append(what, "status")
+		}
+		if s.sum != base.sum {
+			what = append(what, "body")
+		}
+		added, removed, changed := headerDiff(base.header, s.header)
+		for _, h := range added {
+			details = append(details, fmt.Sprintf("compare: %s added %s", names[i], h))
+		}
+		for _, h := range removed {
+			details = append(details, fmt.Sprintf("compare: %s removed %s", names[i], h))
+		}
+		for _, h := range changed {
+			details = append(details, fmt.Sprintf("compare: %s changed %s", names[i], h))
+		}
+		verdict := "same"
+		if len(what) > 0 {
+			verdict = "REWRITES " + strings.Join(what, " and ")
+			rewriters = append(rewriters, names[i]+" ("+strings.Join(what, " and ")+")")
+		} else if len(added)+len(removed)+len(changed) > 0 {
+			verdict = "headers only"
+		}
+		rows = append(rows, []string{names[i], fmt.Sprint(s.status), size(s.size), s.sum[:12],
+			fmt.Sprint(len(added)), fmt.Sprint(len(removed)), fmt.Sprint(len(changed)), verdict})
+	}
+	printColumns([]string{"proxy", "code", "size", "sha256", "added", "removed", "changed", "verdict"}, rows)
+	for _, d := range details {
+		fmt.Println(d)
+	}
+	if len(rewriters) > 0 {
+		fmt.Printf("compare: FAIL, %d of %d proxies differ from the baseline: %s\n", len(rewriters), len(proxies), strings.Join(rewriters, ", "))
+		return 1
+	}
+	fmt.Println("compare: OK, every proxy returned the baseline status and body")
+	return 0
+}
+
+// headerDiff lists the headers of got that base lacks, those of base got
+// lacks and those both have with other values, as "Name: value" lines in
+// name order. compareIgnored are left out.
+func headerDiff(base, got http.Header) (added, removed, changed []string) {
+	names := map[string]bool{}
+	for k := range base {
+		names[k] = true
+	}
+	for k := range got {
+		names[k] = true
+	}
+	var sorted []string
+	for k := range names {
+		if !compareIgnored[k] {
+			sorted = append(sorted, k)
+		}
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		bv, bok := base[k]
+		gv, gok := got[k]
+		switch {
+		case !bok:
+			added = append(added, k+": "+strings.Join(gv, ", "))
+		case !gok:
+			removed = append(removed, k+": "+strings.Join(bv, ", "))
+		case strings.Join(bv, ", ") != strings.Join(gv, ", "):
+			changed = append(changed, fmt.Sprintf("%s: %q -> %q", k, strings.Join(bv, ", "), strings.Join(gv, ", ")))
+		}
+	}
+	return added, removed, changed
+}
+
+// compareRequest sends -dest with client and hashes the body.
+func compareRequest(client *proxyclient.Client) compareSide {
+	req, err := destRequest()
+	if err != nil {
+		return compareSide{err: err}
+	}
+	resp, res, err := client.Measure(req)
+	if err != nil {
+		return compareSide{err: err}
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return compareSide{err: err}
+	}
+	s := compareSide{status: resp.StatusCode, header: resp.Header, size: n, sum: hex.EncodeToString(h.Sum(nil))}
+	for _, ph := range res.Phases {
+		switch ph.Name {
+		case "ttfb":
+			s.ttfb = ph.Duration
+		case "total":
+			s.total = ph.Duration
+		}
+	}
+	return s
+}
+
+// signedDur is dur with the sign spelled out, +5ms or -5ms.
+func signedDur(d time.Duration) string {
+	if d < 0 {
+		return dur(d)
+	}
+	return "+" + dur(d)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// subcommands are the first-argument commands, for completion.
+var subcommands = []struct{ name, desc string }{
+	{"last", "print the last run"},
+	{"rerun", "run the last run again"},
+	{"serve", "run a forward proxy"},
+	{"run", "execute a scenario file"},
+	{"throughput", "measure bandwidth through the proxy"},
+	{"bench", "load the proxy, open and closed loop"},
+	{"mock-origin", "serve the mock origin"},
+	{"ws", "websocket through the proxy"},
+	{"conformance", "score RFC proxy behaviors"},
+	{"watch", "check proxies periodically"},
+	{"report", "summarize the watch store"},
+	{"tls-matrix", "handshake each TLS version and cipher"},
+	{"completion", "print a bash, zsh or fish completion script"},
+}
+
+// runCompletion implements `completion bash|zsh|fish [COMMAND]`: it
+// prints the completion script of COMMAND, the name the binary is run
+// as by default, for the subcommands, the flags and -config profile
+// names, which the scripts get from `completion profiles` when
+// completing, so new profiles need no new script.
+func runCompletion(args []string) int {
+	if len(args) == 1 && args[0] == "profiles" {
+		for _, name := range profileNames() {
+			fmt.Println(name)
+		}
+		return 0
+	}
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Println("erro: completion takes bash, zsh or fish and optionally the command name")
+		return 2
+	}
+	cmd := filepath.Base(os.Args[0])
+	if len(args) == 2 {
+		cmd = args[1]
+	}
+	if !regexp.MustCompile(`^[A-Za-z0-9._-]+$`).MatchString(cmd) {
+		fmt.Printf("erro: completion: %q is not a command name\n", cmd)
+		return 2
+	}
+	switch args[0] {
+	case "bash":
+		fmt.Print(bashCompletion(cmd))
+	case "zsh":
+		fmt.Print(zshCompletion(cmd))
+	case "fish":
+		fmt.Print(fishCompletion(cmd))
+	default:
+		fmt.Printf("erro: completion: unknown shell %q, want bash, zsh or fish\n", args[0])
+		return 2
+	}
+	return 0
+}
+
+// completionFlag is a flag as the scripts offer it.
+type completionFlag struct {
+	name string
+	desc string
+	// value is whether it takes an argument, which is a file unless
+	// name is config
+	value bool
+}
+
+func completionFlags() []completionFlag {
+	var flags []completionFlag
+	flag.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		desc := f.Usage
+		// the first clause, shells show one line
+		if i := strings.Index(desc, ", "); i > 0 {
+			desc = desc[:i]
+		}
+		flags = append(flags, completionFlag{name: f.Name, desc: desc, value: !ok || !b.IsBoolFlag()})
+	})
+	return flags
+}
+
+// shellFunc is cmd made a function name.
+func shellFunc(cmd string) string {
+	return "_" + strings.NewReplacer("-", "_", ".", "_").Replace(cmd)
+}
+
+func bashCompletion(cmd string) string {
+	var all, values []string
+	for _, f := range completionFlags() {
+		all = append(all, "-"+f.name)
+		if f.value && f.name != "config" {
+			values = append(values, "-"+f.name, "--"+f.name)
+		}
+	}
+	var subs []string
+	for _, s := range subcommands {
+		subs = append(subs, s.name)
+	}
+	fn := shellFunc(cmd)
+	return fmt.Sprintf(`# bash completion for %[1]s, from %[1]s completion bash
+%[2]s() {
+	local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}
+	case $prev in
+	-config|--config)
+		COMPREPLY=($(compgen -W "$(%[1]s completion profiles 2>/dev/null)" -f -- "$cur"))
+		return
+		;;
+	%[3]s)
+		COMPREPLY=($(compgen -f -- "$cur"))
+		return
+		;;
+	esac
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W "%[4]s" -- "$cur"))
+	elif [[ $COMP_CWORD -eq 1 ]]; then
+		COMPREPLY=($(compgen -W "%[5]s" -- "$cur"))
+	else
+		COMPREPLY=($(compgen -f -- "$cur"))
+	fi
+}
+complete -o filenames -F %[2]s %[1]s
+`, cmd, fn, strings.Join(values, "|"), strings.Join(all, " "), strings.Join(subs, " "))
+}
+
+func zshCompletion(cmd string) string {
+	var b strings.Builder
+	fn := shellFunc(cmd)
+	fmt.Fprintf(&b, "#compdef %[1]s\n# zsh completion for %[1]s, from %[1]s completion zsh\n%[2]s() {\n", cmd, fn)
+	b.WriteString("\tlocal -a subcommands flags values\n\tsubcommands=(\n")
+	for _, s := range subcommands {
+		fmt.Fprintf(&b, "\t\t%s\n", zshQuote(s.name+":"+s.desc))
+	}
+	b.WriteString("\t)\n\tflags=(\n")
+	var values []string
+	for _, f := range completionFlags() {
+		fmt.Fprintf(&b, "\t\t%s\n", zshQuote("-"+f.name+":"+strings.ReplaceAll(f.desc, ":", `\:`)))
+		if f.value && f.name != "config" {
+			values = append(values, "-"+f.name, "--"+f.name)
+		}
+	}
+	fmt.Fprintf(&b, "\t)\n\tvalues=(%s)\n", strings.Join(values, " "))
+	fmt.Fprintf(&b, `	case $words[CURRENT-1] in
+	-config|--config)
+		local -a profiles
+		profiles=(${(f)"$(%s completion profiles 2>/dev/null)"})
+		_alternative 'profiles:profile:compadd -a profiles' 'files:file:_files'
+		return
+		;;
+	esac
+	if (( ${values[(Ie)$words[CURRENT-1]]} )); then
+		_files
+	elif [[ $PREFIX == -* ]]; then
+		_describe flag flags
+	elif (( CURRENT == 2 )); then
+		_describe command subcommands
+	else
+		_files
+	fi
+}
+compdef %s %s
+`, cmd, fn, cmd)
+	return b.String()
+}
+
+func zshQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func fishCompletion(cmd string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# fish completion for %[1]s, from %[1]s completion fish\ncomplete -c %[1]s -f\n", cmd)
+	for _, s := range subcommands {
+		fmt.Fprintf(&b, "complete -c %s -n __fish_use_subcommand -a %s -d %s\n", cmd, s.name, fishQuote(s.desc))
+	}
+	for _, f := range completionFlags() {
+		switch {
+		case f.name == "config":
+			fmt.Fprintf(&b, "complete -c %s -o config -r -F -a '(%s completion profiles 2>/dev/null)' -d %s\n", cmd, cmd, fishQuote(f.desc))
+		case f.value:
+			fmt.Fprintf(&b, "complete -c %s -o %s -r -F -d %s\n", cmd, f.name, fishQuote(f.desc))
+		default:
+			fmt.Fprintf(&b, "complete -c %s -o %s -d %s\n", cmd, f.name, fishQuote(f.desc))
+		}
+	}
+	return b.String()
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
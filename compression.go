@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// compression is -compression: "" leaves the transport to ask for gzip
+// and decode it out of sight, none, gzip and br ask for that coding
+// themselves and show what came back.
+var compression string
+
+// acceptEncoding is the Accept-Encoding -compression sends, "" for the
+// transport's own. A request with its own header is not decoded by the
+// transport, so the response is the proxy's as it sent it.
+func acceptEncoding() string {
+	switch compression {
+	case "none":
+		return "identity"
+	case "gzip", "br":
+		return compression
+	}
+	return ""
+}
+
+func checkCompression() error {
+	switch compression {
+	case "", "none", "gzip", "br":
+		return nil
+	}
+	return fmt.Errorf("-compression is none, gzip or br, not %q", compression)
+}
+
+// checkBrotli refuses -compression br where the body is used: it stays
+// brotli, -o would save it encoded and the body checks would search the
+// encoded bytes. Run once -health and the assertions are parsed.
+func checkBrotli() error {
+	if compression != "br" {
+		return nil
+	}
+	var uses []string
+	if output != "" {
+		uses = append(uses, "-o")
+	}
+	if streaming() {
+		uses = append(uses, "-grep, -head and -decompress")
+	}
+	if hasBodyTerm(healthChecks) {
+		uses = append(uses, "-health body terms")
+	}
+	if assertBody != "" {
+		uses = append(uses, "-assert-body-contains")
+	}
+	if len(uses) > 0 {
+		return fmt.Errorf("-compression br leaves the body undecoded, there is no brotli decoder, so it cannot be used with %s", strings.Join(uses, ", "))
+	}
+	return nil
+}
+
+// hasBodyTerm reports whether groups look at the body.
+func hasBodyTerm(groups [][]healthCheck) bool {
+	for _, group := range groups {
+		for _, c := range group {
+			if c.field == "body" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compressionCheck is what reportCompression found, the sizes come once
+// the body was read.
+type compressionCheck struct {
+	wire, decoded *countingBody
+}
+
+// reportCompression compares the Content-Encoding of resp to the one
+// asked for and prints a compression: line: as asked, stripped, the
+// proxy decoded it or the origin does not compress, or re-encoded, with
+// Warning 214 as the proxy's own admission. A gzip or deflate body is
+// decoded for printing and the checks, br is printed as it came, there
+// is no decoder for it in the standard library; checkBrotli keeps it from
+// the checks.
+func reportCompression(resp *http.Response) *compressionCheck {
+	got := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if got == "" || got == "identity" {
+		got = "none"
+	}
+	switch {
+	case resp.Request.Method == "HEAD" || resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusNoContent:
+		fmt.Printf("compression: not checked, %d has no body\n", resp.StatusCode)
+	case got == compression:
+		fmt.Printf("compression: %s as asked\n", got)
+	case got == "none":
+		fmt.Printf("compression: asked for %s, got none: stripped, the proxy decoded it or the origin does not compress\n", compression)
+	case compression == "none":
+		fmt.Printf("compression: asked for none, got %s: the proxy or the origin compressed it anyway\n", got)
+	default:
+		fmt.Printf("compression: asked for %s, got %s: re-encoded\n", compression, got)
+	}
+	for _, w := range resp.Header.Values("Warning") {
+		if strings.HasPrefix(strings.TrimSpace(w), "214") {
+			fmt.Printf("compression: the proxy says it transformed the body: Warning: %s\n", w)
+		}
+	}
+	c := &compressionCheck{wire: &countingBody{ReadCloser: resp.Body}}
+	resp.Body = c.wire
+	if got == "gzip" || got == "x-gzip" || got == "deflate" {
+		if r, err := decoder(got, c.wire); err == nil {
+			c.decoded = &countingBody{ReadCloser: struct {
+				io.Reader
+				io.Closer
+			}{r, c.wire}}
+			resp.Body = c.decoded
+			// streamBody decodes it no more
+			resp.Uncompressed = true
+		} else {
+			fmt.Printf("compression: %s body does not decode: %s\n", got, err)
+		}
+	} else if got == "br" {
+		fmt.Println("compression: br body NOT decoded, there is no brotli decoder: the body below is the encoded bytes")
+	}
+	return c
+}
+
+// done prints the sizes, on the wire and decoded.
+func (c *compressionCheck) done() {
+	if c.decoded == nil {
+		fmt.Printf("compression: %s on the wire\n", size(c.wire.n))
+		return
+	}
+	ratio := 0.0
+	if c.decoded.n > 0 {
+		ratio = float64(c.wire.n) * 100 / float64(c.decoded.n)
+	}
+	fmt.Printf("compression: %s on the wire, %s decoded, %.0f%%\n", size(c.wire.n), size(c.decoded.n), ratio)
+}
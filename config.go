@@ -0,0 +1,287 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// configAliases map friendlier config keys to flag names.
+var configAliases = map[string]string{
+	"header":  "H",
+	"headers": "H",
+}
+
+// configSetting is one value of the config file and the line it is on.
+type configSetting struct {
+	name, value string
+	line        int
+}
+
+// loadConfig applies -config. The file sets flags by name, in a flat YAML
+// ("name: value", lists as "- item" lines under "name:") or TOML ("name =
+// value", lists as [...]) subset. Flags given on the command line or in
+// POC_PROXY_HTTPS_* variables win over the file; its headers come before
+// the -H ones, which replace those of the same name.
+func loadConfig(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	settings, err := parseConfig(string(data))
+	if err != nil {
+		return fmt.Errorf("%s:%s", path, err)
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Mode().Perm()&0077 != 0 {
+		for _, s := range settings {
+			if isSecretFlag(s.name) {
+				fmt.Fprintf(os.Stderr, "config: %s holds %s and is readable by others, chmod 600 it\n", path, s.name)
+				break
+			}
+		}
+	}
+
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var headers []string
+	for _, s := range settings {
+		if flag.Lookup(s.name) == nil {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, s.line, s.name)
+		}
+		if s.name == "H" {
+			if _, _, err := splitHeader(s.value); err != nil {
+				return fmt.Errorf("%s:%d: %s", path, s.line, err)
+			}
+			headers = append(headers, s.value)
+			continue
+		}
+		if set[s.name] {
+			continue
+		}
+		if err := flag.Set(s.name, s.value); err != nil {
+			return fmt.Errorf("%s:%d: %s: %s", path, s.line, s.name, err)
+		}
+	}
+
+	given := map[string]bool{}
+	for _, h := range extraHeaders {
+		name, _, _ := splitHeader(h)
+		given[http.CanonicalHeaderKey(name)] = true
+	}
+	var merged headerList
+	for _, h := range headers {
+		if name, _, _ := splitHeader(h); !given[http.CanonicalHeaderKey(name)] {
+			merged = append(merged, h)
+		}
+	}
+	extraHeaders = append(merged, extraHeaders...)
+	return nil
+}
+
+// profileExts are the config file extensions a profile name may leave
+// out, in lookup order.
+var profileExts = []string{".yaml", ".yml", ".toml"}
+
+// profileDir holds the named config files -config takes without a path.
+func profileDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "poc-proxy-https", "profiles"), nil
+}
+
+// configPath resolves -config: a file that exists, else the profile of
+// that name, e.g. "corp" for profiles/corp.yaml.
+func configPath(name string) string {
+	if _, err := os.Stat(name); err == nil || strings.ContainsRune(name, os.PathSeparator) {
+		return name
+	}
+	dir, err := profileDir()
+	if err != nil {
+		return name
+	}
+	for _, ext := range profileExts {
+		p := filepath.Join(dir, name+ext)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return name
+}
+
+// profileNames lists the profiles, sorted as ReadDir sorts.
+func profileNames() []string {
+	dir, err := profileDir()
+	if err != nil {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	seen := map[string]bool{}
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		name := strings.TrimSuffix(e.Name(), ext)
+		if e.IsDir() || name == "" || seen[name] {
+			continue
+		}
+		for _, x := range profileExts {
+			if ext == x {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// parseConfig reads the settings in file order, a list giving one setting
+// per item.
+func parseConfig(data string) ([]configSetting, error) {
+	var settings []configSetting
+	list := "" // the YAML key whose "- item" lines follow
+	for i, raw := range strings.Split(data, "\n") {
+		n := i + 1
+		line := strings.TrimSpace(stripComment(raw))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "- ") || line == "-" {
+			if list == "" {
+				return nil, fmt.Errorf("%d: list item without a setting", n)
+			}
+			v, err := configValue(strings.TrimSpace(line[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("%d: %s", n, err)
+			}
+			settings = append(settings, configSetting{list, v, n})
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("%d: tables are not supported, keep settings at the top level", n)
+		}
+		if raw[0] == ' ' || raw[0] == '\t' {
+			return nil, fmt.Errorf("%d: nested settings are not supported, keep them at the top level", n)
+		}
+		sep := strings.IndexAny(line, ":=")
+		if sep <= 0 {
+			return nil, fmt.Errorf("%d: want name: value or name = value", n)
+		}
+		name := strings.TrimSpace(line[:sep])
+		if alias, ok := configAliases[name]; ok {
+			name = alias
+		}
+		value := strings.TrimSpace(line[sep+1:])
+		list = ""
+		switch {
+		case value == "" && line[sep] == ':':
+			list = name
+		case strings.HasPrefix(value, "["):
+			items, err := configArray(value)
+			if err != nil {
+				return nil, fmt.Errorf("%d: %s", n, err)
+			}
+			for _, v := range items {
+				settings = append(settings, configSetting{name, v, n})
+			}
+		default:
+			v, err := configValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("%d: %s", n, err)
+			}
+			settings = append(settings, configSetting{name, v, n})
+		}
+	}
+	return settings, nil
+}
+
+// stripComment cuts a # comment that is not inside quotes.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0 && c == '\\' && quote == '"':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// configValue unquotes a scalar: "double" with escapes, 'single' verbatim,
+// or bare.
+func configValue(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		return strconv.Unquote(v)
+	case strings.HasPrefix(v, "'"):
+		if len(v) < 2 || !strings.HasSuffix(v, "'") {
+			return "", fmt.Errorf("unterminated string %s", v)
+		}
+		return v[1 : len(v)-1], nil
+	}
+	return v, nil
+}
+
+// configArray splits a one line [a, "b", 'c'] list.
+func configArray(v string) ([]string, error) {
+	if !strings.HasSuffix(v, "]") {
+		return nil, fmt.Errorf("lists must close on the same line")
+	}
+	inner := strings.TrimSpace(v[1 : len(v)-1])
+	var items []string
+	for inner != "" {
+		end := len(inner)
+		if inner[0] == '"' || inner[0] == '\'' {
+			// the closing quote, skipping escaped ones in double quotes
+			end = 1
+			for end < len(inner) && inner[end] != inner[0] {
+				if inner[0] == '"' && inner[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(inner) {
+				return nil, fmt.Errorf("unterminated string in list")
+			}
+			end++
+		} else if c := strings.IndexByte(inner, ','); c >= 0 {
+			end = c
+		}
+		item, err := configValue(strings.TrimSpace(inner[:end]))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		inner = strings.TrimSpace(inner[end:])
+		if strings.HasPrefix(inner, ",") {
+			inner = strings.TrimSpace(inner[1:])
+		} else if inner != "" {
+			return nil, fmt.Errorf("want , between list items")
+		}
+	}
+	return items, nil
+}
+
+// isSecretFlag reports whether name is one of secretFlags.
+func isSecretFlag(name string) bool {
+	for _, s := range secretFlags {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		data string
+		want []configSetting
+	}{
+		{"proxy: 10.0.0.1:3128\nuser: alice # the service account\n", []configSetting{
+			{"proxy", "10.0.0.1:3128", 1}, {"user", "alice", 2},
+		}},
+		{"# toml\nproxy = \"10.0.0.1:3128\"\npassword = 'p#ss'\n", []configSetting{
+			{"proxy", "10.0.0.1:3128", 2}, {"password", "p#ss", 3},
+		}},
+		{"headers:\n  - \"X-A: 1\"\n  - X-B: 2\ndest: https://example.com\n", []configSetting{
+			{"H", "X-A: 1", 2}, {"H", "X-B: 2", 3}, {"dest", "https://example.com", 4},
+		}},
+		{"H = [\"X-A: 1\", 'X-B: \"2\"', X-C]\n", []configSetting{
+			{"H", "X-A: 1", 1}, {"H", `X-B: "2"`, 1}, {"H", "X-C", 1},
+		}},
+		{"user: \"a \\\"quoted\\\" name\"\n", []configSetting{{"user", `a "quoted" name`, 1}}},
+		{"\n\n# nothing\n", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseConfig(tt.data)
+		if err != nil {
+			t.Errorf("parseConfig(%q): %s", tt.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseConfig(%q) = %v, want %v", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, data := range []string{
+		"- orphan item\n",
+		"[section]\nproxy = x\n",
+		"proxy: x\n  nested: y\n",
+		"just words\n",
+		"user: 'unterminated\n",
+		"H = [\"X-A: 1\",\n",
+		"H = [\"X-A: 1\" \"X-B: 2\"]\n",
+	} {
+		if got, err := parseConfig(data); err == nil {
+			t.Errorf("parseConfig(%q) = %v, want an error", data, got)
+		}
+	}
+}
+
+// TestConfigPrecedence runs the order main applies the sources in:
+// POC_PROXY_HTTPS_* variables, the command line, then -config, which
+// only fills what the other two left unset.
+func TestConfigPrecedence(t *testing.T) {
+	file := "proxy: file:3128\nuser: file\nheaders:\n  - X-A: file\n  - X-B: file\n"
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		proxy   string
+		user    string
+		headers headerList
+	}{
+		{"file", nil, nil, "file:3128", "file", headerList{"X-A: file", "X-B: file"}},
+		{"env over file", map[string]string{"POC_PROXY_HTTPS_PROXY": "env:3128"}, nil, "env:3128", "file", headerList{"X-A: file", "X-B: file"}},
+		{"command line over env and file", map[string]string{"POC_PROXY_HTTPS_PROXY": "env:3128"}, []string{"-proxy", "cli:3128", "-user", "cli"}, "cli:3128", "cli", headerList{"X-A: file", "X-B: file"}},
+		// -H adds to the file's headers and replaces those of its name
+		{"headers", nil, []string{"-H", "X-B: cli", "-H", "X-C: cli"}, "file:3128", "file", headerList{"X-A: file", "X-B: cli", "X-C: cli"}},
+	}
+	saved := flag.CommandLine
+	defer func() { flag.CommandLine, extraHeaders = saved, nil }()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+			var proxy, user string
+			extraHeaders = nil
+			flag.StringVar(&proxy, "proxy", "", "")
+			flag.StringVar(&user, "user", "", "")
+			flag.Var(&extraHeaders, "H", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			if err := envFlags(); err != nil {
+				t.Fatal(err)
+			}
+			if err := flag.CommandLine.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if err := loadConfig(path); err != nil {
+				t.Fatal(err)
+			}
+			if proxy != tt.proxy || user != tt.user || !reflect.DeepEqual(extraHeaders, tt.headers) {
+				t.Errorf("proxy %q user %q headers %q, want %q %q %q", proxy, user, extraHeaders, tt.proxy, tt.user, tt.headers)
+			}
+		})
+	}
+}
+
+// TestPasswordPrecedence checks that a password source on the command line
+// replaces a password from the environment or -config rather than clash
+// with it.
+func TestPasswordPrecedence(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		file     string
+		args     []string
+		password string
+		err      bool
+	}{
+		{"file", nil, "password: file\n", nil, "file", false},
+		{"env over file", map[string]string{"POC_PROXY_HTTPS_PASSWORD": "env"}, "password: file\n", nil, "env", false},
+		{"-password-env over file", map[string]string{"PW": "var"}, "password: file\n", []string{"-password-env", "PW"}, "var", false},
+		{"-password-env over env", map[string]string{"PW": "var", "POC_PROXY_HTTPS_PASSWORD": "env"}, "", []string{"-password-env", "PW"}, "var", false},
+		{"-password over env -password-env", map[string]string{"PW": "var", "POC_PROXY_HTTPS_PASSWORD_ENV": "PW"}, "", []string{"-password", "cli"}, "cli", false},
+		// the file's -password-env replaces the file's password
+		{"file -password-env", map[string]string{"PW": "var"}, "password: file\npassword-env: PW\n", nil, "var", false},
+		{"two on the command line", map[string]string{"PW": "var"}, "", []string{"-password", "cli", "-password-env", "PW"}, "", true},
+		{"two in the environment", map[string]string{"PW": "var", "POC_PROXY_HTTPS_PASSWORD_ENV": "PW", "POC_PROXY_HTTPS_PASSWORD_FILE": "/nonexistent"}, "", nil, "", true},
+	}
+	saved := flag.CommandLine
+	defer func() {
+		flag.CommandLine, cmdLineFlags = saved, map[string]bool{}
+		password, passwordFile, passwordEnv, passwordPrompt = "", "", "", false
+	}()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+			cmdLineFlags = map[string]bool{}
+			flag.StringVar(&password, "password", "", "")
+			flag.StringVar(&passwordFile, "password-file", "", "")
+			flag.StringVar(&passwordEnv, "password-env", "", "")
+			flag.BoolVar(&passwordPrompt, "password-prompt", false, "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			if err := envFlags(); err != nil {
+				t.Fatal(err)
+			}
+			recordFlags(tt.args)
+			if err := flag.CommandLine.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if tt.file != "" {
+				path := filepath.Join(t.TempDir(), "config.yaml")
+				if err := ioutil.WriteFile(path, []byte(tt.file), 0600); err != nil {
+					t.Fatal(err)
+				}
+				if err := loadConfig(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := loadPassword()
+			if (err != nil) != tt.err || err == nil && password != tt.password {
+				t.Errorf("password %q, error %v, want %q, error %v", password, err, tt.password, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// confRun checks how the proxy forwards requests to the mock origin. Like
+// the cache test it needs the origin reachable from the proxy over plain
+// http, tunneled requests show the proxy nothing.
+type confRun struct {
+	client *proxyclient.Client
+	origin *mockOrigin
+	base   string
+	nonce  string
+	// hasCreds tells whether a Proxy-Authorization goes to the proxy
+	hasCreds bool
+}
+
+// confCheck is one proxy behavior. run returns "PASS", "FAIL" or "SKIP"
+// and what was seen.
+type confCheck struct {
+	name string
+	rfc  string
+	run  func(c *confRun) (string, string)
+}
+
+var confChecks = []confCheck{
+	{"via request", "RFC 9110 7.6.3", func(c *confRun) (string, string) {
+		uri := c.uri("/conformance/via")
+		if _, _, err := c.send("GET", uri, nil); err != nil {
+			return "FAIL", err.Error()
+		}
+		reqs := c.origin.requests(uri)
+		if len(reqs) == 0 {
+			return "FAIL", "mock origin not reached through the proxy, check -origin-url"
+		}
+		if via := reqs[0].Header.Get("Via"); via != "" {
+			return "PASS", "Via: " + via
+		}
+		return "FAIL", "request reached the origin without Via"
+	}},
+	{"via response", "RFC 9110 7.6.3", func(c *confRun) (string, string) {
+		resp, _, err := c.send("GET", c.uri("/conformance/via-response"), nil)
+		if err != nil {
+			return "FAIL", err.Error()
+		}
+		if via := resp.Header.Get("Via"); via != "" {
+			return "PASS", "Via: " + via
+		}
+		return "FAIL", "response came back without Via"
+	}},
+	{"hop-by-hop request", "RFC 9110 7.6.1", func(c *confRun) (string, string) {
+		uri := c.uri("/conformance/hop")
+		_, _, err := c.send("GET", uri, http.Header{
+			"Connection":        {"keep-alive, X-Conformance-Hop"},
+			"X-Conformance-Hop": {"1"},
+			"Keep-Alive":        {"timeout=5"},
+		})
+		if err != nil {
+			return "FAIL", err.Error()
+		}
+		reqs := c.origin.requests(uri)
+		if len(reqs) == 0 {
+			return "FAIL", "mock origin not reached"
+		}
+		if leaked := presentHeaders(reqs[0].Header, "X-Conformance-Hop", "Keep-Alive"); leaked != "" {
+			return "FAIL", "forwarded to the origin: " + leaked
+		}
+		return "PASS", "Connection listed and Keep-Alive headers dropped"
+	}},
+	{"hop-by-hop response", "RFC 9110 7.6.1", func(c *confRun) (string, string) {
+		resp, _, err := c.send("GET", c.uri("/conformance/hop-response"), nil)
+		if err != nil {
+			return "FAIL", err.Error()
+		}
+		if leaked := presentHeaders(resp.Header, "X-Conformance-Hop", "Keep-Alive"); leaked != "" {
+			return "FAIL", "relayed to the client: " + leaked
+		}
+		return "PASS", "origin's Connection listed and Keep-Alive headers dropped"
+	}},
+	{"connection close", "RFC 9112 9.6", func(c *confRun) (string, string) {
+		resp, _, err := c.send("GET", c.uri("/conformance/close"), http.Header{"Connection": {"close"}})
+		if err != nil {
+			return "FAIL", err.Error()
+		}
+		if !resp.Close {
+			return "FAIL", "Connection: close answered without closing"
+		}
+		return "PASS", "proxy closes the connection after the response"
+	}},
+	{"trace blocked", "RFC 9110 9.3.8", func(c *confRun) (string, string) {
+		uri := c.uri("/conformance/trace")
+		resp, body, err := c.send("TRACE", uri, http.Header{"Cookie": {"conformance=secret"}})
+		if err != nil {
+			return "PASS", "TRACE refused: " + err.Error()
+		}
+		if len(c.origin.requests(uri)) == 0 {
+			return "PASS", fmt.Sprintf("TRACE answered by the proxy with %d", resp.StatusCode)
+		}
+		if strings.Contains(body, "conformance=secret") {
+			return "FAIL", "TRACE forwarded and the cookie reflected, cross-site tracing possible"
+		}
+		return "FAIL", "TRACE forwarded to the origin"
+	}},
+	{"max-forwards", "RFC 9110 7.6.2", func(c *confRun) (string, string) {
+		uri := c.uri("/conformance/max-forwards")
+		resp, _, err := c.send("OPTIONS", uri, http.Header{"Max-Forwards": {"0"}})
+		if err != nil {
+			return "FAIL", err.Error()
+		}
+		if len(c.origin.requests(uri)) > 0 {
+			return "FAIL", "OPTIONS with Max-Forwards: 0 forwarded to the origin"
+		}
+		return "PASS", fmt.Sprintf("answered by the proxy with %d", resp.StatusCode)
+	}},
+	{"credentials kept", "RFC 9110 11.7.1", func(c *confRun) (string, string) {
+		if !c.hasCreds {
+			return "SKIP", "no proxy credentials given"
+		}
+		uri := c.uri("/conformance/credentials")
+		if _, _, err := c.send("GET", uri, nil); err != nil {
+			return "FAIL", err.Error()
+		}
+		reqs := c.origin.requests(uri)
+		if len(reqs) == 0 {
+			return "FAIL", "mock origin not reached"
+		}
+		if reqs[0].Header.Get("Proxy-Authorization") != "" {
+			return "FAIL", "Proxy-Authorization forwarded to the origin"
+		}
+		return "PASS", "Proxy-Authorization consumed by the proxy"
+	}},
+}
+
+// presentHeaders returns those of names present in h.
+func presentHeaders(h http.Header, names ...string) string {
+	var found []string
+	for _, n := range names {
+		if v := h.Get(n); v != "" {
+			found = append(found, n+": "+v)
+		}
+	}
+	return strings.Join(found, ", ")
+}
+
+func (c *confRun) uri(path string) string {
+	return path + "?run=" + c.nonce
+}
+
+func (c *confRun) send(method, uri string, header http.Header) (*http.Response, string, error) {
+	req, err := http.NewRequest(method, c.base+uri, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp, string(body), err
+}
+
+// runConformance implements `conformance`: it starts the mock origin, runs
+// every check through the proxy and scores them. It returns 1 when any
+// check failed.
+func runConformance(client *proxyclient.Client, cfg proxyclient.Config) int {
+	if client.ProxyURL() == nil {
+		fmt.Println("erro: conformance needs a proxy")
+		return 2
+	}
+	ln, err := net.Listen("tcp", originListen)
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 1
+	}
+	origin := newMockOrigin()
+	go http.Serve(ln, origin)
+
+	if err := startOriginDNS(ln); err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 2
+	}
+	base := originBase(ln)
+	c := &confRun{
+		client:   client,
+		origin:   origin,
+		base:     base,
+		nonce:    fmt.Sprint(time.Now().UnixNano()),
+		hasCreds: cfg.User != "" || cfg.Password != "",
+	}
+	fmt.Printf("conformance: mock origin %s, listening on %s\n", c.base, ln.Addr())
+
+	passed, failed := 0, 0
+	for _, check := range confChecks {
+		verdict, detail := check.run(c)
+		switch verdict {
+		case "PASS":
+			passed++
+		case "FAIL":
+			failed++
+		}
+		fmt.Printf("conformance: %-19s %s %s (%s)\n", check.name, verdict, detail, check.rfc)
+	}
+	fmt.Printf("conformance: %d/%d passed, score %d%%\n", passed, passed+failed, 100*passed/max(passed+failed, 1))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
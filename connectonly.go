@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// runConnectOnly opens the tunnel to -dest and sends no request through
+// it, printing every CONNECT response as the proxy sent it. For https
+// destinations the TLS handshake runs inside the tunnel too. It returns 0
+// when the tunnel (and handshake) came up.
+func runConnectOnly(client *proxyclient.Client) int {
+	p := client.ProxyURL()
+	if p == nil {
+		fmt.Println("erro: -connect-only needs a proxy")
+		return 2
+	}
+	destURL, err := url.Parse(dest)
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 2
+	}
+	port := destURL.Port()
+	if port == "" {
+		port = "80"
+		if destURL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(destURL.Hostname(), port)
+
+	var raw []string
+	var connectResp *http.Response
+	ctx := proxyclient.WithConnectRaw(context.Background(), &raw)
+	ctx = proxyclient.WithConnectResponse(ctx, &connectResp)
+	start := time.Now()
+	conn, err := client.Tunnel(ctx, addr)
+	elapsed := time.Since(start)
+	for i, head := range raw {
+		fmt.Printf("connect response %d:\n", i+1)
+		for _, line := range strings.SplitAfter(head, "\n") {
+			if line != "" {
+				fmt.Printf("  %q\n", line)
+			}
+		}
+	}
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		if connectResp != nil && connectResp.StatusCode == http.StatusProxyAuthRequired {
+			return reportProxyAuth(connectResp.Header)
+		}
+		return 1
+	}
+	defer conn.Close()
+	if len(raw) > 0 {
+		// RFC 9110 9.3.6: a 2xx to CONNECT has neither, clients treating
+		// the tunnel as a body break on them
+		for _, line := range strings.Split(strings.ToLower(raw[len(raw)-1]), "\n") {
+			if strings.HasPrefix(line, "transfer-encoding:") || strings.HasPrefix(line, "content-length:") {
+				fmt.Printf("connect: WARN, 2xx to CONNECT carries %s (RFC 9110 9.3.6)\n", strings.TrimSpace(line[:strings.IndexByte(line, ':')]))
+			}
+		}
+	}
+	if strings.HasPrefix(p.Scheme, "socks") {
+		fmt.Printf("connect: socks tunnel to %s in %s\n", addr, dur(elapsed))
+	} else {
+		fmt.Printf("connect: tunnel to %s in %s\n", addr, dur(elapsed))
+	}
+	if destURL.Scheme != "https" {
+		return 0
+	}
+
+	conf := client.TLSConfig().Clone()
+	if conf.ServerName == "" {
+		conf.ServerName = destURL.Hostname()
+	}
+	tc := tls.Client(conn, conf)
+	start = time.Now()
+	err = tc.HandshakeContext(ctx)
+	if err != nil {
+		fmt.Printf("erro: tls handshake: %s\n", err)
+		return 1
+	}
+	cs := tc.ConnectionState()
+	printTLS("client<->destination", &cs)
+	fmt.Printf("connect: tls handshake in %s, no request sent\n", dur(time.Since(start)))
+	return 0
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cookieList collects repeated -cookie flags, each NAME=VALUE or several
+// separated by semicolons as in a Cookie header.
+type cookieList []string
+
+func (l *cookieList) String() string {
+	return strings.Join(*l, "; ")
+}
+
+func (l *cookieList) Set(v string) error {
+	for _, c := range strings.Split(v, ";") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if name, _, ok := strings.Cut(c, "="); !ok || name == "" {
+			return fmt.Errorf("want NAME=VALUE, got %q", c)
+		}
+		*l = append(*l, c)
+	}
+	return nil
+}
+
+// cookieJar is the jar of the run, nil without -cookie or -cookie-jar.
+var cookieJar *fileJar
+
+// fileJar is a cookiejar.Jar that remembers what it was given, to write
+// the cookies still valid to -cookie-jar at the end of the run, in the
+// Netscape format curl and wget read and write.
+type fileJar struct {
+	*cookiejar.Jar
+
+	mu    sync.Mutex
+	saved map[string]jarEntry
+}
+
+// jarEntry is one line of the jar file. domain has a leading dot when
+// the cookie goes to subdomains too; expires is zero for a session
+// cookie.
+type jarEntry struct {
+	domain   string
+	path     string
+	secure   bool
+	httpOnly bool
+	expires  time.Time
+	name     string
+	value    string
+}
+
+func (j *fileJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.Jar.SetCookies(u, cookies)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	host := strings.ToLower(u.Hostname())
+	now := time.Now()
+	for _, c := range cookies {
+		e := jarEntry{domain: host, path: c.Path, secure: c.Secure, httpOnly: c.HttpOnly, name: c.Name, value: c.Value}
+		if d := strings.TrimPrefix(strings.ToLower(c.Domain), "."); d != "" {
+			// the jar ignores a Domain the host is not in
+			if host != d && !strings.HasSuffix(host, "."+d) {
+				continue
+			}
+			e.domain = "." + d
+		}
+		if e.path == "" || e.path[0] != '/' {
+			// the default path, RFC 6265 5.1.4
+			e.path = "/"
+			if i := strings.LastIndex(u.Path, "/"); i > 0 {
+				e.path = u.Path[:i]
+			}
+		}
+		switch {
+		case c.MaxAge > 0:
+			e.expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		case c.MaxAge == 0 && !c.Expires.IsZero():
+			e.expires = c.Expires
+		}
+		key := e.domain + ";" + e.path + ";" + e.name
+		if c.MaxAge < 0 || (!e.expires.IsZero() && !e.expires.After(now)) {
+			delete(j.saved, key)
+			continue
+		}
+		j.saved[key] = e
+	}
+}
+
+// newCookieJar sets up cookieJar from -cookie-jar, reading the file when
+// it exists, and -cookie, the cookies sent to -dest.
+func newCookieJar() (http.CookieJar, error) {
+	if cookieJarFile == "" && len(cookies) == 0 {
+		return nil, nil
+	}
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	cookieJar = &fileJar{Jar: jar, saved: map[string]jarEntry{}}
+	if cookieJarFile != "" {
+		if err := cookieJar.load(cookieJarFile); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if len(cookies) > 0 {
+		u, err := url.Parse(dest)
+		if err != nil {
+			return nil, err
+		}
+		var cs []*http.Cookie
+		for _, c := range cookies {
+			name, value, _ := strings.Cut(c, "=")
+			cs = append(cs, &http.Cookie{Name: name, Value: value, Path: "/"})
+		}
+		cookieJar.SetCookies(u, cs)
+	}
+	return cookieJar, nil
+}
+
+func (j *fileJar) load(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		httpOnly := strings.HasPrefix(line, "#HttpOnly_")
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return fmt.Errorf("%s:%d: want 7 tab separated fields, got %d", file, n, len(fields))
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: bad expiry %q", file, n, fields[4])
+		}
+		c := &http.Cookie{Name: fields[5], Value: fields[6], Path: fields[2], Secure: fields[3] == "TRUE", HttpOnly: httpOnly}
+		host := strings.TrimPrefix(fields[0], ".")
+		if fields[1] == "TRUE" {
+			c.Domain = host
+		}
+		if expires > 0 {
+			c.Expires = time.Unix(expires, 0)
+		}
+		scheme := "http"
+		if c.Secure {
+			scheme = "https"
+		}
+		j.SetCookies(&url.URL{Scheme: scheme, Host: host, Path: path.Join("/", c.Path)}, []*http.Cookie{c})
+	}
+	return sc.Err()
+}
+
+// save writes the cookies still valid to file.
+func (j *fileJar) save(file string) (int, error) {
+	j.mu.Lock()
+	var entries []jarEntry
+	now := time.Now()
+	for _, e := range j.saved {
+		if e.expires.IsZero() || e.expires.After(now) {
+			entries = append(entries, e)
+		}
+	}
+	j.mu.Unlock()
+	sort.Slice(entries, func(a, b int) bool {
+		if entries[a].domain != entries[b].domain {
+			return entries[a].domain < entries[b].domain
+		}
+		if entries[a].path != entries[b].path {
+			return entries[a].path < entries[b].path
+		}
+		return entries[a].name < entries[b].name
+	})
+	var b strings.Builder
+	b.WriteString("# Netscape HTTP Cookie File\n# written by poc-proxy-https, edit at will\n\n")
+	tf := func(v bool) string {
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+	for _, e := range entries {
+		if e.httpOnly {
+			b.WriteString("#HttpOnly_")
+		}
+		var expires int64
+		if !e.expires.IsZero() {
+			expires = e.expires.Unix()
+		}
+		fmt.Fprintf(&b, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", e.domain, tf(strings.HasPrefix(e.domain, ".")), e.path, tf(e.secure), expires, e.name, e.value)
+	}
+	// cookies are credentials
+	return len(entries), ioutil.WriteFile(file, []byte(b.String()), 0600)
+}
+
+// saveCookieJar writes the jar back to -cookie-jar, if any.
+func saveCookieJar() {
+	if cookieJar == nil || cookieJarFile == "" {
+		return
+	}
+	n, err := cookieJar.save(cookieJarFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "erro: -cookie-jar: %s\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "cookie-jar: %d cookies in %s\n", n, cookieJarFile)
+}
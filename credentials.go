@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// credentialsProvider returns the Config.Credentials hook of
+// -credentials-cmd or -credentials-url, nil without either.
+func credentialsProvider() (func(ctx context.Context, proxy string) (string, string, error), error) {
+	switch {
+	case credentialsCmd != "" && credentialsURL != "":
+		return nil, fmt.Errorf("-credentials-cmd and -credentials-url are mutually exclusive")
+	case credentialsCmd != "":
+		return func(ctx context.Context, proxy string) (string, string, error) {
+			return fetchCredentials(proxy, "-credentials-cmd", func(ctx context.Context) ([]byte, error) {
+				return runCredentialsCmd(ctx, proxy)
+			})
+		}, nil
+	case credentialsURL != "":
+		return func(ctx context.Context, proxy string) (string, string, error) {
+			return fetchCredentials(proxy, "-credentials-url", getCredentialsURL)
+		}, nil
+	}
+	return nil, nil
+}
+
+// fetchCredentials runs fetch within 30s and parses what it returned.
+// Failures are printed, the request then keeps the proxy's refusal.
+func fetchCredentials(proxy, source string, fetch func(ctx context.Context) ([]byte, error)) (string, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	out, err := fetch(ctx)
+	if err == nil {
+		var user, password string
+		if user, password, err = parseCredentials(out); err == nil {
+			fmt.Fprintf(os.Stderr, "credentials: %s refused the old ones, got new ones for %s from %s\n", proxy, user, source)
+			return user, password, nil
+		}
+	}
+	fmt.Fprintf(os.Stderr, "erro: %s: %s\n", source, err)
+	return "", "", err
+}
+
+// runCredentialsCmd runs -credentials-cmd through the shell with the
+// refusing proxy in PROXY_HOST.
+func runCredentialsCmd(ctx context.Context, proxy string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", credentialsCmd)
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", credentialsCmd)
+	}
+	cmd.Env = append(os.Environ(), "PROXY_HOST="+proxy)
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
+
+// getCredentialsURL fetches -credentials-url directly, never through the
+// proxy that just refused.
+func getCredentialsURL(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", credentialsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+}
+
+// parseCredentials reads a JSON object with user, or username, and
+// password, or a first line of USER:PASSWORD.
+func parseCredentials(out []byte) (string, string, error) {
+	text := strings.TrimSpace(string(out))
+	if strings.HasPrefix(text, "{") {
+		var v struct {
+			User     string `json:"user"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := json.Unmarshal([]byte(text), &v); err != nil {
+			return "", "", err
+		}
+		if v.User == "" {
+			v.User = v.Username
+		}
+		if v.User == "" {
+			return "", "", fmt.Errorf("no user in the answer")
+		}
+		return v.User, v.Password, nil
+	}
+	line := strings.TrimRight(strings.SplitN(text, "\n", 2)[0], "\r")
+	i := strings.Index(line, ":")
+	if i <= 0 {
+		return "", "", fmt.Errorf("want USER:PASSWORD or a JSON object")
+	}
+	return line[:i], line[i+1:], nil
+}
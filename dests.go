@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// destList is -dest, repeatable. The first URL is also dest, the one the
+// single destination modes use.
+type destList struct {
+	urls []string
+	// fromEnv is set while the URLs came from the environment, the
+	// command line replaces them rather than adding to them
+	fromEnv bool
+}
+
+func (l *destList) String() string {
+	return strings.Join(l.urls, ", ")
+}
+
+func (l *destList) Set(v string) error {
+	if l.fromEnv {
+		l.urls, l.fromEnv = nil, false
+	}
+	u, err := splitTags(v)
+	if err != nil {
+		return err
+	}
+	l.urls = append(l.urls, u)
+	dest = l.urls[0]
+	return nil
+}
+
+// loadDests adds the URLs of -dest-file to the -dest ones.
+func loadDests() error {
+	if destFile == "" {
+		return nil
+	}
+	f, err := os.Open(destFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := dests.Set(line); err != nil {
+			return fmt.Errorf("%s: %s", destFile, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("%s: %s", destFile, err)
+	}
+	if len(dests.urls) == 0 {
+		return fmt.Errorf("%s: no destinations", destFile)
+	}
+	return nil
+}
+
+// hasFlag tells whether args set the flag name.
+func hasFlag(args []string, name string) bool {
+	return len(dropFlag(args, name)) != len(args)
+}
+
+// dropFlag returns args without the flag name and its value.
+func dropFlag(args []string, name string) []string {
+	var kept []string
+	for i := 0; i < len(args); i++ {
+		a := strings.TrimPrefix(strings.TrimPrefix(args[i], "-"), "-")
+		switch {
+		case a == name:
+			i++
+		case strings.HasPrefix(a, name+"="):
+		default:
+			kept = append(kept, args[i])
+		}
+	}
+	return kept
+}
+
+// destOutcome is one row of the -dest summary.
+type destOutcome struct {
+	url     string
+	res     *proxyclient.Result
+	elapsed time.Duration
+	bytes   int64
+	failure string
+	// page is the text of an error page with -html-text
+	page string
+}
+
+// runMultiDest requests every destination through the one client, so
+// connections to the proxy are reused across them, -parallel at a time,
+// and prints a summary table in the order given, rolled up by domain for
+// a big batch. It returns 1 when any request failed or, with -health, any
+// response failed the checks. An interrupt cancels the requests in flight,
+// prints what came back and the destinations not attempted and returns
+// exitInterrupted. With -checkpoint the destinations done in an earlier
+// run are not requested again, their saved rows fill the table.
+func runMultiDest(client *proxyclient.Client) int {
+	if destParallel < 1 {
+		fmt.Println("erro: -parallel must be at least 1")
+		return 2
+	}
+	var cp *checkpoint
+	if checkpointFile != "" {
+		var err error
+		if cp, err = loadCheckpoint(); err != nil {
+			fmt.Printf("erro: %s\n", err)
+			return 2
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	outcomes := make([]destOutcome, len(dests.urls))
+	todo := len(outcomes)
+	if cp != nil {
+		for i, u := range dests.urls {
+			if o, ok := cp.outcome(u); ok {
+				outcomes[i] = o
+				todo--
+			}
+		}
+		fmt.Printf("checkpoint: %d of %d destinations done in %s\n", len(outcomes)-todo, len(outcomes), checkpointFile)
+	}
+	progress := &batchProgress{what: "dest", total: todo}
+	sem := make(chan struct{}, destParallel)
+	var wg sync.WaitGroup
+	started := 0
+dispatch:
+	for i, u := range dests.urls {
+		if outcomes[i].res != nil {
+			// done in an earlier run
+			started = i + 1
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break dispatch
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		started = i + 1
+		wg.Add(1)
+		go func(o *destOutcome, u string) {
+			defer func() { <-sem; wg.Done() }()
+			*o = requestDest(ctx, client, u)
+			progress.entry(u + " " + o.verdict())
+			// one cut short by the interrupt is still to do
+			if cp != nil && ctx.Err() == nil {
+				cp.record(*o)
+			}
+		}(&outcomes[i], u)
+	}
+	wg.Wait()
+	if cp != nil {
+		cp.save()
+	}
+
+	table := &batchTable{columns: []string{"destination", "via", "code", "proto", "time", "size", "reused", "error"}}
+	if len(targetTags) > 0 {
+		table.columns = append(table.columns, "tags")
+	}
+	failed := 0
+	for _, o := range outcomes[:started] {
+		code, proto, reused := "-", "-", "-"
+		via := "direct"
+		switch {
+		case o.res.Fallback != "":
+			via = "fallback"
+		case client.ProxyURL() != nil:
+			via = "proxy"
+		}
+		if o.res.Status != 0 {
+			code, proto, reused = fmt.Sprint(o.res.Status), o.res.Proto, "no"
+			if o.res.Reused {
+				reused = "yes"
+			}
+		}
+		if o.failure != "" {
+			failed++
+		}
+		note := o.failure
+		if note == "" {
+			note = o.page
+		}
+		cells := []string{o.url, via, code, proto, dur(o.elapsed), size(o.bytes), reused, note}
+		if len(targetTags) > 0 {
+			cells = append(cells, formatTags(targetTags[o.url]))
+		}
+		table.add(batchGroup(o.url, targetTags[o.url]), o.failure != "", cells...)
+	}
+	table.print("dest")
+	if ctx.Err() != nil {
+		// the ones in flight were cancelled and fail in the table
+		for _, u := range dests.urls[started:] {
+			fmt.Printf("dest: not attempted: %s\n", u)
+		}
+		if cp != nil {
+			fmt.Printf("checkpoint: %d destinations done in %s, run again with it to go on\n", len(cp.Done), checkpointFile)
+		}
+		fmt.Printf("dest: interrupted, %d of %d destinations attempted, %d failed\n", started, len(outcomes), failed)
+		return exitInterrupted
+	}
+	if failed > 0 {
+		fmt.Printf("dest: FAIL, %d of %d destinations\n", failed, len(outcomes))
+		return 1
+	}
+	fmt.Printf("dest: OK, all %d destinations\n", len(outcomes))
+	return 0
+}
+
+func (o destOutcome) verdict() string {
+	if o.failure != "" {
+		return "FAIL " + o.failure
+	}
+	if o.res.Fallback != "" {
+		return fmt.Sprintf("%d %s, DIRECT fallback", o.res.Status, dur(o.elapsed))
+	}
+	return fmt.Sprintf("%d %s", o.res.Status, dur(o.elapsed))
+}
+
+// requestDest fetches u and reads the body through, cut short when ctx is
+// done.
+func requestDest(ctx context.Context, client *proxyclient.Client, u string) destOutcome {
+	o := destOutcome{url: u, res: &proxyclient.Result{URL: u}}
+	req, err := destRequestTo(u)
+	if err != nil {
+		o.failure = err.Error()
+		return o
+	}
+	req = req.WithContext(ctx)
+	start := time.Now()
+	resp, res, err := client.Measure(req)
+	o.res = res
+	if err != nil {
+		o.elapsed = time.Since(start)
+		o.failure = fmt.Sprintf("%s: %s", o.res.ErrorClass, err)
+		return o
+	}
+	defer resp.Body.Close()
+	var body []byte
+	switch {
+	case sampleMax > 0:
+		body, _, err = sampleBody(resp.Body, sampleMax)
+		o.bytes = int64(len(body))
+	case healthChecks != nil || assertChecks != nil || htmlText && resp.StatusCode >= 400:
+		body, err = ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		o.bytes = int64(len(body))
+	}
+	if err == nil && sampleMax == 0 {
+		var n int64
+		n, err = io.Copy(ioutil.Discard, resp.Body)
+		o.bytes += n
+	}
+	o.elapsed = time.Since(start)
+	switch {
+	case err != nil:
+		o.failure = fmt.Sprintf("reading body: %s", err)
+	case healthChecks != nil:
+		if ok, reason := passesHealth(healthChecks, resp, body, o.elapsed); !ok {
+			o.failure = withPage(reason, resp, body)
+		}
+	}
+	if o.failure == "" && assertChecks != nil {
+		if ok, reason := passesAssertions(assertChecks, resp, body, o.elapsed); !ok {
+			o.failure = withPage(reason, resp, body)
+		}
+	}
+	if o.failure == "" && resp.StatusCode >= 400 {
+		o.page = pageReason(resp, body)
+	}
+	return o
+}
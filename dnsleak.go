@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// dnsLeakWait is how long -dns-leak waits for the queries of a name once
+// its request is done, resolvers may still be retrying.
+const dnsLeakWait = 3 * time.Second
+
+// leakQueries are the resolvers that asked about each name, with the
+// types they asked for.
+type leakQueries struct {
+	mu   sync.Mutex
+	seen map[string]map[string]map[string]bool
+}
+
+func (l *leakQueries) add(name string, qtype uint16, from net.Addr) {
+	host, _, err := net.SplitHostPort(from.String())
+	if err != nil {
+		host = from.String()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.seen[name] == nil {
+		l.seen[name] = map[string]map[string]bool{}
+	}
+	if l.seen[name][host] == nil {
+		l.seen[name][host] = map[string]bool{}
+	}
+	l.seen[name][host][dnsTypeName(qtype)] = true
+}
+
+// resolvers returns who asked about name, waiting up to dnsLeakWait for
+// the first query.
+func (l *leakQueries) resolvers(name string) map[string][]string {
+	deadline := time.Now().Add(dnsLeakWait)
+	for {
+		l.mu.Lock()
+		seen := l.seen[name]
+		out := map[string][]string{}
+		for host, types := range seen {
+			for t := range types {
+				out[host] = append(out[host], t)
+			}
+			sort.Strings(out[host])
+		}
+		l.mu.Unlock()
+		if len(out) > 0 || time.Now().After(deadline) {
+			return out
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// runDNSLeak implements -dns-leak ZONE: it answers the DNS queries for
+// ZONE on -dns-leak-listen, which the zone's NS records have to point at,
+// and requests a fresh name under it twice, once leaving the name to the
+// proxy and once resolving it here and asking the proxy for the address.
+// The resolvers that asked about each name show where resolution really
+// happens. Names answer with -dns-leak-addr, or with no address, the
+// query being the finding. It returns 1 when the proxy's lookup never
+// arrived, or came from the resolver the client uses.
+func runDNSLeak(client *proxyclient.Client, cfg proxyclient.Config) int {
+	if client.ProxyURL() == nil {
+		fmt.Println("erro: -dns-leak needs a proxy")
+		return 2
+	}
+	zone := strings.ToLower(strings.Trim(dnsLeak, "."))
+	var ips []net.IP
+	if dnsLeakAddr != "" {
+		ip := net.ParseIP(dnsLeakAddr)
+		if ip == nil {
+			fmt.Printf("erro: -dns-leak-addr %q is not an IP address\n", dnsLeakAddr)
+			return 2
+		}
+		ips = append(ips, ip)
+	}
+	destURL, err := url.Parse(dest)
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 2
+	}
+
+	queries := &leakQueries{seen: map[string]map[string]map[string]bool{}}
+	srv, err := listenZone(dnsLeakListen, func(name string) ([]net.IP, bool) {
+		if name == zone || strings.HasSuffix(name, "."+zone) {
+			return ips, true
+		}
+		return nil, false
+	}, queries.add)
+	if err != nil {
+		fmt.Printf("erro: -dns-leak-listen: %s\n", err)
+		return 2
+	}
+	defer srv.Close()
+	fmt.Printf("dns-leak: answering for %s on %s, its NS records have to point at this host\n", zone, srv.Addr())
+
+	byName, local := leakName(zone), leakName(zone)
+
+	u := *destURL
+	u.Host = byName
+	if p := destURL.Port(); p != "" {
+		u.Host = net.JoinHostPort(byName, p)
+	}
+	fmt.Printf("dns-leak by name, %s: %s\n", byName, leakRequest(client, &u))
+	proxySide := queries.resolvers(byName)
+	printLeakResolvers("by name", proxySide)
+
+	u.Host = local
+	if p := destURL.Port(); p != "" {
+		u.Host = net.JoinHostPort(local, p)
+	}
+	addrs, err := client.Resolver().LookupIP(context.Background(), "ip", local)
+	switch {
+	case err != nil:
+		fmt.Printf("dns-leak locally resolved, %s: erro: %s\n", local, err)
+	case len(addrs) == 0:
+		fmt.Printf("dns-leak locally resolved, %s: no address\n", local)
+	default:
+		pinned, target, err := pinnedClient(cfg, &u, addrs[0])
+		if err != nil {
+			fmt.Printf("erro: %s\n", err)
+			return 2
+		}
+		// the address alone, a Host with the name would have a plain
+		// http proxy look it up again
+		fmt.Printf("dns-leak locally resolved, %s as %s: %s\n", local, addrs[0], leakRequest(pinned, target))
+		pinned.Transport().CloseIdleConnections()
+	}
+	clientSide := queries.resolvers(local)
+	printLeakResolvers("locally resolved", clientSide)
+
+	var shared []string
+	for host := range proxySide {
+		if _, ok := clientSide[host]; ok {
+			shared = append(shared, host)
+		}
+	}
+	sort.Strings(shared)
+	switch {
+	case len(proxySide) == 0 && len(clientSide) == 0:
+		fmt.Printf("dns-leak: UNKNOWN, no query reached %s: check that %s is delegated to this host\n", srv.Addr(), zone)
+		return 1
+	case len(proxySide) == 0:
+		fmt.Println("dns-leak: UNKNOWN, the proxy never looked the name up: it refused the request first, or hands names to something that does not resolve them")
+		return 1
+	case len(shared) > 0:
+		fmt.Printf("dns-leak: LEAK, the name left to the proxy was resolved by the client's own resolver %s\n", strings.Join(shared, ", "))
+		return 1
+	}
+	fmt.Printf("dns-leak: OK, the proxy resolves names itself, through %s\n", strings.Join(leakHosts(proxySide), ", "))
+	return 0
+}
+
+// leakName returns a name under zone no resolver has cached.
+func leakName(zone string) string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return "leak-" + hex.EncodeToString(b) + "." + zone
+}
+
+// leakRequest sends -dest's request to u and says how it went. Failing is
+// fine, the lookup is what counts.
+func leakRequest(client *proxyclient.Client, u *url.URL) string {
+	req, err := destRequestTo(u.String())
+	if err != nil {
+		return "erro: " + err.Error()
+	}
+	resp, res, err := client.Measure(req)
+	if err != nil {
+		return fmt.Sprintf("erro (%s): %s", res.ErrorClass, err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if res.Fallback != "" {
+		return fmt.Sprintf("code %d, gone direct: %s", resp.StatusCode, res.Fallback)
+	}
+	return fmt.Sprintf("code %d", resp.StatusCode)
+}
+
+func printLeakResolvers(mode string, seen map[string][]string) {
+	if len(seen) == 0 {
+		fmt.Printf("dns-leak %s: no query arrived\n", mode)
+		return
+	}
+	for _, host := range leakHosts(seen) {
+		fmt.Printf("dns-leak %s: queried by %s (%s)\n", mode, host, strings.Join(seen[host], ", "))
+	}
+}
+
+func leakHosts(m map[string][]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
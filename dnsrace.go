@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// familyResult is the outcome of one address family in the DNS race.
+type familyResult struct {
+	name    string
+	network string
+	addrs   []net.IP
+	lookup  time.Duration
+	err     error
+}
+
+// runDNSRace resolves A and AAAA for the first hop (the proxy, or the
+// destination when there is no proxy) in parallel and runs connect, TLS and
+// the request itself once per family, so a broken family is reported
+// instead of being hidden by the dialer falling back to the other one.
+// It returns 1 when a family that resolved fails, or when neither
+// resolved.
+func runDNSRace(client *proxyclient.Client, cfg proxyclient.Config) int {
+	target := client.ProxyURL()
+	if target == nil {
+		u, err := url.Parse(dest)
+		if err != nil {
+			fmt.Printf("erro: %s", err)
+			return 1
+		}
+		target = u
+	}
+	host, port := target.Hostname(), target.Port()
+	if port == "" {
+		switch target.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+
+	families := []*familyResult{{name: "A", network: "ip4"}, {name: "AAAA", network: "ip6"}}
+	done := make(chan struct{})
+	for _, f := range families {
+		go func(f *familyResult) {
+			start := time.Now()
+			f.addrs, f.err = client.Resolver().LookupIP(context.Background(), f.network, host)
+			f.lookup = time.Since(start)
+			done <- struct{}{}
+		}(f)
+	}
+	for range families {
+		<-done
+	}
+
+	failed, resolved := 0, 0
+	for _, f := range families {
+		if f.err != nil || len(f.addrs) == 0 {
+			fmt.Printf("%s %s: no address (%v) %s\n", f.name, host, f.err, f.lookup)
+			continue
+		}
+		resolved++
+		addr := net.JoinHostPort(f.addrs[0].String(), port)
+		fmt.Printf("%s %s: %v %s, trying %s\n", f.name, host, f.addrs, f.lookup, addr)
+		if err := raceFamily(client, cfg, f, addr, host, port, target.Scheme); err != nil {
+			fmt.Printf("%s: FAIL %s\n", f.name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: OK\n", f.name)
+	}
+	if resolved == 0 {
+		fmt.Printf("erro: %s resolves in neither family\n", host)
+		return 1
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func raceFamily(client *proxyclient.Client, cfg proxyclient.Config, f *familyResult, addr, host, port, scheme string) error {
+	start := time.Now()
+	conn, err := client.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("connect: %s", err)
+	}
+	fmt.Printf("%s: connect %s\n", f.name, dur(time.Since(start)))
+	if scheme == "https" {
+		start = time.Now()
+		conf := client.TLSConfig()
+		if conf.ServerName == "" {
+			conf.ServerName = host
+		}
+		tc := tls.Client(conn, conf)
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return fmt.Errorf("tls: %s", err)
+		}
+		fmt.Printf("%s: tls %s %s\n", f.name, tls.VersionName(tc.ConnectionState().Version), dur(time.Since(start)))
+	}
+	conn.Close()
+
+	// run the real request with the first hop pinned to this address
+	cfg.Resolve = map[string]string{net.JoinHostPort(host, port): addr}
+	pinned, err := proxyclient.New(cfg)
+	if err != nil {
+		return err
+	}
+	defer pinned.Transport().CloseIdleConnections()
+	req, err := destRequest()
+	if err != nil {
+		return err
+	}
+	start = time.Now()
+	resp, err := pinned.Do(req)
+	if err != nil {
+		return fmt.Errorf("request: %s", err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	fmt.Printf("%s: request %d %s\n", f.name, resp.StatusCode, dur(time.Since(start)))
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsRcodeFormErr = 1
+	dnsRcodeRefused = 5
+)
+
+var dnsTypeNames = map[uint16]string{1: "A", 2: "NS", 5: "CNAME", 6: "SOA", 15: "MX", 16: "TXT", 28: "AAAA", 33: "SRV", 64: "SVCB", 65: "HTTPS"}
+
+func dnsTypeName(t uint16) string {
+	if n, ok := dnsTypeNames[t]; ok {
+		return n
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+// zoneServer is a minimal authoritative DNS server over UDP, enough for
+// resolvers to ask it about the names of a zone: it answers A and AAAA
+// from lookup, other types with no data, and refuses names lookup does not
+// own. observe, when set, hears of every query before it is answered.
+type zoneServer struct {
+	conn    net.PacketConn
+	lookup  func(name string) ([]net.IP, bool)
+	observe func(name string, qtype uint16, from net.Addr)
+}
+
+// listenZone starts a zoneServer on the UDP addr.
+func listenZone(addr string, lookup func(string) ([]net.IP, bool), observe func(string, uint16, net.Addr)) (*zoneServer, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &zoneServer{conn: conn, lookup: lookup, observe: observe}
+	go s.serve()
+	return s, nil
+}
+
+func (s *zoneServer) Addr() net.Addr { return s.conn.LocalAddr() }
+
+func (s *zoneServer) Close() error { return s.conn.Close() }
+
+func (s *zoneServer) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if reply := s.answer(buf[:n], from); reply != nil {
+			s.conn.WriteTo(reply, from)
+		}
+	}
+}
+
+// answer builds the reply to the query msg, nil for something not worth
+// one.
+func (s *zoneServer) answer(msg []byte, from net.Addr) []byte {
+	q, err := parseDNSQuery(msg)
+	if err != nil {
+		if len(msg) < 12 || msg[2]&0x80 != 0 {
+			return nil
+		}
+		// header only, the question could not be read
+		reply := append([]byte(nil), msg[:12]...)
+		binary.BigEndian.PutUint16(reply[2:], 0x8000|uint16(msg[2]&0x01)<<8|dnsRcodeFormErr)
+		for i := 4; i < 12; i++ {
+			reply[i] = 0
+		}
+		return reply
+	}
+	if s.observe != nil {
+		s.observe(q.name, q.qtype, from)
+	}
+	ips, ok := s.lookup(q.name)
+	// QR and AA, RD echoed
+	flags := uint16(0x8400) | q.flags&0x0100
+	var answers [][]byte
+	if !ok {
+		flags &^= 0x0400
+		flags |= dnsRcodeRefused
+	} else if q.qclass == dnsClassIN {
+		for _, ip := range ips {
+			var rr []byte
+			switch v4 := ip.To4(); {
+			case q.qtype == dnsTypeA && v4 != nil:
+				rr = dnsRR(dnsTypeA, v4)
+			case q.qtype == dnsTypeAAAA && v4 == nil:
+				rr = dnsRR(dnsTypeAAAA, ip.To16())
+			}
+			if rr != nil {
+				answers = append(answers, rr)
+			}
+		}
+	}
+	reply := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(reply[0:], q.id)
+	binary.BigEndian.PutUint16(reply[2:], flags)
+	binary.BigEndian.PutUint16(reply[4:], 1)
+	binary.BigEndian.PutUint16(reply[6:], uint16(len(answers)))
+	reply = append(reply, q.question...)
+	for _, rr := range answers {
+		reply = append(reply, rr...)
+	}
+	return reply
+}
+
+// dnsRR is an answer for the question's name, TTL 0 so that resolvers ask
+// again every time.
+func dnsRR(qtype uint16, rdata []byte) []byte {
+	rr := []byte{0xc0, 12, 0, 0, 0, dnsClassIN, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(rr[2:], qtype)
+	binary.BigEndian.PutUint16(rr[10:], uint16(len(rdata)))
+	return append(rr, rdata...)
+}
+
+// dnsQuery is the part of a query the server looks at. name is lower
+// case without the final dot, resolvers randomize the case (0x20).
+type dnsQuery struct {
+	id, flags     uint16
+	name          string
+	qtype, qclass uint16
+	// question is the question section as received, for the reply
+	question []byte
+}
+
+var errDNSQuery = errors.New("dns: malformed query")
+
+func parseDNSQuery(msg []byte) (*dnsQuery, error) {
+	if len(msg) < 12 {
+		return nil, errDNSQuery
+	}
+	q := &dnsQuery{id: binary.BigEndian.Uint16(msg), flags: binary.BigEndian.Uint16(msg[2:])}
+	// a query, opcode QUERY, one question
+	if q.flags&0x8000 != 0 || q.flags&0x7800 != 0 || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return nil, errDNSQuery
+	}
+	var labels []string
+	i := 12
+	for {
+		if i >= len(msg) {
+			return nil, errDNSQuery
+		}
+		n := int(msg[i])
+		i++
+		if n == 0 {
+			break
+		}
+		// no compression pointers in a question of its own
+		if n > 63 || i+n > len(msg) {
+			return nil, errDNSQuery
+		}
+		labels = append(labels, strings.ToLower(string(msg[i:i+n])))
+		i += n
+	}
+	if i+4 > len(msg) {
+		return nil, errDNSQuery
+	}
+	q.name = strings.Join(labels, ".")
+	q.qtype = binary.BigEndian.Uint16(msg[i:])
+	q.qclass = binary.BigEndian.Uint16(msg[i+2:])
+	q.question = msg[12 : i+4]
+	return q, nil
+}
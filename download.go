@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+var (
+	benchmarkDownload bool
+	downloadInterval  time.Duration
+)
+
+// downloadSlowdown is how far below its start the rate of a download has
+// to fall, and stay, for it to count as throttled.
+const downloadSlowdown = 0.7
+
+// runDownload implements -benchmark-download: it streams -dest once,
+// throwing the body away, and prints the rate of every -download-interval
+// since the first byte, then the average rate and the first byte latency.
+// A rate that falls to below 70% of the first quarter's and stays there
+// is a proxy throttling long transfers, the interval it fell in is when.
+// It returns 1 when the request failed, answered 400 or more, broke off
+// or was throttled, and 130 when interrupted, after the report of what
+// came so far.
+func runDownload(client *proxyclient.Client) int {
+	if downloadInterval <= 0 {
+		fmt.Println("erro: -download-interval must be positive")
+		return 2
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	req, err := destRequest()
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 2
+	}
+	start := time.Now()
+	resp, res, err := client.Measure(req.WithContext(ctx))
+	if err != nil {
+		fmt.Printf("download: erro (%s): %s\n", res.ErrorClass, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	fmt.Printf("download: %s %s\n", dest, resp.Status)
+
+	var rates []int64
+	var total, cur int64
+	var first time.Time
+	tick := downloadInterval
+	buf := make([]byte, 64<<10)
+	for {
+		n, rerr := resp.Body.Read(buf)
+		now := time.Now()
+		if n > 0 && first.IsZero() {
+			first = now
+			fmt.Printf("download: first byte after %s\n", dur(first.Sub(start)))
+		}
+		// a read after a stall closes the intervals it waited through,
+		// empty but for the first
+		for !first.IsZero() && now.Sub(first) >= tick {
+			rates = append(rates, cur)
+			fmt.Printf("download: %6s  %s/s\n", dur(tick), size(int64(float64(cur)/downloadInterval.Seconds())))
+			cur, tick = 0, tick+downloadInterval
+		}
+		cur += int64(n)
+		total += int64(n)
+		if rerr != nil {
+			err = rerr
+			break
+		}
+	}
+	took := time.Duration(0)
+	if !first.IsZero() {
+		took = time.Since(first)
+	}
+	rate := ""
+	if took > 0 {
+		rate = fmt.Sprintf(", %.2f MB/s (%s)", float64(total)/took.Seconds()/1e6, bitRate(total, took))
+	}
+	fmt.Printf("download: %s in %s%s\n", size(total), dur(took.Round(time.Millisecond)), rate)
+	throttled := printSlowdown(rates)
+
+	switch {
+	case ctx.Err() != nil:
+		fmt.Println("download: interrupted")
+		return exitInterrupted
+	case err != io.EOF:
+		fmt.Printf("download: erro after %s: %s\n", size(total), err)
+		return 1
+	case resp.StatusCode >= 400, throttled:
+		return 1
+	}
+	return 0
+}
+
+// printSlowdown compares the last quarter of the interval rates to the
+// first and names the interval from which the rate stayed below
+// downloadSlowdown of the first quarter's. It reports whether the rate
+// fell that far.
+func printSlowdown(rates []int64) bool {
+	if len(rates) < 4 {
+		fmt.Printf("download: too short to tell a slowdown, it takes 4 intervals of %s\n", dur(downloadInterval))
+		return false
+	}
+	q := len(rates) / 4
+	early, late := mean(rates[:q]), mean(rates[len(rates)-q:])
+	if early == 0 {
+		return false
+	}
+	ratio := late / early
+	if ratio >= downloadSlowdown {
+		fmt.Printf("download: steady, the last quarter at %.0f%% of the first\n", ratio*100)
+		return false
+	}
+	from := len(rates)
+	for from > 0 && float64(rates[from-1]) < early*downloadSlowdown {
+		from--
+	}
+	fmt.Printf("download: throttled, from %s/s in the first quarter to %s/s in the last, %.0f%%, slow since %s\n",
+		size(int64(early/downloadInterval.Seconds())), size(int64(late/downloadInterval.Seconds())), ratio*100, dur(time.Duration(from)*downloadInterval))
+	return true
+}
+
+func mean(ns []int64) float64 {
+	var sum int64
+	for _, n := range ns {
+		sum += n
+	}
+	return float64(sum) / float64(len(ns))
+}
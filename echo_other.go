@@ -0,0 +1,27 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+func openTerminal() (*os.File, error) {
+	return os.Open("/dev/tty")
+}
+
+// disableEcho turns off echo on tty with stty, which knows the termios
+// layout of every unix.
+func disableEcho(tty *os.File) (func(), error) {
+	cmd := exec.Command("stty", "-echo")
+	cmd.Stdin = tty
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	return func() {
+		cmd := exec.Command("stty", "echo")
+		cmd.Stdin = tty
+		cmd.Run()
+	}, nil
+}
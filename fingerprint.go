@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// environment describes the machine a run came from, so a shared report
+// answers the usual triage questions by itself.
+type environment struct {
+	OS        string            `json:"os"`
+	Arch      string            `json:"arch"`
+	GoVersion string            `json:"go_version"`
+	Hostname  string            `json:"hostname,omitempty"`
+	LocalIPs  []string          `json:"local_ips,omitempty"`
+	Resolvers []string          `json:"resolvers,omitempty"`
+	Search    []string          `json:"search,omitempty"`
+	ProxyEnv  map[string]string `json:"proxy_env,omitempty"`
+}
+
+// proxyEnvVars are the variables proxy aware tools read.
+var proxyEnvVars = []string{
+	"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy",
+	"ALL_PROXY", "all_proxy", "NO_PROXY", "no_proxy",
+}
+
+func fingerprint() *environment {
+	env := &environment{OS: runtime.GOOS, Arch: runtime.GOARCH, GoVersion: runtime.Version()}
+	env.Hostname, _ = os.Hostname()
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+				env.LocalIPs = append(env.LocalIPs, ipnet.IP.String())
+			}
+		}
+	}
+	// resolv.conf only exists on unix, elsewhere the fields stay empty
+	if f, err := os.Open("/etc/resolv.conf"); err == nil {
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) < 2 {
+				continue
+			}
+			switch fields[0] {
+			case "nameserver":
+				env.Resolvers = append(env.Resolvers, fields[1])
+			case "search", "domain":
+				env.Search = append(env.Search, fields[1:]...)
+			}
+		}
+		f.Close()
+	}
+	for _, name := range proxyEnvVars {
+		if v := os.Getenv(name); v != "" {
+			if env.ProxyEnv == nil {
+				env.ProxyEnv = map[string]string{}
+			}
+			env.ProxyEnv[name] = redactURL(v)
+		}
+	}
+	return env
+}
+
+// redactURL masks the password of a proxy URL, leaving anything that does
+// not parse as one untouched.
+func redactURL(v string) string {
+	u, err := url.Parse(v)
+	if err != nil || u.User == nil {
+		return v
+	}
+	return u.Redacted()
+}
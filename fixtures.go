@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// fixture is one recorded exchange as -record-fixtures writes it and
+// `mock-origin -fixtures` replays it. Bodies are text when they are valid
+// UTF-8 and base64 otherwise.
+type fixture struct {
+	Method            string      `json:"method"`
+	URL               string      `json:"url"`
+	RequestHeader     http.Header `json:"request_header,omitempty"`
+	RequestBody       string      `json:"request_body,omitempty"`
+	RequestBodyBase64 []byte      `json:"request_body_base64,omitempty"`
+	Status            int         `json:"status"`
+	Header            http.Header `json:"header,omitempty"`
+	Body              string      `json:"body,omitempty"`
+	BodyBase64        []byte      `json:"body_base64,omitempty"`
+	// Truncated marks a body the client stopped reading, e.g. with -head.
+	Truncated bool `json:"truncated,omitempty"`
+	// RequestTruncated marks a request body cut to the first
+	// proxyclient.ExchangeBodyMax bytes, RequestSize has all it sent.
+	RequestTruncated bool  `json:"request_truncated,omitempty"`
+	RequestSize      int64 `json:"request_size,omitempty"`
+}
+
+// fixtureSecrets are request headers masked in fixtures.
+var fixtureSecrets = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+func newFixture(e proxyclient.Exchange) fixture {
+	f := fixture{
+		Method:        e.Request.Method,
+		URL:           e.Request.URL.Redacted(),
+		RequestHeader: e.Request.Header.Clone(),
+		Status:        e.Response.StatusCode,
+		Header:        e.Response.Header.Clone(),
+		Truncated:     !e.Complete,
+	}
+	for _, h := range fixtureSecrets {
+		if f.RequestHeader.Get(h) != "" {
+			f.RequestHeader.Set(h, "****")
+		}
+	}
+	f.RequestBody, f.RequestBodyBase64 = fixtureBody(e.RequestBody)
+	if int64(len(e.RequestBody)) < e.RequestSize {
+		f.RequestTruncated, f.RequestSize = true, e.RequestSize
+	}
+	f.Body, f.BodyBase64 = fixtureBody(e.ResponseBody)
+	return f
+}
+
+func fixtureBody(b []byte) (string, []byte) {
+	if utf8.Valid(b) {
+		return string(b), nil
+	}
+	return "", b
+}
+
+func (f fixture) body() []byte {
+	if f.BodyBase64 != nil {
+		return f.BodyBase64
+	}
+	return []byte(f.Body)
+}
+
+// writeFixtures saves exchanges to dir as NNN-METHOD-host-path.json,
+// numbered after the files already there so runs add up.
+func writeFixtures(dir string, exchanges []proxyclient.Exchange) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	existing, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for i, e := range exchanges {
+		f := newFixture(e)
+		data, err := json.MarshalIndent(f, "", "  ")
+		if err != nil {
+			return err
+		}
+		name := fmt.Sprintf("%03d-%s-%s.json", len(existing)+i+1, f.Method, fixtureName(e.Request.URL))
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, append(data, '\n'), 0600); err != nil {
+			return err
+		}
+		fmt.Printf("fixture: %d %s %s -> %s\n", f.Status, f.Method, f.URL, path)
+	}
+	return nil
+}
+
+// fixtureName makes host and path safe for a file name.
+func fixtureName(u *url.URL) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, u.Host+u.Path)
+	if len(name) > 80 {
+		name = name[:80]
+	}
+	return name
+}
+
+// fixtureSet answers requests from recorded fixtures, by method and
+// request URI. Fixtures recorded for one URI are served in order, the last
+// one again once they run out.
+type fixtureSet struct {
+	mu     sync.Mutex
+	byKey  map[string][]fixture
+	served map[string]int
+}
+
+func loadFixtures(dir string) (*fixtureSet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	s := &fixtureSet{byKey: map[string][]fixture{}, served: map[string]int{}}
+	for _, p := range paths {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		var f fixture
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("%s: %s", p, err)
+		}
+		u, err := url.Parse(f.URL)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", p, err)
+		}
+		key := f.Method + " " + u.RequestURI()
+		s.byKey[key] = append(s.byKey[key], f)
+	}
+	return s, nil
+}
+
+// serve answers r from a fixture and reports whether there was one.
+func (s *fixtureSet) serve(w http.ResponseWriter, r *http.Request) bool {
+	key := r.Method + " " + r.URL.RequestURI()
+	s.mu.Lock()
+	fixtures := s.byKey[key]
+	n := s.served[key]
+	s.served[key]++
+	s.mu.Unlock()
+	if len(fixtures) == 0 {
+		return false
+	}
+	f := fixtures[min(n, len(fixtures)-1)]
+	for k, v := range f.Header {
+		w.Header()[k] = v
+	}
+	// the recorded body is what the client read, length and framing
+	// come from it
+	for _, h := range []string{"Content-Length", "Transfer-Encoding", "Connection", "Keep-Alive"} {
+		w.Header().Del(h)
+	}
+	w.WriteHeader(f.Status)
+	w.Write(f.body())
+	return true
+}
+
+func (s *fixtureSet) len() int {
+	n := 0
+	for _, f := range s.byKey {
+		n += len(f)
+	}
+	return n
+}
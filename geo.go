@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// geoHint is one clue about where the request left the proxy network.
+type geoHint struct {
+	source string
+	value  string
+}
+
+var (
+	cfRay       = regexp.MustCompile(`-([A-Z]{3})$`)             // CF-Ray: 7d1f2a3b4c5d6e7f-FRA
+	fastlyCache = regexp.MustCompile(`-([A-Z]{3})(?:,|$)`)       // X-Served-By: cache-fra19123-FRA
+	cfPop       = regexp.MustCompile(`^([A-Z]{3})`)              // X-Amz-Cf-Pop: FRA56-C1
+	vercelID    = regexp.MustCompile(`^([a-z]{3})\d*::`)         // X-Vercel-Id: fra1::abcde
+	edgescape   = regexp.MustCompile(`country_code=([A-Za-z]+)`) // X-Akamai-Edgescape
+)
+
+// geoHeaderHints extracts CDN points of presence and language hints from
+// response headers.
+func geoHeaderHints(h http.Header) []geoHint {
+	var hints []geoHint
+	add := func(source string, re *regexp.Regexp, value string) {
+		if m := re.FindStringSubmatch(value); m != nil {
+			hints = append(hints, geoHint{source, strings.ToUpper(m[1])})
+		}
+	}
+	add("cloudflare pop", cfRay, h.Get("CF-Ray"))
+	add("fastly pop", fastlyCache, h.Get("X-Served-By"))
+	add("cloudfront pop", cfPop, h.Get("X-Amz-Cf-Pop"))
+	add("vercel pop", vercelID, h.Get("X-Vercel-Id"))
+	add("akamai country", edgescape, h.Get("X-Akamai-Edgescape"))
+	if cl := h.Get("Content-Language"); cl != "" {
+		hints = append(hints, geoHint{"content-language", cl})
+	}
+	return hints
+}
+
+// geoAPIHints asks an IP geolocation API, through the proxy, where the
+// request came from. Field names of the common free APIs are understood.
+func geoAPIHints(client *proxyclient.Client, api string) ([]geoHint, error) {
+	req, err := newRequest(api)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", api, resp.Status)
+	}
+	var fields map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&fields); err != nil {
+		return nil, fmt.Errorf("%s: %s", api, err)
+	}
+	var hints []geoHint
+	for _, k := range []string{"ip", "query", "country", "country_code", "countryCode", "region", "regionName", "city", "org"} {
+		if v, ok := fields[k].(string); ok && v != "" {
+			hints = append(hints, geoHint{"geo api " + k, v})
+		}
+	}
+	return hints, nil
+}
+
+// reportGeo prints the egress location hints and returns 1 when -geo-expect
+// is set and none of the hints matches any of its comma separated values.
+func reportGeo(resp *http.Response, client *proxyclient.Client) int {
+	hints := geoHeaderHints(resp.Header)
+	if geoAPI != "" {
+		api, err := geoAPIHints(client, geoAPI)
+		if err != nil {
+			fmt.Printf("geo: erro: %s\n", err)
+		}
+		hints = append(hints, api...)
+	}
+	if len(hints) == 0 {
+		fmt.Println("geo: no location hints")
+	}
+	for _, h := range hints {
+		fmt.Printf("geo: %s: %s\n", h.source, h.value)
+	}
+	if geoExpect == "" {
+		return 0
+	}
+	for _, want := range strings.Split(geoExpect, ",") {
+		want = strings.TrimSpace(want)
+		for _, h := range hints {
+			for _, token := range strings.FieldsFunc(h.value, func(r rune) bool { return r == '-' || r == ',' || r == ' ' }) {
+				if strings.EqualFold(token, want) {
+					fmt.Printf("geo: OK, %s matches %s\n", h.source, want)
+					return 0
+				}
+			}
+		}
+	}
+	fmt.Printf("geo: FAIL, no hint matches %s\n", geoExpect)
+	return 1
+}
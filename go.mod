@@ -0,0 +1,3 @@
+module github.com/LeoCBS/poc-proxy-https
+
+go 1.25
@@ -0,0 +1,3 @@
+// The Go devel tree the first Dockerfile built, kept for history. It is a
+// module of its own so it stays out of the poc-proxy-https module.
+module golang.org/go-devel-snapshot
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// gssapiCmd is -gssapi-cmd, a helper holding the GSS-API context of
+// -auth gssapi where the binary has no mechanism of its own, Kerberos on
+// Linux or macOS through python-gssapi or the like.
+var gssapiCmd string
+
+// cmdGSSAPI is one context of -gssapi-cmd: a helper started for the
+// connection, talked to over its stdin and stdout a line each way,
+// tokens and messages in base64:
+//
+//	init TARGET [TOKEN]  continue TOKEN, or done [TOKEN] once established
+//	wrap conf|integ MSG  ok TOKEN
+//	unwrap TOKEN         ok MSG
+//
+// An answer "error TEXT" fails the call.
+type cmdGSSAPI struct {
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *bufio.Reader
+
+	mu sync.Mutex
+}
+
+// newCmdGSSAPI starts -gssapi-cmd through the shell.
+func newCmdGSSAPI() (proxyclient.GSSAPI, error) {
+	cmd := exec.Command("sh", "-c", gssapiCmd)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", gssapiCmd)
+	}
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("-gssapi-cmd: %s", err)
+	}
+	return &cmdGSSAPI{cmd: cmd, in: in, out: bufio.NewReader(out)}, nil
+}
+
+// call sends one request line and returns the answer's word and token.
+func (g *cmdGSSAPI) call(args ...string) (string, []byte, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, err := fmt.Fprintln(g.in, strings.Join(args, " ")); err != nil {
+		return "", nil, fmt.Errorf("-gssapi-cmd: %s", err)
+	}
+	line, err := g.out.ReadString('\n')
+	if err != nil {
+		return "", nil, fmt.Errorf("-gssapi-cmd: no answer to %s: %s", args[0], err)
+	}
+	word, rest, _ := strings.Cut(strings.TrimSpace(line), " ")
+	if word == "error" {
+		return "", nil, fmt.Errorf("-gssapi-cmd: %s", rest)
+	}
+	token, err := base64.StdEncoding.DecodeString(strings.TrimSpace(rest))
+	if err != nil {
+		return "", nil, fmt.Errorf("-gssapi-cmd: %s answer: %s", args[0], err)
+	}
+	return word, token, nil
+}
+
+func (g *cmdGSSAPI) InitSecContext(target string, input []byte) ([]byte, bool, error) {
+	args := []string{"init", target}
+	if input != nil {
+		args = append(args, base64.StdEncoding.EncodeToString(input))
+	}
+	word, token, err := g.call(args...)
+	if err != nil {
+		return nil, false, err
+	}
+	switch word {
+	case "continue":
+		return token, false, nil
+	case "done":
+		return token, true, nil
+	}
+	return nil, false, fmt.Errorf("-gssapi-cmd: init answered %q", word)
+}
+
+func (g *cmdGSSAPI) Wrap(msg []byte, confidential bool) ([]byte, error) {
+	level := "integ"
+	if confidential {
+		level = "conf"
+	}
+	return g.ok("wrap", level, base64.StdEncoding.EncodeToString(msg))
+}
+
+func (g *cmdGSSAPI) Unwrap(token []byte) ([]byte, error) {
+	return g.ok("unwrap", base64.StdEncoding.EncodeToString(token))
+}
+
+func (g *cmdGSSAPI) ok(args ...string) ([]byte, error) {
+	word, token, err := g.call(args...)
+	if err == nil && word != "ok" {
+		err = fmt.Errorf("-gssapi-cmd: %s answered %q", args[0], word)
+	}
+	return token, err
+}
+
+// Close ends the helper with the connection.
+func (g *cmdGSSAPI) Close() error {
+	g.in.Close()
+	return g.cmd.Wait()
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// harReporter is -har: the run's round trips, redirect hops included, as
+// a HAR 1.2 file for browser devtools and HAR viewers. Credentials are
+// masked like in fixtures.
+type harReporter struct{ path string }
+
+func (harReporter) name() string    { return "har" }
+func (harReporter) exchanges() bool { return true }
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	Started  string      `json:"startedDateTime"`
+	Time     float64     `json:"time"`
+	Request  harRequest  `json:"request"`
+	Response harResponse `json:"response"`
+	Cache    struct{}    `json:"cache"`
+	Timings  harTimings  `json:"timings"`
+	// ServerIP is the proxy's with one, where the connection went.
+	ServerIP string `json:"serverIPAddress,omitempty"`
+}
+
+type harRequest struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []harPair    `json:"cookies"`
+	Headers     []harPair    `json:"headers"`
+	QueryString []harPair    `json:"queryString"`
+	PostData    *harPostData `json:"postData,omitempty"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int          `json:"bodySize"`
+	// SentSize and SentSHA256 are what went out of the body, as the sent:
+	// line of the run gives them, to match against what the origin got.
+	SentSize   int64  `json:"_sentSize,omitempty"`
+	SentSHA256 string `json:"_sentSha256,omitempty"`
+}
+
+type harResponse struct {
+	Status      int        `json:"status"`
+	StatusText  string     `json:"statusText"`
+	HTTPVersion string     `json:"httpVersion"`
+	Cookies     []harPair  `json:"cookies"`
+	Headers     []harPair  `json:"headers"`
+	Content     harContent `json:"content"`
+	RedirectURL string     `json:"redirectURL"`
+	HeadersSize int        `json:"headersSize"`
+	BodySize    int        `json:"bodySize"`
+}
+
+type harPair struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// harTimings are in milliseconds, -1 for a phase that did not happen or
+// was not measured.
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func (r harReporter) report(run *session) error {
+	log := harLog{Version: "1.2", Creator: harCreator{Name: "poc-proxy-https", Version: "0"}, Entries: []harEntry{}}
+	for i, e := range run.exchanges {
+		entry := newHAREntry(e)
+		// the run's timing is of its first connection
+		if i == 0 && run.Result != nil {
+			entry.ServerIP, _, _ = net.SplitHostPort(run.Result.Dialed)
+			entry.Timings = harPhases(run.Result.Phases, e)
+		}
+		log.Entries = append(log.Entries, entry)
+	}
+	data, err := json.MarshalIndent(struct {
+		Log harLog `json:"log"`
+	}{log}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.path, append(data, '\n'), 0600)
+}
+
+func newHAREntry(e proxyclient.Exchange) harEntry {
+	req, resp := e.Request, e.Response
+	entry := harEntry{
+		Started: e.Start.UTC().Format(proxyclient.WallFormat),
+		Time:    ms(e.End.Sub(e.Start)),
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         req.URL.Redacted(),
+			HTTPVersion: req.Proto,
+			Cookies:     []harPair{},
+			Headers:     harHeaders(req.Header, fixtureSecrets),
+			QueryString: []harPair{},
+			HeadersSize: -1,
+			BodySize:    int(e.RequestSize),
+			SentSize:    e.RequestSize,
+			SentSHA256:  e.RequestSHA256,
+		},
+		Response: harResponse{
+			Status:      resp.StatusCode,
+			StatusText:  http.StatusText(resp.StatusCode),
+			HTTPVersion: resp.Proto,
+			Cookies:     []harPair{},
+			Headers:     harHeaders(resp.Header, nil),
+			RedirectURL: resp.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    len(e.ResponseBody),
+		},
+		Timings: harTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Wait: ms(e.Headers.Sub(e.Start)), Receive: ms(e.End.Sub(e.Headers))},
+	}
+	// a client request has no Proto, it goes out in the response's
+	if req.Proto == "" {
+		entry.Request.HTTPVersion = resp.Proto
+	}
+	// Status is "200 OK", statusText the words the server sent
+	if _, text, ok := strings.Cut(resp.Status, " "); ok {
+		entry.Response.StatusText = text
+	}
+	for k, vs := range req.URL.Query() {
+		for _, v := range vs {
+			entry.Request.QueryString = append(entry.Request.QueryString, harPair{k, v})
+		}
+	}
+	if len(e.RequestBody) > 0 {
+		entry.Request.PostData = &harPostData{MimeType: req.Header.Get("Content-Type"), Text: string(e.RequestBody)}
+		if int64(len(e.RequestBody)) < e.RequestSize {
+			entry.Request.PostData.Comment = fmt.Sprintf("the first %d of %d bytes", len(e.RequestBody), e.RequestSize)
+		}
+	}
+	entry.Response.Content = harContent{Size: len(e.ResponseBody), MimeType: resp.Header.Get("Content-Type")}
+	if text, b64 := fixtureBody(e.ResponseBody); b64 != nil {
+		entry.Response.Content.Text, entry.Response.Content.Encoding = base64.StdEncoding.EncodeToString(b64), "base64"
+	} else {
+		entry.Response.Content.Text = text
+	}
+	return entry
+}
+
+// harPhases fills the timings of the first entry from the run's phases:
+// the dial and handshakes happened before its request went out.
+func harPhases(phases []proxyclient.Phase, e proxyclient.Exchange) harTimings {
+	t := harTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Receive: ms(e.End.Sub(e.Headers))}
+	wait := e.Headers.Sub(e.Start)
+	for _, p := range phases {
+		switch {
+		case p.Name == "dns":
+			t.DNS = ms(p.Duration)
+		case p.Name == "connect", strings.HasPrefix(p.Name, "tunnel"):
+			t.Connect = max(t.Connect, 0) + ms(p.Duration)
+		case p.Name == "tls", p.Name == "proxy tls":
+			t.SSL = max(t.SSL, 0) + ms(p.Duration)
+		case p.Name == "server":
+			wait = p.Duration
+		}
+	}
+	// HAR counts the handshakes into connect as well
+	if t.SSL > 0 {
+		t.Connect = max(t.Connect, 0) + t.SSL
+	}
+	t.Wait = ms(wait)
+	return t
+}
+
+// harHeaders lists h sorted by name, masking the secrets.
+func harHeaders(h http.Header, secrets []string) []harPair {
+	names := make([]string, 0, len(h))
+	for k := range h {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	pairs := []harPair{}
+	for _, k := range names {
+		for _, v := range h[k] {
+			for _, s := range secrets {
+				if strings.EqualFold(k, s) {
+					v = "****"
+				}
+			}
+			pairs = append(pairs, harPair{k, v})
+		}
+	}
+	return pairs
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
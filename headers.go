@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// headerFilter is a parsed -show-headers: glob patterns matched against
+// lower case header names, a leading ! denying the names it matches.
+type headerFilter struct {
+	allow, deny []string
+}
+
+// parseHeaderFilter parses a comma separated pattern list such as
+// "content-*,via,!content-length". With only deny patterns every other
+// header is shown.
+func parseHeaderFilter(s string) (*headerFilter, error) {
+	f := &headerFilter{}
+	for _, p := range strings.Split(s, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		deny := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+		if p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("-show-headers: bad pattern %q", p)
+		}
+		if deny {
+			f.deny = append(f.deny, p)
+		} else {
+			f.allow = append(f.allow, p)
+		}
+	}
+	if f.allow == nil && f.deny == nil {
+		return nil, fmt.Errorf("-show-headers: no patterns in %q", s)
+	}
+	return f, nil
+}
+
+func (f *headerFilter) shows(name string) bool {
+	name = strings.ToLower(name)
+	matches := func(patterns []string) bool {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return (f.allow == nil || matches(f.allow)) && !matches(f.deny)
+}
+
+// printHeaders prints the response headers f shows, sorted by name.
+func printHeaders(f *headerFilter, h http.Header) {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		if f.shows(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range h[name] {
+			fmt.Printf("header: %s: %s\n", name, v)
+		}
+	}
+}
+
+// headerList collects repeated -H flags.
+type headerList []string
+
+func (l *headerList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *headerList) Set(v string) error {
+	if _, _, err := splitHeader(v); err != nil {
+		return err
+	}
+	*l = append(*l, v)
+	return nil
+}
+
+// splitHeader parses "Name: value".
+func splitHeader(line string) (string, string, error) {
+	i := strings.IndexByte(line, ':')
+	if i <= 0 {
+		return "", "", fmt.Errorf("header %q is not Name: value", line)
+	}
+	name := strings.TrimSpace(line[:i])
+	if strings.ContainsAny(name, " \t") {
+		return "", "", fmt.Errorf("header name %q contains spaces", name)
+	}
+	return name, strings.TrimSpace(line[i+1:]), nil
+}
+
+// loadHeaders reads -headers-file, one "Name: value" per line, blank lines
+// and lines starting with # skipped, and parses it with the -H flags into
+// reqHeaders. -H comes last, so it adds to what the file sets.
+func loadHeaders() error {
+	var lines []string
+	if headersFile != "" {
+		data, err := ioutil.ReadFile(headersFile)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				lines = append(lines, line)
+			}
+		}
+	}
+	lines = append(lines, extraHeaders...)
+	for _, line := range lines {
+		name, value, err := splitHeader(line)
+		if err != nil {
+			return fmt.Errorf("%s: %s", headersFile, err)
+		}
+		if reqHeaders == nil {
+			reqHeaders = http.Header{}
+		}
+		reqHeaders.Add(name, value)
+	}
+	return nil
+}
+
+// setHeaders adds the -H and -headers-file headers to req, Host setting
+// the request's host.
+func setHeaders(req *http.Request) {
+	for name, values := range reqHeaders {
+		if http.CanonicalHeaderKey(name) == "Host" {
+			req.Host = values[len(values)-1]
+			continue
+		}
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+}
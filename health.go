@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// healthCheck is one term of a -health expression, e.g. latency<500ms.
+type healthCheck struct {
+	term  string
+	field string
+	op    string
+	value string
+	dur   time.Duration
+}
+
+var healthTerm = regexp.MustCompile(`^(status|latency|body|cert)\s*(!=|!~|=|<|>|~)\s*(.+)$`)
+
+// parseHealth parses terms joined by && and ||, && binding tighter, into
+// groups of which at least one must pass entirely.
+func parseHealth(expr string) ([][]healthCheck, error) {
+	var groups [][]healthCheck
+	for _, alt := range strings.Split(expr, "||") {
+		var group []healthCheck
+		for _, term := range strings.Split(alt, "&&") {
+			term = strings.TrimSpace(term)
+			m := healthTerm.FindStringSubmatch(term)
+			if m == nil {
+				return nil, fmt.Errorf("health check %q: want status, latency, body or cert, an operator and a value", term)
+			}
+			c := healthCheck{term: term, field: m[1], op: m[2], value: strings.TrimSpace(m[3])}
+			ops := map[string]string{"status": "= !=", "latency": "< >", "body": "~ !~", "cert": "< >"}[c.field]
+			if !strings.Contains(" "+ops+" ", " "+c.op+" ") {
+				return nil, fmt.Errorf("health check %q: %s takes %s", term, c.field, ops)
+			}
+			if c.field == "latency" || c.field == "cert" {
+				d, err := parseDays(c.value)
+				if err != nil {
+					return nil, fmt.Errorf("health check %q: %s", term, err)
+				}
+				c.dur = d
+			}
+			group = append(group, c)
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// parseDays is time.ParseDuration that also takes whole days, e.g. 14d.
+func parseDays(s string) (time.Duration, error) {
+	if n := strings.TrimSuffix(s, "d"); n != s {
+		days, err := strconv.Atoi(n)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// eval reports whether the check passes and what was observed.
+func (c healthCheck) eval(resp *http.Response, body []byte, elapsed time.Duration) (bool, string) {
+	switch c.field {
+	case "status":
+		got := strconv.Itoa(resp.StatusCode)
+		match := got == c.value
+		if len(c.value) == 3 && strings.HasSuffix(strings.ToLower(c.value), "xx") {
+			match = got[0] == c.value[0]
+		}
+		return match == (c.op == "="), got
+	case "latency":
+		return (elapsed < c.dur) == (c.op == "<"), dur(elapsed)
+	case "body":
+		found := strings.Contains(string(body), c.value)
+		if found {
+			return c.op == "~", "found"
+		}
+		return c.op == "!~", "not found"
+	case "cert":
+		if resp.TLS == nil || resp.Request.URL.Scheme != "https" || len(resp.TLS.PeerCertificates) == 0 {
+			return false, "no destination certificate"
+		}
+		left := time.Until(resp.TLS.PeerCertificates[0].NotAfter).Truncate(time.Hour)
+		return (left < c.dur) == (c.op == "<"), dur(left) + " left"
+	}
+	return false, ""
+}
+
+// passesHealth evaluates the checks without printing them and returns,
+// when no group passes, the first failed term of the last group.
+func passesHealth(groups [][]healthCheck, resp *http.Response, body []byte, elapsed time.Duration) (bool, string) {
+	failed := ""
+	for _, group := range groups {
+		failed = ""
+		for _, c := range group {
+			if pass, got := c.eval(resp, body, elapsed); !pass && failed == "" {
+				failed = fmt.Sprintf("%s (%s)", c.term, got)
+			}
+		}
+		if failed == "" {
+			return true, ""
+		}
+	}
+	return false, failed
+}
+
+// reportHealth prints every check and the combined verdict, and returns 1
+// when no group passes.
+func reportHealth(groups [][]healthCheck, resp *http.Response, body []byte, elapsed time.Duration) int {
+	healthy := false
+	for _, group := range groups {
+		ok := true
+		for _, c := range group {
+			pass, got := c.eval(resp, body, elapsed)
+			verdict := "PASS"
+			if !pass {
+				verdict, ok = "FAIL", false
+			}
+			fmt.Printf("health: %s %s (%s)\n", c.term, verdict, got)
+		}
+		healthy = healthy || ok
+	}
+	if !healthy {
+		fmt.Println("health: FAIL")
+		return 1
+	}
+	fmt.Println("health: OK")
+	return 0
+}
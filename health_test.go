@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseHealth(t *testing.T) {
+	tests := []struct {
+		expr string
+		want [][]healthCheck
+	}{
+		{"status=2xx", [][]healthCheck{
+			{{term: "status=2xx", field: "status", op: "=", value: "2xx"}},
+		}},
+		// && binds tighter than ||
+		{"status=2xx && latency<500ms || status=304", [][]healthCheck{
+			{
+				{term: "status=2xx", field: "status", op: "=", value: "2xx"},
+				{term: "latency<500ms", field: "latency", op: "<", value: "500ms", dur: 500 * time.Millisecond},
+			},
+			{{term: "status=304", field: "status", op: "=", value: "304"}},
+		}},
+		{" body !~ access denied  &&cert>14d ", [][]healthCheck{{
+			{term: "body !~ access denied", field: "body", op: "!~", value: "access denied"},
+			{term: "cert>14d", field: "cert", op: ">", value: "14d", dur: 14 * 24 * time.Hour},
+		}}},
+		{"status!=407&&body~ok", [][]healthCheck{{
+			{term: "status!=407", field: "status", op: "!=", value: "407"},
+			{term: "body~ok", field: "body", op: "~", value: "ok"},
+		}}},
+	}
+	for _, tt := range tests {
+		got, err := parseHealth(tt.expr)
+		if err != nil {
+			t.Errorf("parseHealth(%q): %s", tt.expr, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseHealth(%q) = %+v, want %+v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseHealthErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"status=2xx &&",
+		"code=200",
+		"status<300",
+		"latency=1s",
+		"body>ok",
+		"cert=14d",
+		"latency<fast",
+		"cert>xd",
+	} {
+		if got, err := parseHealth(expr); err == nil {
+			t.Errorf("parseHealth(%q) = %+v, want an error", expr, got)
+		}
+	}
+}
+
+func TestHealthEval(t *testing.T) {
+	resp := &http.Response{StatusCode: 503, Request: &http.Request{URL: &url.URL{Scheme: "http", Host: "example.com"}}}
+	tests := []struct {
+		term string
+		want bool
+	}{
+		{"status=503", true},
+		{"status=5xx", true},
+		{"status=5XX", true},
+		{"status=2xx", false},
+		{"status!=503", false},
+		{"status!=2xx", true},
+		{"latency<1s", true},
+		{"latency>1s", false},
+		{"body~maintenance", true},
+		{"body!~maintenance", false},
+		{"body~ok", false},
+		{"body!~ok", true},
+		// a plain http destination has no certificate to pass any term
+		{"cert>1d", false},
+		{"cert<1d", false},
+	}
+	for _, tt := range tests {
+		groups, err := parseHealth(tt.term)
+		if err != nil {
+			t.Fatalf("parseHealth(%q): %s", tt.term, err)
+		}
+		if got, _ := groups[0][0].eval(resp, []byte("down for maintenance"), 200*time.Millisecond); got != tt.want {
+			t.Errorf("%s on a 503 in 200ms = %v, want %v", tt.term, got, tt.want)
+		}
+	}
+}
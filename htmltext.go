@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// htmlText is -html-text: HTML bodies, block and error pages mostly, are
+// shown as the text a browser would, in the probe and in the batch and
+// watch reasons.
+var htmlText bool
+
+// pageReasonMax caps the page text a table cell or reason line gets.
+const pageReasonMax = 160
+
+var (
+	// htmlHidden are the elements whose content is not text on the page
+	htmlHidden = regexp.MustCompile(`(?is)<(script|style|head|noscript|template)\b.*?</(script|style|head|noscript|template)\s*>|<!--.*?-->`)
+	htmlTitle  = regexp.MustCompile(`(?is)<title\b[^>]*>(.*?)</title\s*>`)
+	// htmlBreak are the tags that start a new line of text
+	htmlBreak = regexp.MustCompile(`(?i)<(br|p|div|h[1-6]|li|tr|table|ul|ol|pre|blockquote|hr|section|article|header|footer|form|title)\b[^>]*>|</(p|div|h[1-6]|li|tr|table|ul|ol|pre|blockquote|section|article|header|footer|form|title)\s*>`)
+	htmlTag   = regexp.MustCompile(`(?s)<[^>]*>`)
+	spaceRun  = regexp.MustCompile(`[ \t\r\f\v\x{a0}]+`)
+)
+
+// isHTML tells whether resp, whose body starts with body, is an HTML page.
+func isHTML(resp *http.Response, body []byte) bool {
+	if ct := strings.ToLower(resp.Header.Get("Content-Type")); ct != "" {
+		return strings.Contains(ct, "html")
+	}
+	start := strings.ToLower(string(bytes.TrimSpace(body[:min(len(body), 512)])))
+	return strings.HasPrefix(start, "<!doctype html") || strings.HasPrefix(start, "<html")
+}
+
+// pageText renders HTML as its visible text, the title first line, one
+// line per block, blank lines dropped.
+func pageText(page []byte) string {
+	s := string(page)
+	title := ""
+	if m := htmlTitle.FindStringSubmatch(s); m != nil {
+		title = strings.TrimSpace(spaceRun.ReplaceAllString(html.UnescapeString(htmlTag.ReplaceAllString(m[1], "")), " "))
+	}
+	s = htmlHidden.ReplaceAllString(s, "")
+	s = htmlBreak.ReplaceAllString(s, "\n")
+	s = html.UnescapeString(htmlTag.ReplaceAllString(s, ""))
+	var lines []string
+	if title != "" {
+		lines = append(lines, title)
+	}
+	for _, l := range strings.Split(s, "\n") {
+		l = strings.TrimSpace(spaceRun.ReplaceAllString(l, " "))
+		// pages repeat the title as their heading
+		if l != "" && !(len(lines) == 1 && l == title) {
+			lines = append(lines, l)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// pageReason is the text of an HTML error page on one line, cut to
+// pageReasonMax, "" without -html-text or when the body is no HTML.
+func pageReason(resp *http.Response, body []byte) string {
+	if !htmlText || len(body) == 0 || !isHTML(resp, body) {
+		return ""
+	}
+	text := strings.ReplaceAll(pageText(body), "\n", " / ")
+	if r := []rune(text); len(r) > pageReasonMax {
+		text = string(r[:pageReasonMax-3]) + "..."
+	}
+	return text
+}
+
+// withPage appends the page text of resp to reason.
+func withPage(reason string, resp *http.Response, body []byte) string {
+	if text := pageReason(resp, body); text != "" {
+		return reason + ": " + text
+	}
+	return reason
+}
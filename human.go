@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// human is -human: durations and sizes for people rather than scripts.
+// -json keeps the raw values either way.
+var human bool
+
+// dur formats d as Go prints it, or with -human to three significant
+// digits in µs, ms or s, and in minutes, hours or days past a minute.
+func dur(d time.Duration) string {
+	if !human {
+		return d.String()
+	}
+	switch a := d; {
+	case a < 0:
+		return "-" + dur(-d)
+	case a < time.Microsecond:
+		return fmt.Sprintf("%d ns", d.Nanoseconds())
+	case a < time.Millisecond:
+		return sig3(float64(d)/float64(time.Microsecond), "µs")
+	case a < time.Second:
+		return sig3(float64(d)/float64(time.Millisecond), "ms")
+	case a < time.Minute:
+		return sig3(d.Seconds(), "s")
+	case a < time.Hour:
+		d = d.Round(time.Second)
+		return fmt.Sprintf("%dm %02ds", d/time.Minute, d%time.Minute/time.Second)
+	case a < 24*time.Hour:
+		d = d.Round(time.Minute)
+		return fmt.Sprintf("%dh %02dm", d/time.Hour, d%time.Hour/time.Minute)
+	}
+	d = d.Round(time.Hour)
+	return fmt.Sprintf("%dd %02dh", d/(24*time.Hour), d%(24*time.Hour)/time.Hour)
+}
+
+// size formats n bytes as "N bytes", or with -human in binary units.
+func size(n int64) string {
+	if !human {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	v := float64(n) / 1024
+	for _, unit := range []string{"KiB", "MiB", "GiB"} {
+		if v < 1024 || unit == "GiB" {
+			return sig3(v, unit)
+		}
+		v /= 1024
+	}
+	return ""
+}
+
+// sig3 prints v with three significant digits, v under 1000.
+func sig3(v float64, unit string) string {
+	switch {
+	case v < 10:
+		return fmt.Sprintf("%.2f %s", v, unit)
+	case v < 100:
+		return fmt.Sprintf("%.1f %s", v, unit)
+	}
+	return fmt.Sprintf("%.0f %s", v, unit)
+}
+
+// sizeUnits are the suffixes parseSize takes, binary ones as size prints.
+var sizeUnits = []struct {
+	suffix string
+	n      int64
+}{
+	{"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+	{"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3},
+	{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+}
+
+// parseSize reads a byte count, plain or with a unit, e.g. 64KiB or 1.5M.
+func parseSize(s string) (int64, error) {
+	num, mult := strings.TrimSpace(s), int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(strings.ToUpper(num), strings.ToUpper(u.suffix)) {
+			num, mult = strings.TrimSpace(num[:len(num)-len(u.suffix)]), u.n
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(v * float64(mult)), nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The annotations -k8s-discover looks for. Services and Ingresses with
+// k8sWatch set to "true" are watched, at the URL of k8sURL when set,
+// otherwise at one made of their host, port and k8sPath, with k8sPriority
+// as their priority tag.
+const (
+	k8sWatch    = "poc-proxy-https/watch"
+	k8sURL      = "poc-proxy-https/url"
+	k8sPath     = "poc-proxy-https/path"
+	k8sPriority = "poc-proxy-https/priority"
+)
+
+// k8sServiceAccount is where a pod finds its service account.
+const k8sServiceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// k8sClient lists Services and Ingresses from the API server with the
+// pod's service account token, over the standard library alone.
+type k8sClient struct {
+	base      string
+	tokenFile string
+	namespace string
+	http      *http.Client
+}
+
+// inClusterK8s is the client of the cluster the process runs in, from
+// KUBERNETES_SERVICE_HOST and the mounted service account. namespace ""
+// lists every namespace the account may read.
+func inClusterK8s(namespace string) (*k8sClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes pod, KUBERNETES_SERVICE_HOST is not set")
+	}
+	ca, err := os.ReadFile(k8sServiceAccount + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("%s/ca.crt: no certificate", k8sServiceAccount)
+	}
+	return &k8sClient{
+		base:      "https://" + net.JoinHostPort(host, port),
+		tokenFile: k8sServiceAccount + "/token",
+		namespace: namespace,
+		// the API server is reached directly, never through the watched proxies
+		http: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// k8sMeta is the part of an object's metadata discovery reads.
+type k8sMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type k8sServiceList struct {
+	Items []struct {
+		Metadata k8sMeta `json:"metadata"`
+		Spec     struct {
+			Type         string `json:"type"`
+			ExternalName string `json:"externalName"`
+			Ports        []struct {
+				Name string `json:"name"`
+				Port int    `json:"port"`
+			} `json:"ports"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+type k8sIngressList struct {
+	Items []struct {
+		Metadata k8sMeta `json:"metadata"`
+		Spec     struct {
+			TLS []struct {
+				Hosts []string `json:"hosts"`
+			} `json:"tls"`
+			Rules []struct {
+				Host string `json:"host"`
+			} `json:"rules"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// k8sTarget is a destination discovered in the cluster and the object
+// that named it.
+type k8sTarget struct {
+	url  string
+	tags map[string]string
+}
+
+// get decodes the list at path, "" namespace for all of them.
+func (k *k8sClient) get(ctx context.Context, group, resource string, v interface{}) error {
+	path := group + "/" + resource
+	if k.namespace != "" {
+		path = group + "/namespaces/" + k.namespace + "/" + resource
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", k.base+path, nil)
+	if err != nil {
+		return err
+	}
+	// read for every request, the kubelet rotates the token
+	token, err := os.ReadFile(k.tokenFile)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s: %s", path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover lists the annotated Services and Ingresses, sorted by URL. An
+// object naming a URL twice, or two objects the same one, gives one
+// target.
+func (k *k8sClient) discover(ctx context.Context) ([]k8sTarget, error) {
+	var services k8sServiceList
+	if err := k.get(ctx, "/api/v1", "services", &services); err != nil {
+		return nil, err
+	}
+	var ingresses k8sIngressList
+	if err := k.get(ctx, "/apis/networking.k8s.io/v1", "ingresses", &ingresses); err != nil {
+		return nil, err
+	}
+	found := map[string]k8sTarget{}
+	add := func(kind string, m k8sMeta, u string) {
+		if _, ok := found[u]; ok {
+			return
+		}
+		tags := map[string]string{"k8s_kind": kind, "k8s_namespace": m.Namespace, "k8s_name": m.Name}
+		if p, ok := m.Annotations[k8sPriority]; ok {
+			tags["priority"] = p
+		}
+		found[u] = k8sTarget{url: u, tags: tags}
+	}
+	for _, s := range services.Items {
+		m := s.Metadata
+		if m.Annotations[k8sWatch] != "true" {
+			continue
+		}
+		if u := m.Annotations[k8sURL]; u != "" {
+			add("Service", m, u)
+			continue
+		}
+		host := m.Name + "." + m.Namespace + ".svc"
+		if s.Spec.Type == "ExternalName" {
+			host = s.Spec.ExternalName
+		}
+		scheme, port := "http", 80
+		if len(s.Spec.Ports) > 0 {
+			p := s.Spec.Ports[0]
+			port = p.Port
+			if p.Port == 443 || p.Name == "https" {
+				scheme = "https"
+			}
+		}
+		u := scheme + "://" + host
+		if port != 80 && port != 443 || scheme == "http" && port == 443 {
+			u = scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		add("Service", m, u+k8sURLPath(m))
+	}
+	for _, in := range ingresses.Items {
+		m := in.Metadata
+		if m.Annotations[k8sWatch] != "true" {
+			continue
+		}
+		if u := m.Annotations[k8sURL]; u != "" {
+			add("Ingress", m, u)
+			continue
+		}
+		secure := map[string]bool{}
+		for _, t := range in.Spec.TLS {
+			for _, h := range t.Hosts {
+				secure[h] = true
+			}
+		}
+		for _, r := range in.Spec.Rules {
+			if r.Host == "" {
+				// a catch-all rule has no name to reach it by
+				continue
+			}
+			scheme := "http"
+			if secure[r.Host] {
+				scheme = "https"
+			}
+			add("Ingress", m, scheme+"://"+r.Host+k8sURLPath(m))
+		}
+	}
+	targets := make([]k8sTarget, 0, len(found))
+	for _, t := range found {
+		targets = append(targets, t)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].url < targets[j].url })
+	return targets, nil
+}
+
+// k8sURLPath is the path annotation of m, "/" without one.
+func k8sURLPath(m k8sMeta) string {
+	p := m.Annotations[k8sPath]
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// fakeK8s serves the lists discover reads, the ingresses of *ingresses so
+// a test can change them, and wants the token.
+func fakeK8s(t *testing.T, ingresses *string) *k8sClient {
+	const services = `{"items": [
+		{"metadata": {"name": "api", "namespace": "shop", "annotations": {"poc-proxy-https/watch": "true", "poc-proxy-https/path": "healthz"}},
+		 "spec": {"type": "ClusterIP", "ports": [{"name": "https", "port": 8443}]}},
+		{"metadata": {"name": "pay", "namespace": "shop", "annotations": {"poc-proxy-https/watch": "true"}},
+		 "spec": {"type": "ExternalName", "externalName": "pay.example.com", "ports": [{"port": 443}]}},
+		{"metadata": {"name": "db", "namespace": "shop"}, "spec": {"ports": [{"port": 5432}]}}]}`
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/services":
+			rw.Write([]byte(services))
+		case "/apis/networking.k8s.io/v1/ingresses":
+			rw.Write([]byte(*ingresses))
+		default:
+			http.NotFound(rw, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	token := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(token, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &k8sClient{base: srv.URL, tokenFile: token, http: srv.Client()}
+}
+
+const shopIngress = `{"items": [
+	{"metadata": {"name": "web", "namespace": "shop", "annotations": {"poc-proxy-https/watch": "true"}},
+	 "spec": {"tls": [{"hosts": ["shop.example.com"]}], "rules": [{"host": "shop.example.com"}, {"host": "static.example.com"}, {}]}},
+	{"metadata": {"name": "admin", "namespace": "shop", "annotations": {"poc-proxy-https/url": "https://admin.example.com/ping"}},
+	 "spec": {"rules": [{"host": "admin.example.com"}]}}]}`
+
+func TestK8sDiscover(t *testing.T) {
+	ingresses := shopIngress
+	got, err := fakeK8s(t, &ingresses).discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var urls []string
+	for _, d := range got {
+		urls = append(urls, d.url)
+	}
+	want := []string{
+		"http://static.example.com/",
+		"https://api.shop.svc:8443/healthz",
+		"https://pay.example.com/",
+		"https://shop.example.com/",
+	}
+	if !reflect.DeepEqual(urls, want) {
+		t.Errorf("discover = %v, want %v", urls, want)
+	}
+	if tags := got[0].tags; tags["k8s_kind"] != "Ingress" || tags["k8s_namespace"] != "shop" || tags["k8s_name"] != "web" {
+		t.Errorf("discover tags = %v, want the Ingress shop/web", tags)
+	}
+
+	k := fakeK8s(t, &ingresses)
+	k.tokenFile = filepath.Join(t.TempDir(), "other")
+	os.WriteFile(k.tokenFile, []byte("expired"), 0600)
+	if _, err := k.discover(context.Background()); err == nil {
+		t.Error("discover with a refused token succeeded")
+	}
+}
+
+func TestWatchSync(t *testing.T) {
+	allowInternal = true
+	defer func() { allowInternal = false }()
+	client, err := proxyclient.New(proxyclient.Config{Proxy: "http://127.0.0.1:3128"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingresses := shopIngress
+	p := &watchProxy{name: "http://127.0.0.1:3128", client: client}
+	static := &watchTarget{Proxy: p.name, Dest: "https://www.example.com/", client: client}
+	w := &watcher{k8s: fakeK8s(t, &ingresses), proxies: []*watchProxy{p}, targets: []*watchTarget{static}}
+	dests := func() []string {
+		var d []string
+		for _, t := range w.targets {
+			d = append(d, t.Dest)
+		}
+		return d
+	}
+
+	if err := w.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"https://www.example.com/", "http://static.example.com/", "https://api.shop.svc:8443/healthz", "https://pay.example.com/", "https://shop.example.com/"}
+	if got := dests(); !reflect.DeepEqual(got, want) {
+		t.Errorf("first sync targets = %v, want %v", got, want)
+	}
+	kept := w.targets[2]
+
+	ingresses = `{"items": []}`
+	if err := w.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"https://www.example.com/", "https://api.shop.svc:8443/healthz", "https://pay.example.com/"}
+	if got := dests(); !reflect.DeepEqual(got, want) {
+		t.Errorf("sync without the Ingress targets = %v, want %v", got, want)
+	}
+	if w.targets[1] != kept {
+		t.Error("a target found again lost its checks")
+	}
+
+	ingresses = shopIngress
+	filters = tagFilters{{key: "k8s_kind", value: "Ingress"}}
+	defer func() { filters = nil }()
+	if err := w.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"https://www.example.com/", "http://static.example.com/", "https://shop.example.com/"}
+	if got := dests(); !reflect.DeepEqual(got, want) {
+		t.Errorf("sync with -filter k8s_kind=Ingress targets = %v, want %v", got, want)
+	}
+}
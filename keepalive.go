@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// runReuse implements -requests-per-conn: it sends that many requests to
+// -dest one after the other, -conn-pause apart, and prints for each
+// whether it got a new connection or reused one and after how long idle,
+// and what the response said about persistence. A new connection where
+// the one before was left open means the other end closed it idle, and
+// with a pause that bounds its idle timeout. With -keepalive=false every
+// request has a connection of its own. It returns 1 when a request
+// failed.
+func runReuse(client *proxyclient.Client) int {
+	// conns numbers the connections by local address, in order of use
+	conns := map[string]int{}
+	var uses []int
+	reused, failed := 0, 0
+	// keptOpen is whether the last response left its connection open
+	keptOpen, closedIdle := false, 0
+	for i := 1; i <= requestsPerConn; i++ {
+		if i > 1 && connPause > 0 {
+			time.Sleep(connPause)
+		}
+		req, err := destRequest()
+		if err != nil {
+			fmt.Printf("erro: %s\n", err)
+			return 2
+		}
+		start := time.Now()
+		resp, res, err := client.Measure(req)
+		if err != nil {
+			fmt.Printf("request %d: erro (%s): %s\n", i, res.ErrorClass, err)
+			failed++
+			keptOpen = false
+			continue
+		}
+		// a connection goes back to the pool once its body is read
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		elapsed := time.Since(start)
+
+		how := "new connection"
+		switch {
+		case res.Reused:
+			how = fmt.Sprintf("reused, idle %s", dur(res.Idle))
+			reused++
+		case keptOpen && keepAlive:
+			how = "new connection, the last one was closed while idle"
+			closedIdle++
+		}
+		if res.Conn != "" {
+			n, ok := conns[res.Conn]
+			if !ok {
+				n = len(uses)
+				conns[res.Conn] = n
+				uses = append(uses, 0)
+			}
+			uses[n]++
+			how = fmt.Sprintf("conn %d (%s) %s", n+1, res.Conn, how)
+		}
+		fmt.Printf("request %d: code %d %s %s, %s%s\n", i, resp.StatusCode, res.Proto, dur(elapsed), how, persistence(resp))
+		keptOpen = !resp.Close
+	}
+
+	fmt.Printf("reuse: %d requests, %d connections, %d reused", requestsPerConn-failed, len(uses), reused)
+	if closedIdle > 0 {
+		fmt.Printf(", %d closed while idle", closedIdle)
+	}
+	fmt.Println()
+	if len(uses) > 1 {
+		var per []string
+		for _, n := range uses {
+			per = append(per, fmt.Sprint(n))
+		}
+		fmt.Printf("reuse: requests per connection %s\n", strings.Join(per, ", "))
+	}
+	if keepAlive && requestsPerConn > 1 && reused == 0 && failed == 0 {
+		fmt.Println("reuse: no connection was kept alive")
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// persistence describes the response headers about the connection, the
+// proxy's for plain http, the destination's through a tunnel.
+func persistence(resp *http.Response) string {
+	var parts []string
+	if resp.Close {
+		parts = append(parts, "Connection: close")
+	}
+	if ka := resp.Header.Get("Keep-Alive"); ka != "" {
+		parts = append(parts, "Keep-Alive: "+ka)
+	}
+	if pc := resp.Header.Get("Proxy-Connection"); pc != "" {
+		parts = append(parts, "Proxy-Connection: "+pc)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return ", " + strings.Join(parts, ", ")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// lifecycle is what /healthz and /readyz tell an orchestrator about a long
+// run: live while it runs, ready once its first request is done and no
+// longer ready from the signal that ends it.
+type lifecycle struct {
+	// pending is what /readyz answers before the run is ready
+	pending string
+
+	mu              sync.Mutex
+	ready, draining bool
+}
+
+func (l *lifecycle) setReady() {
+	l.mu.Lock()
+	l.ready = true
+	l.mu.Unlock()
+}
+
+// listen serves /healthz and /readyz at addr, nothing without one.
+func (l *lifecycle) listen(name, addr string) (*http.Server, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	l.handle(mux)
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	fmt.Printf("%s: http://%s/healthz and /readyz\n", name, ln.Addr())
+	return srv, nil
+}
+
+// handle adds /healthz and /readyz to mux.
+func (l *lifecycle) handle(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", l.serveHealthz)
+	mux.HandleFunc("/readyz", l.serveReadyz)
+}
+
+// serveHealthz answers 200 while the run is on.
+func (l *lifecycle) serveHealthz(rw http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(rw, "ok")
+}
+
+// serveReadyz answers 200 once the run is ready, 503 before that and
+// while draining. Failing requests do not make it unready, reporting them
+// is the run's job.
+func (l *lifecycle) serveReadyz(rw http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	ready, draining := l.ready, l.draining
+	l.mu.Unlock()
+	switch {
+	case draining:
+		http.Error(rw, "draining", http.StatusServiceUnavailable)
+	case !ready:
+		http.Error(rw, l.pending, http.StatusServiceUnavailable)
+	default:
+		fmt.Fprintln(rw, "ok")
+	}
+}
+
+// drain waits for done, the work in flight when the signal came, for up
+// to limit or until a second signal, and cancels it then.
+func (l *lifecycle) drain(name, what string, limit time.Duration, done <-chan struct{}, cancel func()) {
+	l.mu.Lock()
+	l.draining = true
+	l.mu.Unlock()
+	fmt.Printf("%s: draining, waiting up to %s for %s\n", name, dur(limit), what)
+	again, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case <-done:
+		return
+	case <-again.Done():
+		fmt.Printf("%s: second signal, cancelling %s\n", name, what)
+	case <-time.After(limit):
+		fmt.Printf("%s: drain timed out, cancelling %s\n", name, what)
+	}
+	cancel()
+}
+
+// shutdown stops srv, letting the answers under way finish.
+func shutdown(srv *http.Server) {
+	if srv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+}
@@ -1,14 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
-	"encoding/base64"
+	"expvar"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
 )
 
 var (
@@ -16,46 +26,1281 @@ var (
 	user     string
 	password string
 	dest     string
+	authMode string
+	noProxy  string
+
+	dests        destList
+	destFile     string
+	destParallel int
+	proxyFile    string
+
+	passwordFile   string
+	passwordEnv    string
+	passwordPrompt bool
+
+	gssapiService    string
+	gssapiProtection string
+
+	destUser     string
+	destPassword string
+	destAuthType string
+
+	soak         time.Duration
+	soakInterval time.Duration
+	soakListen   string
+	soakDrain    time.Duration
+	traceSample  string
+
+	hopTimeout   time.Duration
+	hopBudget    time.Duration
+	maxRedirects int
+	noFollow     bool
+
+	retries      int
+	retryBackoff time.Duration
+	retryOn      string
+	fallback     string
+
+	credentialsCmd string
+	credentialsURL string
+
+	cacheTest    bool
+	originListen string
+	originURL    string
+	originDNS    string
+	originName   string
+
+	oauthTokenURL     string
+	oauthClientID     string
+	oauthClientSecret string
+	oauthScope        string
+	oauthSkew         time.Duration
+
+	dnsRace     bool
+	splitDNS    bool
+	authBypass  bool
+	connectOnly bool
+	tlsExts     bool
+	anonCheck   bool
+	compare     bool
+	maxTunnels  int
+
+	keepAlive       bool
+	requestsPerConn int
+	connPause       time.Duration
+
+	seed int64
+
+	watchInterval time.Duration
+	watchDrain    time.Duration
+	watchListen   string
+	watchStore    string
+	watchWorkers  int
+	allowInternal bool
+
+	k8sDiscover  bool
+	k8sNamespace string
+	k8sResync    time.Duration
+
+	timeout               time.Duration
+	connectTimeout        time.Duration
+	tlsTimeout            time.Duration
+	responseHeaderTimeout time.Duration
+
+	iface    string
+	sourceIP string
+	ipv6Src  string
+	ipv4Only bool
+	ipv6Only bool
+
+	dnsLeak       string
+	dnsLeakListen string
+	dnsLeakAddr   string
+
+	searchDomains string
+	resolves      = resolveList{}
+	dnsServer     string
+
+	geo       bool
+	geoAPI    string
+	geoExpect string
+
+	health       string
+	healthChecks [][]healthCheck
+
+	// -assert-status, -assert-header, -assert-body-contains, -assert-max-latency
+	assertStatus  string
+	assertHeaders headerList
+	assertBody    string
+	assertLatency time.Duration
+
+	showHeaders string
+	headerShow  *headerFilter
+
+	extraHeaders  headerList
+	pins          pinList
+	cookies       cookieList
+	cookieJarFile string
+	headersFile   string
+	reqHeaders    http.Header
+
+	saveCertsDir string
+
+	recordFixtures string
+	fixturesDir    string
+
+	method   string
+	data     string
+	dataFile string
+	body     []byte
+
+	uploadSize string
+	uploadData string
+
+	insecure      bool
+	caCert        string
+	tlsServerName string
+	forceHTTP2    bool
+
+	clientCert         string
+	clientKey          string
+	clientCertPassword string
+
+	command  string
+	duration time.Duration
+	streams  int
+
+	limitRate   string
+	summaryOnly bool
+	batchExport string
+	groupBy     string
+
+	benchRate    float64
+	benchWorkers int
+	benchLoop    string
+
+	expvarListen string
+
+	metricsListen string
+	promReg       *promMetrics
+
+	silent  bool
+	output  string
+	bodyOut io.Writer
+
+	jsonOutput bool
+	format     string
+	harFile    string
+
+	verbose     bool
+	veryVerbose bool
+
+	configFile string
+
+	decompress bool
+	grep       string
+	head       int
+	bodySample string
 )
 
 func main() {
 
-	flag.StringVar(&proxy, "proxy", "", "provide proxy URL: IP:PORT")
+	flag.StringVar(&configFile, "config", "", "YAML or TOML file of flag settings, e.g. proxy: IP:PORT, or the name of one in the profiles directory; command line flags override it")
+	flag.StringVar(&proxy, "proxy", "", "provide proxy URL: IP:PORT, https://IP:PORT or socks5://IP:PORT")
 	flag.StringVar(&user, "user", "", "provide proxy user")
 	flag.StringVar(&password, "password", "", "provide proxy password")
-	flag.StringVar(&dest, "dest", "", "provide URL to access")
-	flag.Parse()
+	flag.StringVar(&passwordFile, "password-file", "", "read the proxy password from the first line of this file")
+	flag.StringVar(&passwordEnv, "password-env", "", "read the proxy password from this environment variable")
+	flag.BoolVar(&passwordPrompt, "password-prompt", false, "ask for the proxy password on the terminal, without echo")
+	flag.Var(&dests, "dest", "provide URL to access, repeat for several with a summary table")
+	flag.BoolVar(&summaryOnly, "summary-only", false, "batch runs: print the rollup by domain only, not every entry")
+	flag.StringVar(&limitRate, "limit-rate", "", "read and write at most this many bytes a second each, e.g. 500k, over all connections, like a slow client")
+	flag.BoolVar(&htmlText, "html-text", false, "show HTML bodies as text: the body printed, and block and error pages in batch tables, -proxy-file and watch reasons")
+	flag.StringVar(&groupBy, "group-by", "", "batch runs: roll up by this tag of the entries rather than by domain")
+	flag.Var(&filters, "filter", "batch runs and watch: only the targets with this tag, key=value or key!=value, repeatable")
+	flag.StringVar(&batchExport, "export", "", "batch runs: write every entry to this file, CSV for .csv, JSON otherwise")
+	flag.StringVar(&destFile, "dest-file", "", "read more destination URLs from this file, one per line, # for comments")
+	flag.StringVar(&checkpointFile, "checkpoint", "", "with several destinations, keep the ones done in this JSON file and skip them when run again with it")
+	flag.IntVar(&destParallel, "parallel", 1, "with several destinations, request this many at once over the shared connection pool; with -proxy-file, check this many proxies at once")
+	flag.StringVar(&proxyFile, "proxy-file", "", "check -dest through every proxy of this file, one per line, and rank them")
+	flag.StringVar(&noProxy, "no-proxy", "", "comma separated hosts, domains and CIDRs reached without the proxy, overrides NO_PROXY")
+	flag.StringVar(&method, "method", "GET", "request method: GET, POST, PUT, DELETE, PATCH, HEAD or OPTIONS")
+	flag.StringVar(&data, "data", "", "request body")
+	flag.StringVar(&dataFile, "data-file", "", "read the request body from a file, - for stdin")
+	flag.StringVar(&uploadSize, "upload-size", "", "send a generated body of this size, e.g. 100MB, streamed rather than held in memory, and report the upload throughput; the method defaults to POST")
+	flag.BoolVar(&benchmarkDownload, "benchmark-download", false, "stream -dest once discarding the body and report its rate, first byte latency and whether it slows down over time")
+	flag.DurationVar(&downloadInterval, "download-interval", time.Second, "-benchmark-download: how often the rate is sampled")
+	flag.StringVar(&uploadData, "upload-data", "random", "-upload-size body: random, which compression cannot shrink, or zero")
+	flag.Var(&extraHeaders, "H", "request header \"Name: value\", repeatable")
+	flag.StringVar(&headersFile, "headers-file", "", "file of request headers, one \"Name: value\" per line")
+	flag.DurationVar(&duration, "duration", 10*time.Second, "throughput: how long to transfer in each direction; bench: how long to run each load model")
+	flag.IntVar(&streams, "streams", 4, "throughput: parallel transfers")
+	flag.Float64Var(&benchRate, "rate", 10, "bench: requests started per second in the open loop")
+	flag.IntVar(&benchWorkers, "workers", 4, "bench: workers of the closed loop, each sending a request once its last one is done")
+	flag.StringVar(&benchLoop, "loop", "both", "bench: load model, open (fixed -rate), closed (-workers) or both one after the other, or adaptive (concurrency steered by the SLO)")
+	flag.DurationVar(&sloLatency, "slo-latency", time.Second, "bench -loop adaptive: p95 latency a window must stay within")
+	flag.Float64Var(&sloErrors, "slo-errors", 1, "bench -loop adaptive: percent of failed requests a window may have")
+	flag.DurationVar(&adaptWindow, "adapt-window", 2*time.Second, "bench -loop adaptive: how long each concurrency is measured before it is raised or halved")
+	flag.IntVar(&adaptStep, "adapt-step", 1, "bench -loop adaptive: requests in flight added after a window that met the SLO")
+	flag.StringVar(&expvarListen, "expvar-listen", "", "serve the client counters as expvar on /debug/vars at this address, e.g. :8082")
+	flag.StringVar(&metricsListen, "metrics-listen", "", "serve request counts, errors by class and latency histograms by proxy and destination as Prometheus metrics on /metrics at this address")
+	flag.StringVar(&output, "o", "", "write the response body verbatim to a file, - for stdout with diagnostics on stderr")
+	flag.StringVar(&bodySample, "body-sample", "", "read the body only as far as the -health body checks need, this much at most, e.g. 64KiB, and print none of it")
+	flag.BoolVar(&decompress, "decompress", false, "decode a gzip or deflate Content-Encoding of the body")
+	flag.StringVar(&compression, "compression", "", "ask for none, gzip or br in Accept-Encoding and report what the proxy returned; gzip is decoded, br printed encoded and refused with -o and the body checks; by default the transport asks for gzip and decodes it unseen")
+	flag.StringVar(&grep, "grep", "", "print only body lines matching this regexp, streaming the body")
+	flag.IntVar(&head, "head", 0, "print only the first N body lines (after -grep) and stop reading")
+	flag.BoolVar(&human, "human", false, "print durations rounded in µs/ms/s and sizes in KiB/MiB, -json keeps the raw values")
+	flag.BoolVar(&verbose, "v", false, "dump the request and response heads exchanged with the proxy and destination, CONNECT and 407 rounds included, to stderr with credentials masked")
+	flag.BoolVar(&veryVerbose, "vv", false, "like -v, adding DNS, dials, TLS handshakes and connection reuse")
+	flag.BoolVar(&jsonOutput, "json", false, "print the run as JSON on stdout, the same schema as proxyclient.Result, with diagnostics on stderr")
+	flag.StringVar(&format, "format", "text", "what stdout carries: text, the diagnostics, or json, the same as -json")
+	flag.StringVar(&rangeSpec, "range", "", "ask for part of -dest, bytes=FIRST-LAST, bytes=FIRST- or bytes=-N, and check the 206 answer")
+	flag.BoolVar(&resume, "resume", false, "continue the download in the file of -o: ask for the bytes after what it has and append them only on a matching 206")
+	flag.StringVar(&harFile, "har", "", "write the request/response pairs, redirects included, to this file as HAR 1.2")
+	flag.BoolVar(&silent, "silent", false, "print no diagnostics, only the body with -o -")
+	flag.BoolVar(&forceHTTP2, "http2", false, "speak only HTTP/2 to the destination, failing instead of downgrading when the tunnel or destination cannot")
+	flag.BoolVar(&insecure, "insecure", false, "do not verify proxy and destination certificates")
+	flag.StringVar(&caCert, "ca-cert", "", "PEM bundle of CAs to trust besides the system ones")
+	flag.Var(&trustProfiles, "trust", "check the destination chain against a trust profile, system or NAME=FILE for the roots of a PEM bundle alone, repeatable")
+	flag.Var(&cookies, "cookie", "send this cookie to -dest, NAME=VALUE or several as in a Cookie header, repeatable")
+	flag.StringVar(&cookieJarFile, "cookie-jar", "", "read cookies from this file, Netscape format as curl writes, and save the ones the run ends with back to it")
+	flag.Var(&pins, "pin-sha256", "fail unless the destination chain holds this key, base64 SPKI SHA-256, repeatable; detects TLS interception")
+	flag.StringVar(&tlsServerName, "tls-server-name", "", "server name to send as SNI and verify the certificate for")
+	flag.StringVar(&clientCert, "client-cert", "", "client certificate for mutual TLS: PEM, or a PKCS#12 .p12/.pfx bundle")
+	flag.StringVar(&clientKey, "client-key", "", "PEM key for -client-cert, when not in the same file")
+	flag.StringVar(&clientCertPassword, "client-cert-password", "", "password of a PKCS#12 -client-cert")
+	flag.StringVar(&authMode, "auth-type", "basic", "same as -auth")
+	flag.StringVar(&destUser, "dest-user", "", "provide destination user")
+	flag.StringVar(&destPassword, "dest-password", "", "provide destination password")
+	flag.StringVar(&destAuthType, "dest-auth-type", "basic", "destination auth for -dest-user: basic or digest")
+	flag.StringVar(&authMode, "auth", "basic", "proxy auth: basic, digest or ntlm (user/password, DOMAIN\\user for ntlm), or sspi (logged-in windows user, Negotiate); gssapi for socks5 proxies (kerberos, built in on windows, -gssapi-cmd elsewhere)")
+	flag.StringVar(&gssapiService, "gssapi-service", "rcmd", "service of the socks proxy principal for -auth gssapi, SERVICE/PROXY-HOST")
+	flag.StringVar(&gssapiCmd, "gssapi-cmd", "", "shell command holding the -auth gssapi context, answering init, wrap and unwrap lines on stdout; needed off windows")
+	flag.StringVar(&gssapiProtection, "gssapi-protection", "integrity", "per-message protection after -auth gssapi: integrity, confidentiality or clear")
+	flag.DurationVar(&soak, "soak", 0, "repeat the request for this long, failing if the tool leaks resources")
+	flag.DurationVar(&soakInterval, "soak-interval", 10*time.Second, "delay between requests in soak mode")
+	flag.StringVar(&soakListen, "soak-listen", "", "serve /healthz and /readyz at this address during soak, e.g. :8080 for a Kubernetes Deployment")
+	flag.DurationVar(&soakDrain, "soak-drain", 30*time.Second, "on SIGTERM or SIGINT, how long soak waits for the request in flight before cancelling it")
+	flag.StringVar(&traceSample, "trace-sample", "", "print the phase timing of this share of soak requests, e.g. 1% or 0.01")
+	flag.DurationVar(&hopTimeout, "hop-timeout", 0, "abort when a single redirect hop takes longer than this")
+	flag.IntVar(&retries, "retries", 0, "retry transient failures this many times with jittered exponential backoff")
+	flag.DurationVar(&retryBackoff, "retry-backoff", 200*time.Millisecond, "wait before the first retry, doubled for each following one")
+	flag.StringVar(&retryOn, "retry-on", "502,503,504,network", "comma separated status codes to retry, network for connection errors")
+	flag.StringVar(&fallback, "fallback", "", "direct: connect without the proxy when it cannot be reached, like PAC's 'PROXY x; DIRECT'")
+	flag.StringVar(&credentialsCmd, "credentials-cmd", "", "shell command printing new proxy credentials, USER:PASSWORD or JSON, run when the proxy refuses the current ones")
+	flag.StringVar(&credentialsURL, "credentials-url", "", "URL answering new proxy credentials like -credentials-cmd, fetched directly")
+	flag.IntVar(&maxRedirects, "max-redirects", 10, "follow at most this many redirects, fail beyond")
+	flag.BoolVar(&noFollow, "no-follow", false, "do not follow redirects, report the redirect response itself")
+	flag.DurationVar(&hopBudget, "hop-budget", 0, "latency budget per redirect hop, exit 1 when exceeded")
+	flag.BoolVar(&cacheTest, "cache-test", false, "check the proxy cache (RFC 9111) against the built-in mock origin")
+	flag.StringVar(&originListen, "origin-listen", ":8081", "listen address of the built-in mock origin")
+	flag.StringVar(&originURL, "origin-url", "", "URL the proxy uses to reach the mock origin (default http://HOSTNAME:PORT, http://NAME:PORT with -origin-dns)")
+	flag.StringVar(&originDNS, "origin-dns", "", "answer DNS queries for -origin-name with the mock origin's address on this UDP address, e.g. 127.0.0.1:5353")
+	flag.StringVar(&originName, "origin-name", "origin.test", "name, and the names under it, -origin-dns resolves to the mock origin")
+	flag.StringVar(&oauthTokenURL, "oauth-token-url", "", "fetch a bearer token for the destination from this OAuth2 token endpoint")
+	flag.StringVar(&oauthClientID, "oauth-client-id", "", "OAuth2 client id (client credentials grant)")
+	flag.StringVar(&oauthClientSecret, "oauth-client-secret", "", "OAuth2 client secret")
+	flag.StringVar(&oauthScope, "oauth-scope", "", "OAuth2 scope to request")
+	flag.DurationVar(&oauthSkew, "oauth-skew", 30*time.Second, "refresh the token this long before it expires")
+	flag.StringVar(&dnsLeak, "dns-leak", "", "zone delegated to this host: request fresh names under it through the proxy and report which resolvers asked about them")
+	flag.StringVar(&dnsLeakListen, "dns-leak-listen", ":53", "UDP address -dns-leak answers the zone's DNS queries on")
+	flag.StringVar(&dnsLeakAddr, "dns-leak-addr", "", "address the -dns-leak names resolve to, none by default")
+	flag.BoolVar(&splitDNS, "split-dns", false, "compare the destination as the proxy resolves it with every address the client resolves")
+	flag.DurationVar(&progressEvery, "progress", 0, "print a progress line to stderr this often while the request runs, e.g. 1s; 0 for none")
+	flag.DurationVar(&timeout, "timeout", 0, "give up on the request after this long, redirects and body included; 0 for no limit")
+	flag.DurationVar(&connectTimeout, "connect-timeout", 30*time.Second, "limit for each TCP connect, to the proxy or destination")
+	flag.DurationVar(&tlsTimeout, "tls-timeout", 10*time.Second, "limit for each TLS handshake, with the proxy or destination")
+	flag.DurationVar(&responseHeaderTimeout, "response-header-timeout", 0, "limit for the wait on response headers once the request is sent, and on CONNECT answers with -auth digest or ntlm; 0 for none, a CONNECT gives up after 1m anyway")
+	flag.DurationVar(&watchInterval, "watch-interval", 30*time.Second, "delay between the checks of watch")
+	flag.DurationVar(&watchDrain, "watch-drain", 30*time.Second, "on SIGINT or SIGTERM, how long watch waits for the checks in flight before cancelling them")
+	flag.StringVar(&watchListen, "watch-listen", "", "serve the watch state as JSON on /status and Prometheus metrics on /metrics at this address, with /healthz and /readyz, e.g. :9090")
+	flag.IntVar(&watchWorkers, "watch-workers", 32, "how many checks watch runs at once, the targets with the highest priority tag first")
+	flag.BoolVar(&allowInternal, "allow-internal", false, "let watch check destinations on loopback, private and link-local addresses")
+	flag.StringVar(&watchStore, "watch-store", "", "where watch keeps every check: a file of JSON lines report reads, watch.jsonl under the user config dir by default; memory for this run only; none to keep nothing")
+	flag.BoolVar(&k8sDiscover, "k8s-discover", false, "watch: also check the Services and Ingresses annotated poc-proxy-https/watch=true in the cluster the pod runs in, kept in sync as they change")
+	flag.StringVar(&k8sNamespace, "k8s-namespace", "", "-k8s-discover: look in this namespace only, every namespace the service account may list by default")
+	flag.DurationVar(&k8sResync, "k8s-resync", time.Minute, "-k8s-discover: how often to list the annotated objects again")
+	flag.Int64Var(&seed, "seed", 0, "seed for the run's random choices, as printed by an earlier run, to replay it; 0 picks a fresh one")
+	flag.BoolVar(&keepAlive, "keepalive", true, "reuse connections; false gives every request, CONNECT included, a connection of its own")
+	flag.IntVar(&requestsPerConn, "requests-per-conn", 0, "send this many requests to -dest in a row and report which connections they went out on")
+	flag.DurationVar(&connPause, "conn-pause", 0, "-requests-per-conn: wait this long between the requests, to find the proxy's idle timeout")
+	flag.IntVar(&maxTunnels, "max-tunnels", 0, "open up to this many tunnels at once to find where the proxy refuses or queues them")
+	flag.BoolVar(&connectOnly, "connect-only", false, "open the tunnel to -dest, and the TLS session for https, print the CONNECT response verbatim and send no request")
+	flag.BoolVar(&anonCheck, "anonymity-check", false, "grade the proxy transparent, anonymous or elite from the headers an echo receives, the built-in one unless -dest is given")
+	flag.BoolVar(&compare, "compare", false, "send the request directly and through the proxy and diff the status, headers, body hash and timing")
+	flag.BoolVar(&tlsExts, "tls-extensions", false, "handshake with the https -dest and list the TLS extensions offered and answered, encrypted ones of TLS 1.3 included")
+	flag.BoolVar(&authBypass, "auth-bypass", false, "send the request and a bare CONNECT without credentials too, exit 1 when the proxy lets them through")
+	flag.BoolVar(&dnsRace, "dns-race", false, "resolve A and AAAA in parallel and report connect, TLS and request per address family")
+	flag.StringVar(&iface, "interface", "", "bind outgoing connections to the first address of this interface")
+	flag.StringVar(&sourceIP, "source-ip", "", "bind outgoing connections to this local address")
+	flag.BoolVar(&ipv4Only, "4", false, "connect over IPv4 only, to the proxy or, without one, to the destination")
+	flag.BoolVar(&ipv6Only, "6", false, "connect over IPv6 only, to the proxy or, without one, to the destination")
+	flag.StringVar(&ipv6Src, "ipv6-source", "", "have the kernel pick a temporary (privacy extension) or stable IPv6 source address: temporary or stable, linux only")
+	flag.Var(resolves, "resolve", "connect to ADDR for HOST:PORT, as HOST:PORT:ADDR like curl, repeatable")
+	flag.StringVar(&dnsServer, "dns-server", "", "resolve names with this DNS server, IP or IP:PORT, instead of the system resolver")
+	flag.StringVar(&searchDomains, "search-domains", "", "expand short host names with these comma separated domains, or none (default: system resolver config)")
+	flag.BoolVar(&geo, "geo", false, "report where the request appears to leave the proxy (CDN pop, Content-Language, geolocation API)")
+	flag.StringVar(&geoAPI, "geo-api", "https://ipinfo.io/json", "IP geolocation API queried through the proxy in -geo mode, empty to skip")
+	flag.StringVar(&geoExpect, "geo-expect", "", "comma separated expected country, region, city or pop codes, exit 1 when none matches")
+	flag.StringVar(&recordFixtures, "record-fixtures", "", "save every request/response pair as a JSON fixture in this directory, for mock-origin -fixtures")
+	flag.StringVar(&fixturesDir, "fixtures", "", "mock-origin: replay the -record-fixtures files in this directory")
+	flag.StringVar(&saveCertsDir, "save-certs", "", "write the destination and https proxy certificate chains as PEM files to this directory")
+	flag.StringVar(&showHeaders, "show-headers", "", "print the response headers matching these comma separated globs, !glob to hide, e.g. 'content-*,via,!content-length'")
+	flag.StringVar(&assertStatus, "assert-status", "", "fail unless the status is this, a code or class like 2xx, several separated by commas")
+	flag.Var(&assertHeaders, "assert-header", "fail unless a response header matches, \"Name: regex\", repeatable")
+	flag.StringVar(&assertBody, "assert-body-contains", "", "fail unless the body contains this")
+	flag.DurationVar(&assertLatency, "assert-max-latency", 0, "fail when the response takes longer than this")
+	flag.StringVar(&health, "health", "", "health checks joined by && and ||, e.g. 'status=2xx && latency<500ms && body~ok && cert>14d || status=304', exit 1 when unhealthy")
+	if err := envFlags(); err != nil {
+		fmt.Printf("erro: %s", err)
+		os.Exit(2)
+	}
+
+	args := os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "last":
+			os.Exit(printLastSession())
+		case "serve":
+			os.Exit(runServe(args[1:]))
+		case "completion":
+			os.Exit(runCompletion(args[1:]))
+		case "rerun":
+			last, err := loadSession()
+			if err != nil {
+				fmt.Printf("erro: no saved session: %s\n", err)
+				os.Exit(1)
+			}
+			// flags given to rerun come last and override the saved ones,
+			// the saved seed makes the random choices repeat
+			args = append([]string{}, last.Args...)
+			if hasFlag(os.Args[2:], "dest") {
+				// -dest adds up, so the new ones replace rather than join
+				args = dropFlag(args, "dest")
+			}
+			if last.Seed != 0 {
+				args = append(args, "-seed", strconv.FormatInt(last.Seed, 10))
+			}
+			args = append(args, os.Args[2:]...)
+		}
+	}
+	flagArgs := args
+	if len(args) > 0 && (args[0] == "throughput" || args[0] == "mock-origin" || args[0] == "ws" || args[0] == "conformance" || args[0] == "watch" || args[0] == "report" || args[0] == "tls-matrix" || args[0] == "bench" || args[0] == "run") {
+		command, flagArgs = args[0], args[1:]
+	}
+	recordFlags(flagArgs)
+	flag.CommandLine.Parse(flagArgs)
+	if configFile != "" {
+		if err := loadConfig(configPath(configFile)); err != nil {
+			fmt.Printf("erro: config: %s\n", err)
+			os.Exit(2)
+		}
+	}
+	if err := loadPassword(); err != nil {
+		fmt.Printf("erro: %s\n", err)
+		os.Exit(2)
+	}
+	switch command {
+	case "mock-origin":
+		os.Exit(runMockOrigin())
+	case "report":
+		os.Exit(runReport())
+	}
+	if err := setupRange(); err != nil {
+		fmt.Printf("erro: %s\n", err)
+		os.Exit(2)
+	}
+	if err := setupOutput(); err != nil {
+		fmt.Printf("erro: %s\n", err)
+		os.Exit(2)
+	}
+	if err := loadBody(); err != nil {
+		fmt.Printf("erro: %s\n", err)
+		os.Exit(2)
+	}
+	if err := loadDests(); err != nil {
+		fmt.Printf("erro: %s\n", err)
+		os.Exit(2)
+	}
+	if len(dests.urls) > 1 {
+		urls, err := filterTargets("destinations", dests.urls)
+		if err != nil {
+			fmt.Printf("erro: %s\n", err)
+			os.Exit(2)
+		}
+		dests.urls, dest = urls, urls[0]
+	}
+	if checkpointFile != "" && len(dests.urls) < 2 {
+		fmt.Println("erro: -checkpoint keeps the progress of a batch of destinations, -dest-file or several -dest")
+		os.Exit(2)
+	}
+	if err := loadHeaders(); err != nil {
+		fmt.Printf("erro: %s\n", err)
+		os.Exit(2)
+	}
+	if showHeaders != "" {
+		var err error
+		if headerShow, err = parseHeaderFilter(showHeaders); err != nil {
+			fmt.Printf("erro: %s\n", err)
+			os.Exit(2)
+		}
+	}
+	if health != "" {
+		var err error
+		if healthChecks, err = parseHealth(health); err != nil {
+			fmt.Printf("erro: %s\n", err)
+			os.Exit(2)
+		}
+	}
+	if err := parseAssertions(); err != nil {
+		fmt.Printf("erro: %s\n", err)
+		os.Exit(2)
+	}
+	if err := checkAssertMode(); err != nil {
+		fmt.Printf("erro: %s\n", err)
+		os.Exit(2)
+	}
+	if err := checkTraceSampleMode(); err != nil {
+		fmt.Printf("erro: %s\n", err)
+		os.Exit(2)
+	}
+	if k8sDiscover && command != "watch" {
+		fmt.Println("erro: -k8s-discover finds the destinations of watch")
+		os.Exit(2)
+	}
+	if err := checkBrotli(); err != nil {
+		fmt.Printf("erro: %s\n", err)
+		os.Exit(2)
+	}
+
+	var rateLimit int64
+	if limitRate != "" {
+		var err error
+		if rateLimit, err = parseSize(limitRate); err != nil || rateLimit == 0 {
+			fmt.Println("erro: -limit-rate wants a positive size a second, e.g. 500k")
+			os.Exit(2)
+		}
+	}
+	if bodySample != "" {
+		var err error
+		if sampleMax, err = parseSize(bodySample); err != nil || sampleMax == 0 {
+			fmt.Println("erro: -body-sample wants a positive size, e.g. 64KiB")
+			os.Exit(2)
+		}
+		if streaming() || output != "" {
+			fmt.Println("erro: -body-sample prints no body, it excludes -o, -grep, -head and -decompress")
+			os.Exit(2)
+		}
+	}
+	if maxRedirects < 1 {
+		fmt.Println("erro: -max-redirects must be at least 1, -no-follow stops at the first response")
+		os.Exit(2)
+	}
+	for name, d := range map[string]time.Duration{"timeout": timeout, "connect-timeout": connectTimeout, "tls-timeout": tlsTimeout, "response-header-timeout": responseHeaderTimeout} {
+		if d < 0 {
+			fmt.Printf("erro: -%s must not be negative\n", name)
+			os.Exit(2)
+		}
+	}
+	if forceHTTP2 && !strings.HasPrefix(dest, "https://") {
+		fmt.Println("erro: -http2 needs an https destination, h2 is negotiated with ALPN")
+		os.Exit(2)
+	}
+	if destURL, err := url.Parse(dest); err == nil {
+		var source string
+		switch proxy, source = resolveProxy(destURL); {
+		case proxy == "" && source != "":
+			fmt.Printf("proxy: none, bypassed by %s\n", source)
+		case source != "" && source != "-proxy":
+			fmt.Printf("proxy: %s (from %s)\n", redactURL(proxy), source)
+		}
+	}
+
+	network := ""
+	switch {
+	case ipv4Only && ipv6Only:
+		fmt.Println("erro: -4 and -6 are mutually exclusive")
+		os.Exit(2)
+	case ipv4Only:
+		network = "tcp4"
+	case ipv6Only:
+		network = "tcp6"
+	}
+	cfg := proxyclient.Config{
+		Proxy:         proxy,
+		User:          user,
+		Password:      password,
+		Auth:          authMode,
+		Interface:     iface,
+		SourceIP:      sourceIP,
+		IPv6Source:    ipv6Src,
+		Network:       network,
+		SearchDomains: searchDomains,
+		Resolve:       resolves,
+		DNSServer:     dnsServer,
+		Insecure:      insecure,
+		CAFile:        caCert,
+		TLSServerName: tlsServerName,
+		PinSHA256:     pins,
+
+		ClientCert:         clientCert,
+		ClientKey:          clientKey,
+		ClientCertPassword: clientCertPassword,
+		HopTimeout:         hopTimeout,
+
+		Timeout:               timeout,
+		ConnectTimeout:        connectTimeout,
+		TLSTimeout:            tlsTimeout,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+
+		MaxRedirects: maxRedirects,
+		NoFollow:     noFollow,
+		HTTP2:        forceHTTP2,
+		Fallback:     fallback,
+
+		DisableKeepAlives: !keepAlive,
+		LimitRate:         rateLimit,
+
+		GSSAPIService:    gssapiService,
+		GSSAPIProtection: gssapiProtection,
+	}
+	if jar, err := newCookieJar(); err != nil {
+		fmt.Printf("erro: %s\n", err)
+		os.Exit(2)
+	} else if jar != nil {
+		cfg.Jar = jar
+	}
+	if creds, err := credentialsProvider(); err != nil {
+		fmt.Printf("erro: %s\n", err)
+		os.Exit(2)
+	} else {
+		cfg.Credentials = creds
+	}
+	if gssapiCmd != "" {
+		if authMode != "gssapi" {
+			fmt.Println("erro: -gssapi-cmd is the mechanism of -auth gssapi")
+			os.Exit(2)
+		}
+		cfg.GSSAPI = newCmdGSSAPI
+	}
+	if metricsListen != "" || (command == "watch" && watchListen != "") {
+		promReg = newPromMetrics()
+		cfg.Observe = promReg.observe
+	}
+	if verbose || veryVerbose {
+		cfg.Wire = os.Stderr
+		cfg.WireConns = veryVerbose
+	}
+	if retries > 0 {
+		r, err := parseRetry()
+		if err != nil {
+			fmt.Printf("erro: %s\n", err)
+			os.Exit(2)
+		}
+		r.Seed = streamSeed("retry")
+		cfg.Retry = r
+	}
+	if oauthTokenURL != "" {
+		destURL, err := url.Parse(dest)
+		if err != nil {
+			fmt.Printf("erro: %s", err)
+			os.Exit(2)
+		}
+		cfg.OAuth = &proxyclient.OAuth{
+			TokenURL:     oauthTokenURL,
+			ClientID:     oauthClientID,
+			ClientSecret: oauthClientSecret,
+			Scope:        oauthScope,
+			Skew:         oauthSkew,
+			Host:         destURL.Host,
+		}
+	}
+	if destUser != "" || destPassword != "" {
+		destURL, err := url.Parse(dest)
+		if err != nil {
+			fmt.Printf("erro: %s", err)
+			os.Exit(2)
+		}
+		cfg.DestAuth = &proxyclient.DestAuth{
+			Type:     destAuthType,
+			User:     destUser,
+			Password: destPassword,
+			Host:     destURL.Host,
+		}
+	}
+	client, err := proxyclient.New(cfg)
+	if err != nil {
+		fmt.Printf("erro: %s", err)
+		os.Exit(2)
+	}
+	if err := reportSearch(client); err != nil {
+		fmt.Printf("erro: %s", err)
+		os.Exit(2)
+	}
+	if expvarListen != "" {
+		if err := serveExpvar(client); err != nil {
+			fmt.Printf("erro: %s\n", err)
+			os.Exit(2)
+		}
+	}
+	if metricsListen != "" {
+		if command != "watch" {
+			// watch has a client per proxy and adds those
+			promReg.watch(client)
+		}
+		if err := serveMetrics(metricsListen, promReg); err != nil {
+			fmt.Printf("erro: %s\n", err)
+			os.Exit(2)
+		}
+	}
+	if addr := client.LocalAddr(); addr != nil {
+		fmt.Printf("source: %s\n", addr)
+	}
+
+	run := &session{Args: args, Time: time.Now(), Env: fingerprint()}
+	switch {
+	case command == "throughput":
+		run.ExitCode = runThroughput(client)
+	case command == "bench":
+		run.ExitCode = runBench(client)
+	case command == "ws":
+		run.ExitCode = runWS(client)
+	case command == "conformance":
+		run.ExitCode = runConformance(client, cfg)
+	case command == "watch":
+		run.ExitCode = runWatch(cfg)
+	case command == "tls-matrix":
+		run.ExitCode = runTLSMatrix(cfg)
+	case command == "run":
+		run.ExitCode = runScenario(cfg)
+	case proxyFile != "":
+		run.ExitCode = runProxyFile(cfg)
+	case dnsRace:
+		run.ExitCode = runDNSRace(client, cfg)
+	case splitDNS:
+		run.ExitCode = runSplitDNS(client, cfg)
+	case dnsLeak != "":
+		run.ExitCode = runDNSLeak(client, cfg)
+	case authBypass:
+		run.ExitCode = runAuthBypass(client, cfg)
+	case connectOnly:
+		run.ExitCode = runConnectOnly(client)
+	case tlsExts:
+		run.ExitCode = runTLSExtensions(client)
+	case anonCheck:
+		run.ExitCode = runAnonymityCheck(client, cfg)
+	case compare:
+		run.ExitCode = runCompare(client, cfg)
+	case benchmarkDownload:
+		run.ExitCode = runDownload(client)
+	case requestsPerConn > 0:
+		run.ExitCode = runReuse(client)
+	case maxTunnels > 0:
+		run.ExitCode = runMaxTunnels(client)
+	case cacheTest:
+		run.ExitCode = runCacheTest(client)
+	case soak > 0:
+		run.ExitCode = runSoak(client)
+	case len(dests.urls) > 1:
+		run.ExitCode = runMultiDest(client)
+	default:
+		run.ExitCode = probe(client, run)
+	}
+	saveCookieJar()
+	run.Seed = runSeed
+	if batchDone != nil {
+		run.Batch = batchDone.records()
+	}
+	runReporters(run)
+	os.Exit(run.ExitCode)
+}
+
+// runMode names the mode main runs as picked on the command line: the
+// subcommand or the flag that selects it, "" for a plain request or a
+// -dest batch. It follows the order of the switch in main.
+func runMode() string {
+	switch {
+	case command != "":
+		return command
+	case proxyFile != "":
+		return "-proxy-file"
+	case dnsRace:
+		return "-dns-race"
+	case splitDNS:
+		return "-split-dns"
+	case dnsLeak != "":
+		return "-dns-leak"
+	case authBypass:
+		return "-auth-bypass"
+	case connectOnly:
+		return "-connect-only"
+	case tlsExts:
+		return "-tls-extensions"
+	case anonCheck:
+		return "-anonymity-check"
+	case compare:
+		return "-compare"
+	case benchmarkDownload:
+		return "-benchmark-download"
+	case requestsPerConn > 0:
+		return "-requests-per-conn"
+	case maxTunnels > 0:
+		return "-max-tunnels"
+	case cacheTest:
+		return "-cache-test"
+	case soak > 0:
+		return "-soak"
+	}
+	return ""
+}
 
-	req, _ := http.NewRequest("GET", dest, nil)
-	req.Header.Set("Host", "www.google.com.br")
+func newRequest(target string) (*http.Request, error) {
+	return http.NewRequest("GET", target, nil)
+}
 
-	proxyURL := url.URL{
-		Scheme: "http",
-		Host:   proxy}
+// destRequest builds the request to -dest with -method, the -data body and
+// the -H headers. The body is replayed on redirects that keep the method.
+func destRequest() (*http.Request, error) {
+	return destRequestTo(dest)
+}
 
-	auth := fmt.Sprintf("%s:%s", user, password)
-	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
-	req.Header.Add("Proxy-Authorization", basic)
+// destRequestTo is destRequest for another URL.
+func destRequestTo(u string) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if uploadBytes > 0 {
+		req.Body = newGeneratedBody()
+		req.ContentLength = uploadBytes
+		req.GetBody = func() (io.ReadCloser, error) { return newGeneratedBody(), nil }
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if wantRange != nil {
+		req.Header.Set("Range", wantRange.String())
+	}
+	if ae := acceptEncoding(); ae != "" && reqHeaders.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", ae)
+	}
+	// -H Content-Type replaces the form default
+	if reqHeaders.Get("Content-Type") != "" {
+		req.Header.Del("Content-Type")
+	}
+	setHeaders(req)
+	return req, nil
+}
+
+// setupOutput handles -json, -o and -silent and sets up the reporters.
+// With -o the body is written verbatim to the file, "-" for stdout, and
+// diagnostics move to stderr so stdout carries nothing but the body;
+// -json takes stdout the same way. -silent drops the diagnostics, the exit
+// code still tells the outcome.
+func setupOutput() error {
+	switch format {
+	case "text":
+	case "json":
+		jsonOutput = true
+	default:
+		return fmt.Errorf("-format is text or json, not %q", format)
+	}
+	if jsonOutput {
+		if output == "-" {
+			return fmt.Errorf("-json and -o - both need stdout")
+		}
+		reporters = append(reporters, jsonReporter{w: os.Stdout})
+		os.Stdout = os.Stderr
+	}
+	if harFile != "" {
+		reporters = append(reporters, harReporter{path: harFile})
+	}
+	if recordFixtures != "" {
+		reporters = append(reporters, fixturesReporter{dir: recordFixtures})
+	}
+	reporters = append(reporters, sessionReporter{})
+	switch output {
+	case "":
+	case "-":
+		bodyOut = os.Stdout
+		os.Stdout = os.Stderr
+	default:
+		// -resume opened it to append
+		if resume {
+			break
+		}
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		bodyOut = f
+	}
+	if silent {
+		null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		os.Stdout = null
+	}
+	return nil
+}
 
-	transport := &http.Transport{
-		Proxy:           http.ProxyURL(&proxyURL),
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+// loadBody checks -method and reads the request body from -data or
+// -data-file, "-" for stdin.
+func loadBody() error {
+	method = strings.ToUpper(method)
+	switch method {
+	case "GET", "POST", "PUT", "DELETE", "PATCH", "HEAD", "OPTIONS":
+	default:
+		return fmt.Errorf("unsupported method %q", method)
+	}
+	if err := checkUpload(); err != nil {
+		return err
 	}
-	transport.ProxyConnectHeader = req.Header
-	client := &http.Client{Transport: transport}
-	req.RequestURI = ""
+	if err := checkCompression(); err != nil {
+		return err
+	}
+	switch {
+	case data != "" && dataFile != "":
+		return fmt.Errorf("-data and -data-file are mutually exclusive")
+	case data != "":
+		body = []byte(data)
+	case dataFile == "-":
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		body = b
+	case dataFile != "":
+		b, err := ioutil.ReadFile(dataFile)
+		if err != nil {
+			return err
+		}
+		body = b
+	}
+	return nil
+}
 
-	resp, err := client.Do(req)
+// probe runs the request once, prints the findings and returns the exit
+// code. The outcome is recorded into run.
+func probe(client *proxyclient.Client, run *session) int {
+	run.Result = &proxyclient.Result{URL: dest}
+	req, err := destRequest()
 	if err != nil {
+		run.Error = err.Error()
 		fmt.Printf("erro: %s", err)
-		return
+		return 1
+	}
+	sent := recordBody(req)
+
+	// With an https proxy the transport runs two handshakes per connection,
+	// the first one with the proxy and the second inside the tunnel.
+	var legs []tls.ConnectionState
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
+			if err == nil {
+				legs = append(legs, cs)
+			}
+		},
 	}
-	fmt.Printf("code: %s", resp.StatusCode)
-	htmlData, err := ioutil.ReadAll(resp.Body)
+	var hops []proxyclient.Hop
+	var attempts []proxyclient.Attempt
+	var connectResp *http.Response
+	ctx := proxyclient.WithHops(httptrace.WithClientTrace(req.Context(), trace), &hops)
+	ctx = proxyclient.WithAttempts(ctx, &attempts)
+	if wantExchanges() {
+		var exchanges []proxyclient.Exchange
+		ctx = proxyclient.WithExchanges(ctx, &exchanges)
+		// bodies are done with when probe returns
+		defer func() { run.exchanges = exchanges }()
+	}
+	req = req.WithContext(proxyclient.WithConnectResponse(ctx, &connectResp))
+
+	meter := startProgress()
+	defer meter.end()
+	start := time.Now()
+	resp, res, err := client.Measure(req)
+	run.Duration = time.Since(start)
+	run.Result = res
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		meter.end()
+	} else {
+		meter.body(resp)
+	}
+	if body != nil {
+		run.SentBytes, run.SentSHA256 = sent.n, sent.sum()
+		printSent(sent, int64(len(body)))
+	}
+	if uploadBytes > 0 {
+		run.SentBytes, run.SentSHA256 = sent.n, sent.sum()
+		printSent(sent, uploadBytes)
+		printUpload(sent, resp)
+	}
+	if err != nil {
+		printHops(hops, hopBudget)
+		printAttempts(attempts)
+		printFallback(res)
+		printDialed(client, res)
+		fmt.Printf("timing: %s\n", formatTiming(res))
+		code := 1
+		if connectResp != nil {
+			fmt.Printf("connect: %s\n", connectResp.Status)
+			if proxyclient.IsGatewayError(connectResp.StatusCode) {
+				fmt.Printf("%d generated by proxy: CONNECT refused, origin never reached\n", connectResp.StatusCode)
+			}
+			if connectResp.StatusCode == http.StatusProxyAuthRequired {
+				code = reportProxyAuth(connectResp.Header)
+			}
+		}
+		// crypto/tls does not export the alert type it fails with
+		if forceHTTP2 && strings.Contains(err.Error(), "tls: no application protocol") {
+			fmt.Println("http2: FAIL, h2 refused in the TLS handshake, the destination or a TLS intercepting proxy only speaks HTTP/1.x")
+		}
+		if len(pins) > 0 {
+			reportPinMismatch(client, err)
+		}
+		fmt.Printf("erro: %s", err)
+		if healthChecks != nil {
+			fmt.Println("\nhealth: FAIL")
+		}
+		if assertChecks != nil {
+			fmt.Println("\nassert: FAIL, no response")
+		}
+		return code
+	}
+	overBudget := 0
+	if len(hops) > 1 || hopBudget > 0 || (noFollow && resp.Header.Get("Location") != "") {
+		overBudget = printHops(hops, hopBudget)
+	}
+	printAttempts(attempts)
+	printFallback(res)
+	printDialed(client, res)
+	fmt.Printf("code: %d\n", resp.StatusCode)
+	code := 0
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		code = reportProxyAuth(resp.Header)
+	}
+	if headerShow != nil {
+		printHeaders(headerShow, resp.Header)
+	}
+	var ranged *rangeCheck
+	if wantRange != nil {
+		ranged = checkRange(resp)
+	}
+	var compressed *compressionCheck
+	if compression != "" {
+		compressed = reportCompression(resp)
+	}
+	var proxyLeg *tls.ConnectionState
+	if p := client.ProxyURL(); p != nil && p.Scheme == "https" && res.Fallback == "" && len(legs) > 0 {
+		proxyLeg = &legs[0]
+		printTLS("client<->proxy", proxyLeg)
 	}
+	// for http destinations behind an https proxy resp.TLS is the proxy leg
+	if resp.TLS != nil && resp.Request.URL.Scheme == "https" {
+		printTLS("client<->destination", resp.TLS)
+	}
+	if len(pins) > 0 {
+		reportPin(resp)
+	}
+	if len(trustProfiles) > 0 && reportTrust(resp) != 0 && code == 0 {
+		code = 1
+	}
+	if saveCertsDir != "" && reportSavedCerts(client, resp, proxyLeg) != 0 && code == 0 {
+		code = 1
+	}
+	reportProtocol(client, resp, proxyLeg)
+	var htmlData []byte
+	if streaming() {
+		out := bodyOut
+		if out == nil {
+			out = os.Stdout
+		}
+		// the timing line comes after the body, which is read as it prints
+		htmlData, err = streamBody(resp, out)
+		resp.Body.Close()
+		if err != nil {
+			run.Error = err.Error()
+			fmt.Printf("erro: reading body: %s\n", err)
+			return 1
+		}
+		fmt.Printf("timing: %s\n", formatTiming(res))
+	} else if sampleMax > 0 {
+		var cut bool
+		htmlData, cut, err = sampleBody(resp.Body, sampleMax)
+		// closing a body not read to the end drops the connection
+		resp.Body.Close()
+		if err != nil {
+			run.Error = err.Error()
+			fmt.Printf("erro: reading body: %s\n", err)
+			return 1
+		}
+		fmt.Printf("timing: %s\n", formatTiming(res))
+		printSample(htmlData, cut, resp.ContentLength)
+	} else {
+		htmlData, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			run.Error = err.Error()
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Printf("timing: %s\n", formatTiming(res))
 
-	fmt.Println(os.Stdout, string(htmlData))
+		if bodyOut != nil {
+			if _, err := bodyOut.Write(htmlData); err != nil {
+				run.Error = err.Error()
+				fmt.Printf("erro: writing body: %s\n", err)
+				return 1
+			}
+		} else if htmlText && isHTML(resp, htmlData) {
+			fmt.Println(pageText(htmlData))
+		} else {
+			fmt.Println(string(htmlData))
+		}
+	}
+	if compressed != nil {
+		compressed.done()
+	}
+	if ranged != nil && !ranged.done() && code == 0 {
+		code = 1
+	}
+	if proxyclient.IsGatewayError(resp.StatusCode) {
+		source, evidence := client.ClassifyGatewayError(resp, htmlData)
+		if source == "unknown" {
+			fmt.Printf("%d source unknown: %s\n", resp.StatusCode, evidence)
+		} else {
+			fmt.Printf("%d generated by %s: %s\n", resp.StatusCode, source, evidence)
+		}
+	}
+	if geo && reportGeo(resp, client) != 0 && code == 0 {
+		code = 1
+	}
+	if healthChecks != nil && reportHealth(healthChecks, resp, htmlData, run.Duration) != 0 && code == 0 {
+		code = 1
+	}
+	if assertChecks != nil && reportAssertions(assertChecks, resp, htmlData, run.Duration) != 0 && code == 0 {
+		code = 1
+	}
+	if overBudget > 0 && code == 0 {
+		code = 1
+	}
+	return code
+}
+
+// serveExpvar publishes the client counters under "proxyclient" and serves
+// /debug/vars on -expvar-listen for the rest of the run.
+func serveExpvar(client *proxyclient.Client) error {
+	ln, err := net.Listen("tcp", expvarListen)
+	if err != nil {
+		return err
+	}
+	expvar.Publish("proxyclient", expvar.Func(func() interface{} { return client.Stats() }))
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	go http.Serve(ln, mux)
+	fmt.Printf("expvar: http://%s/debug/vars\n", ln.Addr())
+	return nil
+}
+
+// exitAuthRequired is the exit code for a 407 when no credentials were
+// given, so scripts can tell a missing -user from a failing proxy.
+const exitAuthRequired = 3
+
+// reportProxyAuth explains a 407 from the schemes the proxy offers and
+// returns the exit code.
+func reportProxyAuth(h http.Header) int {
+	challenges := proxyclient.ProxyChallenges(h)
+	var offered []string
+	for _, c := range challenges {
+		if c.Realm != "" {
+			offered = append(offered, fmt.Sprintf("%s (realm %q)", c.Scheme, c.Realm))
+		} else {
+			offered = append(offered, c.Scheme)
+		}
+	}
+	if len(offered) == 0 {
+		offered = []string{"no scheme, Proxy-Authenticate missing"}
+	}
+	if user != "" || password != "" || authMode == "sspi" {
+		fmt.Printf("proxy auth: credentials rejected, proxy offers %s\n", strings.Join(offered, ", "))
+		return 1
+	}
+	fmt.Printf("proxy auth: required but no credentials given, proxy offers %s\n", strings.Join(offered, ", "))
+	for _, c := range challenges {
+		switch strings.ToLower(c.Scheme) {
+		case "basic":
+			fmt.Println("proxy auth: pass -user USER -password PASSWORD, or set POC_PROXY_HTTPS_USER and POC_PROXY_HTTPS_PASSWORD")
+		case "negotiate", "ntlm":
+			fmt.Println("proxy auth: on Windows pass -auth sspi to authenticate as the logged-in user")
+		}
+	}
+	return exitAuthRequired
+}
+
+// cmdLineFlags are the flags given on the command line, as opposed to the
+// environment or -config.
+var cmdLineFlags = map[string]bool{}
+
+// recordFlags notes in cmdLineFlags the flags args sets, without setting
+// them: args are parsed into stand-ins of the flags that only record.
+func recordFlags(args []string) {
+	fs := flag.NewFlagSet("record", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	flag.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		fs.Var(recordedFlag{name: f.Name, isBool: ok && b.IsBoolFlag()}, f.Name, "")
+	})
+	// the real parse reports the errors
+	fs.Parse(args)
+}
+
+// recordedFlag stands in for a flag in recordFlags.
+type recordedFlag struct {
+	name   string
+	isBool bool
+}
+
+func (f recordedFlag) String() string { return "" }
+
+func (f recordedFlag) Set(string) error {
+	cmdLineFlags[f.name] = true
+	return nil
+}
+
+func (f recordedFlag) IsBoolFlag() bool { return f.isBool }
+
+// envFlags sets every flag from POC_PROXY_HTTPS_<NAME> when present, e.g.
+// POC_PROXY_HTTPS_SOAK_INTERVAL=30s. Flags on the command line still win.
+func envFlags() error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		name := "POC_PROXY_HTTPS_" + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		v, ok := os.LookupEnv(name)
+		if !ok || err != nil {
+			return
+		}
+		if e := flag.Set(f.Name, v); e != nil {
+			err = fmt.Errorf("%s: %s", name, e)
+		}
+	})
+	dests.fromEnv = len(dests.urls) > 0
+	return err
+}
+
+// printFallback labels a request -fallback sent without the proxy.
+func printFallback(res *proxyclient.Result) {
+	if res.Fallback != "" {
+		fmt.Printf("fallback: DIRECT, not through the proxy, it was unreachable: %s\n", res.Fallback)
+	}
+}
+
+// reportProtocol prints the protocol negotiated on each leg and flags a
+// downgrade when h2 was offered but the response came back over HTTP/1.x.
+func reportProtocol(client *proxyclient.Client, resp *http.Response, proxyLeg *tls.ConnectionState) {
+	if resp.TLS == nil || resp.Request.URL.Scheme != "https" {
+		// plain http destination, the proxy forwards it and h2 is never offered
+		fmt.Printf("proto: %s\n", resp.Proto)
+		return
+	}
+	proxyALPN := "http, no alpn"
+	if proxyLeg != nil {
+		proxyALPN = "https, alpn: " + alpnOrNone(proxyLeg.NegotiatedProtocol)
+	}
+	fmt.Printf("proto: %s (proxy leg: %s; destination leg alpn: %s)\n",
+		resp.Proto, proxyALPN, alpnOrNone(resp.TLS.NegotiatedProtocol))
+	if resp.ProtoMajor == 2 {
+		if forceHTTP2 {
+			fmt.Println("http2: OK, h2 end to end with the destination")
+		}
+		return
+	}
+	fmt.Printf("downgrade: requested h2, got %s, refused by %s\n", resp.Proto, client.DowngradeHop(resp))
+}
+
+// printHops prints the redirect chain and returns how many hops went over
+// the latency budget.
+func printHops(hops []proxyclient.Hop, budget time.Duration) int {
+	over := 0
+	for i, h := range hops {
+		mark := ""
+		if budget > 0 && h.Duration > budget {
+			mark = " over budget"
+			over++
+		}
+		via := "direct"
+		if h.Proxied {
+			via = "via proxy"
+		}
+		if h.Err != nil {
+			fmt.Printf("hop %d: erro %s %s %s%s: %s\n", i+1, h.URL, via, dur(h.Duration), mark, h.Err)
+			continue
+		}
+		if h.Location != "" {
+			mark += " -> " + h.Location
+		}
+		fmt.Printf("hop %d: %d %s %s %s%s\n", i+1, h.Status, h.URL, via, dur(h.Duration), mark)
+	}
+	return over
+}
+
+// printTLS prints version, cipher and the peer chain of one TLS session.
+func printTLS(leg string, cs *tls.ConnectionState) {
+	fmt.Printf("tls %s: %s %s alpn: %s\n", leg, tls.VersionName(cs.Version),
+		tls.CipherSuiteName(cs.CipherSuite), alpnOrNone(cs.NegotiatedProtocol))
+	for i, c := range cs.PeerCertificates {
+		fmt.Printf("  %d s:%s\n    i:%s\n", i, c.Subject, c.Issuer)
+	}
+}
+
+func alpnOrNone(p string) string {
+	if p == "" {
+		return "none"
+	}
+	return p
+}
+
+// reportSearch prints the FQDN of the names this client resolves itself, the
+// proxy or the destination when there is none. A proxied destination is
+// resolved by the proxy, so only an explicit -search-domains list rewrites
+// it, to keep the proxy's own search list out of the way.
+func reportSearch(client *proxyclient.Client) error {
+	expand := func(what, host string) string {
+		fqdn := client.FQDN(context.Background(), host)
+		switch {
+		case fqdn == "":
+			fmt.Printf("fqdn: %s %s does not resolve here\n", what, host)
+		case searchDomains != "" || strings.TrimSuffix(fqdn, ".") != host:
+			fmt.Printf("fqdn: %s %s -> %s\n", what, host, fqdn)
+		}
+		return fqdn
+	}
+
+	destURL, err := url.Parse(dest)
+	if err != nil {
+		return err
+	}
+	p := client.ProxyURL()
+	if p == nil {
+		expand("destination", destURL.Hostname())
+		return nil
+	}
+	expand("proxy", p.Hostname())
+	if searchDomains == "" || searchDomains == "none" {
+		return nil
+	}
+	if fqdn := expand("destination", destURL.Hostname()); fqdn != "" {
+		destURL.Host = strings.TrimSuffix(fqdn, ".")
+		if port := destURL.Port(); port != "" {
+			destURL.Host = net.JoinHostPort(destURL.Host, port)
+		}
+		dest = destURL.String()
+	}
+	return nil
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// promBuckets are the upper bounds of the latency histogram, in seconds.
+var promBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// promLabel escapes a Prometheus label value.
+var promLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promKey labels a series: the proxy, "" for none, the destination and
+// the target tags, formatTags rendered.
+type promKey struct {
+	proxy, dest, tags string
+}
+
+type promSeries struct {
+	tags    map[string]string
+	codes   map[string]int64 // status code or "error"
+	errors  map[string]int64 // by ErrorClass
+	buckets []int64
+	sum     float64
+	count   int64
+}
+
+// promMetrics collects requests for /metrics: counts by code, errors by
+// class and a latency histogram per proxy and destination, and the
+// counters of the clients it watches.
+type promMetrics struct {
+	mu      sync.Mutex
+	series  map[promKey]*promSeries
+	clients []*proxyclient.Client
+
+	// hostTags are the tags of the destinations by host, made on first
+	// use
+	hostTags map[string]map[string]string
+}
+
+func newPromMetrics() *promMetrics {
+	return &promMetrics{series: map[promKey]*promSeries{}}
+}
+
+// observe is the clients' Config.Observe.
+func (m *promMetrics) observe(o proxyclient.Observation) {
+	m.observeTagged(o, nil)
+}
+
+// observeTagged counts o with tags, a watched proxy's, and those of its
+// destination.
+func (m *promMetrics) observeTagged(o proxyclient.Observation, tags map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.hostTags == nil {
+		m.hostTags = map[string]map[string]string{}
+		for _, d := range dests.urls {
+			if u, err := url.Parse(d); err == nil && len(targetTags[d]) > 0 {
+				m.hostTags[u.Host] = mergeTags(m.hostTags[u.Host], targetTags[d])
+			}
+		}
+	}
+	tags = mergeTags(m.hostTags[o.Host], tags)
+	k := promKey{o.Proxy, o.Host, formatTags(tags)}
+	s := m.series[k]
+	if s == nil {
+		s = &promSeries{tags: tags, codes: map[string]int64{}, errors: map[string]int64{}, buckets: make([]int64, len(promBuckets))}
+		m.series[k] = s
+	}
+	if o.ErrorClass != "" {
+		s.codes["error"]++
+		s.errors[o.ErrorClass]++
+	} else {
+		s.codes[strconv.Itoa(o.Status)]++
+	}
+	secs := o.Duration.Seconds()
+	for i, b := range promBuckets {
+		if secs <= b {
+			s.buckets[i]++
+		}
+	}
+	s.sum += secs
+	s.count++
+}
+
+// watch adds c's counters to the output.
+func (m *promMetrics) watch(c *proxyclient.Client) {
+	m.mu.Lock()
+	m.clients = append(m.clients, c)
+	m.mu.Unlock()
+}
+
+// write renders the metrics in the Prometheus text format.
+func (m *promMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]promKey, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].proxy != keys[j].proxy {
+			return keys[i].proxy < keys[j].proxy
+		}
+		if keys[i].dest != keys[j].dest {
+			return keys[i].dest < keys[j].dest
+		}
+		return keys[i].tags < keys[j].tags
+	})
+	// every series has every tag as a label, empty where it lacks it
+	seen := map[string]bool{}
+	var tagLabels []string
+	for _, s := range m.series {
+		for k := range s.tags {
+			if !seen[k] {
+				seen[k] = true
+				tagLabels = append(tagLabels, k)
+			}
+		}
+	}
+	sort.Strings(tagLabels)
+	labels := func(k promKey) string {
+		l := fmt.Sprintf(`proxy="%s",dest="%s"`, promLabel.Replace(k.proxy), promLabel.Replace(k.dest))
+		for _, t := range tagLabels {
+			l += fmt.Sprintf(`,%s="%s"`, t, promLabel.Replace(m.series[k].tags[t]))
+		}
+		return l
+	}
+
+	fmt.Fprintf(w, "# HELP poc_proxy_https_requests_total Requests by response code, error for those without a response.\n# TYPE poc_proxy_https_requests_total counter\n")
+	for _, k := range keys {
+		for _, code := range sortedKeys(m.series[k].codes) {
+			fmt.Fprintf(w, "poc_proxy_https_requests_total{%s,code=\"%s\"} %d\n", labels(k), code, m.series[k].codes[code])
+		}
+	}
+	fmt.Fprintf(w, "# HELP poc_proxy_https_errors_total Requests without a response, by error class.\n# TYPE poc_proxy_https_errors_total counter\n")
+	for _, k := range keys {
+		for _, class := range sortedKeys(m.series[k].errors) {
+			fmt.Fprintf(w, "poc_proxy_https_errors_total{%s,class=\"%s\"} %d\n", labels(k), class, m.series[k].errors[class])
+		}
+	}
+	fmt.Fprintf(w, "# HELP poc_proxy_https_request_duration_seconds Time to the response headers or the error.\n# TYPE poc_proxy_https_request_duration_seconds histogram\n")
+	for _, k := range keys {
+		s := m.series[k]
+		for i, b := range promBuckets {
+			fmt.Fprintf(w, "poc_proxy_https_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels(k), b, s.buckets[i])
+		}
+		fmt.Fprintf(w, "poc_proxy_https_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels(k), s.count)
+		fmt.Fprintf(w, "poc_proxy_https_request_duration_seconds_sum{%s} %g\n", labels(k), s.sum)
+		fmt.Fprintf(w, "poc_proxy_https_request_duration_seconds_count{%s} %d\n", labels(k), s.count)
+	}
+
+	if len(m.clients) == 0 {
+		return
+	}
+	var total proxyclient.Stats
+	for _, c := range m.clients {
+		s := c.Stats()
+		total.RoundTrips += s.RoundTrips
+		total.Retries += s.Retries
+		total.Dials += s.Dials
+		total.DialErrors += s.DialErrors
+		total.OpenConns += s.OpenConns
+		total.BytesRead += s.BytesRead
+		total.BytesWritten += s.BytesWritten
+	}
+	for _, c := range []struct {
+		name, kind, help string
+		value            int64
+	}{
+		{"round_trips_total", "counter", "Requests sent, redirect hops and retries included.", total.RoundTrips},
+		{"retries_total", "counter", "Round trips sent again by the retry policy.", total.Retries},
+		{"dials_total", "counter", "Connections opened.", total.Dials},
+		{"dial_errors_total", "counter", "Connections that failed to open.", total.DialErrors},
+		{"open_connections", "gauge", "Connections open now.", total.OpenConns},
+		{"read_bytes_total", "counter", "Bytes read on the wire.", total.BytesRead},
+		{"written_bytes_total", "counter", "Bytes written on the wire.", total.BytesWritten},
+	} {
+		name := "poc_proxy_https_client_" + c.name
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, c.help, name, c.kind, name, c.value)
+	}
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *promMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+// serveMetrics serves m on /metrics at addr for the rest of the run.
+func serveMetrics(addr string, m *promMetrics) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go http.Serve(ln, mux)
+	fmt.Printf("metrics: http://%s/metrics\n", ln.Addr())
+	return nil
+}
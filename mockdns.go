@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// originBase is the URL the proxy reaches the mock origin listening on
+// ln at: -origin-url, else http://NAME:PORT with -origin-dns, else
+// http://HOSTNAME:PORT.
+func originBase(ln net.Listener) string {
+	if originURL != "" {
+		return strings.TrimSuffix(originURL, "/")
+	}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	host, _ := os.Hostname()
+	if originDNS != "" {
+		host = originName
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// startOriginDNS serves -origin-name and the names under it on the UDP
+// -origin-dns for the rest of the run, answering with the address of the
+// mock origin on ln: its listen address, or when it listens on all of
+// them the one the host name resolves to, loopback at worst. Pointing the
+// proxy's resolver, and -dns-server for direct runs, at it has the
+// self-tests reach the origin by name, CONNECT included, without editing
+// /etc/hosts. Other names are refused.
+func startOriginDNS(ln net.Listener) error {
+	if originDNS == "" {
+		return nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(originName, "."))
+	if name == "" {
+		return fmt.Errorf("-origin-name is empty")
+	}
+	ip := originIP(ln)
+	lookup := func(q string) ([]net.IP, bool) {
+		if q != name && !strings.HasSuffix(q, "."+name) {
+			return nil, false
+		}
+		return []net.IP{ip}, true
+	}
+	s, err := listenZone(originDNS, lookup, nil)
+	if err != nil {
+		return fmt.Errorf("-origin-dns: %s", err)
+	}
+	fmt.Printf("mock-origin: dns on %s answers %s and *.%s with %s\n", s.Addr(), name, name, ip)
+	return nil
+}
+
+func originIP(ln net.Listener) net.IP {
+	if a, ok := ln.Addr().(*net.TCPAddr); ok && !a.IP.IsUnspecified() {
+		return a.IP
+	}
+	if host, err := os.Hostname(); err == nil {
+		if addrs, err := net.LookupIP(host); err == nil && len(addrs) > 0 {
+			for _, ip := range addrs {
+				if ip.To4() != nil && !ip.IsLoopback() {
+					return ip
+				}
+			}
+			return addrs[0]
+		}
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
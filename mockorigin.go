@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// mockOrigin is a small origin server the tool runs itself, so behaviour
+// behind the proxy can be checked against known responses. It counts the
+// requests that actually reach it per URL.
+type mockOrigin struct {
+	mu   sync.Mutex
+	hits map[string][]*http.Request
+	mux  *http.ServeMux
+	// fixtures, when loaded, answer before the built-in endpoints
+	fixtures *fixtureSet
+}
+
+func newMockOrigin() *mockOrigin {
+	o := &mockOrigin{hits: map[string][]*http.Request{}, mux: http.NewServeMux()}
+	o.mux.HandleFunc("/cache/max-age", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		fmt.Fprintf(w, "fresh %d\n", o.count(r))
+	})
+	o.mux.HandleFunc("/cache/no-store", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		fmt.Fprintf(w, "no-store %d\n", o.count(r))
+	})
+	o.mux.HandleFunc("/cache/etag", func(w http.ResponseWriter, r *http.Request) {
+		o.count(r)
+		w.Header().Set("Cache-Control", "public, max-age=0, must-revalidate")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprintln(w, "etag v1")
+	})
+	o.mux.HandleFunc("/cache/vary", func(w http.ResponseWriter, r *http.Request) {
+		o.count(r)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprintf(w, "lang %s\n", r.Header.Get("Accept-Language"))
+	})
+	// the conformance endpoint answers with hop-by-hop headers a proxy
+	// has to drop, and TRACE with the request as received
+	o.mux.HandleFunc("/conformance/", func(w http.ResponseWriter, r *http.Request) {
+		o.count(r)
+		w.Header().Set("Connection", "X-Conformance-Hop")
+		w.Header().Set("X-Conformance-Hop", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method == "TRACE" {
+			w.Header().Set("Content-Type", "message/http")
+			r.Header.Write(w)
+			return
+		}
+		fmt.Fprintln(w, "conformance")
+	})
+	// headers echoes the request in httpbin's format, for the anonymity
+	// level of -proxy-file
+	o.mux.HandleFunc("/headers", func(w http.ResponseWriter, r *http.Request) {
+		o.count(r)
+		echo := headerEcho{Headers: map[string]string{"Host": r.Host}}
+		echo.Origin, _, _ = net.SplitHostPort(r.RemoteAddr)
+		for k, v := range r.Header {
+			echo.Headers[k] = strings.Join(v, ", ")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(echo)
+	})
+	// speed endpoints are not counted, they would only pile up requests
+	o.mux.HandleFunc("/speed/down", speedDown)
+	o.mux.HandleFunc("/speed/up", speedUp)
+	return o
+}
+
+// speedChunk is random so a compressing proxy cannot inflate the numbers.
+var speedChunk = func() []byte {
+	b := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(b)
+	return b
+}()
+
+// speedDown streams ?bytes=N bytes, or until the client goes away.
+func speedDown(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.ParseInt(r.URL.Query().Get("bytes"), 10, 64)
+	if err != nil || n <= 0 {
+		n = 1 << 50
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	for n > 0 {
+		chunk := speedChunk
+		if n < int64(len(chunk)) {
+			chunk = chunk[:n]
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return
+		}
+		n -= int64(len(chunk))
+	}
+}
+
+// speedUp discards the request body and answers with its size.
+func speedUp(w http.ResponseWriter, r *http.Request) {
+	n, _ := io.Copy(ioutil.Discard, r.Body)
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(w, "%d\n", n)
+}
+
+// runMockOrigin implements `mock-origin`: it serves the mock origin on
+// -origin-listen until killed, to be the far end of `throughput` or of a
+// cache test run elsewhere, replaying -fixtures when given.
+func runMockOrigin() int {
+	o := newMockOrigin()
+	if fixturesDir != "" {
+		var err error
+		if o.fixtures, err = loadFixtures(fixturesDir); err != nil {
+			fmt.Printf("erro: %s\n", err)
+			return 2
+		}
+		fmt.Printf("mock-origin: replaying %d fixtures from %s\n", o.fixtures.len(), fixturesDir)
+	}
+	ln, err := net.Listen("tcp", originListen)
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 1
+	}
+	if err := startOriginDNS(ln); err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 2
+	}
+	fmt.Printf("mock-origin: listening on %s\n", originListen)
+	err = http.Serve(ln, o)
+	fmt.Printf("erro: %s\n", err)
+	return 1
+}
+
+func (o *mockOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if o.fixtures != nil && o.fixtures.serve(w, r) {
+		o.count(r)
+		return
+	}
+	o.mux.ServeHTTP(w, r)
+}
+
+// count records r and returns how many requests reached its URL so far.
+func (o *mockOrigin) count(r *http.Request) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	key := r.URL.RequestURI()
+	o.hits[key] = append(o.hits[key], r)
+	return len(o.hits[key])
+}
+
+// requests returns the requests that reached the origin for uri.
+func (o *mockOrigin) requests(uri string) []*http.Request {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.hits[uri]
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// pinList collects repeated -pin-sha256 flags, each one pin or several
+// separated by commas.
+type pinList []string
+
+func (l *pinList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *pinList) Set(v string) error {
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			*l = append(*l, p)
+		}
+	}
+	return nil
+}
+
+// reportPin prints which certificate of the destination chain matched
+// -pin-sha256.
+func reportPin(resp *http.Response) {
+	if resp.TLS == nil || resp.Request.URL.Scheme != "https" {
+		fmt.Println("pin: not checked, the destination is not https")
+		return
+	}
+	want := map[string]bool{}
+	for _, p := range pins {
+		want["sha256//"+strings.TrimPrefix(p, "sha256//")] = true
+	}
+	certs := resp.TLS.PeerCertificates[:1:1]
+	for _, chain := range resp.TLS.VerifiedChains {
+		certs = append(certs, chain...)
+	}
+	for _, cert := range certs {
+		if pin := proxyclient.SPKISHA256(cert); want[pin] {
+			fmt.Printf("pin: OK, %s %s\n", cert.Subject, pin)
+			return
+		}
+	}
+}
+
+// reportPinMismatch explains a handshake -pin-sha256 failed.
+func reportPinMismatch(client *proxyclient.Client, err error) {
+	var pe *proxyclient.PinError
+	if !errors.As(err, &pe) {
+		return
+	}
+	who := "something on the path"
+	if client.ProxyURL() != nil {
+		who = "the proxy, most likely,"
+	}
+	fmt.Printf("pin: FAIL, the destination presented none of the pinned keys, issued by %s: %s intercepts TLS, or the key was replaced\n", pe.Issuer, who)
+	for i, p := range pe.Presented {
+		fmt.Printf("  %d %s\n", i, p)
+	}
+}
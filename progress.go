@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressEvery is -progress, the interval of the progress lines of a
+// probe; 0 for none.
+var progressEvery time.Duration
+
+// progressMeter prints a line to stderr every progressEvery while the
+// request runs: how long it has waited for the response, then how much
+// of the body arrived and how fast. A nil meter does nothing.
+type progressMeter struct {
+	start time.Time
+	// read counts the body bytes, -1 until the response arrives
+	read  int64
+	total int64
+	// began is when the response arrived, as time since start
+	began int64
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// startProgress starts the meter of a request sent now, nil without
+// -progress.
+func startProgress() *progressMeter {
+	if progressEvery <= 0 {
+		return nil
+	}
+	p := &progressMeter{start: time.Now(), read: -1, total: -1, stop: make(chan struct{}), done: make(chan struct{})}
+	go p.run()
+	return p
+}
+
+func (p *progressMeter) run() {
+	defer close(p.done)
+	t := time.NewTicker(progressEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+		}
+		elapsed := time.Since(p.start).Round(time.Millisecond)
+		read := atomic.LoadInt64(&p.read)
+		if read < 0 {
+			fmt.Fprintf(os.Stderr, "progress: %s, no response yet\n", dur(elapsed))
+			continue
+		}
+		line := fmt.Sprintf("progress: %s, %s", dur(elapsed), size(read))
+		if total := atomic.LoadInt64(&p.total); total > 0 {
+			line += fmt.Sprintf(" of %s (%d%%)", size(total), read*100/total)
+		}
+		if s := (time.Since(p.start) - time.Duration(atomic.LoadInt64(&p.began))).Seconds(); s > 0 {
+			line += fmt.Sprintf(", %s/s", size(int64(float64(read)/s)))
+		}
+		fmt.Fprintln(os.Stderr, line)
+	}
+}
+
+// body has the meter count the body of resp as it is read, and stop when
+// it is closed.
+func (p *progressMeter) body(resp *http.Response) {
+	if p == nil {
+		return
+	}
+	atomic.StoreInt64(&p.began, int64(time.Since(p.start)))
+	atomic.StoreInt64(&p.total, resp.ContentLength)
+	atomic.StoreInt64(&p.read, 0)
+	resp.Body = &progressBody{ReadCloser: resp.Body, p: p}
+}
+
+// end stops the meter, once it printed its last line.
+func (p *progressMeter) end() {
+	if p == nil {
+		return
+	}
+	p.stopOnce.Do(func() { close(p.stop) })
+	<-p.done
+}
+
+type progressBody struct {
+	io.ReadCloser
+	p *progressMeter
+}
+
+func (b *progressBody) Read(buf []byte) (int, error) {
+	n, err := b.ReadCloser.Read(buf)
+	atomic.AddInt64(&b.p.read, int64(n))
+	return n, err
+}
+
+func (b *progressBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.p.end()
+	return err
+}
@@ -0,0 +1,46 @@
+package proxyclient
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// from linux/in6.h, RFC 5014
+const (
+	ipv6AddrPreferences = 72
+	ipv6PreferSrcTmp    = 0x0001
+	ipv6PreferSrcPublic = 0x0002
+)
+
+// setIPv6Source makes d's IPv6 sockets ask the kernel for a temporary
+// (privacy extension) or a stable source address.
+func setIPv6Source(d *net.Dialer, pref string) error {
+	var flags int
+	switch pref {
+	case "":
+		return nil
+	case "temporary":
+		flags = ipv6PreferSrcTmp
+	case "stable":
+		flags = ipv6PreferSrcPublic
+	default:
+		return fmt.Errorf("unknown ipv6 source %q, want temporary or stable", pref)
+	}
+	d.Control = func(network, address string, c syscall.RawConn) error {
+		if network != "tcp6" {
+			return nil
+		}
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6AddrPreferences, flags)
+		}); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return fmt.Errorf("ipv6 source %s: %s", pref, err)
+		}
+		return nil
+	}
+	return nil
+}
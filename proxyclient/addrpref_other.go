@@ -0,0 +1,17 @@
+//go:build !linux
+
+package proxyclient
+
+import (
+	"fmt"
+	"net"
+)
+
+// setIPv6Source needs RFC 5014 source address preferences, which only
+// Linux takes per socket.
+func setIPv6Source(d *net.Dialer, pref string) error {
+	if pref == "" {
+		return nil
+	}
+	return fmt.Errorf("ipv6 source selection is only supported on linux")
+}
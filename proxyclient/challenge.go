@@ -0,0 +1,75 @@
+package proxyclient
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Challenge is one auth scheme offered in a Proxy-Authenticate header.
+type Challenge struct {
+	Scheme string
+	Realm  string
+}
+
+// ProxyChallenges parses the Proxy-Authenticate headers of a 407. A header
+// may carry several challenges separated by commas, as may their params.
+func ProxyChallenges(h http.Header) []Challenge {
+	var out []Challenge
+	for _, v := range h.Values("Proxy-Authenticate") {
+		for _, c := range splitChallenges(v) {
+			scheme, params, _ := strings.Cut(c, " ")
+			out = append(out, Challenge{Scheme: scheme, Realm: authParams(params)["realm"]})
+		}
+	}
+	return out
+}
+
+// splitChallenges splits a Proxy-Authenticate value into its challenges,
+// each its scheme and what follows. A comma inside a quoted string belongs
+// to the param, a new challenge starts only at "token SP" outside quotes,
+// a token not followed by "=".
+func splitChallenges(v string) []string {
+	var out []string
+	for _, e := range listElements(v) {
+		e = strings.TrimSpace(e)
+		switch {
+		case e == "":
+		case startsChallenge(e):
+			out = append(out, e)
+		case len(out) > 0:
+			out[len(out)-1] += ", " + e
+		}
+	}
+	return out
+}
+
+// listElements splits v at the commas outside quoted strings.
+func listElements(v string) []string {
+	var out []string
+	quoted, from := false, 0
+	for i := 0; i < len(v); i++ {
+		switch {
+		case quoted && v[i] == '\\':
+			i++
+		case v[i] == '"':
+			quoted = !quoted
+		case !quoted && v[i] == ',':
+			out = append(out, v[from:i])
+			from = i + 1
+		}
+	}
+	return append(out, v[from:])
+}
+
+// startsChallenge reports whether the list element e is a scheme, alone or
+// followed by a space and its params or token68, rather than a param.
+func startsChallenge(e string) bool {
+	end := strings.IndexAny(e, " \t=")
+	if end < 0 {
+		return true
+	}
+	if e[end] == '=' {
+		return false
+	}
+	return !strings.HasPrefix(strings.TrimLeft(e[end:], " \t"), "=")
+}
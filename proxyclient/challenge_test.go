@@ -0,0 +1,52 @@
+package proxyclient
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestProxyChallenges(t *testing.T) {
+	tests := []struct {
+		headers []string
+		want    []Challenge
+	}{
+		{
+			[]string{`Basic realm="corp"`},
+			[]Challenge{{"Basic", "corp"}},
+		},
+		{
+			[]string{`Digest realm="x", qop="auth, auth-int", nonce="abc", Basic realm="y"`},
+			[]Challenge{{"Digest", "x"}, {"Basic", "y"}},
+		},
+		{
+			[]string{`Digest realm="a, b", nonce="n", algorithm=MD5`, `Negotiate`, `NTLM`},
+			[]Challenge{{"Digest", "a, b"}, {"Negotiate", ""}, {"NTLM", ""}},
+		},
+		{
+			[]string{`Basic realm = "spaced", NTLM TlRMTVNTUAACAAAA==`},
+			[]Challenge{{"Basic", "spaced"}, {"NTLM", ""}},
+		},
+		{
+			[]string{`Digest realm="say \"hi\", then go", nonce="n"`},
+			[]Challenge{{"Digest", `say "hi", then go`}},
+		},
+	}
+	for _, tt := range tests {
+		h := http.Header{"Proxy-Authenticate": tt.headers}
+		if got := ProxyChallenges(h); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ProxyChallenges(%q) = %v, want %v", tt.headers, got, tt.want)
+		}
+	}
+}
+
+func TestChallengeValue(t *testing.T) {
+	h := http.Header{"Proxy-Authenticate": {`Basic realm="y", Digest realm="x", qop="auth, auth-int", nonce="abc"`}}
+	got, ok := challengeValue(h, "digest")
+	if want := `Digest realm="x", qop="auth, auth-int", nonce="abc"`; !ok || got != want {
+		t.Errorf("challengeValue = %q, %v, want %q", got, ok, want)
+	}
+	if p := authParams(got[len("Digest"):]); p["qop"] != "auth, auth-int" || p["nonce"] != "abc" {
+		t.Errorf("authParams = %v", p)
+	}
+}
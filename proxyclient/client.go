@@ -0,0 +1,481 @@
+// Package proxyclient is an HTTP client for testing proxies: it sends the
+// proxy credentials on CONNECT as well as on plain requests, offers h2 so
+// downgrades show, and records per hop timings and CONNECT failures for
+// diagnosis.
+package proxyclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config describes how a Client reaches destinations.
+type Config struct {
+	// Proxy is IP:PORT or a URL, https:// for a TLS connection to the
+	// proxy itself, socks5:// or socks5h:// (names resolved by the proxy)
+	// for a SOCKS proxy. Empty connects directly.
+	Proxy    string
+	User     string
+	Password string
+	// Auth is the proxy auth scheme: "basic" (default), "digest", "ntlm"
+	// or "sspi" for Negotiate as the logged-in Windows user; "gssapi" for
+	// SOCKS5 proxies.
+	Auth string
+	// GSSAPI creates the security context for Auth "gssapi", by default
+	// Kerberos as the logged-in user, only built in on Windows.
+	// GSSAPIService names the proxy's principal, service/proxy-host,
+	// "rcmd" by default. GSSAPIProtection is "integrity" (default),
+	// "confidentiality" or "clear" for the tunneled bytes.
+	GSSAPI           func() (GSSAPI, error)
+	GSSAPIService    string
+	GSSAPIProtection string
+	// Credentials, when set, is asked for a new User and Password when
+	// the proxy turns the current ones down, with a 407 or a failed SOCKS
+	// authentication, and the request is sent once more with them. It
+	// gets the proxy's host:port; concurrent refusals share one call.
+	Credentials func(ctx context.Context, proxy string) (user, password string, err error)
+
+	// Interface or SourceIP bind the local end of outgoing connections.
+	Interface string
+	SourceIP  string
+	// IPv6Source is "temporary" or "stable" to have the kernel pick a
+	// privacy extension or a stable IPv6 source address, when neither
+	// Interface nor SourceIP bind one. Linux only.
+	IPv6Source string
+	// Network is "tcp4" or "tcp6" to connect over that address family
+	// only, to the proxy or, without one, to the destination; "" for
+	// either.
+	Network string
+	// SearchDomains is "" for the system search list, "none" or a comma
+	// separated list of domains used to expand short host names.
+	SearchDomains string
+	// Resolve pins host:port to another address, e.g. an IP:port, for
+	// every connection the client makes to it.
+	Resolve map[string]string
+	// LimitRate caps the bytes a second the client reads, and separately
+	// writes, over all its connections together, TLS handshakes
+	// included, like a slow client; 0 for no limit.
+	LimitRate int64
+	// DNSServer, IP or IP:port, answers the names the client resolves
+	// itself instead of the system resolver. With a proxy that is the
+	// proxy's name, the destination's is the proxy's to resolve.
+	DNSServer string
+	// DenyInternal refuses destinations, redirects included, that are or
+	// resolve to internal addresses, see CheckDestination, before the
+	// proxy is asked for them: a shared deployment is then no relay into
+	// the networks behind the proxy.
+	DenyInternal bool
+
+	// Insecure skips certificate verification. CAFile is a PEM bundle
+	// trusted on top of the system roots. TLSServerName overrides SNI and
+	// the verified name; the transport applies it to an https proxy as
+	// well.
+	Insecure      bool
+	CAFile        string
+	TLSServerName string
+	// PinSHA256 fails a destination handshake unless the certificates
+	// hold one of these keys, SPKI SHA-256 hashes in base64, optionally
+	// prefixed with sha256//. It holds with Insecure too. See PinError.
+	PinSHA256 []string
+	// VerifyPeerCertificate and VerifyConnection, when set, are called on
+	// every handshake once the chain verified, unless Insecure, and the
+	// pins passed, with leg "proxy" for an https proxy's own and
+	// "destination"; an error fails the handshake as a VerificationError.
+	// They are tls.Config's hooks with the leg added, for checks of an
+	// organization's own, an internal CT log or pinning database, and
+	// both see resumed sessions too.
+	VerifyPeerCertificate func(leg string, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+	VerifyConnection      func(leg string, cs tls.ConnectionState) error
+	// ClientCert is a PEM certificate, with ClientKey or the key in the
+	// same file, or a PKCS#12 bundle opened with ClientCertPassword. It is
+	// presented to whoever asks for one, an https proxy included.
+	ClientCert         string
+	ClientKey          string
+	ClientCertPassword string
+
+	// HTTP2 speaks only HTTP/2 to https destinations: ALPN offers h2
+	// alone, so a tunnel or destination that cannot carry it fails the
+	// request instead of downgrading it silently.
+	HTTP2 bool
+
+	// DisableKeepAlives sends every request, CONNECT included, on a
+	// connection of its own, closed after it.
+	DisableKeepAlives bool
+
+	// Timeout limits a request as a whole, redirects and reading the body
+	// included; 0 for none. ConnectTimeout limits each dial, 30s when 0,
+	// TLSTimeout each handshake, 10s when 0. ResponseHeaderTimeout limits
+	// the wait for response headers once the request is written, and for
+	// the answer to a CONNECT the client sends itself; 0 for none. Any
+	// CONNECT gives up after a minute, as the transport's always do.
+	Timeout               time.Duration
+	ConnectTimeout        time.Duration
+	TLSTimeout            time.Duration
+	ResponseHeaderTimeout time.Duration
+	// HopTimeout limits every redirect hop separately.
+	HopTimeout time.Duration
+	// MaxRedirects caps the redirects followed, 10 when zero like
+	// http.Client; more fail the request. NoFollow returns the first
+	// response, a redirect included.
+	MaxRedirects int
+	NoFollow     bool
+	// Retry, when set, resends hops that fail transiently, each try with
+	// its own HopTimeout.
+	Retry *Retry
+	// Fallback "direct" sends a request without the proxy when the proxy
+	// cannot be reached, as a PAC file's "PROXY x; DIRECT" does. See
+	// WithFallback and Result.Fallback to tell when it happened.
+	Fallback string
+	// Jar, when set, keeps the cookies responses set and sends them back,
+	// across redirects and the requests of the client.
+	Jar http.CookieJar
+
+	// Wire, when set, gets the head of every request and response the
+	// client exchanges, CONNECTs and their 407 rounds included, with
+	// credentials masked. WireConns adds dials, TLS handshakes and
+	// connection reuse.
+	Wire      io.Writer
+	WireConns bool
+
+	// Observe, when set, is called after every Do, for metrics. It may be
+	// called concurrently.
+	Observe func(Observation)
+
+	// OAuth, when set, sends a refreshed bearer token to the destination.
+	OAuth *OAuth
+	// DestAuth, when set, sends basic or digest credentials to the
+	// destination. It cannot be combined with OAuth.
+	DestAuth *DestAuth
+}
+
+// OAuth configures the client credentials grant for destination auth.
+type OAuth struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scope        string
+	// Skew is how long before expiry a token gets refreshed.
+	Skew time.Duration
+	// Host is the destination host:port the token is sent to.
+	Host string
+}
+
+// Client sends requests through the configured proxy.
+type Client struct {
+	cfg       Config
+	proxyURL  *url.URL
+	dialer    *net.Dialer
+	search    *searchList
+	transport *http.Transport
+	// forward carries the plain http requests of a tunneled client
+	forward *forwardTransport
+	client  *http.Client
+
+	pins map[string]bool
+
+	mu       sync.Mutex
+	names    map[string]string
+	digest   *digestChallenge
+	digestNC int
+
+	// creds are the proxy credentials, see Credentials
+	creds credentials
+
+	stats Stats
+	wire  *wireLog
+	// readBucket and writeBucket pace LimitRate, nil without it
+	readBucket, writeBucket *tokenBucket
+	// direct is the Fallback client, nil without one
+	direct *Client
+}
+
+// New builds a Client from cfg.
+func New(cfg Config) (*Client, error) {
+	c := &Client{
+		cfg:    cfg,
+		creds:  credentials{user: cfg.User, password: cfg.Password},
+		dialer: &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		search: newSearchList(cfg.SearchDomains),
+		names:  map[string]string{},
+		wire:   newWireLog(cfg),
+	}
+	if cfg.LimitRate > 0 {
+		c.readBucket, c.writeBucket = newTokenBucket(cfg.LimitRate), newTokenBucket(cfg.LimitRate)
+	}
+	if cfg.Proxy != "" {
+		u := &url.URL{Scheme: "http", Host: cfg.Proxy}
+		if strings.Contains(cfg.Proxy, "://") {
+			var err error
+			if u, err = url.Parse(cfg.Proxy); err != nil {
+				return nil, fmt.Errorf("invalid proxy: %s", err)
+			}
+		}
+		if (u.Scheme == "socks5" || u.Scheme == "socks5h") && u.User == nil && (cfg.User != "" || cfg.Password != "") {
+			// shown with the proxy like credentials in the URL
+			u.User = url.UserPassword(cfg.User, cfg.Password)
+		}
+		if u.User != nil && cfg.User == "" && cfg.Password == "" {
+			c.creds.user = u.User.Username()
+			c.creds.password, _ = u.User.Password()
+		}
+		c.proxyURL = u
+	}
+	if cfg.ConnectTimeout > 0 {
+		c.dialer.Timeout = cfg.ConnectTimeout
+	}
+	switch cfg.Network {
+	case "", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unknown network %q, want tcp4 or tcp6", cfg.Network)
+	}
+	if cfg.Network == "tcp4" && cfg.IPv6Source != "" {
+		return nil, fmt.Errorf("ipv6 source and tcp4 are mutually exclusive")
+	}
+	if err := bindSource(c.dialer, cfg.Interface, cfg.SourceIP, cfg.Network); err != nil {
+		return nil, err
+	}
+	if cfg.IPv6Source != "" && c.dialer.LocalAddr != nil {
+		return nil, fmt.Errorf("ipv6 source and a bound local address are mutually exclusive")
+	}
+	if err := setIPv6Source(c.dialer, cfg.IPv6Source); err != nil {
+		return nil, err
+	}
+	if cfg.DNSServer != "" {
+		r, err := dnsResolver(cfg.DNSServer)
+		if err != nil {
+			return nil, err
+		}
+		c.dialer.Resolver = r
+	}
+	c.search.resolver = c.Resolver()
+
+	switch cfg.Auth {
+	case "", "basic":
+	case "sspi", "digest", "ntlm":
+		if c.isSOCKS() {
+			return nil, fmt.Errorf("%s auth needs an http or https proxy", cfg.Auth)
+		}
+	case "gssapi":
+		if !c.isSOCKS() {
+			return nil, fmt.Errorf("gssapi auth needs a socks5 proxy")
+		}
+		if _, ok := gssProtectionLevels[cfg.GSSAPIProtection]; !ok {
+			return nil, fmt.Errorf("unknown gssapi protection %q", cfg.GSSAPIProtection)
+		}
+	default:
+		return nil, fmt.Errorf("unknown proxy auth %q", cfg.Auth)
+	}
+
+	tlsConf, err := tlsConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if c.pins, err = parsePins(cfg.PinSHA256); err != nil {
+		return nil, err
+	}
+	if c.pins != nil || c.verifyHooked() {
+		tlsConf.VerifyConnection = c.verifyDestination
+	}
+	// A custom TLSClientConfig disables HTTP/2 unless asked for, and we
+	// want to offer h2 so a downgrade along the way becomes visible.
+	c.transport = &http.Transport{
+		TLSClientConfig:   tlsConf,
+		ForceAttemptHTTP2: true,
+		DialContext:       c.DialContext,
+
+		TLSHandshakeTimeout:   c.tlsTimeout(),
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+
+		OnProxyConnectResponse: c.onProxyConnectResponse,
+		DisableKeepAlives:      cfg.DisableKeepAlives,
+	}
+	if cfg.HTTP2 {
+		c.transport.Protocols = new(http.Protocols)
+		c.transport.Protocols.SetHTTP2(true)
+	}
+	switch {
+	case c.tunneled():
+		c.transport.DialContext = c.dialTunnel
+	case c.cfg.Auth == "gssapi":
+		c.transport.DialContext = c.dialSOCKS
+	case c.proxyURL != nil:
+		c.transport.Proxy = c.transportProxy
+	}
+	c.transport.GetProxyConnectHeader = func(ctx context.Context, proxyURL *url.URL, target string) (http.Header, error) {
+		auth, err := c.proxyAuthorization()
+		if err != nil || auth == "" {
+			return nil, err
+		}
+		return http.Header{"Proxy-Authorization": {auth}}, nil
+	}
+
+	var rt http.RoundTripper = c.transport
+	if c.tunneled() {
+		c.forward = &forwardTransport{next: c.transport, c: c}
+		rt = c.forward
+	}
+	rt = &proxyAuthTransport{next: rt, c: c}
+	if a := cfg.DestAuth; a != nil {
+		if cfg.OAuth != nil {
+			return nil, fmt.Errorf("destination auth and oauth are mutually exclusive")
+		}
+		switch a.Type {
+		case "", "basic", "digest":
+		default:
+			return nil, fmt.Errorf("unknown destination auth %q", a.Type)
+		}
+		rt = &destAuthTransport{next: rt, auth: *a}
+	}
+	if o := cfg.OAuth; o != nil {
+		source := &tokenSource{
+			client: &http.Client{Transport: rt},
+			url:    o.TokenURL,
+			id:     o.ClientID,
+			secret: o.ClientSecret,
+			scope:  o.Scope,
+			skew:   o.Skew,
+		}
+		rt = &tokenTransport{next: rt, source: source, host: o.Host}
+	}
+	rt = &hopTransport{next: rt, timeout: cfg.HopTimeout, stats: &c.stats, wire: c.wire}
+	if r := cfg.Retry; r != nil && r.Max > 0 {
+		rt = newRetryTransport(rt, *r, &c.stats)
+	}
+	rt = &hopRecorder{next: rt, proxied: c.proxyURL != nil}
+	c.client = &http.Client{Transport: rt, CheckRedirect: c.checkRedirect, Jar: cfg.Jar, Timeout: cfg.Timeout}
+
+	switch cfg.Fallback {
+	case "":
+	case "direct":
+		if c.proxyURL == nil {
+			break
+		}
+		d := cfg
+		d.Proxy, d.User, d.Password, d.Auth, d.Fallback = "", "", "", "", ""
+		if c.direct, err = New(d); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown fallback %q", cfg.Fallback)
+	}
+	return c, nil
+}
+
+// checkRedirect applies MaxRedirects and NoFollow.
+func (c *Client) checkRedirect(req *http.Request, via []*http.Request) error {
+	if c.cfg.NoFollow {
+		return http.ErrUseLastResponse
+	}
+	max := c.cfg.MaxRedirects
+	if max <= 0 {
+		max = 10
+	}
+	if len(via) > max {
+		return fmt.Errorf("stopped after %d redirects", max)
+	}
+	return c.checkInternal(req.Context(), req.URL)
+}
+
+// Do sends req, following redirects as MaxRedirects and NoFollow allow.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&c.stats.Requests, 1)
+	if err := c.checkInternal(req.Context(), req.URL); err != nil {
+		atomic.AddInt64(&c.stats.Errors, 1)
+		return nil, err
+	}
+	if c.cfg.Observe == nil {
+		resp, err := c.send(req)
+		resp, err = c.fallback(req, resp, err)
+		if err != nil {
+			atomic.AddInt64(&c.stats.Errors, 1)
+		}
+		return resp, err
+	}
+
+	connect, ok := req.Context().Value(connectKey{}).(**http.Response)
+	if !ok {
+		connect = new(*http.Response)
+		req = req.WithContext(WithConnectResponse(req.Context(), connect))
+	}
+	start := time.Now()
+	resp, err := c.send(req)
+	o := Observation{Host: req.URL.Host, Duration: time.Since(start)}
+	if c.proxyURL != nil {
+		o.Proxy = c.proxyURL.Redacted()
+	}
+	if err != nil {
+		atomic.AddInt64(&c.stats.Errors, 1)
+		o.ErrorClass = ErrorClass(err, *connect)
+	} else {
+		o.Status = resp.StatusCode
+	}
+	c.cfg.Observe(o)
+	// the direct try is observed by the direct client, without a proxy
+	return c.fallback(req, resp, err)
+}
+
+// ProxyURL returns the proxy in use, nil when connecting directly.
+func (c *Client) ProxyURL() *url.URL {
+	return c.proxyURL
+}
+
+// Transport returns the underlying transport, without the redirect, token
+// and proxy credential layers Do adds on top.
+func (c *Client) Transport() *http.Transport {
+	return c.transport
+}
+
+// LocalAddr returns the address outgoing connections are bound to, if any.
+func (c *Client) LocalAddr() net.Addr {
+	return c.dialer.LocalAddr
+}
+
+// isSOCKS reports whether the proxy is a SOCKS5 proxy.
+func (c *Client) isSOCKS() bool {
+	return c.proxyURL != nil && (c.proxyURL.Scheme == "socks5" || c.proxyURL.Scheme == "socks5h")
+}
+
+// proxyAuthorization returns the Basic Proxy-Authorization value to
+// send, "" when there are no credentials. The challenge schemes, sspi
+// included, answer on their tunnel, see challengeAuth.
+func (c *Client) proxyAuthorization() (string, error) {
+	user, password, _ := c.creds.get()
+	if user == "" && password == "" {
+		return "", nil
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password)), nil
+}
+
+// proxyAuthTransport adds the proxy credentials to requests the proxy
+// forwards itself. Tunneled requests get them on CONNECT only, so they
+// never reach the destination.
+type proxyAuthTransport struct {
+	next http.RoundTripper
+	c    *Client
+}
+
+func (t *proxyAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.c.proxyURL == nil || t.c.isSOCKS() || t.c.tunneled() || req.URL.Scheme != "http" {
+		return t.next.RoundTrip(req)
+	}
+	auth, err := t.c.proxyAuthorization()
+	if err != nil {
+		return nil, err
+	}
+	if auth != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,112 @@
+package proxyclient
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// credentials are the proxy user and password in use, replaced when the
+// Credentials hook hands out new ones. gen counts the replacements.
+type credentials struct {
+	mu       sync.Mutex
+	user     string
+	password string
+	gen      int
+	// rotating serializes the Credentials calls
+	rotating sync.Mutex
+}
+
+func (cr *credentials) get() (user, password string, gen int) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.user, cr.password, cr.gen
+}
+
+// transportProxy is the transport's Proxy: the proxy URL with the current
+// credentials for SOCKS, which the transport reads from the URL, and
+// without any for HTTP proxies, which get them from proxyAuthorization.
+func (c *Client) transportProxy(*http.Request) (*url.URL, error) {
+	u := *c.proxyURL
+	u.User = nil
+	if c.isSOCKS() {
+		if user, password, _ := c.creds.get(); user != "" || password != "" {
+			u.User = url.UserPassword(user, password)
+		}
+	}
+	return &u, nil
+}
+
+// send is c.client.Do, trying once more with new credentials from the
+// Credentials hook when the proxy refused the current ones.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	if c.cfg.Credentials == nil || c.proxyURL == nil {
+		return c.client.Do(req)
+	}
+	connect, ok := req.Context().Value(connectKey{}).(**http.Response)
+	if !ok {
+		connect = new(*http.Response)
+		req = req.WithContext(WithConnectResponse(req.Context(), connect))
+	}
+	_, _, gen := c.creds.get()
+	resp, err := c.client.Do(req)
+	if !c.credentialsRefused(resp, err, *connect) || !c.rotate(req.Context(), gen) {
+		return resp, err
+	}
+	retry := req
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return resp, err
+		}
+		body, gerr := req.GetBody()
+		if gerr != nil {
+			return resp, err
+		}
+		retry = req.Clone(req.Context())
+		retry.Body = body
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	*connect = nil
+	return c.client.Do(retry)
+}
+
+// credentialsRefused tells whether the proxy turned the credentials down.
+func (c *Client) credentialsRefused(resp *http.Response, err error, connect *http.Response) bool {
+	if err != nil {
+		return ErrorClass(err, connect) == "proxy_auth"
+	}
+	// a plain http request gets the proxy's 407 as its response, also
+	// when the client tunnels the https ones
+	return resp.StatusCode == http.StatusProxyAuthRequired && (resp.Request.URL.Scheme == "http" || !c.tunneled()) && !c.isSOCKS()
+}
+
+// rotate asks the Credentials hook for new credentials, unless another
+// request already replaced the ones of generation gen meanwhile. It tells
+// whether there are new ones to try.
+func (c *Client) rotate(ctx context.Context, gen int) bool {
+	c.creds.rotating.Lock()
+	defer c.creds.rotating.Unlock()
+	if _, _, now := c.creds.get(); now != gen {
+		return true
+	}
+	user, password, err := c.cfg.Credentials(ctx, c.proxyURL.Host)
+	if err != nil {
+		return false
+	}
+	c.creds.mu.Lock()
+	c.creds.user, c.creds.password = user, password
+	c.creds.gen++
+	c.creds.mu.Unlock()
+	// a digest challenge answered with the old ones is no use anymore
+	c.mu.Lock()
+	c.digest, c.digestNC = nil, 0
+	c.mu.Unlock()
+	c.transport.CloseIdleConnections()
+	if c.forward != nil {
+		c.forward.closeIdle()
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package proxyclient
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// DestAuth configures credentials for the destination itself.
+type DestAuth struct {
+	// Type is "basic" or "digest".
+	Type     string
+	User     string
+	Password string
+	// Host is the destination host:port the credentials are sent to.
+	Host string
+}
+
+// destAuthTransport authenticates requests to host. Basic credentials go
+// on every request; Digest answers a 401 once and then reuses the
+// challenge with an increasing nonce count.
+type destAuthTransport struct {
+	next http.RoundTripper
+	auth DestAuth
+
+	mu        sync.Mutex
+	challenge *digestChallenge
+	nc        int
+}
+
+func (t *destAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.auth.Host {
+		return t.next.RoundTrip(req)
+	}
+	if t.auth.Type != "digest" {
+		req = req.Clone(req.Context())
+		req.SetBasicAuth(t.auth.User, t.auth.Password)
+		return t.next.RoundTrip(req)
+	}
+
+	answered := false
+	if v, err := t.authorize(req, nil); err != nil {
+		return nil, err
+	} else if v != "" {
+		req = withAuthorization(req, v)
+		answered = true
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	v, ok := wwwChallenge(resp.Header, "Digest")
+	if !ok {
+		return resp, nil
+	}
+	params := authParams(v[len("Digest"):])
+	if answered && !strings.EqualFold(params["stale"], "true") {
+		// the credentials were wrong
+		return resp, nil
+	}
+	if req.Body != nil && req.GetBody == nil {
+		// the body is gone, let the 401 through
+		return resp, nil
+	}
+	ch, err := parseDigestChallenge(v)
+	if err != nil {
+		return resp, nil
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	auth, err := t.authorize(req, ch)
+	if err != nil {
+		return nil, err
+	}
+	retry := withAuthorization(req, auth)
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return t.next.RoundTrip(retry)
+}
+
+// authorize returns the Authorization for req from the cached challenge,
+// replacing it with ch when given; "" when there is none yet.
+func (t *destAuthTransport) authorize(req *http.Request, ch *digestChallenge) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ch != nil {
+		t.challenge, t.nc = ch, 0
+	}
+	if t.challenge == nil {
+		return "", nil
+	}
+	t.nc++
+	return t.challenge.authorize(req.Method, req.URL.RequestURI(), t.auth.User, t.auth.Password, t.nc)
+}
+
+func withAuthorization(req *http.Request, v string) *http.Request {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", v)
+	return req
+}
+
+// wwwChallenge returns the WWW-Authenticate value for scheme.
+func wwwChallenge(h http.Header, scheme string) (string, bool) {
+	return challengeValue(http.Header{"Proxy-Authenticate": h.Values("WWW-Authenticate")}, scheme)
+}
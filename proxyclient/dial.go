@@ -0,0 +1,124 @@
+package proxyclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// DialContext connects like the client does: from the bound local address,
+// to the pinned address if any, and with short host names expanded by the
+// search list.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if pinned, ok := c.cfg.Resolve[addr]; ok {
+		addr = pinned
+	} else if host, port, err := net.SplitHostPort(addr); err == nil {
+		if fqdn := c.FQDN(ctx, host); fqdn != "" {
+			addr = net.JoinHostPort(fqdn, port)
+		}
+	}
+	if network == "tcp" && c.cfg.Network != "" {
+		network = c.cfg.Network
+	}
+	atomic.AddInt64(&c.stats.Dials, 1)
+	conn, err := c.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		atomic.AddInt64(&c.stats.DialErrors, 1)
+		return nil, err
+	}
+	atomic.AddInt64(&c.stats.OpenConns, 1)
+	return &countingConn{Conn: c.limit(conn), stats: &c.stats}, nil
+}
+
+// dnsResolver returns a resolver asking server, IP or IP:port, only.
+func dnsResolver(server string) (*net.Resolver, error) {
+	if net.ParseIP(server) != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	host, _, err := net.SplitHostPort(server)
+	if err != nil || net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("invalid dns server %q, want IP or IP:PORT", server)
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}, nil
+}
+
+// Resolver returns the resolver the client looks names up with, the
+// DNSServer one or the system's.
+func (c *Client) Resolver() *net.Resolver {
+	if c.dialer.Resolver != nil {
+		return c.dialer.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// bindSource sets the local address connections are made from, either
+// sourceIP or the first usable address of the named interface. Multi-homed
+// hosts route by source address, so this picks the path to the proxy.
+// With network tcp4 or tcp6 the interface address is of that family.
+func bindSource(d *net.Dialer, iface, sourceIP, network string) error {
+	if iface != "" && sourceIP != "" {
+		return fmt.Errorf("interface and source ip are mutually exclusive")
+	}
+	var ip net.IP
+	switch {
+	case sourceIP != "":
+		if ip = net.ParseIP(sourceIP); ip == nil {
+			return fmt.Errorf("invalid source ip %q", sourceIP)
+		}
+	case iface != "":
+		var err error
+		if ip, err = interfaceAddr(iface, network); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	d.LocalAddr = &net.TCPAddr{IP: ip}
+	return nil
+}
+
+// interfaceAddr returns the first global address of iface, IPv4 first,
+// of the family of network if it names one.
+func interfaceAddr(iface, network string) (net.IP, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %s", iface, err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var v6 net.IP
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			if network != "tcp6" {
+				return ipnet.IP, nil
+			}
+			continue
+		}
+		if v6 == nil && network != "tcp4" {
+			v6 = ipnet.IP
+		}
+	}
+	if v6 == nil {
+		switch network {
+		case "tcp4":
+			return nil, fmt.Errorf("interface %s has no usable IPv4 address", iface)
+		case "tcp6":
+			return nil, fmt.Errorf("interface %s has no usable IPv6 address", iface)
+		}
+		return nil, fmt.Errorf("interface %s has no usable address", iface)
+	}
+	return v6, nil
+}
@@ -0,0 +1,155 @@
+package proxyclient
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// digestChallenge is a parsed Digest challenge (RFC 7616).
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+}
+
+// parseDigestChallenge reads the params of a "Digest ..." header value.
+func parseDigestChallenge(v string) (*digestChallenge, error) {
+	params := authParams(strings.TrimSpace(v[len("Digest"):]))
+	c := &digestChallenge{
+		realm:     params["realm"],
+		nonce:     params["nonce"],
+		opaque:    params["opaque"],
+		algorithm: params["algorithm"],
+	}
+	if c.nonce == "" {
+		return nil, fmt.Errorf("digest: challenge without nonce")
+	}
+	for _, q := range strings.Split(params["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			c.qop = "auth"
+		}
+	}
+	return c, nil
+}
+
+// authorize returns the Authorization value for method and uri, nc being
+// the count of requests sent with this nonce.
+func (c *digestChallenge) authorize(method, uri, user, password string, nc int) (string, error) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return c.authorizeWith(method, uri, user, password, nc, hex.EncodeToString(b))
+}
+
+// authorizeWith is authorize with the client nonce given.
+func (c *digestChallenge) authorizeWith(method, uri, user, password string, nc int, cnonce string) (string, error) {
+	var h func() hash.Hash
+	alg := strings.ToUpper(c.algorithm)
+	switch strings.TrimSuffix(alg, "-SESS") {
+	case "", "MD5":
+		h = md5.New
+	case "SHA-256":
+		h = sha256.New
+	default:
+		return "", fmt.Errorf("digest: unsupported algorithm %s", c.algorithm)
+	}
+	sum := func(s string) string {
+		d := h()
+		d.Write([]byte(s))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+	count := fmt.Sprintf("%08x", nc)
+
+	ha1 := sum(user + ":" + c.realm + ":" + password)
+	if strings.HasSuffix(alg, "-SESS") {
+		ha1 = sum(ha1 + ":" + c.nonce + ":" + cnonce)
+	}
+	ha2 := sum(method + ":" + uri)
+	var response string
+	if c.qop == "auth" {
+		response = sum(strings.Join([]string{ha1, c.nonce, count, cnonce, c.qop, ha2}, ":"))
+	} else {
+		response = sum(ha1 + ":" + c.nonce + ":" + ha2)
+	}
+
+	v := fmt.Sprintf(`Digest username=%s, realm=%s, nonce=%s, uri=%s, response="%s"`,
+		quoted(user), quoted(c.realm), quoted(c.nonce), quoted(uri), response)
+	if c.algorithm != "" {
+		v += ", algorithm=" + c.algorithm
+	}
+	if c.qop != "" {
+		v += fmt.Sprintf(`, qop=%s, nc=%s, cnonce=%s`, c.qop, count, quoted(cnonce))
+	}
+	if c.opaque != "" {
+		v += ", opaque=" + quoted(c.opaque)
+	}
+	return v, nil
+}
+
+var quotedEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// quoted returns s as a quoted-string, " and \ escaped.
+func quoted(s string) string {
+	return `"` + quotedEscaper.Replace(s) + `"`
+}
+
+// authParams splits comma separated name=value pairs, values optionally
+// quoted and possibly containing commas.
+func authParams(s string) map[string]string {
+	params := map[string]string{}
+	for s != "" {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " ")
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end > len(s) {
+				end = len(s)
+			}
+			value = unquote(s[1:end])
+			s = s[min(end+1, len(s)):]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		params[name] = value
+	}
+	return params
+}
+
+// unquote drops the backslash of every quoted pair in s, so \\ is one
+// backslash and \" a quote.
+func unquote(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
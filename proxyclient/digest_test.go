@@ -0,0 +1,64 @@
+package proxyclient
+
+import (
+	"strings"
+	"testing"
+)
+
+// The examples of RFC 7616 3.9.1, MD5 and SHA-256.
+func TestDigestAuthorize(t *testing.T) {
+	const (
+		nonce  = "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v"
+		opaque = "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"
+		cnonce = "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ"
+	)
+	tests := []struct {
+		algorithm, response string
+	}{
+		{"MD5", "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	}
+	for _, tt := range tests {
+		ch, err := parseDigestChallenge(`Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=` + tt.algorithm +
+			`, nonce="` + nonce + `", opaque="` + opaque + `"`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := ch.authorizeWith("GET", "/dir/index.html", "Mufasa", "Circle of Life", 1, cnonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := authParams(strings.TrimPrefix(v, "Digest "))
+		want := map[string]string{
+			"username":  "Mufasa",
+			"realm":     "http-auth@example.org",
+			"uri":       "/dir/index.html",
+			"algorithm": tt.algorithm,
+			"qop":       "auth",
+			"nc":        "00000001",
+			"cnonce":    cnonce,
+			"nonce":     nonce,
+			"opaque":    opaque,
+			"response":  tt.response,
+		}
+		for k, w := range want {
+			if p[k] != w {
+				t.Errorf("%s: %s = %q, want %q", tt.algorithm, k, p[k], w)
+			}
+		}
+	}
+}
+
+func TestDigestQuotedUsername(t *testing.T) {
+	ch := &digestChallenge{realm: `say "hi"`, nonce: "n"}
+	for _, user := range []string{`Mu"fasa`, `DOMAIN\user`, `a\"b`} {
+		v, err := ch.authorizeWith("GET", "/", user, "pw", 1, "c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := authParams(strings.TrimPrefix(v, "Digest "))
+		if p["username"] != user || p["realm"] != ch.realm || p["response"] == "" {
+			t.Errorf("%s: parsed back %q", v, p)
+		}
+	}
+}
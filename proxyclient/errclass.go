@@ -0,0 +1,106 @@
+package proxyclient
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// proxyServers are Server header values of common proxies and gateways.
+// Apache Traffic Server's short name is matched as a product token
+// apart, as a substring "ats" would be found in "stats" or "cats".
+var proxyServers = []string{
+	"squid", "tinyproxy", "privoxy", "zscaler", "bluecoat", "proxysg",
+	"mcafee web gateway", "fortigate", "forcepoint", "websense",
+	"apache traffic server", "ccproxy", "kerio", "wingate",
+}
+
+// isProxyServer reports whether a Server header names a proxy of
+// proxyServers, or starts with the ATS product token.
+func isProxyServer(server string) bool {
+	server = strings.ToLower(server)
+	if server == "" {
+		return false
+	}
+	if server == "ats" || strings.HasPrefix(server, "ats/") || strings.HasPrefix(server, "ats ") {
+		return true
+	}
+	for _, p := range proxyServers {
+		if strings.Contains(server, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyPageMarkers appear in the error pages proxies generate themselves.
+var proxyPageMarkers = []string{
+	"err_connect_fail", "err_dns_fail", "err_read_timeout", "generated by squid",
+	"the proxy server", "proxy error", "zscaler", "blue coat", "tinyproxy",
+	"privoxy", "forcepoint", "websense", "gateway timeout error from proxy",
+}
+
+// IsGatewayError reports whether code is 502, 503 or 504.
+func IsGatewayError(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable ||
+		code == http.StatusGatewayTimeout
+}
+
+// ClassifyGatewayError tells whether a 502/503/504 was generated by the
+// proxy or relayed from the origin. The verdict is "proxy", "origin" or
+// "unknown", followed by the evidence for it.
+func (c *Client) ClassifyGatewayError(resp *http.Response, body []byte) (string, string) {
+	if resp.Request.URL.Scheme == "https" && resp.TLS != nil {
+		// inside a CONNECT tunnel the proxy only sees ciphertext
+		if c.DestTrusted(resp) {
+			return "origin", "response came through the CONNECT tunnel from a trusted destination certificate"
+		}
+		return "unknown", "response came through the tunnel but the destination certificate is not trusted, a TLS intercepting proxy could have generated it"
+	}
+	if ps := resp.Header.Get("Proxy-Status"); strings.Contains(ps, "error=") {
+		return "proxy", "Proxy-Status: " + ps
+	}
+	if e := resp.Header.Get("X-Squid-Error"); e != "" {
+		return "proxy", "X-Squid-Error: " + e
+	}
+	if server := resp.Header.Get("Server"); isProxyServer(server) {
+		return "proxy", "Server: " + server
+	}
+	lower := bytes.ToLower(body)
+	for _, m := range proxyPageMarkers {
+		if bytes.Contains(lower, []byte(m)) {
+			return "proxy", fmt.Sprintf("body contains %q", m)
+		}
+	}
+	if via := resp.Header.Get("Via"); via != "" {
+		return "origin", "no proxy error markers and the proxy relayed it (Via: " + via + ")"
+	}
+	return "unknown", "no proxy error markers and no Via header"
+}
+
+type connectKey struct{}
+
+// WithConnectResponse returns a context under which a non-200 response to
+// CONNECT is stored into res.
+func WithConnectResponse(ctx context.Context, res **http.Response) context.Context {
+	return context.WithValue(ctx, connectKey{}, res)
+}
+
+// onProxyConnectResponse is the transport's OnProxyConnectResponse hook.
+func (c *Client) onProxyConnectResponse(ctx context.Context, proxyURL *url.URL, req *http.Request, res *http.Response) error {
+	c.wire.connect(req, res)
+	return recordConnect(ctx, proxyURL, req, res)
+}
+
+// recordConnect keeps a failed CONNECT's response. The
+// transport only returns the status text as an error when CONNECT fails,
+// this keeps the response so the failure can be attributed to the proxy.
+func recordConnect(ctx context.Context, _ *url.URL, _ *http.Request, res *http.Response) error {
+	if p, ok := ctx.Value(connectKey{}).(**http.Response); ok && res.StatusCode != http.StatusOK {
+		*p = res
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package proxyclient
+
+import "testing"
+
+func TestIsProxyServer(t *testing.T) {
+	tests := []struct {
+		server string
+		want   bool
+	}{
+		{"ATS/9.2.3", true},
+		{"ats/8.1.1", true},
+		{"ATS", true},
+		{"Apache Traffic Server/7.1", true},
+		{"squid/4.10", true},
+		{"Zscaler/6.2", true},
+		// ats inside another word is some other server
+		{"Cats/1.0", false},
+		{"nginx-stats", false},
+		{"Whatsapp", false},
+		{"nginx/1.25.3", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isProxyServer(tt.server); got != tt.want {
+			t.Errorf("isProxyServer(%q) = %v, want %v", tt.server, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package proxyclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Exchange is one round trip with the bodies as far as they were read.
+type Exchange struct {
+	Request *http.Request
+	// RequestBody holds the first ExchangeBodyMax bytes of the request
+	// body, RequestSize counts all that was sent and RequestSHA256 is the
+	// hex SHA-256 of it, "" without a body.
+	RequestBody   []byte
+	RequestSize   int64
+	RequestSHA256 string
+	// Response has its body consumed, ResponseBody holds it.
+	Response     *http.Response
+	ResponseBody []byte
+	// Complete is false when the response body was closed before its end.
+	Complete bool
+	// Start is when the round trip began, Headers when the response head
+	// arrived and End when its body was done with.
+	Start, Headers, End time.Time
+}
+
+// ExchangeBodyMax is how much of a request body an Exchange keeps, the
+// rest is counted only: a generated upload can run to gigabytes.
+const ExchangeBodyMax = 1 << 20
+
+type exchangesKey struct{}
+
+// WithExchanges returns a context whose round trips, redirect hops
+// included, are appended to exchanges once their response body is read
+// or closed. The bodies are kept in memory.
+func WithExchanges(ctx context.Context, exchanges *[]Exchange) context.Context {
+	return context.WithValue(ctx, exchangesKey{}, exchanges)
+}
+
+// recordExchange tees the request body of req, returning the request to
+// send and a function that wraps the response.
+func recordExchange(req *http.Request) (*http.Request, func(*http.Response)) {
+	exchanges, ok := req.Context().Value(exchangesKey{}).(*[]Exchange)
+	if !ok {
+		return req, func(*http.Response) {}
+	}
+	start := time.Now()
+	sent := &sentBody{}
+	if req.Body != nil && req.Body != http.NoBody {
+		body := req.Body
+		req = req.Clone(req.Context())
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(body, sent), body}
+	}
+	return req, func(resp *http.Response) {
+		headers := time.Now()
+		b := &exchangeBody{ReadCloser: resp.Body}
+		b.done = func(complete bool) {
+			*exchanges = append(*exchanges, Exchange{
+				Request:       req,
+				RequestBody:   sent.buf.Bytes(),
+				RequestSize:   sent.n,
+				RequestSHA256: sent.sum(),
+				Response:      resp,
+				ResponseBody:  b.buf.Bytes(),
+				Complete:      complete,
+				Start:         start,
+				Headers:       headers,
+				End:           time.Now(),
+			})
+		}
+		resp.Body = b
+	}
+}
+
+// sentBody keeps the first ExchangeBodyMax bytes written, and counts and
+// hashes all.
+type sentBody struct {
+	buf  bytes.Buffer
+	n    int64
+	hash hash.Hash
+}
+
+func (s *sentBody) Write(p []byte) (int, error) {
+	if s.hash == nil {
+		s.hash = sha256.New()
+	}
+	s.hash.Write(p)
+	s.n += int64(len(p))
+	if room := ExchangeBodyMax - s.buf.Len(); room > 0 {
+		if len(p) > room {
+			s.buf.Write(p[:room])
+		} else {
+			s.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (s *sentBody) sum() string {
+	if s.hash == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.hash.Sum(nil))
+}
+
+// exchangeBody keeps what is read and reports the exchange at the end.
+type exchangeBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	once sync.Once
+	done func(complete bool)
+}
+
+func (b *exchangeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.once.Do(func() { b.done(true) })
+	}
+	return n, err
+}
+
+func (b *exchangeBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(false) })
+	return err
+}
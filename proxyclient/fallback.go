@@ -0,0 +1,63 @@
+package proxyclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+type fallbackKey struct{}
+
+// WithFallback returns a context under which a request that fell back to
+// a direct connection stores why, the error reaching the proxy, into
+// reason.
+func WithFallback(ctx context.Context, reason *string) context.Context {
+	return context.WithValue(ctx, fallbackKey{}, reason)
+}
+
+// proxyUnreachable tells whether err means the proxy itself could not be
+// reached: its name did not resolve or the dial to it failed. A proxy that
+// answered, even with a refusal, is reachable.
+func proxyUnreachable(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	// the transport wraps the dial error in a proxyconnect one
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if op, ok := e.(*net.OpError); ok && op.Op == "dial" {
+			return true
+		}
+	}
+	return false
+}
+
+// fallback resends req directly when Fallback is "direct" and err says
+// the proxy was unreachable, like a PAC file's "PROXY x; DIRECT". It
+// returns resp and err unchanged otherwise.
+func (c *Client) fallback(req *http.Request, resp *http.Response, err error) (*http.Response, error) {
+	if c.direct == nil || err == nil || !proxyUnreachable(err) || errors.Is(err, context.Canceled) {
+		return resp, err
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return resp, err
+		}
+		body, gerr := req.GetBody()
+		if gerr != nil {
+			return resp, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	if reason, ok := req.Context().Value(fallbackKey{}).(*string); ok {
+		cause := err
+		if ue, ok := err.(*url.Error); ok {
+			cause = ue.Err
+		}
+		*reason = cause.Error()
+	}
+	return c.direct.Do(req)
+}
@@ -0,0 +1,232 @@
+package proxyclient
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// forwardTransport sends the plain http requests of a tunneled client to
+// the proxy itself, in absolute form, instead of through CONNECT: proxies
+// like squid refuse CONNECT to port 80. A 407 is answered on the
+// connection it came on, so NTLM, which authenticates the connection,
+// completes its three messages; the connections are kept alive for the
+// next request.
+type forwardTransport struct {
+	next http.RoundTripper
+	c    *Client
+
+	mu   sync.Mutex
+	idle []*forwardConn
+}
+
+// maxIdleForward is how many idle proxy connections forwardTransport
+// keeps.
+const maxIdleForward = 8
+
+type forwardConn struct {
+	net.Conn
+	br    *bufio.Reader
+	since time.Time
+}
+
+func (t *forwardTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" {
+		return t.next.RoundTrip(req)
+	}
+	ctx := req.Context()
+	fc, reused, err := t.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.GotConn != nil {
+		info := httptrace.GotConnInfo{Conn: fc.Conn, Reused: reused, WasIdle: reused}
+		if reused {
+			info.IdleTime = time.Since(fc.since)
+		}
+		trace.GotConn(info)
+	}
+	// the request's context owns the connection until its body is closed
+	stop := context.AfterFunc(ctx, func() { fc.Close() })
+
+	target := req.URL.String()
+	auth := t.c.challengeAuth(req.Method)
+	defer closeAuth(auth)
+	header, err := auth.start(target)
+	if err != nil {
+		stop()
+		fc.Close()
+		return nil, err
+	}
+	for round := 0; ; round++ {
+		out := req.Clone(ctx)
+		out.Header.Del("Proxy-Authorization")
+		if header != "" {
+			out.Header.Set("Proxy-Authorization", header)
+		}
+		if round > 0 && req.Body != nil && req.Body != http.NoBody {
+			if out.Body, err = req.GetBody(); err != nil {
+				stop()
+				fc.Close()
+				return nil, err
+			}
+		}
+		resp, err := t.send(ctx, fc, out, trace)
+		if err != nil {
+			stop()
+			fc.Close()
+			return nil, err
+		}
+		// a body sent once can only be sent again with GetBody
+		replay := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+		if resp.StatusCode == http.StatusProxyAuthRequired && round < 3 && replay {
+			next, err := auth.respond(resp.Header, target)
+			if err != nil {
+				resp.Body.Close()
+				stop()
+				fc.Close()
+				return nil, err
+			}
+			if next != "" {
+				t.c.wire.response(resp)
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.Close {
+					// the proxy hung up, only schemes not bound to the
+					// connection survive this
+					stop()
+					fc.Close()
+					if fc, _, err = t.get(ctx); err != nil {
+						return nil, err
+					}
+					stop = context.AfterFunc(ctx, func() { fc.Close() })
+				}
+				header = next
+				continue
+			}
+		}
+		resp.Request = req
+		resp.Body = &forwardBody{ReadCloser: resp.Body, t: t, fc: fc, resp: resp, stop: stop, eof: resp.ContentLength == 0}
+		return resp, nil
+	}
+}
+
+// get returns an idle proxy connection, or dials one; reused tells which.
+func (t *forwardTransport) get(ctx context.Context) (*forwardConn, bool, error) {
+	t.mu.Lock()
+	if n := len(t.idle); n > 0 {
+		fc := t.idle[n-1]
+		t.idle = t.idle[:n-1]
+		t.mu.Unlock()
+		return fc, true, nil
+	}
+	t.mu.Unlock()
+	conn, br, err := t.c.dialProxy(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	return &forwardConn{Conn: conn, br: br}, false, nil
+}
+
+// put keeps fc for the next request, or closes it.
+func (t *forwardTransport) put(fc *forwardConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.c.cfg.DisableKeepAlives || len(t.idle) >= maxIdleForward {
+		fc.Close()
+		return
+	}
+	fc.since = time.Now()
+	t.idle = append(t.idle, fc)
+}
+
+// send writes req in absolute form on fc and reads the response head,
+// within the response header timeout once the request is written.
+func (t *forwardTransport) send(ctx context.Context, fc *forwardConn, req *http.Request, trace *httptrace.ClientTrace) (*http.Response, error) {
+	if trace != nil && trace.WroteHeaders != nil {
+		// what the transport reports of the fields it writes, for the
+		// wire log
+		if trace.WroteHeaderField != nil {
+			trace.WroteHeaderField("Host", []string{req.URL.Host})
+			for _, f := range sortedFields(req.Header) {
+				trace.WroteHeaderField(f[0], []string{f[1]})
+			}
+		}
+		trace.WroteHeaders()
+	}
+	err := req.WriteProxy(fc)
+	if trace != nil && trace.WroteRequest != nil {
+		trace.WroteRequest(httptrace.WroteRequestInfo{Err: err})
+	}
+	if err != nil {
+		return nil, err
+	}
+	var resp *http.Response
+	err = withTimeout(ctx, t.c.connectResponseTimeout(), "waiting for the proxy's response", func(ctx context.Context) error {
+		stop := context.AfterFunc(ctx, func() { fc.Close() })
+		defer stop()
+		if _, err := fc.br.Peek(1); err != nil {
+			return err
+		}
+		if trace != nil && trace.GotFirstResponseByte != nil {
+			trace.GotFirstResponseByte()
+		}
+		var err error
+		resp, err = http.ReadResponse(fc.br, req)
+		return err
+	})
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
+
+// forwardBody hands the connection back once the body was read to the
+// end and the proxy keeps it open.
+type forwardBody struct {
+	io.ReadCloser
+	t    *forwardTransport
+	fc   *forwardConn
+	resp *http.Response
+	stop func() bool
+	eof  bool
+	once sync.Once
+}
+
+func (b *forwardBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *forwardBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		// stop is false when the context already closed the connection
+		if b.stop() && b.eof && !b.resp.Close {
+			b.t.put(b.fc)
+			return
+		}
+		b.fc.Close()
+	})
+	return err
+}
+
+// closeIdle closes the idle proxy connections.
+func (t *forwardTransport) closeIdle() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, fc := range t.idle {
+		fc.Close()
+	}
+	t.idle = nil
+}
@@ -0,0 +1,204 @@
+package proxyclient
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// GSSAPI is one GSS-API security context, Kerberos in practice, used to
+// authenticate to a SOCKS5 proxy (RFC 1961). Config.GSSAPI creates one per
+// connection; a context implementing io.Closer is closed with it.
+type GSSAPI interface {
+	// InitSecContext returns the next token towards target, a service
+	// principal like rcmd/proxy.example.com, given the proxy's last token,
+	// nil at the start. done reports the context is established.
+	InitSecContext(target string, input []byte) (output []byte, done bool, err error)
+	// Wrap protects msg like gss_wrap, encrypting it when confidential.
+	Wrap(msg []byte, confidential bool) ([]byte, error)
+	// Unwrap checks and reverses Wrap on a token from the proxy.
+	Unwrap(token []byte) ([]byte, error)
+}
+
+// RFC 1961 message types and protection levels. Clear, no per-message
+// protection, is not in the RFC but accepted by Dante.
+const (
+	gssVersion         = 1
+	gssAuthMsg         = 1
+	gssProtectionMsg   = 2
+	gssEncapsulatedMsg = 3
+	gssAbort           = 0xff
+
+	gssClear           = 0
+	gssIntegrity       = 1
+	gssConfidentiality = 2
+)
+
+var gssProtectionLevels = map[string]byte{
+	"":                gssIntegrity,
+	"integrity":       gssIntegrity,
+	"confidentiality": gssConfidentiality,
+	"clear":           gssClear,
+}
+
+// gssapi returns a new context from Config.GSSAPI or the platform.
+func (c *Client) gssapi() (GSSAPI, error) {
+	if c.cfg.GSSAPI != nil {
+		return c.cfg.GSSAPI()
+	}
+	return newPlatformGSSAPI()
+}
+
+// gssapiTarget is the proxy's service principal.
+func (c *Client) gssapiTarget() string {
+	service := c.cfg.GSSAPIService
+	if service == "" {
+		service = "rcmd"
+	}
+	return service + "/" + c.proxyURL.Hostname()
+}
+
+// socksGSSAPIAuth establishes the context, negotiates the protection level
+// and returns the connection the rest of the SOCKS exchange and the
+// tunneled bytes go through, encapsulated unless the level is clear.
+func socksGSSAPIAuth(conn net.Conn, br *bufio.Reader, g GSSAPI, target, protection string) (net.Conn, error) {
+	level, ok := gssProtectionLevels[protection]
+	if !ok {
+		return nil, fmt.Errorf("gssapi: unknown protection level %q", protection)
+	}
+	closeContext := func() {
+		if cl, ok := g.(io.Closer); ok {
+			cl.Close()
+		}
+	}
+
+	var input []byte
+	for {
+		output, done, err := g.InitSecContext(target, input)
+		if err != nil {
+			closeContext()
+			return nil, fmt.Errorf("gssapi: %s", err)
+		}
+		if len(output) > 0 {
+			if err := gssWriteMsg(conn, gssAuthMsg, output); err != nil {
+				closeContext()
+				return nil, err
+			}
+		}
+		if done {
+			break
+		}
+		if input, err = gssReadMsg(br, gssAuthMsg); err != nil {
+			closeContext()
+			return nil, err
+		}
+	}
+
+	wrapped, err := g.Wrap([]byte{level}, false)
+	if err == nil {
+		err = gssWriteMsg(conn, gssProtectionMsg, wrapped)
+	}
+	var reply []byte
+	if err == nil {
+		reply, err = gssReadMsg(br, gssProtectionMsg)
+	}
+	if err == nil {
+		reply, err = g.Unwrap(reply)
+	}
+	if err == nil && len(reply) != 1 {
+		err = errors.New("gssapi: bad protection level reply")
+	}
+	if err != nil {
+		closeContext()
+		return nil, err
+	}
+	if reply[0] == gssClear {
+		closeContext()
+		return conn, nil
+	}
+	return &gssConn{Conn: conn, r: br, g: g, confidential: reply[0] == gssConfidentiality}, nil
+}
+
+func gssWriteMsg(w io.Writer, mtyp byte, token []byte) error {
+	if len(token) > 0xffff {
+		return errors.New("gssapi: token too long")
+	}
+	msg := binary.BigEndian.AppendUint16([]byte{gssVersion, mtyp}, uint16(len(token)))
+	_, err := w.Write(append(msg, token...))
+	return err
+}
+
+func gssReadMsg(r *bufio.Reader, mtyp byte) ([]byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	if head[1] == gssAbort {
+		return nil, errors.New("gssapi: proxy rejected the authentication")
+	}
+	if head[0] != gssVersion || head[1] != mtyp {
+		return nil, fmt.Errorf("gssapi: unexpected message %d.%d", head[0], head[1])
+	}
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	token := make([]byte, binary.BigEndian.Uint16(n[:]))
+	_, err := io.ReadFull(r, token)
+	return token, err
+}
+
+// gssConn encapsulates every message in a wrapped token after an
+// integrity or confidentiality level was agreed.
+type gssConn struct {
+	net.Conn
+	r            *bufio.Reader
+	g            GSSAPI
+	confidential bool
+	pending      []byte
+}
+
+// gssChunk leaves room in the 64KiB message for the wrap overhead.
+const gssChunk = 16 << 10
+
+func (c *gssConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), gssChunk)]
+		token, err := c.g.Wrap(chunk, c.confidential)
+		if err != nil {
+			return written, err
+		}
+		if err := gssWriteMsg(c.Conn, gssEncapsulatedMsg, token); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *gssConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		token, err := gssReadMsg(c.r, gssEncapsulatedMsg)
+		if err != nil {
+			return 0, err
+		}
+		if c.pending, err = c.g.Unwrap(token); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *gssConn) Close() error {
+	if cl, ok := c.g.(io.Closer); ok {
+		cl.Close()
+	}
+	return c.Conn.Close()
+}
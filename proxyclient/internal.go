@@ -0,0 +1,65 @@
+package proxyclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+// sharedAddressSpace is 100.64.0.0/10, carrier grade NAT (RFC 6598).
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// InternalError is a destination DenyInternal refused: Host is or
+// resolves to the internal address Addr.
+type InternalError struct {
+	Host string
+	Addr net.IP
+}
+
+func (e *InternalError) Error() string {
+	if e.Addr.String() == e.Host {
+		return fmt.Sprintf("destination %s is an internal address, refused", e.Host)
+	}
+	return fmt.Sprintf("destination %s resolves to the internal address %s, refused", e.Host, e.Addr)
+}
+
+// IsInternal reports whether ip is loopback, private (RFC 1918 and
+// fc00::/7), shared (100.64.0.0/10), link-local, cloud metadata included,
+// or unspecified.
+func IsInternal(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip)
+}
+
+// CheckDestination returns an *InternalError when host, a name or an
+// address, is internal in the sense of IsInternal or resolves to such an
+// address with the client's resolver. A name the client cannot resolve
+// passes: it is the proxy's to resolve, and names only the proxy knows go
+// unchecked.
+func (c *Client) CheckDestination(ctx context.Context, host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if IsInternal(ip) {
+			return &InternalError{Host: host, Addr: ip}
+		}
+		return nil
+	}
+	addrs, err := c.Resolver().LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil
+	}
+	for _, ip := range addrs {
+		if IsInternal(ip) {
+			return &InternalError{Host: host, Addr: ip}
+		}
+	}
+	return nil
+}
+
+// checkInternal applies DenyInternal to a request about to go to u.
+func (c *Client) checkInternal(ctx context.Context, u *url.URL) error {
+	if !c.cfg.DenyInternal {
+		return nil
+	}
+	return c.CheckDestination(ctx, u.Hostname())
+}
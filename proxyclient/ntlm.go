@@ -0,0 +1,134 @@
+package proxyclient
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// NTLMv2 (MS-NLMP) without signing or sealing, which is all proxy auth
+// uses. The negotiate, challenge and authenticate messages have to travel
+// on one connection.
+
+const (
+	ntlmNegotiateUnicode     = 0x00000001
+	ntlmNegotiateOEM         = 0x00000002
+	ntlmRequestTarget        = 0x00000004
+	ntlmNegotiateNTLM        = 0x00000200
+	ntlmNegotiateAlwaysSign  = 0x00008000
+	ntlmNegotiateExtendedSec = 0x00080000
+	ntlmNegotiate128         = 0x20000000
+	ntlmNegotiate56          = 0x80000000
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// ntlmNegotiate is the type 1 message opening the exchange.
+func ntlmNegotiate() []byte {
+	flags := uint32(ntlmNegotiateUnicode | ntlmNegotiateOEM | ntlmRequestTarget | ntlmNegotiateNTLM |
+		ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSec | ntlmNegotiate128 | ntlmNegotiate56)
+	msg := append([]byte{}, ntlmSignature...)
+	msg = binary.LittleEndian.AppendUint32(msg, 1)
+	msg = binary.LittleEndian.AppendUint32(msg, flags)
+	// empty domain and workstation fields
+	return append(msg, make([]byte, 16)...)
+}
+
+// ntlmChallenge is what the type 2 message carries.
+type ntlmChallenge struct {
+	flags      uint32
+	challenge  []byte
+	targetInfo []byte
+}
+
+func parseNTLMChallenge(msg []byte) (*ntlmChallenge, error) {
+	if len(msg) < 32 || !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 2 {
+		return nil, errors.New("ntlm: not a challenge message")
+	}
+	c := &ntlmChallenge{
+		flags:     binary.LittleEndian.Uint32(msg[20:]),
+		challenge: msg[24:32],
+	}
+	if len(msg) >= 48 {
+		n := int(binary.LittleEndian.Uint16(msg[40:]))
+		off := int(binary.LittleEndian.Uint32(msg[44:]))
+		if off+n > len(msg) {
+			return nil, errors.New("ntlm: truncated target info")
+		}
+		c.targetInfo = msg[off : off+n]
+	}
+	return c, nil
+}
+
+// ntlmAuthenticate builds the type 3 message answering c. user may be
+// DOMAIN\user; user@domain is passed through as the user name.
+func ntlmAuthenticate(c *ntlmChallenge, user, password string) []byte {
+	domain := ""
+	if i := strings.Index(user, `\`); i >= 0 {
+		domain, user = user[:i], user[i+1:]
+	}
+	clientChallenge := make([]byte, 8)
+	rand.Read(clientChallenge)
+	ts := uint64(time.Now().UnixNano()/100) + 116444736000000000 // since 1601
+	return ntlmAuthenticateAt(c, domain, user, password, clientChallenge, ts)
+}
+
+func ntlmAuthenticateAt(c *ntlmChallenge, domain, user, password string, clientChallenge []byte, ts uint64) []byte {
+	key := ntowfv2(domain, user, password)
+
+	temp := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	temp = binary.LittleEndian.AppendUint64(temp, ts)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, c.targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	ntProof := hmacMD5(key, append(append([]byte{}, c.challenge...), temp...))
+	nt := append(ntProof, temp...)
+	lm := append(hmacMD5(key, append(append([]byte{}, c.challenge...), clientChallenge...)), clientChallenge...)
+
+	flags := c.flags &^ ntlmNegotiateOEM
+	encode := utf16le
+	if flags&ntlmNegotiateUnicode == 0 {
+		encode = func(s string) []byte { return []byte(s) }
+	}
+	fields := [][]byte{lm, nt, encode(domain), encode(user), encode(""), nil}
+
+	const header = 64
+	msg := append([]byte{}, ntlmSignature...)
+	msg = binary.LittleEndian.AppendUint32(msg, 3)
+	var payload []byte
+	for _, f := range fields {
+		msg = binary.LittleEndian.AppendUint16(msg, uint16(len(f)))
+		msg = binary.LittleEndian.AppendUint16(msg, uint16(len(f)))
+		msg = binary.LittleEndian.AppendUint32(msg, uint32(header+len(payload)))
+		payload = append(payload, f...)
+	}
+	msg = binary.LittleEndian.AppendUint32(msg, flags)
+	return append(msg, payload...)
+}
+
+// ntowfv2 is the NTLMv2 response key.
+func ntowfv2(domain, user, password string) []byte {
+	return hmacMD5(md4(utf16le(password)), utf16le(strings.ToUpper(user)+domain))
+}
+
+func hmacMD5(key, data []byte) []byte {
+	m := hmac.New(md5.New, key)
+	m.Write(data)
+	return m.Sum(nil)
+}
+
+func utf16le(s string) []byte {
+	var b []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, r)
+	}
+	return b
+}
@@ -0,0 +1,64 @@
+package proxyclient
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// The NTLMv2 example of MS-NLMP 4.2.4: user User, domain Domain, password
+// Password, client challenge aa..aa at time 0.
+func TestNTLMv2(t *testing.T) {
+	challengeMsg := unhex(t, "4e544c4d53535000020000000c000c003800000033828ae20123456789abcdef"+
+		"00000000000000002400240044000000060070170000000f53006500720076006500720002000c00"+
+		"44006f006d00610069006e0001000c0053006500720076006500720000000000")
+	ch, err := parseNTLMChallenge(challengeMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := unhex(t, "0123456789abcdef"); !bytes.Equal(ch.challenge, want) {
+		t.Fatalf("server challenge %x, want %x", ch.challenge, want)
+	}
+	if want := unhex(t, "02000c0044006f006d00610069006e0001000c0053006500720076006500720000000000"); !bytes.Equal(ch.targetInfo, want) {
+		t.Fatalf("target info %x, want %x", ch.targetInfo, want)
+	}
+
+	if got, want := ntowfv2("Domain", "User", "Password"), unhex(t, "0c868a403bfd7a93a3001ef22ef02e3f"); !bytes.Equal(got, want) {
+		t.Errorf("NTOWFv2 %x, want %x", got, want)
+	}
+
+	msg := ntlmAuthenticateAt(ch, "Domain", "User", "Password", bytes.Repeat([]byte{0xaa}, 8), 0)
+	field := func(at int) []byte {
+		n := int(binary.LittleEndian.Uint16(msg[at:]))
+		off := int(binary.LittleEndian.Uint32(msg[at+4:]))
+		return msg[off : off+n]
+	}
+	tests := []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{"LMv2 response", field(12), "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa"},
+		{"NTProofStr", field(20)[:16], "68cd0ab851e51c96aabc927bebef6a1c"},
+		{"domain", field(28), "44006f006d00610069006e00"},
+		{"user", field(36), "5500730065007200"},
+	}
+	for _, tt := range tests {
+		if want := unhex(t, tt.want); !bytes.Equal(tt.got, want) {
+			t.Errorf("%s %x, want %x", tt.name, tt.got, want)
+		}
+	}
+	if got := binary.LittleEndian.Uint32(msg[8:]); got != 3 {
+		t.Errorf("message type %d, want 3", got)
+	}
+}
@@ -0,0 +1,73 @@
+package proxyclient
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// PinError is a destination handshake failed by PinSHA256: none of the
+// certificates the destination presented has a pinned key, what a proxy
+// intercepting TLS with its own CA looks like.
+type PinError struct {
+	// Presented are the SPKI hashes of the presented chain, leaf first.
+	Presented []string
+	// Issuer is the leaf's issuer, the intercepting CA if it is one.
+	Issuer string
+}
+
+func (e *PinError) Error() string {
+	return fmt.Sprintf("certificate pin mismatch: the destination presented %s, issued by %s", strings.Join(e.Presented, ", "), e.Issuer)
+}
+
+// SPKISHA256 is the pin of cert: the base64 SHA-256 of its subject public
+// key info, as in HPKP and curl's --pinnedpubkey, prefixed with sha256//.
+func SPKISHA256(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256//" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// parsePins normalizes PinSHA256 to the sha256// form.
+func parsePins(pins []string) (map[string]bool, error) {
+	if len(pins) == 0 {
+		return nil, nil
+	}
+	set := map[string]bool{}
+	for _, p := range pins {
+		b64 := strings.TrimPrefix(strings.TrimSpace(p), "sha256//")
+		sum, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin %q, want the base64 of a SHA-256", p)
+		}
+		set["sha256//"+b64] = true
+	}
+	return set, nil
+}
+
+// verifyPins is the destination TLS VerifyConnection with PinSHA256 set.
+// A verified chain passes when any of its certificates has a pinned key,
+// so pinning an intermediate or a root works; unverified, with Insecure,
+// only the leaf counts, the rest of what was presented proves nothing.
+// An https proxy's own handshake is not pinned, see tunneled.
+func (c *Client) verifyPins(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return &PinError{}
+	}
+	candidates := []*x509.Certificate{cs.PeerCertificates[0]}
+	for _, chain := range cs.VerifiedChains {
+		candidates = append(candidates, chain...)
+	}
+	for _, cert := range candidates {
+		if c.pins[SPKISHA256(cert)] {
+			return nil
+		}
+	}
+	e := &PinError{Issuer: cs.PeerCertificates[0].Issuer.String()}
+	for _, cert := range cs.PeerCertificates {
+		e.Presented = append(e.Presented, SPKISHA256(cert))
+	}
+	return e
+}
@@ -0,0 +1,413 @@
+package proxyclient
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+	"unicode/utf16"
+)
+
+// This is a PKCS#12 (RFC 7292) reader for client certificates, enough for
+// what OpenSSL, Windows and macOS export: PBES2 with AES or 3DES, the
+// legacy SHA1/3DES scheme, and SHA-1 or SHA-256 MACs. RC2 is not
+// supported.
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+
+	oidKeyBag          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidShroudedKeyBag  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+
+	oidSHA1            = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidHMACWithSHA1    = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256  = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidPBEWithSHA3DES  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPBES2           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidDESEDE3CBC      = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidAES128CBC       = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC       = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC       = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidPBEWithSHARC240 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 6}
+)
+
+type pfxPDU struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm algorithmIdentifier
+	Digest    []byte
+}
+
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm algorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"tag:0,optional"`
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue   `asn1:"tag:0,explicit"`
+	Attributes []asn1.RawValue `asn1:"set,optional"`
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     algorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc algorithmIdentifier
+	EncryptionScheme  algorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                 `asn1:"optional"`
+	PRF        algorithmIdentifier `asn1:"optional"`
+}
+
+// parsePKCS12 decodes a bundle holding one private key and its
+// certificates into a tls.Certificate, leaf first.
+func parsePKCS12(der []byte, password string) (tls.Certificate, error) {
+	var cert tls.Certificate
+	var pfx pfxPDU
+	if rest, err := asn1.Unmarshal(der, &pfx); err != nil {
+		return cert, fmt.Errorf("pkcs12: %s", err)
+	} else if len(rest) != 0 {
+		return cert, errors.New("pkcs12: trailing data")
+	}
+	if !pfx.AuthSafe.ContentType.Equal(oidData) {
+		return cert, errors.New("pkcs12: only password integrity mode is supported")
+	}
+	var authSafe []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafe); err != nil {
+		return cert, fmt.Errorf("pkcs12: %s", err)
+	}
+	if len(pfx.MacData.Mac.Digest) > 0 {
+		if err := verifyMac(&pfx.MacData, authSafe, password); err != nil {
+			return cert, err
+		}
+	}
+
+	var infos []contentInfo
+	if _, err := asn1.Unmarshal(authSafe, &infos); err != nil {
+		return cert, fmt.Errorf("pkcs12: %s", err)
+	}
+	var certs []*x509.Certificate
+	for _, ci := range infos {
+		var contents []byte
+		switch {
+		case ci.ContentType.Equal(oidData):
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &contents); err != nil {
+				return cert, fmt.Errorf("pkcs12: %s", err)
+			}
+		case ci.ContentType.Equal(oidEncryptedData):
+			var ed encryptedData
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+				return cert, fmt.Errorf("pkcs12: %s", err)
+			}
+			var err error
+			eci := ed.EncryptedContentInfo
+			if contents, err = pbeDecrypt(eci.ContentEncryptionAlgorithm, eci.EncryptedContent.Bytes, password); err != nil {
+				return cert, err
+			}
+		default:
+			return cert, fmt.Errorf("pkcs12: unsupported content type %s", ci.ContentType)
+		}
+
+		var bags []safeBag
+		if _, err := asn1.Unmarshal(contents, &bags); err != nil {
+			return cert, fmt.Errorf("pkcs12: %s", err)
+		}
+		for _, bag := range bags {
+			switch {
+			case bag.ID.Equal(oidCertBag):
+				var cb certBag
+				if _, err := asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+					return cert, fmt.Errorf("pkcs12: %s", err)
+				}
+				if !cb.ID.Equal(oidX509Certificate) {
+					continue
+				}
+				c, err := x509.ParseCertificate(cb.Data)
+				if err != nil {
+					return cert, fmt.Errorf("pkcs12: %s", err)
+				}
+				certs = append(certs, c)
+			case bag.ID.Equal(oidKeyBag), bag.ID.Equal(oidShroudedKeyBag):
+				if cert.PrivateKey != nil {
+					return cert, errors.New("pkcs12: more than one private key")
+				}
+				pkcs8 := bag.Value.Bytes
+				if bag.ID.Equal(oidShroudedKeyBag) {
+					var epki encryptedPrivateKeyInfo
+					if _, err := asn1.Unmarshal(bag.Value.Bytes, &epki); err != nil {
+						return cert, fmt.Errorf("pkcs12: %s", err)
+					}
+					var err error
+					if pkcs8, err = pbeDecrypt(epki.Algorithm, epki.EncryptedData, password); err != nil {
+						return cert, err
+					}
+				}
+				key, err := x509.ParsePKCS8PrivateKey(pkcs8)
+				if err != nil {
+					return cert, fmt.Errorf("pkcs12: %s", err)
+				}
+				cert.PrivateKey = key
+			}
+		}
+	}
+	if cert.PrivateKey == nil {
+		return cert, errors.New("pkcs12: no private key")
+	}
+
+	// the leaf is the certificate for the key, the rest is its chain
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return cert, fmt.Errorf("pkcs12: %T private key cannot sign", cert.PrivateKey)
+	}
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return cert, fmt.Errorf("pkcs12: %T public key cannot be matched to a certificate", signer.Public())
+	}
+	for i, c := range certs {
+		if pub.Equal(c.PublicKey) {
+			cert.Certificate = append(cert.Certificate, c.Raw)
+			cert.Leaf = c
+			certs = append(certs[:i], certs[i+1:]...)
+			break
+		}
+	}
+	if cert.Leaf == nil {
+		return cert, errors.New("pkcs12: no certificate for the private key")
+	}
+	for _, c := range certs {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert, nil
+}
+
+// verifyMac checks the bundle's HMAC, which is also how a wrong password
+// shows.
+func verifyMac(md *macData, content []byte, password string) error {
+	var h func() hash.Hash
+	switch alg := md.Mac.Algorithm.Algorithm; {
+	case alg.Equal(oidSHA1):
+		h = sha1.New
+	case alg.Equal(oidSHA256):
+		h = sha256.New
+	default:
+		return fmt.Errorf("pkcs12: unsupported mac algorithm %s", alg)
+	}
+	key := pkcs12KDF(h, md.MacSalt, bmpString(password), md.Iterations, 3, h().Size())
+	mac := hmac.New(h, key)
+	mac.Write(content)
+	if !hmac.Equal(mac.Sum(nil), md.Mac.Digest) {
+		return errors.New("pkcs12: wrong password or corrupted bundle")
+	}
+	return nil
+}
+
+// pbeDecrypt decrypts a bag or the encrypted safe contents.
+func pbeDecrypt(alg algorithmIdentifier, data []byte, password string) ([]byte, error) {
+	var block cipher.Block
+	var iv []byte
+	switch {
+	case alg.Algorithm.Equal(oidPBEWithSHA3DES):
+		var params pbeParams
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+			return nil, fmt.Errorf("pkcs12: %s", err)
+		}
+		pass := bmpString(password)
+		key := pkcs12KDF(sha1.New, params.Salt, pass, params.Iterations, 1, 24)
+		iv = pkcs12KDF(sha1.New, params.Salt, pass, params.Iterations, 2, 8)
+		var err error
+		if block, err = des.NewTripleDESCipher(key); err != nil {
+			return nil, err
+		}
+	case alg.Algorithm.Equal(oidPBES2):
+		var err error
+		if block, iv, err = pbes2Cipher(alg.Parameters.FullBytes, password); err != nil {
+			return nil, err
+		}
+	case alg.Algorithm.Equal(oidPBEWithSHARC240):
+		return nil, errors.New("pkcs12: RC2 encryption is not supported, re-export the bundle with AES")
+	default:
+		return nil, fmt.Errorf("pkcs12: unsupported encryption %s", alg.Algorithm)
+	}
+
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("pkcs12: bad ciphertext length")
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+	pad := int(out[len(out)-1])
+	if pad == 0 || pad > block.BlockSize() || !bytes.Equal(out[len(out)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, errors.New("pkcs12: wrong password or corrupted bundle")
+	}
+	return out[:len(out)-pad], nil
+}
+
+// pbes2Cipher derives the PBES2 (RFC 8018) key with PBKDF2. Unlike the
+// legacy scheme the password goes in as UTF-8.
+func pbes2Cipher(der []byte, password string) (cipher.Block, []byte, error) {
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(der, &params); err != nil {
+		return nil, nil, fmt.Errorf("pkcs12: %s", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, nil, fmt.Errorf("pkcs12: unsupported key derivation %s", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, nil, fmt.Errorf("pkcs12: %s", err)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, nil, fmt.Errorf("pkcs12: %s", err)
+	}
+
+	var keyLen int
+	newCipher := aes.NewCipher
+	switch alg := params.EncryptionScheme.Algorithm; {
+	case alg.Equal(oidAES128CBC):
+		keyLen = 16
+	case alg.Equal(oidAES192CBC):
+		keyLen = 24
+	case alg.Equal(oidAES256CBC):
+		keyLen = 32
+	case alg.Equal(oidDESEDE3CBC):
+		keyLen, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, nil, fmt.Errorf("pkcs12: unsupported cipher %s", alg)
+	}
+
+	var key []byte
+	var err error
+	switch prf := kdf.PRF.Algorithm; {
+	case len(prf) == 0, prf.Equal(oidHMACWithSHA1):
+		key, err = pbkdf2.Key(sha1.New, password, kdf.Salt, kdf.Iterations, keyLen)
+	case prf.Equal(oidHMACWithSHA256):
+		key, err = pbkdf2.Key(sha256.New, password, kdf.Salt, kdf.Iterations, keyLen)
+	default:
+		return nil, nil, fmt.Errorf("pkcs12: unsupported prf %s", prf)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := newCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, nil, errors.New("pkcs12: bad iv")
+	}
+	return block, iv, nil
+}
+
+// bmpString is the password as the legacy KDF wants it: UTF-16 big
+// endian with a terminating zero.
+func bmpString(s string) []byte {
+	var b []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(r>>8), byte(r))
+	}
+	return append(b, 0, 0)
+}
+
+// pkcs12KDF derives size bytes of key material for purpose id (1 key, 2
+// iv, 3 mac) as in RFC 7292 appendix B.2.
+func pkcs12KDF(h func() hash.Hash, salt, password []byte, iterations int, id byte, size int) []byte {
+	u := h().Size()
+	v := h().BlockSize()
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fill(salt), fill(password)...)
+
+	var out []byte
+	for len(out) < size {
+		a := append(append([]byte{}, d...), i...)
+		for r := 0; r < iterations; r++ {
+			sum := h()
+			sum.Write(a)
+			a = sum.Sum(nil)
+		}
+		out = append(out, a...)
+
+		// I_j = (I_j + B + 1) mod 2^(8v) for every v byte block of I
+		b := make([]byte, v)
+		for k := range b {
+			b[k] = a[k%u]
+		}
+		for j := 0; j < len(i); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				carry += int(i[j+k]) + int(b[k])
+				i[j+k] = byte(carry)
+				carry >>= 8
+			}
+		}
+	}
+	return out[:size]
+}
@@ -0,0 +1,89 @@
+package proxyclient
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// tokenBucket paces bytes to rate a second, letting up to burst through
+// at once. Bytes taken beyond the tokens there are become a debt the
+// next taker waits out, so a read can be charged after it returned.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	burst := float64(rate) / 10
+	if burst < 1024 {
+		burst = 1024
+	}
+	if burst > 64<<10 {
+		burst = 64 << 10
+	}
+	return &tokenBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take charges n bytes and sleeps until the bucket is out of debt.
+func (b *tokenBucket) take(n int) {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// limitedConn throttles a connection with the client's buckets, one per
+// direction shared by all its connections.
+type limitedConn struct {
+	net.Conn
+	read, write *tokenBucket
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if max := int(c.read.burst); len(p) > max {
+		p = p[:max]
+	}
+	n, err := c.Conn.Read(p)
+	c.read.take(n)
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if max := int(c.write.burst); len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		c.write.take(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// limit wraps conn in the LimitRate throttle, if any.
+func (c *Client) limit(conn net.Conn) net.Conn {
+	if c.readBucket == nil {
+		return conn
+	}
+	return &limitedConn{Conn: conn, read: c.readBucket, write: c.writeBucket}
+}
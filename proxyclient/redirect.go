@@ -0,0 +1,96 @@
+package proxyclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Hop is one request of a redirect chain. Location is where a redirect
+// points, Proxied whether the hop went through the proxy.
+type Hop struct {
+	URL      string
+	Status   int
+	Location string
+	Proxied  bool
+	Duration time.Duration
+	Err      error
+}
+
+type hopsKey struct{}
+
+// WithHops returns a context whose requests, including the redirects the
+// client follows, are recorded into hops.
+func WithHops(ctx context.Context, hops *[]Hop) context.Context {
+	return context.WithValue(ctx, hopsKey{}, hops)
+}
+
+// hopTransport times every round trip separately, so each redirect hop
+// gets its own timeout instead of sharing one for the whole chain.
+type hopTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+	stats   *Stats
+	wire    *wireLog
+}
+
+func (t *hopTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cancel := context.CancelFunc(func() {})
+	if t.timeout > 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(req.Context(), t.timeout)
+		req = req.WithContext(ctx)
+	}
+	atomic.AddInt64(&t.stats.RoundTrips, 1)
+	if t.wire != nil {
+		req = req.WithContext(t.wire.trace(req.Context(), req))
+	}
+	req, record := recordExchange(req)
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// the hop timeout also covers reading the body, so release it on close
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	record(resp)
+	t.wire.response(resp)
+	return resp, nil
+}
+
+// hopRecorder records a Hop for every request of the redirect chain. It
+// sits outside the retries, a hop tried three times is still one hop, its
+// Duration the tries and their backoff.
+type hopRecorder struct {
+	next    http.RoundTripper
+	proxied bool
+}
+
+func (t *hopRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	hops, ok := req.Context().Value(hopsKey{}).(*[]Hop)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	h := Hop{URL: req.URL.Redacted(), Proxied: t.proxied, Duration: time.Since(start), Err: err}
+	if resp != nil {
+		h.Status = resp.StatusCode
+		h.Location = resp.Header.Get("Location")
+	}
+	*hops = append(*hops, h)
+	return resp, err
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
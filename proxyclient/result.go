@@ -0,0 +1,213 @@
+package proxyclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Result is the machine readable outcome of a request, the schema the
+// command line's JSON output shares.
+type Result struct {
+	URL    string `json:"url,omitempty"`
+	Status int    `json:"status,omitempty"`
+	Proto  string `json:"proto,omitempty"`
+	Reused bool   `json:"reused,omitempty"`
+	// Conn is the local address of the connection, Idle how long it
+	// waited in the pool before this request reused it.
+	Conn string        `json:"conn,omitempty"`
+	Idle time.Duration `json:"idle,omitempty"`
+	// Dialed is the IP:port the first connection went to, the proxy's
+	// with one; "" on a reused connection.
+	Dialed string  `json:"dialed,omitempty"`
+	Phases []Phase `json:"phases,omitempty"`
+	// TLS lists the handshakes, the proxy's first for an https proxy.
+	TLS   []TLSInfo  `json:"tls,omitempty"`
+	Proxy *ProxyInfo `json:"proxy,omitempty"`
+	// ErrorClass is "" on success, otherwise one of dns, connect,
+	// timeout, canceled, tls, proxy_connect, proxy_auth or other.
+	ErrorClass string `json:"error_class,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// Fallback is why the request went direct with Fallback "direct", the
+	// error reaching the proxy; "" when it did not.
+	Fallback string `json:"fallback,omitempty"`
+}
+
+// TLSInfo describes one TLS session. Leg is "proxy" or "destination".
+type TLSInfo struct {
+	Leg          string     `json:"leg"`
+	Version      string     `json:"version"`
+	CipherSuite  string     `json:"cipher_suite"`
+	ALPN         string     `json:"alpn,omitempty"`
+	Certificates []CertInfo `json:"certificates,omitempty"`
+}
+
+// CertInfo is one certificate of a peer chain, leaf first.
+type CertInfo struct {
+	Subject  string    `json:"subject"`
+	Issuer   string    `json:"issuer"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+// ProxyInfo is the proxy a request went through. URL has the password
+// masked; ConnectStatus is set when CONNECT failed.
+type ProxyInfo struct {
+	URL           string `json:"url"`
+	Scheme        string `json:"scheme"`
+	Auth          string `json:"auth,omitempty"`
+	ConnectStatus int    `json:"connect_status,omitempty"`
+}
+
+// Measure is Do returning the Result of the request as well. The phases
+// are complete once the body is read to the end or closed. Traces and a
+// WithConnectResponse already on the request's context keep working.
+func (c *Client) Measure(req *http.Request) (*http.Response, *Result, error) {
+	res := &Result{URL: req.URL.Redacted()}
+	if p := c.proxyURL; p != nil {
+		res.Proxy = &ProxyInfo{URL: p.Redacted(), Scheme: p.Scheme, Auth: c.cfg.Auth}
+	}
+	var mu sync.Mutex
+	var legs []tls.ConnectionState
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
+			if err == nil {
+				mu.Lock()
+				legs = append(legs, cs)
+				mu.Unlock()
+			}
+		},
+	}
+	t := &Timing{}
+	t.Trace(trace)
+	ctx := httptrace.WithClientTrace(req.Context(), trace)
+	connect, ok := ctx.Value(connectKey{}).(**http.Response)
+	if !ok {
+		connect = new(*http.Response)
+		ctx = WithConnectResponse(ctx, connect)
+	}
+	fallback, ok := ctx.Value(fallbackKey{}).(*string)
+	if !ok {
+		fallback = new(string)
+		ctx = WithFallback(ctx, fallback)
+	}
+
+	resp, err := c.Do(req.WithContext(ctx))
+	res.Reused, res.Dialed = t.Reused(), t.Dialed()
+	res.Conn, res.Idle = t.Conn()
+	res.Fallback = *fallback
+	mu.Lock()
+	defer mu.Unlock()
+	if c.proxyURL != nil && c.proxyURL.Scheme == "https" && res.Fallback == "" && len(legs) > 0 {
+		res.TLS = append(res.TLS, tlsInfo("proxy", &legs[0]))
+		legs = legs[1:]
+	}
+	if err != nil {
+		res.Phases = t.Phases(c.proxyURL, req.URL.Scheme)
+		if len(legs) > 0 {
+			res.TLS = append(res.TLS, tlsInfo("destination", &legs[len(legs)-1]))
+		}
+		if *connect != nil && res.Proxy != nil {
+			res.Proxy.ConnectStatus = (*connect).StatusCode
+		}
+		res.ErrorClass, res.Error = ErrorClass(err, *connect), err.Error()
+		return nil, res, err
+	}
+	res.URL, res.Status, res.Proto = resp.Request.URL.Redacted(), resp.StatusCode, resp.Proto
+	// for http destinations behind an https proxy resp.TLS is the proxy leg
+	if resp.TLS != nil && resp.Request.URL.Scheme == "https" {
+		res.TLS = append(res.TLS, tlsInfo("destination", resp.TLS))
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		res.ErrorClass = "proxy_auth"
+	}
+	resp.Body = &resultBody{ReadCloser: resp.Body, done: func() {
+		res.Phases = t.Phases(c.proxyURL, req.URL.Scheme)
+	}}
+	return resp, res, nil
+}
+
+func tlsInfo(leg string, cs *tls.ConnectionState) TLSInfo {
+	info := TLSInfo{
+		Leg:         leg,
+		Version:     tls.VersionName(cs.Version),
+		CipherSuite: tls.CipherSuiteName(cs.CipherSuite),
+		ALPN:        cs.NegotiatedProtocol,
+	}
+	for _, cert := range cs.PeerCertificates {
+		info.Certificates = append(info.Certificates, CertInfo{
+			Subject:  cert.Subject.String(),
+			Issuer:   cert.Issuer.String(),
+			NotAfter: cert.NotAfter,
+		})
+	}
+	return info
+}
+
+// ErrorClass sorts a failed request or Tunnel by where it broke down, as
+// Result.ErrorClass does. connect is the failed CONNECT's response, see
+// WithConnectResponse, nil for none.
+func ErrorClass(err error, connect *http.Response) string {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuth x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var pinErr *PinError
+	var verifyErr *VerificationError
+	switch {
+	case connect != nil && connect.StatusCode == http.StatusProxyAuthRequired:
+		return "proxy_auth"
+	case connect != nil:
+		return "proxy_connect"
+	case errors.Is(err, errSOCKSNoMethod), errors.Is(err, errSOCKSUserPass),
+		// the transport's own SOCKS client does not export its errors
+		strings.Contains(err.Error(), "no acceptable authentication methods"),
+		strings.Contains(err.Error(), "username/password authentication failed"):
+		return "proxy_auth"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &recordErr), errors.As(err, &certErr), errors.As(err, &unknownAuth),
+		errors.As(err, &hostErr), errors.As(err, &invalidErr), errors.As(err, &pinErr),
+		errors.As(err, &verifyErr):
+		return "tls"
+	case errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect"):
+		return "connect"
+	}
+	return "other"
+}
+
+// resultBody completes the Result's phases when the body ends.
+type resultBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *resultBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.once.Do(b.done)
+	}
+	return n, err
+}
+
+func (b *resultBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
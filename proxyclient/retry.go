@@ -0,0 +1,133 @@
+package proxyclient
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Retry configures resending round trips that fail transiently.
+type Retry struct {
+	// Max is the number of retries after the first attempt.
+	Max int
+	// Backoff is the wait before the first retry, doubled for every
+	// following one and jittered down to half of it.
+	Backoff time.Duration
+	// Statuses are the response codes retried, e.g. 502, 503, 504.
+	Statuses []int
+	// Network retries errors without a response: refused or reset
+	// connections, failed CONNECTs, timeouts.
+	Network bool
+	// Seed makes the jitter repeatable, the same seed waiting the same;
+	// 0 picks a random one.
+	Seed int64
+}
+
+// Attempt is one try of a retried round trip.
+type Attempt struct {
+	URL    string
+	Try    int // 1 for the first attempt
+	Status int
+	Err    error
+	// Wait is the backoff before the next try, 0 for the last one.
+	Wait time.Duration
+}
+
+type attemptsKey struct{}
+
+// WithAttempts returns a context whose round trips record every try into
+// attempts when the client retries.
+func WithAttempts(ctx context.Context, attempts *[]Attempt) context.Context {
+	return context.WithValue(ctx, attemptsKey{}, attempts)
+}
+
+// retryTransport resends round trips the policy deems transient. Requests
+// with a body are only retried when GetBody can replay it.
+type retryTransport struct {
+	next  http.RoundTripper
+	retry Retry
+	stats *Stats
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newRetryTransport(next http.RoundTripper, r Retry, stats *Stats) *retryTransport {
+	seed := r.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &retryTransport{next: next, retry: r, stats: stats, rand: rand.New(rand.NewSource(seed))}
+}
+
+// jitter returns a random duration in [0, d].
+func (t *retryTransport) jitter(d time.Duration) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Duration(t.rand.Int63n(int64(d) + 1))
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts, _ := req.Context().Value(attemptsKey{}).(*[]Attempt)
+	wait := t.retry.Backoff
+	for try := 1; ; try++ {
+		if try > 1 && req.Body != nil && req.Body != http.NoBody {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		resp, err := t.next.RoundTrip(req)
+		a := Attempt{URL: req.URL.Redacted(), Try: try, Err: err}
+		if resp != nil {
+			a.Status = resp.StatusCode
+		}
+		again := try <= t.retry.Max && t.retryable(req, resp, err)
+		if again {
+			// full jitter over the upper half keeps clients apart
+			a.Wait = wait/2 + t.jitter(wait/2)
+			wait *= 2
+		}
+		if attempts != nil {
+			*attempts = append(*attempts, a)
+		}
+		if !again {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		atomic.AddInt64(&t.stats.Retries, 1)
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(a.Wait):
+		}
+	}
+}
+
+func (t *retryTransport) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		return t.retry.Network
+	}
+	for _, s := range t.retry.Statuses {
+		if resp.StatusCode == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package proxyclient
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scriptedTransport answers round trips in turn with the statuses, 0 for
+// a network error.
+type scriptedTransport struct {
+	statuses []int
+	calls    int
+}
+
+func (s *scriptedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	code := s.statuses[s.calls]
+	s.calls++
+	if req.Body != nil {
+		ioutil.ReadAll(req.Body)
+	}
+	if code == 0 {
+		return nil, errors.New("connection refused")
+	}
+	return &http.Response{StatusCode: code, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		retry    Retry
+		method   string
+		getBody  bool
+		statuses []int
+		calls    int
+		status   int // 0 for an error
+	}{
+		{"no policy", Retry{Max: 3}, "GET", false, []int{503, 200}, 1, 503},
+		{"status retried", Retry{Max: 3, Statuses: []int{502, 503}}, "GET", false, []int{503, 502, 200}, 3, 200},
+		{"retries exhausted", Retry{Max: 2, Statuses: []int{503}}, "GET", false, []int{503, 503, 503, 200}, 3, 503},
+		{"status not listed", Retry{Max: 2, Statuses: []int{502}}, "GET", false, []int{503, 200}, 1, 503},
+		{"network retried", Retry{Max: 2, Network: true}, "GET", false, []int{0, 0, 200}, 3, 200},
+		{"network not listed", Retry{Max: 2, Statuses: []int{503}}, "GET", false, []int{0, 200}, 1, 0},
+		{"body replayed", Retry{Max: 1, Statuses: []int{503}}, "POST", true, []int{503, 200}, 2, 200},
+		// a body that cannot be sent again is not retried
+		{"body not replayable", Retry{Max: 1, Statuses: []int{503}}, "POST", false, []int{503, 200}, 1, 503},
+	}
+	for _, tt := range tests {
+		next := &scriptedTransport{statuses: tt.statuses}
+		tt.retry.Backoff = time.Millisecond
+		rt := newRetryTransport(next, tt.retry, &Stats{})
+		req, _ := http.NewRequest(tt.method, "http://example.com/", nil)
+		if tt.method == "POST" {
+			req, _ = http.NewRequest(tt.method, "http://example.com/", strings.NewReader("data"))
+			if !tt.getBody {
+				req.GetBody = nil
+			}
+		}
+		var attempts []Attempt
+		resp, err := rt.RoundTrip(req.WithContext(WithAttempts(req.Context(), &attempts)))
+		status := 0
+		if err == nil {
+			status = resp.StatusCode
+		}
+		if next.calls != tt.calls || status != tt.status {
+			t.Errorf("%s: %d calls ending with %d (%v), want %d ending with %d", tt.name, next.calls, status, err, tt.calls, tt.status)
+		}
+		if len(attempts) != tt.calls || rt.stats.Retries != int64(tt.calls-1) {
+			t.Errorf("%s: %d attempts and %d retries recorded, want %d and %d", tt.name, len(attempts), rt.stats.Retries, tt.calls, tt.calls-1)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	next := &scriptedTransport{statuses: []int{503, 503, 503, 503}}
+	backoff := 4 * time.Millisecond
+	rt := newRetryTransport(next, Retry{Max: 3, Backoff: backoff, Statuses: []int{503}}, &Stats{})
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	var attempts []Attempt
+	rt.RoundTrip(req.WithContext(WithAttempts(req.Context(), &attempts)))
+	if len(attempts) != 4 {
+		t.Fatalf("%d attempts, want 4", len(attempts))
+	}
+	// each wait doubles and is jittered into the upper half of it
+	for i, a := range attempts[:3] {
+		full := backoff << uint(i)
+		if a.Try != i+1 || a.Wait < full/2 || a.Wait > full {
+			t.Errorf("attempt %d waited %s, want between %s and %s", a.Try, a.Wait, full/2, full)
+		}
+	}
+	if last := attempts[3]; last.Wait != 0 || last.Status != 503 {
+		t.Errorf("last attempt waited %s with %d, want no wait and the 503", last.Wait, last.Status)
+	}
+}
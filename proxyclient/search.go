@@ -0,0 +1,142 @@
+package proxyclient
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// searchList expands short host names the way the resolver would, but in
+// the open, so the name actually probed can be reported and controlled.
+type searchList struct {
+	domains  []string
+	ndots    int
+	hosts    map[string]bool
+	resolver *net.Resolver
+}
+
+// newSearchList parses -search-domains: "" keeps the system search list
+// and ndots from /etc/resolv.conf, "none" disables expansion, anything
+// else is a comma separated list of domains tried in order.
+func newSearchList(spec string) *searchList {
+	l := &searchList{ndots: 1}
+	switch spec {
+	case "":
+		l = systemSearchList("/etc/resolv.conf")
+	case "none":
+	default:
+		for _, d := range strings.Split(spec, ",") {
+			if d = strings.Trim(strings.TrimSpace(d), "."); d != "" {
+				l.domains = append(l.domains, d)
+			}
+		}
+	}
+	l.hosts = hostsNames("/etc/hosts")
+	return l
+}
+
+// hostsNames returns the lower case names in a hosts file. The resolver
+// does not consult it for rooted names, which is all fqdn looks up.
+func hostsNames(path string) map[string]bool {
+	names := map[string]bool{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return names
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		for i := 1; i < len(fields); i++ {
+			names[strings.ToLower(strings.TrimSuffix(fields[i], "."))] = true
+		}
+	}
+	return names
+}
+
+func systemSearchList(path string) *searchList {
+	l := &searchList{ndots: 1}
+	f, err := os.Open(path)
+	if err != nil {
+		return l
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "search", "domain":
+			l.domains = fields[1:]
+		case "options":
+			for _, o := range fields[1:] {
+				if strings.HasPrefix(o, "ndots:") {
+					if n, err := strconv.Atoi(o[len("ndots:"):]); err == nil {
+						l.ndots = n
+					}
+				}
+			}
+		}
+	}
+	return l
+}
+
+// candidates returns the rooted names tried for host, in resolver order.
+func (l *searchList) candidates(host string) []string {
+	if strings.HasSuffix(host, ".") || net.ParseIP(host) != nil {
+		return []string{host}
+	}
+	var expanded []string
+	for _, d := range l.domains {
+		expanded = append(expanded, host+"."+d+".")
+	}
+	if strings.Count(host, ".") >= l.ndots {
+		return append([]string{host + "."}, expanded...)
+	}
+	return append(expanded, host+".")
+}
+
+// fqdn returns the first candidate for host that resolves from here, or
+// "" when none does, looked up within ctx. Names from the hosts file come
+// back unrooted, which is the only way the resolver finds them.
+func (l *searchList) fqdn(ctx context.Context, host string) string {
+	for _, c := range l.candidates(host) {
+		if net.ParseIP(c) != nil {
+			return c
+		}
+		if name := strings.TrimSuffix(c, "."); l.hosts[strings.ToLower(name)] {
+			return name
+		}
+		if _, err := l.resolver.LookupHost(ctx, c); err == nil {
+			return c
+		}
+	}
+	return ""
+}
+
+// FQDN returns the name host is dialed as after search list expansion, ""
+// when no candidate resolves from here, with the lookups bound to ctx.
+// Results are kept for the life of the client so the name reported is the
+// name dialed, but not those of lookups ctx cut short.
+func (c *Client) FQDN(ctx context.Context, host string) string {
+	c.mu.Lock()
+	fqdn, ok := c.names[host]
+	c.mu.Unlock()
+	if ok {
+		return fqdn
+	}
+	fqdn = c.search.fqdn(ctx, host)
+	if ctx.Err() != nil {
+		return fqdn
+	}
+	c.mu.Lock()
+	c.names[host] = fqdn
+	c.mu.Unlock()
+	return fqdn
+}
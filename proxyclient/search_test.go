@@ -0,0 +1,81 @@
+package proxyclient
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSearchCandidates(t *testing.T) {
+	tests := []struct {
+		domains []string
+		ndots   int
+		host    string
+		want    []string
+	}{
+		// fewer dots than ndots: the search list first, the name as given last
+		{[]string{"corp.example", "example"}, 1, "intranet", []string{"intranet.corp.example.", "intranet.example.", "intranet."}},
+		{[]string{"corp.example"}, 5, "a.b.c", []string{"a.b.c.corp.example.", "a.b.c."}},
+		// as many dots as ndots or more: the name as given first
+		{[]string{"corp.example"}, 1, "www.google", []string{"www.google.", "www.google.corp.example."}},
+		{[]string{"corp.example"}, 0, "intranet", []string{"intranet.", "intranet.corp.example."}},
+		{[]string{"corp.example"}, 2, "a.b.c", []string{"a.b.c.", "a.b.c.corp.example."}},
+		// rooted names and addresses are never expanded
+		{[]string{"corp.example"}, 1, "rooted.", []string{"rooted."}},
+		{[]string{"corp.example"}, 1, "10.0.0.1", []string{"10.0.0.1"}},
+		{[]string{"corp.example"}, 1, "::1", []string{"::1"}},
+		{nil, 1, "intranet", []string{"intranet."}},
+	}
+	for _, tt := range tests {
+		l := &searchList{domains: tt.domains, ndots: tt.ndots}
+		if got := l.candidates(tt.host); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("candidates(%q) with search %q ndots:%d = %q, want %q", tt.host, tt.domains, tt.ndots, got, tt.want)
+		}
+	}
+}
+
+func TestSystemSearchList(t *testing.T) {
+	tests := []struct {
+		conf    string
+		domains []string
+		ndots   int
+	}{
+		{"nameserver 10.0.0.53\nsearch corp.example example\noptions timeout:2 ndots:3\n", []string{"corp.example", "example"}, 3},
+		{"domain corp.example\n", []string{"corp.example"}, 1},
+		// the last search or domain line wins, as in the resolver
+		{"domain old.example\nsearch corp.example\n", []string{"corp.example"}, 1},
+		{"options ndots:x\n", nil, 1},
+		{"", nil, 1},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "resolv.conf")
+		if err := ioutil.WriteFile(path, []byte(tt.conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		l := systemSearchList(path)
+		if !reflect.DeepEqual(l.domains, tt.domains) || l.ndots != tt.ndots {
+			t.Errorf("systemSearchList(%q) = %q ndots:%d, want %q ndots:%d", tt.conf, l.domains, l.ndots, tt.domains, tt.ndots)
+		}
+	}
+	if l := systemSearchList(filepath.Join(t.TempDir(), "missing")); l.domains != nil || l.ndots != 1 {
+		t.Errorf("systemSearchList of a missing file = %q ndots:%d, want no domains ndots:1", l.domains, l.ndots)
+	}
+}
+
+func TestNewSearchList(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []string
+	}{
+		{"corp.example, .example.", []string{"corp.example", "example"}},
+		{"corp.example,,", []string{"corp.example"}},
+		{"none", nil},
+	}
+	for _, tt := range tests {
+		l := newSearchList(tt.spec)
+		if !reflect.DeepEqual(l.domains, tt.want) || l.ndots != 1 {
+			t.Errorf("newSearchList(%q) = %q ndots:%d, want %q ndots:1", tt.spec, l.domains, l.ndots, tt.want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package proxyclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// The transport's SOCKS5 support offers no auth but username/password, so
+// for GSSAPI (RFC 1961) the client speaks SOCKS5 itself. Like the
+// transport it sends the destination name and lets the proxy resolve it.
+
+const (
+	socksVersion      = 5
+	socksNoAuth       = 0x00
+	socksGSSAPI       = 0x01
+	socksUserPass     = 0x02
+	socksNoAcceptable = 0xff
+	socksConnect      = 0x01
+	socksIPv4         = 0x01
+	socksDomain       = 0x03
+	socksIPv6         = 0x04
+)
+
+var (
+	// errSOCKSNoMethod is the proxy refusing every auth method offered,
+	// no auth included when there are no credentials.
+	errSOCKSNoMethod = errors.New("socks: proxy accepts none of the offered auth methods")
+	errSOCKSUserPass = errors.New("socks: username/password rejected")
+)
+
+var socksReplies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// dialSOCKS returns a connection to addr through the SOCKS5 proxy.
+func (c *Client) dialSOCKS(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("socks: bad port %q", portStr)
+	}
+	proxyAddr := c.proxyURL.Host
+	if c.proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(c.proxyURL.Hostname(), "1080")
+	}
+	conn, err := c.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	tunnel, err := c.socksHandshake(conn, host, port)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+func (c *Client) socksHandshake(conn net.Conn, host string, port int) (net.Conn, error) {
+	br := bufio.NewReader(conn)
+	user, password, _ := c.creds.get()
+	methods := []byte{socksNoAuth}
+	switch {
+	case c.cfg.Auth == "gssapi":
+		methods = []byte{socksGSSAPI}
+	case user != "" || password != "":
+		methods = append(methods, socksUserPass)
+	}
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return nil, err
+	}
+	var choice [2]byte
+	if _, err := io.ReadFull(br, choice[:]); err != nil {
+		return nil, err
+	}
+	if choice[0] != socksVersion {
+		return nil, fmt.Errorf("socks: proxy answered version %d", choice[0])
+	}
+	if choice[1] != socksNoAcceptable && bytes.IndexByte(methods, choice[1]) < 0 {
+		return nil, fmt.Errorf("socks: proxy chose unoffered auth method %d", choice[1])
+	}
+
+	tunnel := conn
+	switch choice[1] {
+	case socksNoAuth:
+	case socksUserPass:
+		if err := socksUserPassAuth(conn, br, user, password); err != nil {
+			return nil, err
+		}
+	case socksGSSAPI:
+		g, err := c.gssapi()
+		if err != nil {
+			return nil, err
+		}
+		if tunnel, err = socksGSSAPIAuth(conn, br, g, c.gssapiTarget(), c.cfg.GSSAPIProtection); err != nil {
+			return nil, err
+		}
+		// the encapsulation reads through its own buffer
+		br = bufio.NewReader(tunnel)
+	default:
+		return nil, errSOCKSNoMethod
+	}
+
+	req := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(append(req, socksIPv4), ip.To4()...)
+	} else if ip != nil {
+		req = append(append(req, socksIPv6), ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("socks: host name too long")
+		}
+		req = append(append(req, socksDomain, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := tunnel.Write(req); err != nil {
+		return nil, err
+	}
+	var head [4]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return nil, err
+	}
+	if head[1] != 0 {
+		reason := socksReplies[head[1]]
+		if reason == "" {
+			reason = fmt.Sprintf("reply %d", head[1])
+		}
+		return nil, fmt.Errorf("socks: connect: %s", reason)
+	}
+	var skip int
+	switch head[3] {
+	case socksIPv4:
+		skip = 4
+	case socksIPv6:
+		skip = 16
+	case socksDomain:
+		n, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		skip = int(n)
+	default:
+		return nil, fmt.Errorf("socks: bad bound address type %d", head[3])
+	}
+	if _, err := br.Discard(skip + 2); err != nil {
+		return nil, err
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: tunnel, r: br}, nil
+	}
+	return tunnel, nil
+}
+
+// socksUserPassAuth runs RFC 1929.
+func socksUserPassAuth(conn net.Conn, br *bufio.Reader, user, password string) error {
+	if len(user) > 255 || len(password) > 255 {
+		return errors.New("socks: user or password too long")
+	}
+	msg := append([]byte{1, byte(len(user))}, user...)
+	msg = append(append(msg, byte(len(password))), password...)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(br, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errSOCKSUserPass
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package proxyclient
+
+import "errors"
+
+func newSSPINegotiate(host string) (sspiContext, error) {
+	return nil, errors.New("sspi auth is only available on windows builds")
+}
+
+func newPlatformGSSAPI() (GSSAPI, error) {
+	return nil, errors.New("gssapi: no built-in mechanism on this platform, set Config.GSSAPI, -gssapi-cmd on the command line")
+}
@@ -0,0 +1,249 @@
+package proxyclient
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	secur32                        = syscall.NewLazyDLL("secur32.dll")
+	procAcquireCredentialsHandleW  = secur32.NewProc("AcquireCredentialsHandleW")
+	procInitializeSecurityContextW = secur32.NewProc("InitializeSecurityContextW")
+	procDeleteSecurityContext      = secur32.NewProc("DeleteSecurityContext")
+	procFreeCredentialsHandle      = secur32.NewProc("FreeCredentialsHandle")
+	procFreeContextBuffer          = secur32.NewProc("FreeContextBuffer")
+	procQueryContextAttributesW    = secur32.NewProc("QueryContextAttributesW")
+	procEncryptMessage             = secur32.NewProc("EncryptMessage")
+	procDecryptMessage             = secur32.NewProc("DecryptMessage")
+)
+
+const (
+	secpkgCredOutbound    = 2
+	securityNativeDrep    = 0x10
+	secbufferData         = 1
+	secbufferToken        = 2
+	secbufferPadding      = 9
+	secbufferStream       = 10
+	iscReqMutualAuth      = 0x2
+	iscReqConfidentiality = 0x10
+	iscReqAllocateMemory  = 0x100
+	iscReqConnection      = 0x800
+	iscReqIntegrity       = 0x10000
+	secpkgAttrSizes       = 0
+	secqopWrapNoEncrypt   = 0x80000001
+	secEOK                = 0
+	secIContinueNeeded    = 0x00090312
+)
+
+type secHandle struct {
+	lower, upper uintptr
+}
+
+type secTimeStamp struct {
+	lowPart  uint32
+	highPart int32
+}
+
+type secBuffer struct {
+	cbBuffer   uint32
+	bufferType uint32
+	pvBuffer   *byte
+}
+
+type secBufferDesc struct {
+	ulVersion uint32
+	cBuffers  uint32
+	pBuffers  *secBuffer
+}
+
+// sspiNegotiate is a Negotiate context for the logged-in user towards
+// HTTP/host. Kerberos is done in one leg, the NTLM fallback takes three,
+// each step fed the token of the proxy's 407.
+type sspiNegotiate struct {
+	cred, ctx secHandle
+	spn       *uint16
+	started   bool
+}
+
+func newSSPINegotiate(host string) (sspiContext, error) {
+	if err := secur32.Load(); err != nil {
+		return nil, err
+	}
+	n := &sspiNegotiate{}
+	n.spn, _ = syscall.UTF16PtrFromString("HTTP/" + host)
+	pkg, _ := syscall.UTF16PtrFromString("Negotiate")
+	var expiry secTimeStamp
+	r, _, _ := procAcquireCredentialsHandleW.Call(0, uintptr(unsafe.Pointer(pkg)), secpkgCredOutbound,
+		0, 0, 0, 0, uintptr(unsafe.Pointer(&n.cred)), uintptr(unsafe.Pointer(&expiry)))
+	if r != secEOK {
+		return nil, fmt.Errorf("sspi: AcquireCredentialsHandle: 0x%x", r)
+	}
+	return n, nil
+}
+
+// step runs InitializeSecurityContext on input, nil for the first leg,
+// and returns the token to send; done is SEC_E_OK.
+func (n *sspiNegotiate) step(input []byte) ([]byte, bool, error) {
+	out := secBuffer{bufferType: secbufferToken}
+	outDesc := secBufferDesc{cBuffers: 1, pBuffers: &out}
+	var inDesc *secBufferDesc
+	if len(input) > 0 {
+		in := secBuffer{cbBuffer: uint32(len(input)), bufferType: secbufferToken, pvBuffer: &input[0]}
+		inDesc = &secBufferDesc{cBuffers: 1, pBuffers: &in}
+	}
+	var ctxIn *secHandle
+	if n.started {
+		ctxIn = &n.ctx
+	}
+	var attrs uint32
+	var expiry secTimeStamp
+	r, _, _ := procInitializeSecurityContextW.Call(uintptr(unsafe.Pointer(&n.cred)), uintptr(unsafe.Pointer(ctxIn)),
+		uintptr(unsafe.Pointer(n.spn)), iscReqAllocateMemory|iscReqConnection, 0, securityNativeDrep,
+		uintptr(unsafe.Pointer(inDesc)), 0, uintptr(unsafe.Pointer(&n.ctx)), uintptr(unsafe.Pointer(&outDesc)),
+		uintptr(unsafe.Pointer(&attrs)), uintptr(unsafe.Pointer(&expiry)))
+	var token []byte
+	if out.pvBuffer != nil {
+		token = append(token, unsafe.Slice(out.pvBuffer, out.cbBuffer)...)
+		procFreeContextBuffer.Call(uintptr(unsafe.Pointer(out.pvBuffer)))
+	}
+	switch r {
+	case secEOK:
+		n.started = true
+		return token, true, nil
+	case secIContinueNeeded:
+		n.started = true
+		return token, false, nil
+	}
+	return nil, false, fmt.Errorf("sspi: InitializeSecurityContext: 0x%x", r)
+}
+
+func (n *sspiNegotiate) Close() error {
+	if n.started {
+		procDeleteSecurityContext.Call(uintptr(unsafe.Pointer(&n.ctx)))
+	}
+	procFreeCredentialsHandle.Call(uintptr(unsafe.Pointer(&n.cred)))
+	return nil
+}
+
+// sspiKerberos is a GSSAPI context on the Kerberos package, for the
+// logged-in user. SSPI's EncryptMessage token, data and padding laid end
+// to end are a gss_wrap token.
+type sspiKerberos struct {
+	cred, ctx secHandle
+	started   bool
+	sizes     struct{ maxToken, maxSignature, blockSize, securityTrailer uint32 }
+}
+
+func newPlatformGSSAPI() (GSSAPI, error) {
+	if err := secur32.Load(); err != nil {
+		return nil, err
+	}
+	k := &sspiKerberos{}
+	pkg, _ := syscall.UTF16PtrFromString("Kerberos")
+	var expiry secTimeStamp
+	r, _, _ := procAcquireCredentialsHandleW.Call(0, uintptr(unsafe.Pointer(pkg)), secpkgCredOutbound,
+		0, 0, 0, 0, uintptr(unsafe.Pointer(&k.cred)), uintptr(unsafe.Pointer(&expiry)))
+	if r != secEOK {
+		return nil, fmt.Errorf("sspi: AcquireCredentialsHandle: 0x%x", r)
+	}
+	return k, nil
+}
+
+func (k *sspiKerberos) InitSecContext(target string, input []byte) ([]byte, bool, error) {
+	spn, _ := syscall.UTF16PtrFromString(target)
+	out := secBuffer{bufferType: secbufferToken}
+	outDesc := secBufferDesc{cBuffers: 1, pBuffers: &out}
+	var inDesc *secBufferDesc
+	if len(input) > 0 {
+		in := secBuffer{cbBuffer: uint32(len(input)), bufferType: secbufferToken, pvBuffer: &input[0]}
+		inDesc = &secBufferDesc{cBuffers: 1, pBuffers: &in}
+	}
+	var ctxIn *secHandle
+	if k.started {
+		ctxIn = &k.ctx
+	}
+	var attrs uint32
+	var expiry secTimeStamp
+	r, _, _ := procInitializeSecurityContextW.Call(uintptr(unsafe.Pointer(&k.cred)), uintptr(unsafe.Pointer(ctxIn)),
+		uintptr(unsafe.Pointer(spn)), iscReqAllocateMemory|iscReqMutualAuth|iscReqIntegrity|iscReqConfidentiality,
+		0, securityNativeDrep, uintptr(unsafe.Pointer(inDesc)), 0,
+		uintptr(unsafe.Pointer(&k.ctx)), uintptr(unsafe.Pointer(&outDesc)),
+		uintptr(unsafe.Pointer(&attrs)), uintptr(unsafe.Pointer(&expiry)))
+	var token []byte
+	if out.pvBuffer != nil {
+		token = append(token, unsafe.Slice(out.pvBuffer, out.cbBuffer)...)
+		procFreeContextBuffer.Call(uintptr(unsafe.Pointer(out.pvBuffer)))
+	}
+	switch r {
+	case secEOK:
+		k.started = true
+		r, _, _ = procQueryContextAttributesW.Call(uintptr(unsafe.Pointer(&k.ctx)), secpkgAttrSizes,
+			uintptr(unsafe.Pointer(&k.sizes)))
+		if r != secEOK {
+			return nil, false, fmt.Errorf("sspi: QueryContextAttributes: 0x%x", r)
+		}
+		return token, true, nil
+	case secIContinueNeeded:
+		k.started = true
+		return token, false, nil
+	}
+	return nil, false, fmt.Errorf("sspi: InitializeSecurityContext: 0x%x", r)
+}
+
+func (k *sspiKerberos) Wrap(msg []byte, confidential bool) ([]byte, error) {
+	trailer := make([]byte, k.sizes.securityTrailer)
+	data := append([]byte{}, msg...)
+	padding := make([]byte, k.sizes.blockSize)
+	bufs := []secBuffer{
+		{cbBuffer: uint32(len(trailer)), bufferType: secbufferToken, pvBuffer: bufPtr(trailer)},
+		{cbBuffer: uint32(len(data)), bufferType: secbufferData, pvBuffer: bufPtr(data)},
+		{cbBuffer: uint32(len(padding)), bufferType: secbufferPadding, pvBuffer: bufPtr(padding)},
+	}
+	desc := secBufferDesc{cBuffers: uint32(len(bufs)), pBuffers: &bufs[0]}
+	qop := uintptr(0)
+	if !confidential {
+		qop = secqopWrapNoEncrypt
+	}
+	r, _, _ := procEncryptMessage.Call(uintptr(unsafe.Pointer(&k.ctx)), qop, uintptr(unsafe.Pointer(&desc)), 0)
+	if r != secEOK {
+		return nil, fmt.Errorf("sspi: EncryptMessage: 0x%x", r)
+	}
+	token := append(trailer[:bufs[0].cbBuffer], data[:bufs[1].cbBuffer]...)
+	return append(token, padding[:bufs[2].cbBuffer]...), nil
+}
+
+func (k *sspiKerberos) Unwrap(token []byte) ([]byte, error) {
+	stream := append([]byte{}, token...)
+	bufs := []secBuffer{
+		{cbBuffer: uint32(len(stream)), bufferType: secbufferStream, pvBuffer: bufPtr(stream)},
+		{bufferType: secbufferData},
+	}
+	desc := secBufferDesc{cBuffers: uint32(len(bufs)), pBuffers: &bufs[0]}
+	var qop uint32
+	r, _, _ := procDecryptMessage.Call(uintptr(unsafe.Pointer(&k.ctx)), uintptr(unsafe.Pointer(&desc)), 0,
+		uintptr(unsafe.Pointer(&qop)))
+	if r != secEOK {
+		return nil, fmt.Errorf("sspi: DecryptMessage: 0x%x", r)
+	}
+	if bufs[1].pvBuffer == nil {
+		return nil, nil
+	}
+	// the data buffer points into stream
+	return append([]byte{}, unsafe.Slice(bufs[1].pvBuffer, bufs[1].cbBuffer)...), nil
+}
+
+func (k *sspiKerberos) Close() error {
+	if k.started {
+		procDeleteSecurityContext.Call(uintptr(unsafe.Pointer(&k.ctx)))
+	}
+	procFreeCredentialsHandle.Call(uintptr(unsafe.Pointer(&k.cred)))
+	return nil
+}
+
+func bufPtr(b []byte) *byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return &b[0]
+}
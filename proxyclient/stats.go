@@ -0,0 +1,76 @@
+package proxyclient
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Stats are the client's counters since New. Bytes are counted on the
+// wire, TLS and proxy framing included.
+type Stats struct {
+	Requests     int64 // calls to Do
+	Errors       int64 // calls to Do that failed
+	RoundTrips   int64 // requests sent, redirect hops included
+	Retries      int64 // round trips sent again by the retry policy
+	Dials        int64
+	DialErrors   int64
+	OpenConns    int64
+	BytesRead    int64
+	BytesWritten int64
+}
+
+// Observation is one call to Do, as Config.Observe gets it.
+type Observation struct {
+	// Proxy is the proxy URL with the password masked, "" without one.
+	Proxy string
+	// Host is the destination host or host:port as in the request URL.
+	Host string
+	// Duration runs until the response headers or the error.
+	Duration time.Duration
+	// Status is 0 when the request failed, ErrorClass then tells why.
+	Status     int
+	ErrorClass string
+}
+
+// Stats returns a snapshot of the counters.
+func (c *Client) Stats() Stats {
+	s := &c.stats
+	return Stats{
+		Requests:     atomic.LoadInt64(&s.Requests),
+		Errors:       atomic.LoadInt64(&s.Errors),
+		RoundTrips:   atomic.LoadInt64(&s.RoundTrips),
+		Retries:      atomic.LoadInt64(&s.Retries),
+		Dials:        atomic.LoadInt64(&s.Dials),
+		DialErrors:   atomic.LoadInt64(&s.DialErrors),
+		OpenConns:    atomic.LoadInt64(&s.OpenConns),
+		BytesRead:    atomic.LoadInt64(&s.BytesRead),
+		BytesWritten: atomic.LoadInt64(&s.BytesWritten),
+	}
+}
+
+// countingConn feeds the byte and open connection counters.
+type countingConn struct {
+	net.Conn
+	stats  *Stats
+	closed int32
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.stats.BytesRead, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.stats.BytesWritten, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(&c.stats.OpenConns, -1)
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,50 @@
+package proxyclient
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// timeoutError is a phase running over its timeout. It is a net.Error, so
+// ErrorClass counts it as a timeout.
+type timeoutError struct {
+	phase string
+	after time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", e.phase, e.after)
+}
+
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+func (c *Client) tlsTimeout() time.Duration {
+	if c.cfg.TLSTimeout > 0 {
+		return c.cfg.TLSTimeout
+	}
+	return 10 * time.Second
+}
+
+// connectResponseTimeout bounds the wait for the answer to a CONNECT the
+// client sends itself, a minute without ResponseHeaderTimeout as in the
+// transport.
+func (c *Client) connectResponseTimeout() time.Duration {
+	if c.cfg.ResponseHeaderTimeout > 0 {
+		return c.cfg.ResponseHeaderTimeout
+	}
+	return time.Minute
+}
+
+// withTimeout runs f under a deadline of d and names phase in the error
+// when that deadline, not ctx's own, cut it short.
+func withTimeout(ctx context.Context, d time.Duration, phase string, f func(context.Context) error) error {
+	pctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	err := f(pctx)
+	if err != nil && ctx.Err() == nil && pctx.Err() == context.DeadlineExceeded {
+		return &timeoutError{phase: phase, after: d}
+	}
+	return err
+}
@@ -0,0 +1,173 @@
+package proxyclient
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timing collects the phases of the first connection a request opens and
+// the wait for its first response byte. With a proxy, dns and connect are
+// about the proxy, tunnel is CONNECT (or the SOCKS handshake) and tls the
+// handshake with the destination inside it.
+type Timing struct {
+	mu    sync.Mutex
+	start time.Time
+	// phase ends, zero when the phase did not happen
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStarts, tlsDones       []time.Time
+	gotConn                   time.Time
+	reused                    bool
+	idle                      time.Duration
+	conn                      string
+	dialed                    string
+	wrote, firstByte          time.Time
+	done                      time.Time
+}
+
+// Trace adds the timing callbacks to trace, keeping the ones it has. The
+// request starts when Trace is called.
+func (t *Timing) Trace(trace *httptrace.ClientTrace) {
+	t.start = time.Now()
+	first := func(at *time.Time) {
+		t.mu.Lock()
+		if at.IsZero() {
+			*at = time.Now()
+		}
+		t.mu.Unlock()
+	}
+	trace.DNSStart = func(httptrace.DNSStartInfo) { first(&t.dnsStart) }
+	trace.DNSDone = func(httptrace.DNSDoneInfo) { first(&t.dnsDone) }
+	trace.ConnectStart = func(string, string) { first(&t.connectStart) }
+	trace.ConnectDone = func(_, addr string, err error) {
+		first(&t.connectDone)
+		t.mu.Lock()
+		if err == nil && t.dialed == "" {
+			t.dialed = addr
+		}
+		t.mu.Unlock()
+	}
+	trace.TLSHandshakeStart = func() {
+		t.mu.Lock()
+		t.tlsStarts = append(t.tlsStarts, time.Now())
+		t.mu.Unlock()
+	}
+	tlsDone := trace.TLSHandshakeDone
+	trace.TLSHandshakeDone = func(cs tls.ConnectionState, err error) {
+		t.mu.Lock()
+		t.tlsDones = append(t.tlsDones, time.Now())
+		t.mu.Unlock()
+		if tlsDone != nil {
+			tlsDone(cs, err)
+		}
+	}
+	trace.GotConn = func(info httptrace.GotConnInfo) {
+		t.mu.Lock()
+		if t.gotConn.IsZero() {
+			t.gotConn, t.reused, t.idle = time.Now(), info.Reused, info.IdleTime
+			if info.Conn != nil {
+				t.conn = info.Conn.LocalAddr().String()
+			}
+		}
+		t.mu.Unlock()
+	}
+	trace.WroteRequest = func(httptrace.WroteRequestInfo) { first(&t.wrote) }
+	trace.GotFirstResponseByte = func() { first(&t.firstByte) }
+}
+
+// Phase is one timed step. Start is the wall clock reading, to line the
+// step up with proxy and origin logs; Duration comes from the monotonic
+// clock, so a clock step or NTP slew does not distort it.
+type Phase struct {
+	Name     string        `json:"name"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+}
+
+// WallFormat is RFC3339 with milliseconds, what proxy logs usually carry.
+const WallFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// MarshalJSON writes Start in WallFormat and without the monotonic reading.
+func (p Phase) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Name     string        `json:"name"`
+		Start    string        `json:"start"`
+		Duration time.Duration `json:"duration"`
+	}{p.Name, p.Start.Format(WallFormat), p.Duration})
+}
+
+// Phases returns the steps that happened, in order. proxy is the proxy
+// URL, nil for none, and destScheme the scheme of the destination. The
+// total ends with the first call.
+func (t *Timing) Phases(proxy *url.URL, destScheme string) []Phase {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done.IsZero() {
+		t.done = time.Now()
+	}
+	var phases []Phase
+	add := func(name string, from, to time.Time) {
+		if !from.IsZero() && !to.IsZero() {
+			phases = append(phases, Phase{Name: name, Start: from, Duration: to.Sub(from)})
+		}
+	}
+	add("dns", t.dnsStart, t.dnsDone)
+	add("connect", t.connectStart, t.connectDone)
+
+	// handshakes come in order: the proxy's for https proxies, then the
+	// destination's
+	ready := t.connectDone
+	tlsStarts, tlsDones := t.tlsStarts, t.tlsDones
+	if proxy != nil && proxy.Scheme == "https" && len(tlsStarts) > 0 && len(tlsDones) > 0 {
+		add("proxy tls", tlsStarts[0], tlsDones[0])
+		ready = tlsDones[0]
+		tlsStarts, tlsDones = tlsStarts[1:], tlsDones[1:]
+	}
+	if proxy != nil && (destScheme == "https" || strings.HasPrefix(proxy.Scheme, "socks")) {
+		end := t.gotConn
+		if len(tlsStarts) > 0 {
+			end = tlsStarts[0]
+		}
+		name := "tunnel (CONNECT)"
+		if strings.HasPrefix(proxy.Scheme, "socks") {
+			name = "tunnel (SOCKS)"
+		}
+		add(name, ready, end)
+	}
+	if len(tlsStarts) > 0 && len(tlsDones) > 0 {
+		add("tls", tlsStarts[0], tlsDones[0])
+	}
+	add("server", t.wrote, t.firstByte)
+	add("ttfb", t.start, t.firstByte)
+	add("total", t.start, t.done)
+	return phases
+}
+
+// Reused reports whether the request went out on a kept-alive connection.
+func (t *Timing) Reused() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reused
+}
+
+// Conn returns the local address of the connection the request went out
+// on, which tells connections apart, and how long it had been idle in the
+// pool, 0 for a new one.
+func (t *Timing) Conn() (string, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.conn, t.idle
+}
+
+// Dialed returns the address the first connection went to, "" for a
+// reused connection.
+func (t *Timing) Dialed() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dialed
+}
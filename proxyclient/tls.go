@@ -0,0 +1,110 @@
+package proxyclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// tlsConfig builds the TLS settings for the proxy and destination legs.
+// Chains are verified unless Insecure is set; CAFile adds roots to the
+// system ones.
+func tlsConfig(cfg Config) (*tls.Config, error) {
+	conf := &tls.Config{InsecureSkipVerify: cfg.Insecure, ServerName: cfg.TLSServerName}
+	if cfg.ClientCert != "" {
+		cert, err := loadClientCert(cfg.ClientCert, cfg.ClientKey, cfg.ClientCertPassword)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.CAFile == "" {
+		return conf, nil
+	}
+	pem, err := ioutil.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no PEM certificates", cfg.CAFile)
+	}
+	conf.RootCAs = roots
+	return conf, nil
+}
+
+// loadClientCert reads a PEM certificate and key, the key defaulting to
+// the certificate file, or a PKCS#12 bundle when the file is not PEM.
+func loadClientCert(certFile, keyFile, password string) (tls.Certificate, error) {
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if block, _ := pem.Decode(data); block == nil {
+		cert, err := parsePKCS12(data, password)
+		if err != nil {
+			return cert, fmt.Errorf("%s: %s", certFile, err)
+		}
+		return cert, nil
+	}
+	if keyFile == "" {
+		keyFile = certFile
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+// TLSConfig returns a copy of the TLS settings the client uses.
+func (c *Client) TLSConfig() *tls.Config {
+	return c.transport.TLSClientConfig.Clone()
+}
+
+// DestTrusted reports whether the destination chain of resp verifies
+// against the client's roots for the destination host, i.e. no one
+// intercepted the TLS session. It answers even with verification turned
+// off.
+func (c *Client) DestTrusted(resp *http.Response) bool {
+	if resp.TLS == nil {
+		return false
+	}
+	certs := resp.TLS.PeerCertificates
+	if len(certs) == 0 {
+		return false
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       resp.Request.URL.Hostname(),
+		Roots:         c.transport.TLSClientConfig.RootCAs,
+		Intermediates: x509.NewCertPool(),
+	}
+	if name := c.cfg.TLSServerName; name != "" {
+		opts.DNSName = name
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err == nil
+}
+
+// DowngradeHop infers which hop refused h2 for a response that came back
+// over HTTP/1.x. ALPN inside a CONNECT tunnel is negotiated end to end, so
+// the refusal comes from whoever terminated the destination TLS session:
+// the origin, unless its certificate does not verify for the destination
+// host, which points to an intercepting proxy.
+func (c *Client) DowngradeHop(resp *http.Response) string {
+	if resp.TLS.NegotiatedProtocol == "h2" {
+		return "client transport (h2 negotiated but not used)"
+	}
+	if len(resp.TLS.PeerCertificates) == 0 {
+		return "unknown (no destination certificate)"
+	}
+	if !c.DestTrusted(resp) {
+		return "proxy (destination certificate not trusted, likely TLS interception)"
+	}
+	return "origin"
+}
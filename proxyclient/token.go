@@ -0,0 +1,152 @@
+package proxyclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenSource fetches destination access tokens with the OAuth2 client
+// credentials grant and refreshes them skew ahead of their expiry, so a
+// long run never sends a token that expires on the way.
+type tokenSource struct {
+	client *http.Client
+	url    string
+	id     string
+	secret string
+	scope  string
+	skew   time.Duration
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time // zero when the server sent no expires_in
+	// fetch is the refresh under way, the callers that need a token
+	// meanwhile wait for it rather than send their own
+	fetch *tokenFetch
+}
+
+// tokenFetch is one refresh; its fields are set once done is closed.
+type tokenFetch struct {
+	done   chan struct{}
+	token  string
+	expiry time.Time
+	err    error
+	// cancelled is set when the context of the caller that fetched ended,
+	// the others fetch again rather than fail with it
+	cancelled bool
+}
+
+// Token returns the cached token or a fresh one, fetched for the request
+// of ctx. The lock is not held while fetching, callers with a live token
+// are not kept waiting.
+func (s *tokenSource) Token(ctx context.Context) (string, error) {
+	for {
+		s.mu.Lock()
+		if s.token != "" && (s.expiry.IsZero() || time.Now().Add(s.skew).Before(s.expiry)) {
+			token := s.token
+			s.mu.Unlock()
+			return token, nil
+		}
+		if f := s.fetch; f != nil {
+			s.mu.Unlock()
+			select {
+			case <-f.done:
+			case <-ctx.Done():
+				return "", fmt.Errorf("token refresh: %s", ctx.Err())
+			}
+			if f.cancelled {
+				continue
+			}
+			return f.token, f.err
+		}
+		f := &tokenFetch{done: make(chan struct{})}
+		s.fetch = f
+		s.mu.Unlock()
+
+		f.token, f.expiry, f.err = s.fetchToken(ctx)
+		f.cancelled = f.err != nil && ctx.Err() != nil
+		s.mu.Lock()
+		s.fetch = nil
+		if f.err == nil {
+			s.token, s.expiry = f.token, f.expiry
+		}
+		s.mu.Unlock()
+		close(f.done)
+		return f.token, f.err
+	}
+}
+
+// fetchToken asks the token endpoint for a token and its expiry.
+func (s *tokenSource) fetchToken(ctx context.Context) (string, time.Time, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if s.scope != "" {
+		form.Set("scope", s.scope)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(s.id), url.QueryEscape(s.secret))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("token refresh: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("token refresh: %s", resp.Status)
+	}
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", time.Time{}, fmt.Errorf("token refresh: %s", err)
+	}
+	if t.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("token refresh: no access_token in response")
+	}
+	var expiry time.Time
+	if t.ExpiresIn > 0 {
+		expiry = time.Now().Add(time.Duration(t.ExpiresIn) * time.Second)
+	}
+	return t.AccessToken, expiry, nil
+}
+
+// invalidate drops the cached token so the next request fetches a new one.
+func (s *tokenSource) invalidate() {
+	s.mu.Lock()
+	s.token = ""
+	s.mu.Unlock()
+}
+
+// tokenTransport sends a bearer token from source on requests to host.
+// Other hosts, e.g. a redirect elsewhere, never see the token.
+type tokenTransport struct {
+	next   http.RoundTripper
+	source *tokenSource
+	host   string
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.host {
+		return t.next.RoundTrip(req)
+	}
+	token, err := t.source.Token(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		// revoked or rotated early, don't keep sending it
+		t.source.invalidate()
+	}
+	return resp, err
+}
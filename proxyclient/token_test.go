@@ -0,0 +1,50 @@
+package proxyclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenSingleFetch(t *testing.T) {
+	var fetches int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fetches, 1) == 1 {
+			<-release
+		}
+		rw.Write([]byte(`{"access_token": "t1", "expires_in": 3600}`))
+	}))
+	defer srv.Close()
+	s := &tokenSource{client: srv.Client(), url: srv.URL, skew: time.Minute}
+
+	// the first caller gives up, the others get the token it was fetching
+	first, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := s.Token(first); err == nil {
+		t.Error("Token with a cancelled context succeeded")
+	}
+	close(release)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token, err := s.Token(context.Background()); token != "t1" || err != nil {
+				t.Errorf("Token = %q, %v, want t1", token, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("%d fetches, want the cancelled one and one for the 10 callers", n)
+	}
+}
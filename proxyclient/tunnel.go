@@ -0,0 +1,451 @@
+package proxyclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+)
+
+// The transport opens a new connection for every CONNECT it retries, so
+// it cannot answer a challenge that is bound to the connection, like
+// NTLM's. For the challenge schemes the client runs CONNECT itself, inside
+// the TLS session when the proxy is https://, and hands the transport a
+// tunnel it treats as a direct connection. Plain http destinations keep
+// going to the proxy in absolute form, see forwardTransport, squid and
+// others refuse CONNECT to port 80.
+
+// challengeAuth answers 407s on one tunnel. One that is an io.Closer is
+// closed when the exchange is over.
+type challengeAuth interface {
+	// start returns the Proxy-Authorization for the first CONNECT to
+	// target, "" for none.
+	start(target string) (string, error)
+	// respond answers the challenges of a 407, "" to give up.
+	respond(h http.Header, target string) (string, error)
+}
+
+// closeAuth closes auth when it holds a context.
+func closeAuth(auth challengeAuth) {
+	if cl, ok := auth.(io.Closer); ok {
+		cl.Close()
+	}
+}
+
+// tunneled reports whether the client runs CONNECT itself. Besides the
+// challenge schemes that is HTTP2, PinSHA256 or a verification hook
+// through an https proxy: the transport would offer the proxy the
+// destination's h2 only ALPN, hold its certificate to the destination's
+// pins, and not tell the hooks which leg they verify.
+func (c *Client) tunneled() bool {
+	if c.proxyURL == nil || c.isSOCKS() {
+		return false
+	}
+	https := c.proxyURL.Scheme == "https"
+	switch c.cfg.Auth {
+	case "digest", "ntlm", "sspi":
+		return true
+	}
+	return https && (c.cfg.HTTP2 || c.pins != nil || c.verifyHooked())
+}
+
+// challengeAuth returns the answers for one request, method its own or
+// CONNECT, which Digest hashes into its response.
+func (c *Client) challengeAuth(method string) challengeAuth {
+	switch c.cfg.Auth {
+	case "ntlm":
+		user, password, _ := c.creds.get()
+		return &ntlmAuth{user: user, password: password}
+	case "digest":
+		return &digestAuth{c: c, method: method}
+	case "sspi":
+		return &negotiateAuth{host: c.proxyURL.Hostname()}
+	}
+	return &presetAuth{c: c}
+}
+
+// dialTunnel is the transport's DialContext for the challenge schemes: it
+// returns a connection tunneled through the proxy to addr.
+func (c *Client) dialTunnel(ctx context.Context, network, addr string) (net.Conn, error) {
+	auth := c.challengeAuth("CONNECT")
+	defer closeAuth(auth)
+	header, err := auth.start(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, br, err := c.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for round := 0; ; round++ {
+		req := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: http.Header{},
+		}
+		if header != "" {
+			req.Header.Set("Proxy-Authorization", header)
+		}
+		var resp *http.Response
+		err := withTimeout(ctx, c.connectResponseTimeout(), "waiting for the CONNECT response", func(ctx context.Context) error {
+			var err error
+			resp, err = roundTripConnect(ctx, conn, br, req)
+			return err
+		})
+		c.wire.connect(req, resp)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			if br.Buffered() > 0 {
+				return &bufferedConn{Conn: conn, r: br}, nil
+			}
+			return conn, nil
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusProxyAuthRequired && round < 3 {
+			if header, err = auth.respond(resp.Header, addr); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			if header != "" {
+				if resp.Close {
+					// the proxy hung up, only schemes not bound to the
+					// connection survive this
+					conn.Close()
+					if conn, br, err = c.dialProxy(ctx); err != nil {
+						return nil, err
+					}
+				}
+				continue
+			}
+		}
+		conn.Close()
+		recordConnect(ctx, c.proxyURL, req, resp)
+		return nil, errors.New(strings.TrimPrefix(resp.Status, fmt.Sprintf("%d ", resp.StatusCode)))
+	}
+}
+
+// Tunnel returns a connection to addr for protocols the transport does
+// not carry, like WebSocket: a CONNECT tunnel through an http or https
+// proxy, whatever the port, a SOCKS5 connection, or a direct connection
+// without a proxy.
+func (c *Client) Tunnel(ctx context.Context, addr string) (net.Conn, error) {
+	if c.cfg.DenyInternal {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.CheckDestination(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+	if c.wire != nil {
+		ctx = c.wire.trace(ctx, nil)
+	}
+	switch {
+	case c.proxyURL == nil:
+		return c.DialContext(ctx, "tcp", addr)
+	case c.isSOCKS():
+		return c.dialSOCKS(ctx, "tcp", addr)
+	}
+	return c.dialTunnel(ctx, "tcp", addr)
+}
+
+// dialProxy connects to the proxy, with TLS for https:// proxies.
+func (c *Client) dialProxy(ctx context.Context) (net.Conn, *bufio.Reader, error) {
+	p := c.proxyURL
+	addr := p.Host
+	if p.Port() == "" {
+		port := "80"
+		if p.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(p.Hostname(), port)
+	}
+	conn, err := c.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.Scheme == "https" {
+		conf := c.transport.TLSClientConfig.Clone()
+		if conf.ServerName == "" {
+			conf.ServerName = p.Hostname()
+		}
+		// CONNECT is an HTTP/1.1 request
+		conf.NextProtos = []string{"http/1.1"}
+		// the pins are the destination's
+		conf.VerifyConnection = nil
+		if c.verifyHooked() {
+			conf.VerifyConnection = func(cs tls.ConnectionState) error { return c.verifyHooks("proxy", cs) }
+		}
+		trace := httptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.TLSHandshakeStart != nil {
+			trace.TLSHandshakeStart()
+		}
+		tc := tls.Client(conn, conf)
+		err := withTimeout(ctx, c.tlsTimeout(), "tls handshake with the proxy", tc.HandshakeContext)
+		if trace != nil && trace.TLSHandshakeDone != nil {
+			trace.TLSHandshakeDone(tc.ConnectionState(), err)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = tc
+	}
+	return conn, bufio.NewReader(conn), nil
+}
+
+// roundTripConnect sends req on conn and reads the answer, giving up when
+// ctx is done.
+func roundTripConnect(ctx context.Context, conn net.Conn, br *bufio.Reader, req *http.Request) (*http.Response, error) {
+	done, exited := make(chan struct{}), make(chan struct{})
+	defer func() {
+		// without waiting, a ctx canceled right after the return could
+		// still close conn
+		close(done)
+		<-exited
+	}()
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	r := br
+	if raw, ok := ctx.Value(connectRawKey{}).(*[]string); ok {
+		head, err := readHead(br)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		*raw = append(*raw, string(head))
+		r = bufio.NewReader(io.MultiReader(bytes.NewReader(head), br))
+	}
+	resp, err := http.ReadResponse(r, req)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
+
+type connectRawKey struct{}
+
+// WithConnectRaw returns a context under which the status line and headers
+// of every CONNECT response the client reads itself, as on a Tunnel, are
+// appended to raw verbatim.
+func WithConnectRaw(ctx context.Context, raw *[]string) context.Context {
+	return context.WithValue(ctx, connectRawKey{}, raw)
+}
+
+// readHead reads up to and including the empty line ending the headers.
+func readHead(br *bufio.Reader) ([]byte, error) {
+	var head []byte
+	start := 0 // of the current line
+	for {
+		chunk, err := br.ReadSlice('\n')
+		head = append(head, chunk...)
+		switch {
+		case err == bufio.ErrBufferFull:
+		case err != nil:
+			return head, err
+		case strings.TrimRight(string(head[start:]), "\r\n") == "":
+			return head, nil
+		default:
+			start = len(head)
+		}
+		if len(head) > 64<<10 {
+			return head, errors.New("connect response headers over 64KiB")
+		}
+	}
+}
+
+// bufferedConn keeps bytes the proxy sent right after its 200.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// challengeValue returns the Proxy-Authenticate value for scheme.
+func challengeValue(h http.Header, scheme string) (string, bool) {
+	for _, v := range h.Values("Proxy-Authenticate") {
+		for _, c := range splitChallenges(v) {
+			if name, _, _ := strings.Cut(c, " "); strings.EqualFold(name, scheme) {
+				return c, true
+			}
+		}
+	}
+	return "", false
+}
+
+// digestAuth answers Digest challenges. The last challenge is kept on the
+// client, so later tunnels and requests authenticate on their first try.
+type digestAuth struct {
+	c        *Client
+	method   string
+	answered bool
+}
+
+func (a *digestAuth) start(target string) (string, error) {
+	a.c.mu.Lock()
+	defer a.c.mu.Unlock()
+	if a.c.digest == nil {
+		return "", nil
+	}
+	a.c.digestNC++
+	a.answered = true
+	user, password, _ := a.c.creds.get()
+	return a.c.digest.authorize(a.method, target, user, password, a.c.digestNC)
+}
+
+func (a *digestAuth) respond(h http.Header, target string) (string, error) {
+	v, ok := challengeValue(h, "Digest")
+	if !ok {
+		return "", nil
+	}
+	ch, err := parseDigestChallenge(v)
+	if err != nil {
+		return "", err
+	}
+	// a second challenge means the credentials were wrong, unless the
+	// proxy says only the nonce went stale
+	if a.answered && !strings.EqualFold(authParams(v[len("Digest"):])["stale"], "true") {
+		return "", nil
+	}
+	a.answered = true
+	a.c.mu.Lock()
+	defer a.c.mu.Unlock()
+	a.c.digest, a.c.digestNC = ch, 1
+	user, password, _ := a.c.creds.get()
+	return ch.authorize(a.method, target, user, password, 1)
+}
+
+// presetAuth sends the basic credentials up front and has no answer to a
+// challenge.
+type presetAuth struct {
+	c *Client
+}
+
+func (a *presetAuth) start(string) (string, error) {
+	return a.c.proxyAuthorization()
+}
+
+func (a *presetAuth) respond(http.Header, string) (string, error) {
+	return "", nil
+}
+
+// ntlmAuth runs the three NTLM messages on one tunnel.
+type ntlmAuth struct {
+	user, password string
+	sent           bool
+}
+
+func (a *ntlmAuth) start(string) (string, error) {
+	return "NTLM " + base64.StdEncoding.EncodeToString(ntlmNegotiate()), nil
+}
+
+func (a *ntlmAuth) respond(h http.Header, target string) (string, error) {
+	v, ok := challengeValue(h, "NTLM")
+	if !ok || a.sent || len(v) <= len("NTLM ") {
+		return "", nil
+	}
+	msg, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v[len("NTLM "):]))
+	if err != nil {
+		return "", fmt.Errorf("ntlm: %s", err)
+	}
+	ch, err := parseNTLMChallenge(msg)
+	if err != nil {
+		return "", err
+	}
+	a.sent = true
+	return "NTLM " + base64.StdEncoding.EncodeToString(ntlmAuthenticate(ch, a.user, a.password)), nil
+}
+
+// sspiContext is a Negotiate security context of the logged-in Windows
+// user.
+type sspiContext interface {
+	// step returns the next token given the proxy's last, nil for the
+	// first; done is the context established.
+	step(input []byte) (token []byte, done bool, err error)
+	Close() error
+}
+
+// negotiateAuth runs SSPI Negotiate on one tunnel, as many legs as the
+// package needs: a single one with Kerberos, three when it falls back to
+// NTLM, every 407 carrying the proxy's next token.
+type negotiateAuth struct {
+	host string
+	ctx  sspiContext
+	done bool
+}
+
+func (a *negotiateAuth) start(string) (string, error) {
+	ctx, err := newSSPINegotiate(a.host)
+	if err != nil {
+		return "", err
+	}
+	a.ctx = ctx
+	token, done, err := ctx.step(nil)
+	if err != nil {
+		return "", err
+	}
+	if len(token) == 0 {
+		return "", errors.New("sspi: no token produced")
+	}
+	a.done = done
+	return "Negotiate " + base64.StdEncoding.EncodeToString(token), nil
+}
+
+func (a *negotiateAuth) respond(h http.Header, target string) (string, error) {
+	v, ok := challengeValue(h, "Negotiate")
+	// an established context, or a bare Negotiate, is a refusal
+	if !ok || a.done || a.ctx == nil || len(v) <= len("Negotiate ") {
+		return "", nil
+	}
+	input, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v[len("Negotiate "):]))
+	if err != nil {
+		return "", fmt.Errorf("sspi: %s", err)
+	}
+	token, done, err := a.ctx.step(input)
+	if err != nil {
+		return "", err
+	}
+	a.done = done
+	if len(token) == 0 {
+		return "", nil
+	}
+	return "Negotiate " + base64.StdEncoding.EncodeToString(token), nil
+}
+
+func (a *negotiateAuth) Close() error {
+	if a.ctx == nil {
+		return nil
+	}
+	return a.ctx.Close()
+}
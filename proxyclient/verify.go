@@ -0,0 +1,56 @@
+package proxyclient
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// VerificationError is a handshake the VerifyConnection or
+// VerifyPeerCertificate hook failed. Leg is "proxy" or "destination".
+type VerificationError struct {
+	Leg string
+	Err error
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("%s certificate rejected: %s", e.Leg, e.Err)
+}
+
+func (e *VerificationError) Unwrap() error { return e.Err }
+
+// verifyHooked reports whether the Config has a verification hook.
+func (c *Client) verifyHooked() bool {
+	return c.cfg.VerifyConnection != nil || c.cfg.VerifyPeerCertificate != nil
+}
+
+// verifyDestination is the destination TLS VerifyConnection: the pins,
+// then the hooks.
+func (c *Client) verifyDestination(cs tls.ConnectionState) error {
+	if c.pins != nil {
+		if err := c.verifyPins(cs); err != nil {
+			return err
+		}
+	}
+	return c.verifyHooks("destination", cs)
+}
+
+// verifyHooks runs VerifyPeerCertificate and VerifyConnection on a leg's
+// handshake. Both go through tls.Config.VerifyConnection, which unlike
+// tls.Config.VerifyPeerCertificate also runs on resumed sessions.
+func (c *Client) verifyHooks(leg string, cs tls.ConnectionState) error {
+	if f := c.cfg.VerifyPeerCertificate; f != nil {
+		raw := make([][]byte, len(cs.PeerCertificates))
+		for i, cert := range cs.PeerCertificates {
+			raw[i] = cert.Raw
+		}
+		if err := f(leg, raw, cs.VerifiedChains); err != nil {
+			return &VerificationError{Leg: leg, Err: err}
+		}
+	}
+	if f := c.cfg.VerifyConnection; f != nil {
+		if err := f(leg, cs); err != nil {
+			return &VerificationError{Leg: leg, Err: err}
+		}
+	}
+	return nil
+}
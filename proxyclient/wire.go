@@ -0,0 +1,156 @@
+package proxyclient
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// wireSecrets are header values reduced to their scheme in the log.
+var wireSecrets = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// wireLog writes Config.Wire: every message head in one Write, so
+// concurrent requests interleave by message only.
+type wireLog struct {
+	mu    sync.Mutex
+	w     io.Writer
+	conns bool
+}
+
+func newWireLog(cfg Config) *wireLog {
+	if cfg.Wire == nil {
+		return nil
+	}
+	return &wireLog{w: cfg.Wire, conns: cfg.WireConns}
+}
+
+func (l *wireLog) write(s string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.w, s)
+}
+
+// wireValue masks a credential, keeping the scheme so the log still tells
+// basic from NTLM.
+func wireValue(name, value string) string {
+	for _, s := range wireSecrets {
+		if textproto.CanonicalMIMEHeaderKey(name) == s {
+			if i := strings.IndexByte(value, ' '); i > 0 {
+				return value[:i] + " ****"
+			}
+			return "****"
+		}
+	}
+	return value
+}
+
+// wireHead formats a start line and header fields, values masked.
+func wireHead(prefix, start string, fields [][2]string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s\n", prefix, start)
+	for _, f := range fields {
+		fmt.Fprintf(&b, "%s %s: %s\n", prefix, f[0], wireValue(f[0], f[1]))
+	}
+	b.WriteString(prefix + "\n")
+	return b.String()
+}
+
+func sortedFields(h http.Header) [][2]string {
+	var fields [][2]string
+	for k, vs := range h {
+		for _, v := range vs {
+			fields = append(fields, [2]string{k, v})
+		}
+	}
+	sort.SliceStable(fields, func(i, j int) bool { return fields[i][0] < fields[j][0] })
+	return fields
+}
+
+// connect logs a CONNECT the client or the transport sent and the answer,
+// resp nil when none came.
+func (l *wireLog) connect(req *http.Request, resp *http.Response) {
+	if l == nil {
+		return
+	}
+	fields := [][2]string{{"Host", req.Host}}
+	s := wireHead(">", "CONNECT "+req.Host+" HTTP/1.1", append(fields, sortedFields(req.Header)...))
+	if resp != nil {
+		s += wireHead("<", resp.Proto+" "+resp.Status, sortedFields(resp.Header))
+	}
+	l.write(s)
+}
+
+func (l *wireLog) response(resp *http.Response) {
+	l.write(wireHead("<", resp.Proto+" "+resp.Status, sortedFields(resp.Header)))
+}
+
+// trace returns ctx with hooks logging the header fields as the transport
+// writes them, for req, and the connection events when WireConns is set.
+func (l *wireLog) trace(ctx context.Context, req *http.Request) context.Context {
+	var fields [][2]string
+	t := &httptrace.ClientTrace{}
+	if req != nil {
+		t.WroteHeaderField = func(key string, values []string) {
+			for _, v := range values {
+				fields = append(fields, [2]string{key, v})
+			}
+		}
+		t.WroteHeaders = func() {
+			l.write(wireHead(">", req.Method+" "+req.URL.Redacted(), fields))
+			fields = nil
+		}
+		t.Got1xxResponse = func(code int, header textproto.MIMEHeader) error {
+			l.write(wireHead("<", fmt.Sprintf("%d %s", code, http.StatusText(code)), sortedFields(http.Header(header))))
+			return nil
+		}
+	}
+	if l.conns {
+		t.DNSDone = func(info httptrace.DNSDoneInfo) {
+			if info.Err != nil {
+				l.write(fmt.Sprintf("* dns: %s\n", info.Err))
+				return
+			}
+			l.write(fmt.Sprintf("* dns: %v\n", info.Addrs))
+		}
+		t.ConnectDone = func(network, addr string, err error) {
+			if err != nil {
+				l.write(fmt.Sprintf("* connect %s: %s\n", addr, err))
+				return
+			}
+			l.write(fmt.Sprintf("* connected to %s\n", addr))
+		}
+		t.TLSHandshakeDone = func(cs tls.ConnectionState, err error) {
+			if err != nil {
+				l.write(fmt.Sprintf("* tls: %s\n", err))
+				return
+			}
+			alpn := cs.NegotiatedProtocol
+			if alpn == "" {
+				alpn = "none"
+			}
+			name := ""
+			if cs.ServerName != "" {
+				name = " with " + cs.ServerName
+			}
+			l.write(fmt.Sprintf("* tls %s %s%s, alpn %s\n", tls.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite), name, alpn))
+		}
+		t.GotConn = func(info httptrace.GotConnInfo) {
+			how := "new"
+			if info.Reused {
+				how = fmt.Sprintf("reused, idle %s", info.IdleTime)
+			}
+			l.write(fmt.Sprintf("* connection %s -> %s (%s)\n", info.Conn.LocalAddr(), info.Conn.RemoteAddr(), how))
+		}
+	}
+	return httptrace.WithClientTrace(ctx, t)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// resolveProxy picks the proxy for destURL: -proxy when given, else
+// HTTPS_PROXY or HTTP_PROXY by scheme, unless the destination is in the
+// bypass list (-no-proxy, else NO_PROXY). It returns the proxy, "" for a
+// direct connection, and where the decision came from.
+func resolveProxy(destURL *url.URL) (string, string) {
+	bypass, bypassSource := noProxy, "-no-proxy"
+	if !flagSet("no-proxy") {
+		bypass, bypassSource = getenvAny("NO_PROXY", "no_proxy")
+	}
+
+	p, source := proxy, "-proxy"
+	if p == "" {
+		if destURL.Scheme == "https" || destURL.Scheme == "wss" {
+			p, source = getenvAny("HTTPS_PROXY", "https_proxy")
+		} else {
+			p, source = getenvAny("HTTP_PROXY", "http_proxy")
+		}
+	}
+	if p == "" {
+		return "", ""
+	}
+	if entry := bypassed(destURL, bypass); entry != "" {
+		return "", bypassSource + " entry " + entry
+	}
+	return p, source
+}
+
+// flagSet reports whether the flag was given, on the command line or
+// through the environment.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+// getenvAny returns the first of the variables that is set and its name.
+func getenvAny(names ...string) (string, string) {
+	for _, n := range names {
+		if v := os.Getenv(n); v != "" {
+			return v, n
+		}
+	}
+	return "", ""
+}
+
+// bypassed returns the entry of the comma separated list that matches u:
+// "*", an IP, a CIDR, a domain matching itself and its subdomains, a
+// ".domain" matching subdomains only, any of them with a :port.
+func bypassed(u *url.URL, list string) string {
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443", "ws": "80", "wss": "443"}[u.Scheme]
+	}
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return entry
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return entry
+			}
+			continue
+		}
+		name := entry
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			name = h
+		}
+		if eip := net.ParseIP(name); eip != nil {
+			if ip != nil && eip.Equal(ip) {
+				return entry
+			}
+			continue
+		}
+		if strings.HasPrefix(name, ".") {
+			if strings.HasSuffix(host, name) {
+				return entry
+			}
+		} else if host == name || strings.HasSuffix(host, "."+name) {
+			return entry
+		}
+	}
+	return ""
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// proxyVerdicts rank the outcomes, best first.
+var proxyVerdicts = map[string]int{"working": 0, "auth-required": 1, "broken": 2}
+
+// proxyCheck is one proxy of -proxy-file and how it did.
+type proxyCheck struct {
+	proxy     string
+	verdict   string
+	status    int
+	latency   time.Duration
+	anonymity string
+	detail    string
+	tags      map[string]string
+}
+
+// loadProxyFile reads -proxy-file: one proxy per line, IP:PORT or a URL,
+// blank lines and # comments skipped.
+func loadProxyFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var proxies []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := splitTags(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		proxies = append(proxies, p)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if len(proxies) == 0 {
+		return nil, fmt.Errorf("%s: no proxies", path)
+	}
+	return proxies, nil
+}
+
+// runProxyFile is the proxy checker: it requests -dest through every proxy
+// of -proxy-file, -parallel at a time, and ranks them working first, then
+// auth-required, then broken, by latency within each. When -dest echoes
+// the request headers it also grades the anonymity: transparent when the
+// client's address reached the origin, anonymous when only proxy headers
+// did, elite when nothing gave a proxy away. It returns 0 when at least
+// one proxy works, with -assert-* when every proxy meets them.
+func runProxyFile(cfg proxyclient.Config) int {
+	proxies, err := loadProxyFile(proxyFile)
+	if err == nil {
+		proxies, err = filterTargets("proxies", proxies)
+	}
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 2
+	}
+	if destParallel < 1 {
+		fmt.Println("erro: -parallel must be at least 1")
+		return 2
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	own := ownAddresses(cfg, dest, timeout)
+
+	checks := make([]proxyCheck, len(proxies))
+	progress := &batchProgress{what: "proxies", total: len(checks)}
+	sem := make(chan struct{}, destParallel)
+	var wg sync.WaitGroup
+	for i, p := range proxies {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(pc *proxyCheck, p string) {
+			defer func() { <-sem; wg.Done() }()
+			c := cfg
+			c.Proxy, c.Fallback = p, ""
+			*pc = checkProxy(c, timeout, own)
+			pc.tags = targetTags[p]
+			progress.entry(pc.proxy + " " + pc.verdict)
+		}(&checks[i], p)
+	}
+	wg.Wait()
+
+	sort.SliceStable(checks, func(i, j int) bool {
+		a, b := checks[i], checks[j]
+		if proxyVerdicts[a.verdict] != proxyVerdicts[b.verdict] {
+			return proxyVerdicts[a.verdict] < proxyVerdicts[b.verdict]
+		}
+		return a.verdict == "working" && a.latency < b.latency
+	})
+	table := &batchTable{columns: []string{"rank", "proxy", "verdict", "code", "latency", "anonymity", "detail"}}
+	if len(targetTags) > 0 {
+		table.columns = append(table.columns, "tags")
+	}
+	working := 0
+	for i, pc := range checks {
+		code, latency, anon := "-", "-", pc.anonymity
+		if pc.status != 0 {
+			code = fmt.Sprint(pc.status)
+		}
+		if pc.latency > 0 {
+			latency = dur(pc.latency)
+		}
+		if anon == "" {
+			anon = "-"
+		}
+		if pc.verdict == "working" {
+			working++
+		}
+		cells := []string{fmt.Sprint(i + 1), pc.proxy, pc.verdict, code, latency, anon, pc.detail}
+		if len(targetTags) > 0 {
+			cells = append(cells, formatTags(pc.tags))
+		}
+		table.add(batchGroup(pc.proxy, pc.tags), pc.verdict != "working", cells...)
+	}
+	table.print("proxies")
+	fmt.Printf("proxies: %d of %d working\n", working, len(checks))
+	if working == 0 {
+		return 1
+	}
+	if assertChecks != nil {
+		return reportUnmet("proxies", "proxies", len(checks)-working, len(checks))
+	}
+	return 0
+}
+
+// checkOnce requests u through c within timeout and reads the body for
+// the checks.
+func checkOnce(c *proxyclient.Client, u string, timeout time.Duration) (*http.Response, *proxyclient.Result, []byte, error) {
+	req, err := destRequestTo(u)
+	if err != nil {
+		return nil, &proxyclient.Result{}, nil, err
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	resp, res, err := c.Measure(req.WithContext(ctx))
+	if err != nil {
+		return nil, res, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := readForChecks(resp.Body)
+	return resp, res, body, err
+}
+
+func checkProxy(cfg proxyclient.Config, timeout time.Duration, own []string) proxyCheck {
+	pc := proxyCheck{proxy: redactURL(cfg.Proxy), verdict: "broken"}
+	client, err := proxyclient.New(cfg)
+	if err != nil {
+		pc.detail = err.Error()
+		return pc
+	}
+	pc.proxy = client.ProxyURL().Redacted()
+	start := time.Now()
+	resp, res, body, err := checkOnce(client, dest, timeout)
+	pc.latency, pc.status = time.Since(start), res.Status
+	if res.Proxy != nil && res.Proxy.ConnectStatus != 0 {
+		pc.status = res.Proxy.ConnectStatus
+	}
+	switch {
+	case res.ErrorClass == "proxy_auth":
+		pc.verdict, pc.detail = "auth-required", "407, pass -user and -password or put them in the proxy URL"
+	case err != nil:
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		pc.detail = err.Error()
+		if res.ErrorClass != "" {
+			pc.detail = res.ErrorClass + ": " + pc.detail
+		}
+	case healthChecks != nil:
+		if ok, reason := passesHealth(healthChecks, resp, body, pc.latency); !ok {
+			pc.detail = withPage(reason, resp, body)
+			break
+		}
+		pc.verdict = "working"
+	case resp.StatusCode >= 500:
+		pc.detail = withPage(resp.Status, resp, body)
+	default:
+		pc.verdict = "working"
+	}
+	if pc.verdict == "working" && assertChecks != nil {
+		if ok, reason := passesAssertions(assertChecks, resp, body, pc.latency); !ok {
+			pc.verdict, pc.detail = "broken", withPage(reason, resp, body)
+		}
+	}
+	if pc.verdict == "working" {
+		pc.anonymity, pc.detail = anonymity(body, own)
+	}
+	if pc.verdict != "working" && pc.verdict != "auth-required" {
+		pc.latency = 0
+	}
+	return pc
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	rangeSpec string
+	resume    bool
+	// resumeFrom is the size -o had when -resume opened it.
+	resumeFrom int64
+)
+
+// byteRange is one range of a Range header: first to last inclusive, last
+// -1 for open ended; with suffix the last first bytes.
+type byteRange struct {
+	first, last int64
+	suffix      bool
+}
+
+func (r byteRange) String() string {
+	switch {
+	case r.suffix:
+		return fmt.Sprintf("bytes=-%d", r.first)
+	case r.last < 0:
+		return fmt.Sprintf("bytes=%d-", r.first)
+	}
+	return fmt.Sprintf("bytes=%d-%d", r.first, r.last)
+}
+
+// wantRange is the range the run asks for, nil for none.
+var wantRange *byteRange
+
+// parseRange reads -range, bytes=FIRST-LAST, bytes=FIRST- or bytes=-N, the
+// "bytes=" optional. Several ranges are not supported, their multipart
+// answer is not checked.
+func parseRange(spec string) (*byteRange, error) {
+	s := strings.TrimPrefix(strings.TrimSpace(spec), "bytes=")
+	bad := fmt.Errorf("-range wants bytes=FIRST-LAST, bytes=FIRST- or bytes=-N, not %q", spec)
+	if strings.Contains(s, ",") {
+		return nil, fmt.Errorf("-range takes one range, not %q", spec)
+	}
+	a, b, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, bad
+	}
+	if a == "" {
+		n, err := strconv.ParseInt(b, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, bad
+		}
+		return &byteRange{first: n, last: -1, suffix: true}, nil
+	}
+	r := &byteRange{last: -1}
+	var err error
+	if r.first, err = strconv.ParseInt(a, 10, 64); err != nil || r.first < 0 {
+		return nil, bad
+	}
+	if b != "" {
+		if r.last, err = strconv.ParseInt(b, 10, 64); err != nil || r.last < r.first {
+			return nil, bad
+		}
+	}
+	return r, nil
+}
+
+// setupRange handles -range and -resume, which opens -o to append to it
+// and asks for what comes after what it has. It runs before setupOutput,
+// which leaves a bodyOut set here alone.
+func setupRange() error {
+	if rangeSpec != "" {
+		r, err := parseRange(rangeSpec)
+		if err != nil {
+			return err
+		}
+		wantRange = r
+	}
+	if !resume {
+		return nil
+	}
+	switch {
+	case rangeSpec != "":
+		return fmt.Errorf("-resume makes the range, it excludes -range")
+	case output == "" || output == "-":
+		return fmt.Errorf("-resume appends to the file of -o")
+	case streaming():
+		return fmt.Errorf("-resume appends the body as is, it excludes -grep, -head and -decompress")
+	}
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	resumeFrom = st.Size()
+	bodyOut = f
+	wantRange = &byteRange{first: resumeFrom, last: -1}
+	fmt.Printf("resume: %s has %s, asking for %s\n", output, size(resumeFrom), wantRange)
+	return nil
+}
+
+// contentRange parses a Content-Range, "bytes FIRST-LAST/TOTAL" or
+// "bytes */TOTAL", total -1 for "*".
+func contentRange(v string) (first, last, total int64, err error) {
+	s, ok := strings.CutPrefix(strings.TrimSpace(v), "bytes ")
+	span, t, ok2 := strings.Cut(s, "/")
+	if !ok || !ok2 {
+		return 0, 0, 0, fmt.Errorf("Content-Range %q is not bytes FIRST-LAST/TOTAL", v)
+	}
+	total = -1
+	if t != "*" {
+		if total, err = strconv.ParseInt(t, 10, 64); err != nil {
+			return 0, 0, 0, fmt.Errorf("Content-Range %q has a bad total", v)
+		}
+	}
+	if span == "*" {
+		return -1, -1, total, nil
+	}
+	a, b, ok := strings.Cut(span, "-")
+	first, err1 := strconv.ParseInt(a, 10, 64)
+	last, err2 := strconv.ParseInt(b, 10, 64)
+	if !ok || err1 != nil || err2 != nil || last < first || (total >= 0 && last >= total) {
+		return 0, 0, 0, fmt.Errorf("Content-Range %q has a bad span", v)
+	}
+	return first, last, total, nil
+}
+
+// rangeCheck is what checkRange found in the response head; the body
+// length is checked once it was read.
+type rangeCheck struct {
+	what string
+	ok   bool
+	want int64
+	body *countingBody
+}
+
+// checkRange validates the answer to wantRange and prints a range: line.
+// A 206 has to have a Content-Range within what was asked, its length the
+// Content-Length; a 200 is the whole body, the Range header dropped by
+// the proxy or ignored by the origin, Accept-Ranges tells which is more
+// likely. With -resume a body other than the continuation is not
+// appended.
+func checkRange(resp *http.Response) *rangeCheck {
+	what := "range"
+	if resume {
+		what = "resume"
+	}
+	c := &rangeCheck{what: what, want: -1}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		first, last, total, err := contentRange(resp.Header.Get("Content-Range"))
+		switch {
+		case resp.Header.Get("Content-Range") == "":
+			fmt.Printf("%s: FAIL, 206 without Content-Range\n", what)
+		case strings.HasPrefix(resp.Header.Get("Content-Type"), "multipart/byteranges"):
+			fmt.Printf("%s: FAIL, 206 multipart/byteranges for a single range\n", what)
+		case err != nil:
+			fmt.Printf("%s: FAIL, %s\n", what, err)
+		case !wantRange.covers(first, last, total):
+			fmt.Printf("%s: FAIL, asked for %s, got bytes %d-%d of %s\n", what, wantRange, first, last, rangeTotal(total))
+		case resp.ContentLength >= 0 && resp.ContentLength != last-first+1:
+			fmt.Printf("%s: FAIL, Content-Range bytes %d-%d is %d bytes, Content-Length %d\n", what, first, last, last-first+1, resp.ContentLength)
+		default:
+			fmt.Printf("%s: 206 bytes %d-%d of %s\n", what, first, last, rangeTotal(total))
+			c.ok, c.want = true, last-first+1
+		}
+	case http.StatusOK:
+		who := "the proxy dropped the Range header or the origin ignored it"
+		if strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes") {
+			who = "the origin says Accept-Ranges: bytes, the proxy likely dropped the Range header"
+		} else if strings.EqualFold(resp.Header.Get("Accept-Ranges"), "none") {
+			who = "the origin does not serve ranges, Accept-Ranges: none"
+		}
+		fmt.Printf("%s: FAIL, 200 with the whole body for %s: %s\n", what, wantRange, who)
+	case http.StatusRequestedRangeNotSatisfiable:
+		_, _, total, err := contentRange(resp.Header.Get("Content-Range"))
+		if resume && err == nil && total == resumeFrom {
+			fmt.Printf("resume: %s is complete, %s\n", output, size(total))
+			c.ok = true
+			break
+		}
+		fmt.Printf("%s: FAIL, 416 for %s, the resource has %s\n", what, wantRange, rangeTotal(total))
+	default:
+		fmt.Printf("%s: FAIL, status %d answers no range\n", what, resp.StatusCode)
+	}
+	if resume && (!c.ok || resp.StatusCode != http.StatusPartialContent) {
+		if !c.ok {
+			fmt.Printf("resume: %s left as it was\n", output)
+		}
+		bodyOut = ioutil.Discard
+	}
+	c.body = &countingBody{ReadCloser: resp.Body}
+	resp.Body = c.body
+	return c
+}
+
+// covers reports whether the span first-last of total answers r.
+func (r *byteRange) covers(first, last, total int64) bool {
+	switch {
+	case total >= 0 && last != total-1 && (r.suffix || r.last < 0 || r.last >= total):
+		// what runs to the end, or past it, ends with the resource
+		return false
+	case r.suffix:
+		return total < 0 || first == max(total-r.first, 0)
+	case first != r.first:
+		return false
+	}
+	return r.last < 0 || last == r.last || (total >= 0 && r.last >= total)
+}
+
+func rangeTotal(total int64) string {
+	if total < 0 {
+		return "unknown size"
+	}
+	return size(total)
+}
+
+// done checks the body read against the range, false when it fell short
+// or ran over.
+func (c *rangeCheck) done() bool {
+	if !c.ok || c.want < 0 {
+		return c.ok
+	}
+	if c.body.n != c.want {
+		fmt.Printf("%s: FAIL, body has %s, the range %s\n", c.what, size(c.body.n), size(c.want))
+		return false
+	}
+	if resume {
+		fmt.Printf("resume: %s appended, %s now\n", output, size(resumeFrom+c.body.n))
+	}
+	return true
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// heatShades are the latency levels of a heatmap cell, fastest first:
+// under 1.25, 1.5 and 2 times the typical hour, and above.
+var heatShades = []string{"░░", "▒▒", "▓▓", "██"}
+
+// runReport implements `report [PROXY...]`: from the checks watch stored,
+// it draws per proxy an hour of day by day of week heatmap of the median
+// latency, in local time, so congestion at set hours shows. Cells where
+// most checks failed are marked xx, cells without checks stay blank.
+func runReport() int {
+	path, err := watchStoreFile()
+	if err != nil || watchStore == "none" || watchStore == "memory" {
+		fmt.Println("erro: report needs a -watch-store file")
+		return 2
+	}
+	records, err := loadWatchRecords(path)
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 1
+	}
+	only := map[string]bool{}
+	for _, p := range flag.Args() {
+		only[redactURL(p)] = true
+	}
+	byProxy := map[string][]watchRecord{}
+	var proxies []string
+	for _, r := range records {
+		if len(only) > 0 && !only[r.Proxy] && !only[strings.TrimPrefix(r.Proxy, "http://")] {
+			continue
+		}
+		if byProxy[r.Proxy] == nil {
+			proxies = append(proxies, r.Proxy)
+		}
+		byProxy[r.Proxy] = append(byProxy[r.Proxy], r)
+	}
+	if len(proxies) == 0 {
+		fmt.Printf("erro: no checks stored in %s, run watch first\n", path)
+		return 1
+	}
+	sort.Strings(proxies)
+	for i, p := range proxies {
+		if i > 0 {
+			fmt.Println()
+		}
+		printHeatmap(p, byProxy[p])
+	}
+	return 0
+}
+
+// heatCell is one hour of one weekday.
+type heatCell struct {
+	latencies []time.Duration
+	failed    int
+}
+
+func printHeatmap(proxy string, records []watchRecord) {
+	var cells [7][24]heatCell
+	first, last := records[0].Time, records[0].Time
+	for _, r := range records {
+		t := r.Time.Local()
+		// Monday first
+		c := &cells[(int(t.Weekday())+6)%7][t.Hour()]
+		if r.Up {
+			c.latencies = append(c.latencies, r.Latency)
+		} else {
+			c.failed++
+		}
+		if r.Time.Before(first) {
+			first = r.Time
+		}
+		if r.Time.After(last) {
+			last = r.Time
+		}
+	}
+
+	var medians []time.Duration
+	var median [7][24]time.Duration
+	for d := range cells {
+		for h := range cells[d] {
+			if l := cells[d][h].latencies; len(l) > 0 {
+				sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+				median[d][h] = l[len(l)/2]
+				medians = append(medians, median[d][h])
+			}
+		}
+	}
+	sort.Slice(medians, func(i, j int) bool { return medians[i] < medians[j] })
+	// shades are relative to the typical hour, so congested hours stand
+	// out rather than the noise between the quiet ones
+	var bounds []time.Duration
+	if len(medians) > 0 {
+		typical := medians[len(medians)/2]
+		bounds = []time.Duration{typical * 5 / 4, typical * 3 / 2, typical * 2}
+	}
+
+	fmt.Printf("report: %s, %d checks from %s to %s, local time\n", proxy, len(records),
+		first.Local().Format("2006-01-02 15:04"), last.Local().Format("2006-01-02 15:04"))
+	fmt.Print("     ")
+	for h := 0; h < 24; h += 3 {
+		fmt.Printf("%-6s", fmt.Sprintf("%02d", h))
+	}
+	fmt.Println()
+	for d, day := range []string{"Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"} {
+		fmt.Printf("%s  ", day)
+		for h := range cells[d] {
+			c := cells[d][h]
+			switch {
+			case c.failed > 0 && c.failed >= len(c.latencies):
+				fmt.Print("xx")
+			case len(c.latencies) == 0:
+				fmt.Print("  ")
+			default:
+				level := sort.Search(len(bounds), func(i int) bool { return median[d][h] < bounds[i] })
+				fmt.Print(heatShades[level])
+			}
+		}
+		fmt.Println()
+	}
+	if len(medians) == 0 {
+		fmt.Println("report: every check failed")
+		return
+	}
+	var legend []string
+	for i := range bounds {
+		legend = append(legend, fmt.Sprintf("%s under %s", heatShades[i], dur(bounds[i])))
+	}
+	legend = append(legend, fmt.Sprintf("%s %s and over", heatShades[len(bounds)], dur(bounds[len(bounds)-1])))
+	fmt.Printf("median latency: %s, xx mostly failed\n", strings.Join(legend, "  "))
+}
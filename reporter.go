@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// reporter is an output of the finished run. -json, -har,
+// -record-fixtures and the saved session are reporters and any of them
+// combine; the outputs that stream, the -o body and -metrics-listen, run
+// alongside.
+type reporter interface {
+	// name tells the reporter apart in its errors
+	name() string
+	// exchanges tells whether the reporter needs the round trips kept,
+	// bodies included
+	exchanges() bool
+	report(run *session) error
+}
+
+// reporters are the run's, in the order they write.
+var reporters []reporter
+
+// wantExchanges reports whether a reporter needs the round trips.
+func wantExchanges() bool {
+	for _, r := range reporters {
+		if r.exchanges() {
+			return true
+		}
+	}
+	return false
+}
+
+// runReporters hands the finished run to every reporter; an error of one
+// does not keep the others from writing.
+func runReporters(run *session) {
+	for _, r := range reporters {
+		if err := r.report(run); err != nil {
+			fmt.Fprintf(os.Stderr, "erro: %s: %s\n", r.name(), err)
+		}
+	}
+}
+
+// jsonReporter is -json and -format json.
+type jsonReporter struct{ w io.Writer }
+
+func (jsonReporter) name() string    { return "writing json" }
+func (jsonReporter) exchanges() bool { return false }
+func (r jsonReporter) report(run *session) error {
+	return writeJSON(r.w, run)
+}
+
+// fixturesReporter is -record-fixtures.
+type fixturesReporter struct{ dir string }
+
+func (fixturesReporter) name() string    { return "fixtures" }
+func (fixturesReporter) exchanges() bool { return true }
+func (r fixturesReporter) report(run *session) error {
+	return writeFixtures(r.dir, run.exchanges)
+}
+
+// sessionReporter saves the run for `last` and `rerun`.
+type sessionReporter struct{}
+
+func (sessionReporter) name() string    { return "saving session" }
+func (sessionReporter) exchanges() bool { return false }
+func (sessionReporter) report(run *session) error {
+	return saveSession(run)
+}
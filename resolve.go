@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// resolveList collects repeated -resolve HOST:PORT:ADDR flags, curl's
+// syntax, into the Config.Resolve pins.
+type resolveList map[string]string
+
+func (l resolveList) String() string {
+	var s []string
+	for k, v := range l {
+		s = append(s, k+" -> "+v)
+	}
+	return strings.Join(s, ", ")
+}
+
+func (l resolveList) Set(v string) error {
+	host, rest, ok := cutHost(v)
+	var port, addr string
+	if ok {
+		port, addr, ok = strings.Cut(rest, ":")
+	}
+	if !ok || host == "" || port == "" || addr == "" {
+		return fmt.Errorf("want HOST:PORT:ADDR, got %q", v)
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if net.ParseIP(addr) == nil {
+		return fmt.Errorf("%q: %s is not an IP address", v, addr)
+	}
+	l[net.JoinHostPort(host, port)] = net.JoinHostPort(addr, port)
+	return nil
+}
+
+// cutHost splits the host off HOST:REST, HOST possibly a bracketed IPv6
+// address.
+func cutHost(v string) (host, rest string, ok bool) {
+	if strings.HasPrefix(v, "[") {
+		i := strings.Index(v, "]:")
+		if i < 0 {
+			return "", "", false
+		}
+		return v[1:i], v[i+2:], true
+	}
+	return strings.Cut(v, ":")
+}
+
+// printDialed says where the first connection of the run went, over
+// which address family, and whether -resolve sent it there.
+func printDialed(client *proxyclient.Client, res *proxyclient.Result) {
+	if res.Dialed == "" {
+		return
+	}
+	what := "the destination"
+	if client.ProxyURL() != nil && res.Fallback == "" {
+		what = "the proxy"
+	}
+	family := "IPv6"
+	if host, _, err := net.SplitHostPort(res.Dialed); err == nil && net.ParseIP(host).To4() != nil {
+		family = "IPv4"
+	}
+	for name, addr := range resolves {
+		if addr == res.Dialed {
+			fmt.Printf("dialed: %s over %s, %s, pinned by -resolve %s\n", res.Dialed, family, what, name)
+			return
+		}
+	}
+	fmt.Printf("dialed: %s over %s, %s\n", res.Dialed, family, what)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// parseRetry builds the retry policy from -retries, -retry-backoff and
+// -retry-on.
+func parseRetry() (*proxyclient.Retry, error) {
+	if retryBackoff <= 0 {
+		return nil, fmt.Errorf("-retry-backoff must be positive")
+	}
+	r := &proxyclient.Retry{Max: retries, Backoff: retryBackoff}
+	for _, v := range strings.Split(retryOn, ",") {
+		v = strings.TrimSpace(v)
+		switch v {
+		case "":
+		case "network":
+			r.Network = true
+		default:
+			code, err := strconv.Atoi(v)
+			if err != nil || code < 100 || code > 599 {
+				return nil, fmt.Errorf("-retry-on: %q is neither a status code nor network", v)
+			}
+			r.Statuses = append(r.Statuses, code)
+		}
+	}
+	return r, nil
+}
+
+// printAttempts prints the tries of retried round trips, nothing when every
+// round trip went through on the first one.
+func printAttempts(attempts []proxyclient.Attempt) {
+	retried := false
+	for _, a := range attempts {
+		retried = retried || a.Try > 1
+	}
+	if !retried {
+		return
+	}
+	for _, a := range attempts {
+		outcome := fmt.Sprintf("%d %s", a.Status, a.URL)
+		if a.Err != nil {
+			outcome = fmt.Sprintf("erro %s: %s", a.URL, a.Err)
+		}
+		if a.Wait > 0 {
+			fmt.Printf("attempt %d: %s, retrying in %s\n", a.Try, outcome, dur(a.Wait.Round(time.Millisecond)))
+		} else {
+			fmt.Printf("attempt %d: %s\n", a.Try, outcome)
+		}
+	}
+}
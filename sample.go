@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// sampleMax is -body-sample parsed, 0 to read bodies whole.
+var sampleMax int64
+
+// bodyDecided reports whether more of the body cannot change the -health
+// body terms and -assert-body-contains: every ~ term found and no !~ term,
+// which only the whole body can settle. Without body terms nothing more is
+// needed.
+func bodyDecided(body []byte) bool {
+	if assertBody != "" && !bytes.Contains(body, []byte(assertBody)) {
+		return false
+	}
+	for _, group := range healthChecks {
+		for _, c := range group {
+			if c.field != "body" {
+				continue
+			}
+			if c.op == "!~" || !bytes.Contains(body, []byte(c.value)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// sampleBody reads r as far as the checks need and max at most, and
+// reports whether it stopped before the end of the body.
+func sampleBody(r io.Reader, max int64) ([]byte, bool, error) {
+	var body []byte
+	chunk := make([]byte, 32<<10)
+	for int64(len(body)) < max {
+		n, err := r.Read(chunk[:min(int64(len(chunk)), max-int64(len(body)))])
+		body = append(body, chunk[:n]...)
+		if err == io.EOF {
+			return body, false, nil
+		}
+		if err != nil {
+			return body, false, err
+		}
+		if n > 0 && bodyDecided(body) {
+			break
+		}
+	}
+	// a body ending right at the cap was not cut
+	n, err := io.ReadFull(r, chunk[:1])
+	if n == 0 && err == io.EOF {
+		return body, false, nil
+	}
+	return body, true, nil
+}
+
+// readForChecks reads what the checks look at: the -body-sample, or up to
+// 1 MiB of the body without one.
+func readForChecks(r io.Reader) ([]byte, error) {
+	if sampleMax > 0 {
+		body, _, err := sampleBody(r, sampleMax)
+		return body, err
+	}
+	return ioutil.ReadAll(io.LimitReader(r, 1<<20))
+}
+
+// printSample tells how much of the body -body-sample read.
+func printSample(body []byte, cut bool, length int64) {
+	total := ""
+	if length >= 0 {
+		total = " of " + size(length)
+	}
+	if cut {
+		fmt.Printf("body: sampled %s%s, the rest not read, none printed\n", size(int64(len(body))), total)
+		return
+	}
+	fmt.Printf("body: read all %s, none printed\n", size(int64(len(body))))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// saveCerts writes the peer chain of cs to dir/<host_port>-<leg>.pem,
+// leaf first, and returns the file name.
+func saveCerts(dir, hostport, leg string, cs *tls.ConnectionState) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := strings.NewReplacer(":", "_", "[", "", "]", "", "/", "_").Replace(hostport)
+	path := filepath.Join(dir, name+"-"+leg+".pem")
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	for _, c := range cs.PeerCertificates {
+		fmt.Fprintf(f, "# s:%s\n# i:%s\n", c.Subject, c.Issuer)
+		if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}); err != nil {
+			f.Close()
+			return "", err
+		}
+	}
+	return path, f.Close()
+}
+
+// reportSavedCerts saves the chains of a response for -save-certs and
+// returns 1 when a file could not be written.
+func reportSavedCerts(client *proxyclient.Client, resp *http.Response, proxyLeg *tls.ConnectionState) int {
+	code := 0
+	save := func(hostport, leg string, cs *tls.ConnectionState) {
+		path, err := saveCerts(saveCertsDir, hostport, leg, cs)
+		if err != nil {
+			fmt.Printf("erro: saving %s certificates: %s\n", leg, err)
+			code = 1
+			return
+		}
+		fmt.Printf("certs %s: %d written to %s\n", leg, len(cs.PeerCertificates), path)
+	}
+	if proxyLeg != nil {
+		save(client.ProxyURL().Host, "proxy", proxyLeg)
+	}
+	if resp.TLS != nil && resp.Request.URL.Scheme == "https" {
+		save(resp.Request.URL.Host, "destination", resp.TLS)
+	}
+	return code
+}
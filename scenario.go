@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// scenario is the file `run` executes: requests sent in order over one
+// client.
+type scenario struct {
+	Name  string         `json:"name"`
+	Steps []scenarioStep `json:"steps"`
+}
+
+type scenarioStep struct {
+	Name    string            `json:"name"`
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+	Expect  stepExpect        `json:"expect"`
+}
+
+// stepExpect is what a step asserts about its response: the status, as
+// -health takes it (200, 2xx) or several separated by commas, header
+// values matching regular expressions, a body substring, a latency
+// ceiling and any -health expression.
+type stepExpect struct {
+	Status  string            `json:"status"`
+	Header  map[string]string `json:"header"`
+	Body    string            `json:"body"`
+	Latency string            `json:"latency"`
+	Health  string            `json:"health"`
+}
+
+// assertions compiles e, in a fixed order: status, headers by name, body,
+// latency, health.
+func (e stepExpect) assertions() ([]assertion, error) {
+	var as []assertion
+	if e.Status != "" {
+		as = append(as, statusAssertion(e.Status))
+	}
+	var names []string
+	for name := range e.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		a, err := headerAssertion(name, e.Header[name])
+		if err != nil {
+			return nil, err
+		}
+		as = append(as, a)
+	}
+	if e.Body != "" {
+		as = append(as, bodyAssertion(e.Body))
+	}
+	if e.Latency != "" {
+		d, err := parseDays(e.Latency)
+		if err != nil {
+			return nil, fmt.Errorf("latency: %s", err)
+		}
+		as = append(as, latencyAssertion(d))
+	}
+	if e.Health != "" {
+		groups, err := parseHealth(e.Health)
+		if err != nil {
+			return nil, err
+		}
+		as = append(as, assertion{term: e.Health, eval: func(resp *http.Response, body []byte, elapsed time.Duration) (bool, string) {
+			if ok, failed := passesHealth(groups, resp, body, elapsed); !ok {
+				return false, failed
+			}
+			return true, "passes"
+		}})
+	}
+	return as, nil
+}
+
+// runScenario implements `run [flags] FILE`: it sends the steps of the
+// scenario in FILE, JSON or the YAML subset of parseScenarioYAML, one
+// after the other over one client, cookies kept from step to step, and
+// prints each step's outcome and assertions. A step without url requests
+// -dest; -H headers go with every step, under the step's own. The run
+// stops at the first failing step and returns 1 then.
+func runScenario(cfg proxyclient.Config) int {
+	if flag.NArg() != 1 {
+		fmt.Println("erro: run takes one scenario file")
+		return 2
+	}
+	file := flag.Arg(0)
+	sc, err := loadScenario(file)
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 2
+	}
+	if len(sc.Steps) == 0 {
+		fmt.Printf("erro: %s: no steps\n", file)
+		return 2
+	}
+	checks := make([][]assertion, len(sc.Steps))
+	for i, st := range sc.Steps {
+		if checks[i], err = st.Expect.assertions(); err != nil {
+			fmt.Printf("erro: %s: step %d: %s\n", file, i+1, err)
+			return 2
+		}
+	}
+	if cfg.Jar == nil {
+		cfg.Jar, _ = cookiejar.New(nil)
+	}
+	client, err := proxyclient.New(cfg)
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 2
+	}
+	name := sc.Name
+	if name == "" {
+		name = filepath.Base(file)
+	}
+	fmt.Printf("run: %s, %d steps\n", name, len(sc.Steps))
+
+	label := func(i int) string {
+		if sc.Steps[i].Name != "" {
+			return fmt.Sprintf("step %d %s", i+1, sc.Steps[i].Name)
+		}
+		return fmt.Sprintf("step %d", i+1)
+	}
+	passed := 0
+	for i, st := range sc.Steps {
+		if !runStep(client, label(i), st, checks[i]) {
+			for j := i + 1; j < len(sc.Steps); j++ {
+				fmt.Printf("%s: skipped\n", label(j))
+			}
+			fmt.Printf("run: FAIL, %d of %d steps passed\n", passed, len(sc.Steps))
+			return 1
+		}
+		passed++
+	}
+	fmt.Printf("run: OK, %d steps passed\n", passed)
+	return 0
+}
+
+// runStep sends one step and prints how it went and its assertions.
+func runStep(client *proxyclient.Client, label string, st scenarioStep, checks []assertion) bool {
+	u := st.URL
+	if u == "" {
+		u = dest
+	}
+	m := strings.ToUpper(st.Method)
+	if m == "" {
+		m = "GET"
+	}
+	req, err := http.NewRequest(m, u, bytes.NewReader([]byte(st.Body)))
+	if err != nil {
+		fmt.Printf("%s: erro: %s\n", label, err)
+		return false
+	}
+	if st.Body == "" {
+		req.Body, req.GetBody, req.ContentLength = nil, nil, 0
+	}
+	setHeaders(req)
+	for k, v := range st.Headers {
+		req.Header.Set(k, v)
+	}
+	start := time.Now()
+	resp, res, err := client.Measure(req)
+	if err != nil {
+		fmt.Printf("%s: %s %s erro (%s): %s\n", label, m, redactURL(u), res.ErrorClass, err)
+		return false
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	elapsed := time.Since(start)
+	if err != nil {
+		fmt.Printf("%s: %s %s erro reading body: %s\n", label, m, redactURL(u), err)
+		return false
+	}
+	ok := true
+	var lines []string
+	for _, c := range checks {
+		pass, got := c.eval(resp, body, elapsed)
+		verdict := "PASS"
+		if !pass {
+			verdict, ok = "FAIL", false
+		}
+		lines = append(lines, fmt.Sprintf("  %s %s (%s)", c.term, verdict, got))
+	}
+	verdict := "OK"
+	if !ok {
+		verdict = "FAIL"
+	}
+	fmt.Printf("%s: %s %s code %d %s %s %s\n", label, m, redactURL(u), resp.StatusCode, size(int64(len(body))), dur(elapsed), verdict)
+	for _, l := range lines {
+		fmt.Println(l)
+	}
+	return ok
+}
+
+// loadScenario reads a scenario, JSON when the file starts with {.
+func loadScenario(file string) (*scenario, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var sc scenario
+	if t := bytes.TrimSpace(data); len(t) > 0 && t[0] == '{' {
+		if err := json.Unmarshal(t, &sc); err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		return &sc, nil
+	}
+	v, err := parseScenarioYAML(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s:%s", file, err)
+	}
+	// through JSON into the struct, which checks the shape
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(j, &sc); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return &sc, nil
+}
+
+// yamlLine is a line of a scenario with its indentation, comments and
+// blank lines dropped.
+type yamlLine struct {
+	indent int
+	text   string
+	n      int
+}
+
+// parseScenarioYAML reads the block YAML a scenario needs: nested
+// mappings and "- " lists by indentation, plain, 'single' and "double"
+// quoted scalars, and | or |- literal blocks for bodies. Scalars are all
+// strings; flow collections, anchors and multiple documents are not
+// supported.
+func parseScenarioYAML(src string) (interface{}, error) {
+	var lines []yamlLine
+	raw := strings.Split(src, "\n")
+	for i := 0; i < len(raw); i++ {
+		text := strings.TrimRight(stripComment(raw[i]), " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("%d: indent with spaces, not tabs", i+1)
+		}
+		lines = append(lines, yamlLine{indent: len(text) - len(trimmed), text: trimmed, n: i + 1})
+		// a literal block keeps its lines, comments and blank ones too
+		if strings.HasSuffix(trimmed, ": |") || strings.HasSuffix(trimmed, ": |-") || trimmed == "- |" || trimmed == "- |-" {
+			base := len(text) - len(trimmed)
+			var block []string
+			for i+1 < len(raw) {
+				next := strings.TrimRight(raw[i+1], "\r")
+				if strings.TrimSpace(next) != "" && len(next)-len(strings.TrimLeft(next, " ")) <= base {
+					break
+				}
+				block = append(block, next)
+				i++
+			}
+			lines[len(lines)-1].text += "\x00" + strings.Join(block, "\n")
+		}
+	}
+	if len(lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	p := &yamlParser{lines: lines}
+	v, err := p.block(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.i < len(p.lines) {
+		return nil, fmt.Errorf("%d: bad indentation", p.lines[p.i].n)
+	}
+	return v, nil
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	i     int
+}
+
+// block parses the lines at indent, a list when they start with "- ".
+func (p *yamlParser) block(indent int) (interface{}, error) {
+	if l := p.lines[p.i]; l.text == "-" || strings.HasPrefix(l.text, "- ") {
+		return p.list(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) list(indent int) (interface{}, error) {
+	var items []interface{}
+	for p.i < len(p.lines) {
+		l := p.lines[p.i]
+		if l.indent != indent || !(l.text == "-" || strings.HasPrefix(l.text, "- ")) {
+			break
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+		if rest == "" {
+			p.i++
+			if p.i >= len(p.lines) || p.lines[p.i].indent <= indent {
+				items = append(items, "")
+				continue
+			}
+			v, err := p.block(p.lines[p.i].indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+			continue
+		}
+		// the item's content stands where it would as its own line
+		p.lines[p.i] = yamlLine{indent: indent + len(l.text) - len(rest), text: rest, n: l.n}
+		if yamlKey(rest) == "" {
+			v, err := yamlScalar(rest, l.n)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+			p.i++
+			continue
+		}
+		v, err := p.mapping(p.lines[p.i].indent)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+	}
+	return items, nil
+}
+
+func (p *yamlParser) mapping(indent int) (interface{}, error) {
+	m := map[string]interface{}{}
+	for p.i < len(p.lines) {
+		l := p.lines[p.i]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("%d: bad indentation", l.n)
+		}
+		if l.text == "-" || strings.HasPrefix(l.text, "- ") {
+			break
+		}
+		key := yamlKey(l.text)
+		if key == "" {
+			return nil, fmt.Errorf("%d: want key: value", l.n)
+		}
+		k, err := configValue(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s", l.n, err)
+		}
+		if _, dup := m[k]; dup {
+			return nil, fmt.Errorf("%d: %s given twice", l.n, k)
+		}
+		value := strings.TrimSpace(l.text[len(key)+1:])
+		p.i++
+		switch {
+		case strings.HasPrefix(value, "|"):
+			m[k] = yamlLiteral(value)
+		case value != "":
+			if m[k], err = yamlScalar(value, l.n); err != nil {
+				return nil, err
+			}
+		case p.i < len(p.lines) && (p.lines[p.i].indent > indent ||
+			// a list may sit at its key's indentation
+			p.lines[p.i].indent == indent && (p.lines[p.i].text == "-" || strings.HasPrefix(p.lines[p.i].text, "- "))):
+			if m[k], err = p.block(p.lines[p.i].indent); err != nil {
+				return nil, err
+			}
+		default:
+			m[k] = ""
+		}
+	}
+	return m, nil
+}
+
+// yamlKey returns the "key" of a "key: value" or "key:" line, "" when it
+// is none.
+func yamlKey(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case quote != 0 && c == '\\' && quote == '"':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && i == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == ':' && (i+1 == len(text) || text[i+1] == ' '):
+			return text[:i]
+		}
+	}
+	return ""
+}
+
+func yamlScalar(v string, n int) (string, error) {
+	if strings.HasPrefix(v, "[") || strings.HasPrefix(v, "{") {
+		return "", fmt.Errorf("%d: flow collections are not supported, use block style or quote the value", n)
+	}
+	s, err := configValue(v)
+	if err != nil {
+		return "", fmt.Errorf("%d: %s", n, err)
+	}
+	return s, nil
+}
+
+// yamlLiteral is the text of a | block, without its indentation and
+// with one final newline, none for |-.
+func yamlLiteral(value string) string {
+	header, block, _ := strings.Cut(value, "\x00")
+	lines := strings.Split(block, "\n")
+	indent := -1
+	for _, l := range lines {
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		if n := len(l) - len(strings.TrimLeft(l, " ")); indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	for i, l := range lines {
+		if len(l) >= indent && indent > 0 {
+			lines[i] = l[indent:]
+		} else {
+			lines[i] = strings.TrimLeft(l, " ")
+		}
+	}
+	text := strings.TrimRight(strings.Join(lines, "\n"), "\n")
+	if header == "|" && text != "" {
+		text += "\n"
+	}
+	return text
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+// loadPassword sets password from -password-file, -password-env or
+// -password-prompt, which keep it out of ps output and shell history.
+// Given on the command line, one of them or -password wins over the
+// environment and -config; there, one of the three replaces a password
+// found alongside it.
+func loadPassword() error {
+	set := map[string]bool{"password": true, "password-file": passwordFile != "", "password-env": passwordEnv != "", "password-prompt": passwordPrompt}
+	var given []string
+	for _, name := range []string{"password", "password-file", "password-env", "password-prompt"} {
+		if cmdLineFlags[name] && set[name] {
+			given = append(given, name)
+		}
+	}
+	if len(given) > 1 {
+		return fmt.Errorf("-password, -password-file, -password-env and -password-prompt are mutually exclusive")
+	}
+	source := ""
+	if len(given) == 1 {
+		source = given[0]
+	} else {
+		sources := 0
+		for _, name := range []string{"password-file", "password-env", "password-prompt"} {
+			if set[name] {
+				source = name
+				sources++
+			}
+		}
+		if sources > 1 {
+			return fmt.Errorf("-password-file, -password-env and -password-prompt are mutually exclusive")
+		}
+	}
+	switch source {
+	case "password-file":
+		data, err := ioutil.ReadFile(passwordFile)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Stat(passwordFile); err == nil && fi.Mode().Perm()&0077 != 0 {
+			fmt.Fprintf(os.Stderr, "password: %s is readable by others, chmod 600 it\n", passwordFile)
+		}
+		// the first line, so a trailing newline from an editor does not count
+		password = strings.TrimRight(strings.SplitN(string(data), "\n", 2)[0], "\r")
+	case "password-env":
+		v, ok := os.LookupEnv(passwordEnv)
+		if !ok {
+			return fmt.Errorf("-password-env: %s is not set", passwordEnv)
+		}
+		password = v
+	case "password-prompt":
+		v, err := promptSecret(fmt.Sprintf("proxy password for %s: ", user))
+		if err != nil {
+			return fmt.Errorf("-password-prompt: %s", err)
+		}
+		password = v
+	}
+	return nil
+}
+
+// promptSecret reads a line from the terminal with echo off. An interrupt
+// restores the echo before exiting.
+func promptSecret(prompt string) (string, error) {
+	tty, err := openTerminal()
+	if err != nil {
+		return "", err
+	}
+	defer tty.Close()
+	restore, err := disableEcho(tty)
+	if err != nil {
+		return "", err
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	done := make(chan struct{})
+	defer func() {
+		signal.Stop(sig)
+		close(done)
+		restore()
+	}()
+	go func() {
+		select {
+		case <-sig:
+			restore()
+			fmt.Fprintln(os.Stderr)
+			os.Exit(exitInterrupted)
+		case <-done:
+		}
+	}()
+
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	fmt.Fprintln(os.Stderr)
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
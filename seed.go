@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"time"
+)
+
+// runSeed is what every random choice of the run derives from: -seed, or
+// a fresh one printed on first use so the run can be replayed with it.
+var (
+	runSeed     int64
+	seedPrinted bool
+)
+
+// streamSeed returns the seed of one named source of randomness. Each
+// gets its own so adding one does not shift the choices of the others.
+func streamSeed(name string) int64 {
+	if runSeed == 0 {
+		runSeed = seed
+		if runSeed == 0 {
+			runSeed = time.Now().UnixNano()
+		}
+	}
+	if !seedPrinted {
+		fmt.Printf("seed: %d\n", runSeed)
+		seedPrinted = true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return runSeed ^ int64(h.Sum64())
+}
+
+// newRand returns the generator of the named source. It is not safe for
+// concurrent use, give each goroutine its own name.
+func newRand(name string) *rand.Rand {
+	return rand.New(rand.NewSource(streamSeed(name)))
+}
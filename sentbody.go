@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"time"
+)
+
+// sentBody records the request body bytes the transport actually read,
+// for the last attempt when a redirect replays the body.
+type sentBody struct {
+	n    int64
+	hash hash.Hash
+	// first and last are when the first and the last bytes were read
+	first, last time.Time
+}
+
+// recordBody makes req report what it sends into a sentBody.
+func recordBody(req *http.Request) *sentBody {
+	s := &sentBody{hash: sha256.New()}
+	if req.Body == nil || req.Body == http.NoBody {
+		return s
+	}
+	wrap := func(rc io.ReadCloser) io.ReadCloser {
+		s.n, s.hash, s.first = 0, sha256.New(), time.Time{}
+		return &sentBodyReader{ReadCloser: rc, s: s}
+	}
+	req.Body = wrap(req.Body)
+	if getBody := req.GetBody; getBody != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			rc, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			return wrap(rc), nil
+		}
+	}
+	return s
+}
+
+type sentBodyReader struct {
+	io.ReadCloser
+	s *sentBody
+}
+
+func (r *sentBodyReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if r.s.first.IsZero() {
+			r.s.first = time.Now()
+		}
+		r.s.last = time.Now()
+	}
+	r.s.n += int64(n)
+	r.s.hash.Write(p[:n])
+	return n, err
+}
+
+func (s *sentBody) sum() string {
+	return hex.EncodeToString(s.hash.Sum(nil))
+}
+
+// printSent prints the body bytes sent and flags a short read, which
+// means the request went out with less than the whole body.
+func printSent(s *sentBody, want int64) {
+	fmt.Printf("sent: %s sha256 %s\n", size(s.n), s.sum())
+	if s.n < int64(want) {
+		fmt.Printf("sent: body cut short, %s of %s went out\n", size(s.n), size(want))
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// hopHeaders are connection specific and not forwarded (RFC 7230 6.1).
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// dropHopHeaders removes hopHeaders and the headers Connection lists.
+func dropHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// forwardProxy is a minimal forward proxy: CONNECT tunnels and absolute
+// URI requests, optionally behind basic auth.
+type forwardProxy struct {
+	auth      string
+	transport *http.Transport
+	// metrics, when set, counts what the proxy forwarded, labeled by
+	// its listen address
+	metrics *promMetrics
+	listen  string
+}
+
+// runServe implements `serve`: it runs a forward proxy until killed, so
+// this tool can sit at either end of a proxy chain under test.
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", ":3128", "address to listen on")
+	cert := fs.String("cert", "", "TLS certificate file, serves https:// proxies together with -key")
+	key := fs.String("key", "", "TLS key file")
+	user := fs.String("user", "", "require basic auth with this user")
+	password := fs.String("password", "", "require basic auth with this password")
+	metrics := fs.String("metrics-listen", "", "serve Prometheus metrics of the forwarded requests on /metrics at this address")
+	allowInternal := fs.Bool("allow-internal", false, "forward to loopback, private and link-local addresses too")
+	fs.Parse(args)
+	if (*cert == "") != (*key == "") {
+		fmt.Println("erro: -cert and -key go together")
+		return 2
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if !*allowInternal {
+		// checked on the address dialed, so a name cannot rebind past it
+		dialer.Control = denyInternal
+	}
+	p := &forwardProxy{transport: &http.Transport{
+		DialContext:         dialer.DialContext,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	}}
+	if *metrics != "" {
+		p.metrics, p.listen = newPromMetrics(), *listen
+		if err := serveMetrics(*metrics, p.metrics); err != nil {
+			fmt.Printf("erro: %s\n", err)
+			return 2
+		}
+	}
+	if *user != "" || *password != "" {
+		p.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(*user+":"+*password))
+	}
+	srv := &http.Server{
+		Addr:    *listen,
+		Handler: p,
+		// CONNECT needs to hijack the connection, which HTTP/2 cannot
+		TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){},
+	}
+	var err error
+	if *cert != "" {
+		fmt.Printf("serve: https proxy on %s\n", *listen)
+		err = srv.ListenAndServeTLS(*cert, *key)
+	} else {
+		fmt.Printf("serve: http proxy on %s\n", *listen)
+		err = srv.ListenAndServe()
+	}
+	fmt.Printf("erro: %s\n", err)
+	return 1
+}
+
+func (p *forwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	status, err := p.serve(w, r)
+	elapsed := time.Since(start)
+	log.Printf("serve: %s %s %s %d %s", r.RemoteAddr, r.Method, r.Host, status, elapsed)
+	if r.Method != http.MethodConnect || status != http.StatusOK {
+		// a tunnel that came up was counted when it did
+		p.observe(r, elapsed, status, err)
+	}
+}
+
+// observe feeds the metrics, if any, with one answered request.
+func (p *forwardProxy) observe(r *http.Request, elapsed time.Duration, status int, err error) {
+	if p.metrics == nil {
+		return
+	}
+	o := proxyclient.Observation{Proxy: p.listen, Host: r.Host, Duration: elapsed, Status: status}
+	if err != nil {
+		o.Status, o.ErrorClass = 0, proxyclient.ErrorClass(err, nil)
+	}
+	p.metrics.observe(o)
+}
+
+// serve handles one request and returns the status for the log, and the
+// error when the destination could not be reached.
+func (p *forwardProxy) serve(w http.ResponseWriter, r *http.Request) (int, error) {
+	if p.auth != "" {
+		got := r.Header.Get("Proxy-Authorization")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(p.auth)) != 1 {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="poc-proxy-https"`)
+			http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+			return http.StatusProxyAuthRequired, nil
+		}
+	}
+	if r.Method == http.MethodConnect {
+		return p.tunnel(w, r)
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "this is a proxy, send absolute URIs or CONNECT", http.StatusBadRequest)
+		return http.StatusBadRequest, nil
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	dropHopHeaders(out.Header)
+	out.Header.Add("Via", "1.1 poc-proxy-https")
+	if r.ContentLength == 0 {
+		out.Body = nil
+	}
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		code := dialFailedStatus(err)
+		http.Error(w, err.Error(), code)
+		return code, err
+	}
+	defer resp.Body.Close()
+	dropHopHeaders(resp.Header)
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Add("Via", "1.1 poc-proxy-https")
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return resp.StatusCode, nil
+}
+
+// tunnel answers CONNECT by splicing the client to the target.
+func (p *forwardProxy) tunnel(w http.ResponseWriter, r *http.Request) (int, error) {
+	start := time.Now()
+	upstream, err := p.transport.DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		code := dialFailedStatus(err)
+		http.Error(w, err.Error(), code)
+		return code, err
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "connection cannot be hijacked", http.StatusInternalServerError)
+		return http.StatusInternalServerError, nil
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		upstream.Close()
+		return http.StatusInternalServerError, nil
+	}
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	p.observe(r, time.Since(start), http.StatusOK, nil)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// bytes the client sent after CONNECT may already be buffered
+		if n := buf.Reader.Buffered(); n > 0 {
+			b, _ := buf.Reader.Peek(n)
+			upstream.Write(b)
+		}
+		io.Copy(upstream, conn)
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, upstream)
+		closeWrite(conn)
+	}()
+	wg.Wait()
+	conn.Close()
+	upstream.Close()
+	return http.StatusOK, nil
+}
+
+// denyInternal is the dialer Control refusing internal addresses, those
+// of proxyclient.IsInternal.
+func denyInternal(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil && proxyclient.IsInternal(ip) {
+		return &proxyclient.InternalError{Host: host, Addr: ip}
+	}
+	return nil
+}
+
+// dialFailedStatus is 403 for a destination denyInternal refused, 502
+// otherwise.
+func dialFailedStatus(err error) int {
+	var ie *proxyclient.InternalError
+	if errors.As(err, &ie) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+// closeWrite half-closes c when it supports it so the peer sees EOF.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		c.Close()
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMaskArgs(t *testing.T) {
+	for _, tt := range []struct {
+		args, want []string
+	}{
+		{[]string{"-password", "s3cret", "-dest", "https://a.example"}, []string{"-password", "****", "-dest", "https://a.example"}},
+		{[]string{"-password=s3cret"}, []string{"-password=****"}},
+		{[]string{"-H", "Authorization: Bearer abc", "-H", "X-Trace: 1"}, []string{"-H", "Authorization: ****", "-H", "X-Trace: 1"}},
+		{[]string{"--H=proxy-authorization: Basic dTpw"}, []string{"--H=proxy-authorization: ****"}},
+		{[]string{"-H", "Cookie: session=abc"}, []string{"-H", "Cookie: ****"}},
+		{[]string{"-cookie", "session=abc", "-cookie=id=1"}, []string{"-cookie", "****", "-cookie=****"}},
+		{[]string{"-proxy", "http://u:pass@p:3128"}, []string{"-proxy", "http://u:xxxxx@p:3128"}},
+	} {
+		if got := maskArgs(tt.args); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("maskArgs(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
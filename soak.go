@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// soakSample is a snapshot of the tool's own resource usage.
+type soakSample struct {
+	goroutines int
+	fds        int // -1 where /proc/self/fd is not available
+	heap       uint64
+}
+
+func takeSoakSample() soakSample {
+	// collect first so heap reflects live memory and not garbage
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	s := soakSample{goroutines: runtime.NumGoroutine(), fds: -1, heap: m.HeapInuse}
+	if entries, err := ioutil.ReadDir("/proc/self/fd"); err == nil {
+		s.fds = len(entries)
+	}
+	return s
+}
+
+// runSoak repeats the request every soakInterval until soak elapses and
+// returns the process exit code: 1 when goroutines, file descriptors or
+// heap trend upward over the run, or when a request did not meet
+// -assert-*. -soak-listen serves /healthz and
+// /readyz meanwhile. SIGTERM or SIGINT ends the run once the request in
+// flight is done, within -soak-drain, with the verdict over the samples
+// so far and exit code 130 unless that verdict already failed.
+func runSoak(client *proxyclient.Client) int {
+	sampleRate, err := parseSampleRate(traceSample)
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 2
+	}
+	life := &lifecycle{pending: "first request not done"}
+	srv, err := life.listen("soak", soakListen)
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 2
+	}
+	defer shutdown(srv)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// the request in flight outlives the signal, it is drained, not cut off
+	reqs, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	drained := make(chan struct{})
+	stopDrain := context.AfterFunc(ctx, func() {
+		defer close(drained)
+		life.drain("soak", "the request in flight", soakDrain, reqs.Done(), cancel)
+	})
+
+	var sampler *rand.Rand
+	if sampleRate > 0 {
+		sampler = newRand("soak-sample")
+	}
+	var samples []soakSample
+	unmet := 0
+	deadline := time.Now().Add(soak)
+	for i := 1; time.Now().Before(deadline) && ctx.Err() == nil; i++ {
+		status, failed := "erro", ""
+		var res *proxyclient.Result
+		req, err := destRequest()
+		if err == nil {
+			req = req.WithContext(reqs)
+			start := time.Now()
+			var resp *http.Response
+			if sampler != nil && sampler.Float64() < sampleRate {
+				resp, res, err = client.Measure(req)
+			} else {
+				resp, err = client.Do(req)
+			}
+			if err == nil {
+				var body []byte
+				if assertChecks != nil {
+					body, _ = readForChecks(resp.Body)
+				}
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+				status = fmt.Sprint(resp.StatusCode)
+				if assertChecks != nil {
+					if ok, reason := passesAssertions(assertChecks, resp, body, time.Since(start)); !ok {
+						failed = reason
+					}
+				}
+			}
+		}
+		if reqs.Err() != nil {
+			// cancelled by the drain, the sample says nothing
+			break
+		}
+		s := takeSoakSample()
+		samples = append(samples, s)
+		heap := fmt.Sprint(s.heap)
+		if human {
+			heap = size(int64(s.heap))
+		}
+		fmt.Printf("soak %d: code %s goroutines %d fds %d heap %s\n", i, status, s.goroutines, s.fds, heap)
+		if res != nil {
+			fmt.Printf("soak %d: timing: %s\n", i, formatTiming(res))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "soak %d: erro: %s\n", i, err)
+		}
+		if failed != "" {
+			fmt.Printf("soak %d: assert: FAIL %s\n", i, failed)
+		}
+		if assertChecks != nil && (err != nil || failed != "") {
+			unmet++
+		}
+		life.setReady()
+		select {
+		case <-ctx.Done():
+		case <-time.After(soakInterval):
+		}
+	}
+	if !stopDrain() {
+		// the drain is under way, the pause or the request it waits for is over
+		cancel()
+		<-drained
+	}
+	interrupted := ctx.Err() != nil
+	if interrupted {
+		left := time.Until(deadline)
+		fmt.Printf("soak: interrupted after %d samples, %s of the run not attempted\n", len(samples), dur(left.Truncate(time.Second)))
+	}
+	code := soakVerdict(samples)
+	if assertChecks != nil && reportUnmet("soak", "requests", unmet, len(samples)) != 0 && code == 0 {
+		code = 1
+	}
+	if interrupted && code == 0 {
+		code = exitInterrupted
+	}
+	return code
+}
+
+// parseSampleRate reads -trace-sample, a percentage or a fraction.
+func parseSampleRate(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err == nil && strings.HasSuffix(s, "%") {
+		v /= 100
+	}
+	if err != nil || v < 0 || v > 1 {
+		return 0, fmt.Errorf("-trace-sample: %q is not a share between 0%% and 100%%", s)
+	}
+	return v, nil
+}
+
+// checkTraceSampleMode refuses -trace-sample outside -soak: bench,
+// throughput and the rest time their requests their own way and would
+// drop it without a word.
+func checkTraceSampleMode() error {
+	if traceSample == "" {
+		return nil
+	}
+	switch m := runMode(); m {
+	case "-soak":
+		return nil
+	case "":
+		return fmt.Errorf("-trace-sample samples the requests of -soak, not of a single request or a -dest batch")
+	default:
+		return fmt.Errorf("-trace-sample samples the requests of -soak, not of %s", m)
+	}
+}
+
+// exitInterrupted is the exit code of a run cut short by a signal.
+const exitInterrupted = 130
+
+// soakVerdict compares the first and last quarter of the run: a resource
+// trends upward when its floor at the end sits above its ceiling at the
+// start by more than a small slack. Idle connections and GC noise make the
+// values wobble but keep the two ranges overlapping.
+func soakVerdict(samples []soakSample) int {
+	q := len(samples) / 4
+	if q == 0 {
+		fmt.Printf("soak: %d samples, too few to judge a trend\n", len(samples))
+		return 0
+	}
+	first, last := samples[:q], samples[len(samples)-q:]
+	leaks := 0
+	check := func(name string, value func(soakSample) float64, slack func(max float64) float64) {
+		firstMax, lastMin := value(first[0]), value(last[0])
+		for _, s := range first {
+			if v := value(s); v > firstMax {
+				firstMax = v
+			}
+		}
+		for _, s := range last {
+			if v := value(s); v < lastMin {
+				lastMin = v
+			}
+		}
+		if lastMin > firstMax+slack(firstMax) {
+			leaks++
+			fmt.Printf("soak: %s trending up: max %.0f in first quarter, min %.0f in last quarter\n", name, firstMax, lastMin)
+		}
+	}
+	check("goroutines", func(s soakSample) float64 { return float64(s.goroutines) },
+		func(float64) float64 { return 2 })
+	if first[0].fds >= 0 {
+		check("fds", func(s soakSample) float64 { return float64(s.fds) },
+			func(float64) float64 { return 2 })
+	}
+	check("heap", func(s soakSample) float64 { return float64(s.heap) },
+		func(max float64) float64 { return max / 10 })
+	if leaks > 0 {
+		fmt.Printf("soak: FAIL, %d resource(s) trending up over %d samples\n", leaks, len(samples))
+		return 1
+	}
+	fmt.Printf("soak: OK, no upward trend over %d samples\n", len(samples))
+	return 0
+}
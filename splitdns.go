@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// pathResult is what the destination answered on one resolution path.
+type pathResult struct {
+	code int
+	cert string // sha256 of the leaf, "" for plain http
+	err  error
+}
+
+func (r pathResult) String() string {
+	if r.err != nil {
+		return "erro: " + r.err.Error()
+	}
+	if r.cert == "" {
+		return fmt.Sprintf("code %d", r.code)
+	}
+	return fmt.Sprintf("code %d cert %s", r.code, r.cert)
+}
+
+// runSplitDNS sends the request once with the name left to the proxy and
+// once per address the client resolves, asking the proxy for that IP while
+// Host and SNI keep the name. Split DNS shows as paths ending on different
+// answers or certificates. It returns 1 when the paths disagree.
+func runSplitDNS(client *proxyclient.Client, cfg proxyclient.Config) int {
+	if client.ProxyURL() == nil {
+		fmt.Println("erro: -split-dns needs a proxy to compare against")
+		return 2
+	}
+	destURL, err := url.Parse(dest)
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 2
+	}
+	host := destURL.Hostname()
+	if net.ParseIP(host) != nil {
+		fmt.Printf("erro: -split-dns needs a destination name, %s is an address\n", host)
+		return 2
+	}
+
+	viaProxy := splitDNSPath(client, nil)
+	fmt.Printf("split-dns proxy resolved %s: %s\n", host, viaProxy)
+
+	start := time.Now()
+	addrs, err := client.Resolver().LookupIP(context.Background(), "ip", host)
+	if err != nil {
+		fmt.Printf("split-dns client resolved %s: erro: %s\n", host, err)
+		fmt.Println("split-dns: MISMATCH, the name only resolves on the proxy")
+		return 1
+	}
+	fmt.Printf("split-dns client resolved %s: %v %s\n", host, addrs, dur(time.Since(start)))
+
+	mismatches := 0
+	for _, a := range addrs {
+		pinned, target, err := pinnedClient(cfg, destURL, a)
+		var r pathResult
+		if err != nil {
+			r.err = err
+		} else {
+			r = splitDNSPath(pinned, target)
+			pinned.Transport().CloseIdleConnections()
+		}
+		verdict := "same"
+		if !samePath(viaProxy, r) {
+			verdict = "DIFFERENT"
+			mismatches++
+		}
+		fmt.Printf("split-dns via %s: %s, %s\n", a, r, verdict)
+	}
+	if mismatches > 0 {
+		fmt.Printf("split-dns: MISMATCH, %d of %d client resolved addresses differ from the proxy's\n", mismatches, len(addrs))
+		return 1
+	}
+	fmt.Println("split-dns: OK, client and proxy resolution agree")
+	return 0
+}
+
+// pinnedClient returns a client whose CONNECT goes to ip and the URL to
+// request with it.
+func pinnedClient(cfg proxyclient.Config, destURL *url.URL, ip net.IP) (*proxyclient.Client, *url.URL, error) {
+	target := *destURL
+	target.Host = ip.String()
+	if port := destURL.Port(); port != "" {
+		target.Host = net.JoinHostPort(ip.String(), port)
+	} else if ip.To4() == nil {
+		target.Host = "[" + ip.String() + "]"
+	}
+	if cfg.TLSServerName == "" {
+		cfg.TLSServerName = destURL.Hostname()
+	}
+	// destination credentials follow the address the request now names
+	if cfg.OAuth != nil {
+		o := *cfg.OAuth
+		o.Host = target.Host
+		cfg.OAuth = &o
+	}
+	if cfg.DestAuth != nil {
+		d := *cfg.DestAuth
+		d.Host = target.Host
+		cfg.DestAuth = &d
+	}
+	c, err := proxyclient.New(cfg)
+	return c, &target, err
+}
+
+// splitDNSPath runs the request, to target with the Host of -dest when
+// target is set.
+func splitDNSPath(client *proxyclient.Client, target *url.URL) pathResult {
+	req, err := destRequest()
+	if err != nil {
+		return pathResult{err: err}
+	}
+	if target != nil {
+		req.Host = req.URL.Host
+		req.URL = target
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return pathResult{err: err}
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	r := pathResult{code: resp.StatusCode}
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		sum := sha256.Sum256(resp.TLS.PeerCertificates[0].Raw)
+		r.cert = hex.EncodeToString(sum[:8])
+	}
+	return r
+}
+
+// samePath compares outcomes, errors only by whether there was one.
+func samePath(a, b pathResult) bool {
+	if a.err != nil || b.err != nil {
+		return (a.err != nil) == (b.err != nil)
+	}
+	return a.code == b.code && a.cert == b.cert
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// checkStore keeps the checks of watch for report and /checks.
+type checkStore interface {
+	add(r watchRecord) error
+	records() ([]watchRecord, error)
+	close() error
+}
+
+// memoryStoreMax is how many checks the memory store keeps, the oldest
+// dropped first.
+const memoryStoreMax = 10000
+
+// openCheckStore opens the store -watch-store names: "memory" for the
+// checks of this run only, a file of JSON lines otherwise, nil with
+// "none". Database URLs are refused, the standard library has no SQL
+// drivers.
+func openCheckStore() (checkStore, string, error) {
+	switch {
+	case watchStore == "none":
+		return nil, "", nil
+	case watchStore == "memory":
+		return &memoryStore{}, "memory", nil
+	case strings.HasPrefix(watchStore, "sqlite:"), strings.HasPrefix(watchStore, "postgres://"), strings.HasPrefix(watchStore, "postgresql://"):
+		return nil, "", fmt.Errorf("%s: SQL stores need a database/sql driver, which this build does not include; use a file or memory", watchStore)
+	}
+	path, err := watchStoreFile()
+	if err != nil {
+		return nil, "", err
+	}
+	s, err := openJSONLStore(path)
+	return s, path, err
+}
+
+// memoryStore keeps the last memoryStoreMax checks of the run.
+type memoryStore struct {
+	mu   sync.Mutex
+	recs []watchRecord
+}
+
+func (s *memoryStore) add(r watchRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.recs) == memoryStoreMax {
+		s.recs = append(s.recs[:0], s.recs[1:]...)
+	}
+	s.recs = append(s.recs, r)
+	return nil
+}
+
+func (s *memoryStore) records() ([]watchRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]watchRecord(nil), s.recs...), nil
+}
+
+func (s *memoryStore) close() error { return nil }
+
+// jsonlStore appends a JSON line per check to a file, 0600 as it may
+// name internal proxies.
+type jsonlStore struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+func openJSONLStore(path string) (*jsonlStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonlStore{path: path, f: f}, nil
+}
+
+func (s *jsonlStore) add(r watchRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.f.Write(append(line, '\n'))
+	return err
+}
+
+func (s *jsonlStore) records() ([]watchRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return loadWatchRecords(s.path)
+}
+
+func (s *jsonlStore) close() error { return s.f.Close() }
+
+// loadWatchRecords reads the checks of a JSON lines store.
+func loadWatchRecords(path string) ([]watchRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []watchRecord
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		var r watchRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			// a line cut short by a crash should not lose the rest
+			fmt.Fprintf(os.Stderr, "report: %s:%d: skipped, %s\n", path, n, err)
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, sc.Err()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckStores(t *testing.T) {
+	file, err := openJSONLStore(filepath.Join(t.TempDir(), "watch", "watch.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.close()
+	at := time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+	want := []watchRecord{
+		{Time: at, Proxy: "http://p1:3128", Up: true, Status: 200, Latency: 80 * time.Millisecond},
+		{Time: at.Add(time.Minute), Proxy: "http://p2:3128", Reason: "dial: connection refused"},
+	}
+	for _, s := range []checkStore{&memoryStore{}, file} {
+		for _, r := range want {
+			if err := s.add(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := s.records()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%T records = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestMemoryStoreMax(t *testing.T) {
+	s := &memoryStore{}
+	for i := 0; i < memoryStoreMax+5; i++ {
+		s.add(watchRecord{Status: i})
+	}
+	got, _ := s.records()
+	if len(got) != memoryStoreMax || got[0].Status != 5 || got[len(got)-1].Status != memoryStoreMax+4 {
+		t.Errorf("kept %d checks from %d to %d, want %d from 5", len(got), got[0].Status, got[len(got)-1].Status, memoryStoreMax)
+	}
+}
+
+func TestOpenCheckStore(t *testing.T) {
+	defer func() { watchStore = "" }()
+	for _, tt := range []struct {
+		store string
+		kind  string
+		err   bool
+	}{
+		{"none", "<nil>", false},
+		{"memory", "*main.memoryStore", false},
+		{filepath.Join(t.TempDir(), "w.jsonl"), "*main.jsonlStore", false},
+		{"sqlite:/var/lib/watch.db", "<nil>", true},
+		{"postgres://db/watch", "<nil>", true},
+	} {
+		watchStore = tt.store
+		s, _, err := openCheckStore()
+		if kind := fmt.Sprintf("%T", s); kind != tt.kind || (err != nil) != tt.err {
+			t.Errorf("openCheckStore(%q) = %s, %v, want %s, error %v", tt.store, kind, err, tt.kind, tt.err)
+		}
+		if s != nil {
+			s.close()
+		}
+	}
+}
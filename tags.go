@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// tagName is what a tag key may be: a Prometheus label name, the tags
+// become labels of the metrics.
+var tagName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedTags are the labels the metrics have already.
+var reservedTags = map[string]bool{"proxy": true, "dest": true, "code": true, "class": true, "le": true}
+
+// targetTags are the tags given with the targets, -dest, -dest-file and
+// -proxy-file entries and watch proxies, by target as given without them.
+var targetTags = map[string]map[string]string{}
+
+// splitTags splits a target entry, "TARGET key=value ...", into the target
+// and its tags, which it records in targetTags.
+func splitTags(entry string) (string, error) {
+	fields := strings.Fields(entry)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty target")
+	}
+	target := fields[0]
+	for _, f := range fields[1:] {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok || !tagName.MatchString(k) {
+			return "", fmt.Errorf("%s: tag %q is not key=value", target, f)
+		}
+		if reservedTags[k] {
+			return "", fmt.Errorf("%s: %s is not a tag name, the metrics use it", target, k)
+		}
+		if targetTags[target] == nil {
+			targetTags[target] = map[string]string{}
+		}
+		targetTags[target][k] = v
+	}
+	return target, nil
+}
+
+// tagFilter is one -filter: a tag that has to have, or with != must not
+// have, a value.
+type tagFilter struct {
+	key, value string
+	not        bool
+}
+
+// tagFilters collects repeated -filter flags. Targets pass filters on
+// different keys all, and of those on one key any, so -filter env=prod
+// -filter team=payments -filter team=billing picks the prod targets of
+// both teams.
+type tagFilters []tagFilter
+
+var filters tagFilters
+
+func (l *tagFilters) String() string {
+	var s []string
+	for _, f := range *l {
+		op := "="
+		if f.not {
+			op = "!="
+		}
+		s = append(s, f.key+op+f.value)
+	}
+	return strings.Join(s, ", ")
+}
+
+func (l *tagFilters) Set(v string) error {
+	k, value, ok := strings.Cut(v, "=")
+	f := tagFilter{key: k, value: value}
+	if strings.HasSuffix(k, "!") {
+		f.key, f.not = strings.TrimSuffix(k, "!"), true
+	}
+	if !ok || !tagName.MatchString(f.key) {
+		return fmt.Errorf("want key=value or key!=value, got %q", v)
+	}
+	*l = append(*l, f)
+	return nil
+}
+
+// selects reports whether a target with tags passes the filters.
+func (l tagFilters) selects(tags map[string]string) bool {
+	pass := map[string]bool{}
+	for _, f := range l {
+		v, has := tags[f.key]
+		if f.not {
+			if has && v == f.value {
+				return false
+			}
+			continue
+		}
+		if _, seen := pass[f.key]; !seen {
+			pass[f.key] = false
+		}
+		if has && v == f.value {
+			pass[f.key] = true
+		}
+	}
+	for _, ok := range pass {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// filterTargets keeps the targets -filter selects; what names them in
+// the error when none is left.
+func filterTargets(what string, targets []string) ([]string, error) {
+	if len(filters) == 0 {
+		return targets, nil
+	}
+	var kept []string
+	for _, t := range targets {
+		if filters.selects(targetTags[t]) {
+			kept = append(kept, t)
+		}
+	}
+	if len(kept) == 0 {
+		return nil, fmt.Errorf("none of the %d %s have the tags of -filter %s", len(targets), what, filters.String())
+	}
+	return kept, nil
+}
+
+// formatTags renders tags as k=v pairs sorted by key, "-" for none.
+func formatTags(tags map[string]string) string {
+	if len(tags) == 0 {
+		return "-"
+	}
+	var s []string
+	for _, k := range tagKeys(tags) {
+		s = append(s, k+"="+tags[k])
+	}
+	return strings.Join(s, " ")
+}
+
+func tagKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mergeTags returns the tags of a and b, b's winning on a shared key.
+func mergeTags(a, b map[string]string) map[string]string {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	m := map[string]string{}
+	for k, v := range a {
+		m[k] = v
+	}
+	for k, v := range b {
+		m[k] = v
+	}
+	return m
+}
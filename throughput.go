@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// runThroughput implements `throughput`: it measures download then upload
+// bandwidth through the proxy against the speed endpoints of a mock-origin
+// at -dest, with -streams parallel transfers for -duration each. It returns
+// 1 when a direction moved no data at all.
+func runThroughput(client *proxyclient.Client) int {
+	base := strings.TrimSuffix(dest, "/")
+	fmt.Printf("throughput: %s, %d streams, %s per direction\n", base, streams, dur(duration))
+	code := 0
+	for _, dir := range []struct {
+		name string
+		run  func(context.Context, *proxyclient.Client, string) (int64, error)
+	}{{"down", speedDownStream}, {"up", speedUpStream}} {
+		var total int64
+		var wg sync.WaitGroup
+		ctx, cancel := context.WithTimeout(context.Background(), duration)
+		start := time.Now()
+		for i := 0; i < streams; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				n, err := dir.run(ctx, client, base)
+				atomic.AddInt64(&total, n)
+				if err != nil {
+					fmt.Printf("throughput: %s stream %d: erro: %s\n", dir.name, i+1, err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		elapsed := time.Since(start)
+		cancel()
+		if total == 0 {
+			code = 1
+		}
+		fmt.Printf("throughput: %-4s %s (%s in %s)\n", dir.name, bitRate(total, elapsed), byteSize(total), dur(elapsed.Truncate(time.Millisecond)))
+	}
+	return code
+}
+
+// speedDownStream reads from /speed/down until ctx expires.
+func speedDownStream(ctx context.Context, client *proxyclient.Client, base string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", base+"/speed/down", nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s", resp.Status)
+	}
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	if ctx.Err() != nil {
+		// the deadline ends every download, that is not an error
+		err = nil
+	}
+	return n, err
+}
+
+// speedUpStream posts to /speed/up until ctx expires and returns what the
+// origin says it received, so bytes stuck in proxy buffers do not count.
+func speedUpStream(ctx context.Context, client *proxyclient.Client, base string) (int64, error) {
+	req, err := http.NewRequest("POST", base+"/speed/up", &deadlineReader{ctx: ctx})
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	got, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s", resp.Status)
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(got)), 10, 64)
+}
+
+// deadlineReader yields speedChunk data until ctx expires, then EOF.
+type deadlineReader struct {
+	ctx context.Context
+	off int
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	if r.ctx.Err() != nil {
+		return 0, io.EOF
+	}
+	n := copy(p, speedChunk[r.off:])
+	r.off = (r.off + n) % len(speedChunk)
+	return n, nil
+}
+
+// bitRate formats n bytes over d as bits per second.
+func bitRate(n int64, d time.Duration) string {
+	if d <= 0 {
+		return "0 bit/s"
+	}
+	bps := float64(n) * 8 / d.Seconds()
+	for _, unit := range []string{"bit/s", "kbit/s", "Mbit/s", "Gbit/s"} {
+		if bps < 1000 || unit == "Gbit/s" {
+			return fmt.Sprintf("%.1f %s", bps, unit)
+		}
+		bps /= 1000
+	}
+	return ""
+}
+
+// byteSize formats n in decimal units, binary ones with -human.
+func byteSize(n int64) string {
+	if human {
+		return size(n)
+	}
+	v := float64(n)
+	for _, unit := range []string{"B", "kB", "MB", "GB"} {
+		if v < 1000 || unit == "GB" {
+			return fmt.Sprintf("%.1f %s", v, unit)
+		}
+		v /= 1000
+	}
+	return ""
+}
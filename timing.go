@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// formatTiming returns the phases of res on one line, led by the wall
+// clock start of the request.
+func formatTiming(res *proxyclient.Result) string {
+	var parts []string
+	for _, p := range res.Phases {
+		if p.Name == "total" {
+			parts = append([]string{"start " + p.Start.Format(proxyclient.WallFormat)}, parts...)
+		}
+	}
+	if res.Reused {
+		parts = append(parts, "connection reused after "+dur(res.Idle.Round(time.Microsecond))+" idle")
+	}
+	for _, p := range res.Phases {
+		parts = append(parts, fmt.Sprintf("%s %s", p.Name, dur(p.Duration.Round(time.Microsecond))))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// tlsExtNames are the IANA names of the TLS extensions.
+var tlsExtNames = map[uint16]string{
+	0: "server_name", 1: "max_fragment_length", 5: "status_request",
+	10: "supported_groups", 11: "ec_point_formats", 13: "signature_algorithms",
+	15: "heartbeat", 16: "alpn", 18: "signed_certificate_timestamp",
+	21: "padding", 22: "encrypt_then_mac", 23: "extended_master_secret",
+	27: "compress_certificate", 28: "record_size_limit", 35: "session_ticket",
+	41: "pre_shared_key", 42: "early_data", 43: "supported_versions",
+	44: "cookie", 45: "psk_key_exchange_modes", 49: "post_handshake_auth",
+	50: "signature_algorithms_cert", 51: "key_share", 57: "quic_transport_parameters",
+	17513: "application_settings_old", 17613: "application_settings",
+	65037: "encrypted_client_hello", 65281: "renegotiation_info",
+}
+
+// helloRetryRandom marks a ServerHello as a HelloRetryRequest, RFC 8446 4.1.3.
+var helloRetryRandom, _ = hex.DecodeString("cf21ad74e59a6111be1d8c021e65b891c2a211167abb8c5e079e09e2c8a8339c")
+
+func tlsExtName(t uint16) string {
+	if t&0x0f0f == 0x0a0a && t>>8 == t&0xff {
+		return "grease"
+	}
+	if n, ok := tlsExtNames[t]; ok {
+		return n
+	}
+	return fmt.Sprintf("unknown(%d)", t)
+}
+
+type tlsExt struct {
+	typ  uint16
+	data []byte
+}
+
+// tlsReader reads the vectors of a TLS message, err set once it runs short.
+type tlsReader struct {
+	b   []byte
+	err bool
+}
+
+func (r *tlsReader) bytes(n int) []byte {
+	if r.err || len(r.b) < n {
+		r.err = true
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *tlsReader) u8() int {
+	if v := r.bytes(1); v != nil {
+		return int(v[0])
+	}
+	return 0
+}
+
+func (r *tlsReader) u16() int {
+	if v := r.bytes(2); v != nil {
+		return int(v[0])<<8 | int(v[1])
+	}
+	return 0
+}
+
+func (r *tlsReader) vec8() []byte  { return r.bytes(r.u8()) }
+func (r *tlsReader) vec16() []byte { return r.bytes(r.u16()) }
+
+func parseExtensions(b []byte) []tlsExt {
+	var exts []tlsExt
+	r := &tlsReader{b: b}
+	for len(r.b) > 0 {
+		t := uint16(r.u16())
+		data := r.vec16()
+		if r.err {
+			break
+		}
+		exts = append(exts, tlsExt{t, data})
+	}
+	return exts
+}
+
+type tlsRecord struct {
+	typ     byte
+	header  []byte
+	payload []byte
+}
+
+func splitRecords(b []byte) []tlsRecord {
+	var recs []tlsRecord
+	for len(b) >= 5 {
+		n := int(b[3])<<8 | int(b[4])
+		if len(b) < 5+n {
+			break
+		}
+		recs = append(recs, tlsRecord{b[0], b[:5], b[5 : 5+n]})
+		b = b[5+n:]
+	}
+	return recs
+}
+
+type handshakeMsg struct {
+	typ  byte
+	body []byte
+}
+
+// handshakeMessages splits a handshake stream into its complete messages.
+func handshakeMessages(b []byte) []handshakeMsg {
+	var msgs []handshakeMsg
+	for len(b) >= 4 {
+		n := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+		if len(b) < 4+n {
+			break
+		}
+		msgs = append(msgs, handshakeMsg{b[0], b[4 : 4+n]})
+		b = b[4+n:]
+	}
+	return msgs
+}
+
+// serverHello is a ServerHello or HelloRetryRequest.
+type serverHello struct {
+	retry bool
+	suite uint16
+	exts  []tlsExt
+}
+
+func parseServerHello(body []byte) serverHello {
+	r := &tlsReader{b: body}
+	r.u16()
+	random := r.bytes(32)
+	r.vec8()
+	h := serverHello{retry: bytes.Equal(random, helloRetryRandom), suite: uint16(r.u16())}
+	r.u8()
+	if exts := r.vec16(); !r.err {
+		h.exts = parseExtensions(exts)
+	}
+	return h
+}
+
+func clientHelloExtensions(body []byte) []tlsExt {
+	r := &tlsReader{b: body}
+	r.u16()
+	r.bytes(32)
+	r.vec8()
+	r.vec16()
+	r.vec8()
+	exts := r.vec16()
+	if r.err {
+		return nil
+	}
+	return parseExtensions(exts)
+}
+
+// describeExt is the extension's name, with the value for the ones a
+// server answers with a choice.
+func describeExt(e tlsExt) string {
+	name := tlsExtName(e.typ)
+	r := &tlsReader{b: e.data}
+	switch e.typ {
+	case 43:
+		if v := r.u16(); !r.err {
+			return name + "=" + tls.VersionName(uint16(v))
+		}
+	case 51:
+		if g := r.u16(); !r.err {
+			return name + "=" + tls.CurveID(g).String()
+		}
+	case 16:
+		list := &tlsReader{b: r.vec16()}
+		if p := list.vec8(); !r.err && !list.err {
+			return name + "=" + string(p)
+		}
+	}
+	if len(e.data) > 0 {
+		return fmt.Sprintf("%s (%d bytes)", name, len(e.data))
+	}
+	return name
+}
+
+// recordingConn keeps what the handshake sends and receives.
+type recordingConn struct {
+	net.Conn
+	in, out []byte
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in = append(c.in, p[:n]...)
+	return n, err
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.out = append(c.out, p...)
+	return c.Conn.Write(p)
+}
+
+// keyLog takes the server handshake traffic secret from the key log.
+type keyLog struct {
+	secret []byte
+}
+
+func (k *keyLog) Write(p []byte) (int, error) {
+	f := strings.Fields(string(p))
+	if len(f) == 3 && f[0] == "SERVER_HANDSHAKE_TRAFFIC_SECRET" {
+		k.secret, _ = hex.DecodeString(f[2])
+	}
+	return len(p), nil
+}
+
+// expandLabel is HKDF-Expand-Label of RFC 8446 7.1 with an empty context.
+func expandLabel(h func() hash.Hash, secret []byte, label string, n int) ([]byte, error) {
+	info := []byte{byte(n >> 8), byte(n), byte(len("tls13 ") + len(label))}
+	info = append(info, "tls13 "+label...)
+	info = append(info, 0)
+	return hkdf.Expand(h, secret, string(info), n)
+}
+
+// decryptHandshake opens the server's encrypted handshake records far
+// enough for the first message, EncryptedExtensions, and returns the
+// plaintext handshake stream.
+func decryptHandshake(suite uint16, secret []byte, recs []tlsRecord) ([]byte, error) {
+	var h func() hash.Hash
+	var keyLen int
+	switch suite {
+	case tls.TLS_AES_128_GCM_SHA256:
+		h, keyLen = sha256.New, 16
+	case tls.TLS_AES_256_GCM_SHA384:
+		h, keyLen = sha512.New384, 32
+	default:
+		return nil, fmt.Errorf("%s is not decrypted here", tls.CipherSuiteName(suite))
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("no handshake secret")
+	}
+	key, err := expandLabel(h, secret, "key", keyLen)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := expandLabel(h, secret, "iv", 12)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	var stream []byte
+	var seq uint64
+	for _, rec := range recs {
+		if rec.typ != 23 {
+			// change_cipher_spec, sent for middlebox compatibility
+			continue
+		}
+		nonce := append([]byte{}, iv...)
+		for i := 0; i < 8; i++ {
+			nonce[len(nonce)-1-i] ^= byte(seq >> (8 * i))
+		}
+		seq++
+		plain, err := aead.Open(nil, nonce, rec.payload, rec.header)
+		if err != nil {
+			return stream, err
+		}
+		// the content type is the last byte before the zero padding
+		i := len(plain) - 1
+		for i >= 0 && plain[i] == 0 {
+			i--
+		}
+		if i < 0 || plain[i] != 22 {
+			break
+		}
+		stream = append(stream, plain[:i]...)
+		if len(handshakeMessages(stream)) > 0 {
+			break
+		}
+	}
+	return stream, nil
+}
+
+// runTLSExtensions runs a TLS handshake with -dest through the tunnel, or
+// directly without a proxy, and lists the extensions on the wire: the
+// ones the client offered, the ServerHello's and, for TLS 1.3, the
+// EncryptedExtensions, decrypted with the session's handshake keys. An
+// extension the server sent without the client offering it is flagged,
+// RFC 8446 4.2 and RFC 5246 7.4.1.4 forbid those and intercepting
+// proxies are known to add them. It returns 1 when the handshake failed
+// or such an extension came.
+func runTLSExtensions(client *proxyclient.Client) int {
+	destURL, err := url.Parse(dest)
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 2
+	}
+	if destURL.Scheme != "https" {
+		fmt.Println("erro: -tls-extensions needs an https destination")
+		return 2
+	}
+	port := destURL.Port()
+	if port == "" {
+		port = "443"
+	}
+	addr := net.JoinHostPort(destURL.Hostname(), port)
+
+	var connectResp *http.Response
+	ctx := proxyclient.WithConnectResponse(context.Background(), &connectResp)
+	conn, err := client.Tunnel(ctx, addr)
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		if connectResp != nil && connectResp.StatusCode == http.StatusProxyAuthRequired {
+			return reportProxyAuth(connectResp.Header)
+		}
+		return 1
+	}
+	defer conn.Close()
+
+	rc := &recordingConn{Conn: conn}
+	keys := &keyLog{}
+	conf := client.TLSConfig()
+	if conf.ServerName == "" {
+		conf.ServerName = destURL.Hostname()
+	}
+	if len(conf.NextProtos) == 0 {
+		// what the transport offers on a request
+		conf.NextProtos = []string{"h2", "http/1.1"}
+	}
+	conf.KeyLogWriter = keys
+	tc := tls.Client(rc, conf)
+	herr := tc.HandshakeContext(ctx)
+
+	offered := map[uint16]bool{}
+	for _, rec := range splitRecords(rc.out) {
+		for _, m := range handshakeMessages(rec.payload) {
+			if m.typ != 1 {
+				continue
+			}
+			var names []string
+			for _, e := range clientHelloExtensions(m.body) {
+				offered[e.typ] = true
+				names = append(names, tlsExtName(e.typ))
+			}
+			fmt.Printf("tls ext: client hello: %s\n", strings.Join(names, ", "))
+		}
+	}
+
+	unasked := 0
+	list := func(what string, exts []tlsExt, allowed ...uint16) {
+		var s []string
+		for _, e := range exts {
+			s = append(s, describeExt(e))
+		}
+		fmt.Printf("tls ext: %s: %s\n", what, strings.Join(s, ", "))
+	next:
+		for _, e := range exts {
+			for _, a := range allowed {
+				if e.typ == a {
+					continue next
+				}
+			}
+			if !offered[e.typ] {
+				fmt.Printf("tls ext: WARN, %s sent %s, which the client did not offer\n", what, tlsExtName(e.typ))
+				unasked++
+			}
+		}
+	}
+
+	recs := splitRecords(rc.in)
+	var stream []byte
+	var hello *serverHello
+	var rest []tlsRecord
+	for i, rec := range recs {
+		if rec.typ != 22 {
+			continue
+		}
+		stream = append(stream, rec.payload...)
+		for _, m := range handshakeMessages(stream) {
+			stream = stream[4+len(m.body):]
+			if m.typ != 2 {
+				continue
+			}
+			h := parseServerHello(m.body)
+			if h.retry {
+				// the cookie is the one extension a HelloRetryRequest may add
+				list("hello retry request", h.exts, 44)
+				continue
+			}
+			list("server hello", h.exts)
+			hello, rest = &h, recs[i+1:]
+			break
+		}
+		if hello != nil {
+			break
+		}
+	}
+
+	switch {
+	case hello == nil:
+		fmt.Println("tls ext: no server hello received")
+	case hasExt(hello.exts, 43):
+		// supported_versions in a ServerHello means TLS 1.3
+		plain, err := decryptHandshake(hello.suite, keys.secret, rest)
+		msgs := handshakeMessages(plain)
+		switch {
+		case len(msgs) > 0 && msgs[0].typ == 8:
+			list("encrypted extensions", parseExtensions((&tlsReader{b: msgs[0].body}).vec16()))
+		case err != nil:
+			fmt.Printf("tls ext: encrypted extensions: not decrypted, %s\n", err)
+		default:
+			fmt.Println("tls ext: encrypted extensions: not found")
+		}
+	}
+
+	if herr != nil {
+		fmt.Printf("erro: tls handshake: %s\n", herr)
+		return 1
+	}
+	cs := tc.ConnectionState()
+	printTLS("client<->destination", &cs)
+	if unasked > 0 {
+		fmt.Printf("tls ext: FAIL, %d extension(s) sent unasked\n", unasked)
+		return 1
+	}
+	fmt.Println("tls ext: OK, every extension the server sent was offered")
+	return 0
+}
+
+func hasExt(exts []tlsExt, t uint16) bool {
+	for _, e := range exts {
+		if e.typ == t {
+			return true
+		}
+	}
+	return false
+}
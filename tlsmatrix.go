@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// matrixVersions are the versions tls-matrix tries, oldest first.
+var matrixVersions = []uint16{tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13}
+
+// matrixGroups are the key exchange groups tls-matrix tries one by one.
+var matrixGroups = []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521}
+
+// matrixTry is one handshake of the matrix: what it offered and how it
+// went.
+type matrixTry struct {
+	version uint16
+	suite   uint16
+	group   tls.CurveID
+
+	ok    bool
+	state tls.ConnectionState
+	err   error
+}
+
+// errTunnel marks a try that never got to the handshake.
+type errTunnel struct {
+	err     error
+	connect *http.Response
+}
+
+func (e *errTunnel) Error() string { return e.err.Error() }
+
+// runTLSMatrix implements `tls-matrix [flags] [PROXY...]`: for each
+// proxy, -proxy when none are listed and DIRECT for none, it runs TLS
+// handshakes with the https -dest through a tunnel, TLS 1.0 to 1.3, then
+// every cipher suite crypto/tls has under each version the destination
+// took and every key exchange group under the newest one, and prints
+// which the path lets through. The chain is not verified, only what the
+// handshake negotiates matters here. It returns 0 when every proxy got
+// at least one handshake through.
+func runTLSMatrix(cfg proxyclient.Config) int {
+	destURL, err := url.Parse(dest)
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 2
+	}
+	if destURL.Scheme != "https" {
+		fmt.Println("erro: tls-matrix needs an https destination")
+		return 2
+	}
+	if destParallel < 1 {
+		fmt.Println("erro: -parallel must be at least 1")
+		return 2
+	}
+	port := destURL.Port()
+	if port == "" {
+		port = "443"
+	}
+	addr := net.JoinHostPort(destURL.Hostname(), port)
+
+	proxies := flag.Args()
+	if len(proxies) == 0 {
+		proxies = []string{cfg.Proxy}
+	}
+	code := 0
+	for i, p := range proxies {
+		if i > 0 {
+			fmt.Println()
+		}
+		c := cfg
+		c.Proxy, c.Fallback = p, ""
+		if strings.EqualFold(p, "direct") {
+			c.Proxy = ""
+		}
+		client, err := proxyclient.New(c)
+		if err != nil {
+			fmt.Printf("erro: %s: %s\n", redactURL(p), err)
+			return 2
+		}
+		via := "directly"
+		if client.ProxyURL() != nil {
+			via = "through " + client.ProxyURL().Redacted()
+		}
+		fmt.Printf("tls-matrix: %s %s\n", addr, via)
+		if rc := tlsMatrix(client, destURL.Hostname(), addr); rc > code {
+			code = rc
+		}
+	}
+	return code
+}
+
+// tlsMatrix runs and prints the matrix for one client.
+func tlsMatrix(client *proxyclient.Client, host, addr string) int {
+	base := client.TLSConfig()
+	if base.ServerName == "" {
+		base.ServerName = host
+	}
+	base.InsecureSkipVerify = true
+	base.VerifyConnection = nil
+	if len(base.NextProtos) == 0 {
+		base.NextProtos = []string{"h2", "http/1.1"}
+	}
+	try := func(tries []*matrixTry) error {
+		sem := make(chan struct{}, destParallel)
+		var wg sync.WaitGroup
+		for _, t := range tries {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(t *matrixTry) {
+				defer func() { <-sem; wg.Done() }()
+				matrixHandshake(client, base, addr, t)
+			}(t)
+		}
+		wg.Wait()
+		for _, t := range tries {
+			if te, ok := t.err.(*errTunnel); ok {
+				return te
+			}
+		}
+		return nil
+	}
+	tunnelFailed := func(err error) int {
+		te := err.(*errTunnel)
+		fmt.Printf("erro: %s\n", te.err)
+		if te.connect != nil && te.connect.StatusCode == http.StatusProxyAuthRequired {
+			return reportProxyAuth(te.connect.Header)
+		}
+		return 1
+	}
+
+	var versions []*matrixTry
+	for _, v := range matrixVersions {
+		versions = append(versions, &matrixTry{version: v})
+	}
+	if err := try(versions); err != nil {
+		return tunnelFailed(err)
+	}
+	fmt.Printf("%-8s  %-9s  %s\n", "version", "supported", "negotiated")
+	var took []uint16
+	newest := uint16(0)
+	for _, t := range versions {
+		detail := shortTLSError(t.err)
+		if t.ok {
+			detail = tls.CipherSuiteName(t.state.CipherSuite) + ", " + t.state.CurveID.String()
+			took = append(took, t.version)
+			newest = t.version
+		}
+		fmt.Printf("%-8s  %-9s  %s\n", tls.VersionName(t.version), yesNo(t.ok), detail)
+	}
+	if newest == 0 {
+		fmt.Println("tls-matrix: FAIL, no TLS version got through")
+		return 1
+	}
+
+	// crypto/tls does not let TLS 1.3 suites be chosen, they are all
+	// offered and the server picks
+	var suites []*matrixTry
+	var legacy []uint16
+	for _, v := range took {
+		if v != tls.VersionTLS13 {
+			legacy = append(legacy, v)
+		}
+	}
+	if len(legacy) > 0 {
+		var all []*tls.CipherSuite
+		for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			tried := false
+			for _, v := range legacy {
+				if suiteSupports(s, v) {
+					suites = append(suites, &matrixTry{version: v, suite: s.ID})
+					tried = true
+				}
+			}
+			if tried {
+				all = append(all, s)
+			}
+		}
+		if err := try(suites); err != nil {
+			return tunnelFailed(err)
+		}
+		fmt.Println()
+		width := len("cipher suite")
+		for _, s := range all {
+			if len(s.Name) > width {
+				width = len(s.Name)
+			}
+		}
+		row := fmt.Sprintf("%-*s", width, "cipher suite")
+		for _, v := range legacy {
+			row += fmt.Sprintf("  %-7s", tls.VersionName(v))
+		}
+		fmt.Println(strings.TrimRight(row, " "))
+		for _, s := range all {
+			row := fmt.Sprintf("%-*s", width, s.Name)
+			for _, v := range legacy {
+				cell := "-"
+				for _, t := range suites {
+					if t.suite == s.ID && t.version == v {
+						cell = yesNo(t.ok)
+					}
+				}
+				row += fmt.Sprintf("  %-7s", cell)
+			}
+			fmt.Println(strings.TrimRight(row, " "))
+		}
+	}
+
+	var groups []*matrixTry
+	for _, g := range matrixGroups {
+		// hybrid groups are TLS 1.3 only
+		if g != tls.X25519MLKEM768 || newest == tls.VersionTLS13 {
+			groups = append(groups, &matrixTry{version: newest, group: g})
+		}
+	}
+	if err := try(groups); err != nil {
+		return tunnelFailed(err)
+	}
+	fmt.Println()
+	fmt.Printf("%-16s  %s\n", "group", tls.VersionName(newest))
+	for _, t := range groups {
+		fmt.Printf("%-16s  %s\n", t.group, yesNo(t.ok))
+	}
+
+	passed, total := 0, 0
+	for _, set := range [][]*matrixTry{versions, suites, groups} {
+		for _, t := range set {
+			total++
+			if t.ok {
+				passed++
+			}
+		}
+	}
+	fmt.Printf("tls-matrix: %d of %d handshakes succeeded\n", passed, total)
+	return 0
+}
+
+// matrixHandshake runs t's handshake over a fresh tunnel to addr.
+func matrixHandshake(client *proxyclient.Client, base *tls.Config, addr string, t *matrixTry) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var connectResp *http.Response
+	conn, err := client.Tunnel(proxyclient.WithConnectResponse(ctx, &connectResp), addr)
+	if err != nil {
+		t.err = &errTunnel{err: err, connect: connectResp}
+		return
+	}
+	defer conn.Close()
+	conf := base.Clone()
+	conf.MinVersion, conf.MaxVersion = t.version, t.version
+	if t.suite != 0 {
+		conf.CipherSuites = []uint16{t.suite}
+	}
+	if t.group != 0 {
+		conf.CurvePreferences = []tls.CurveID{t.group}
+	}
+	tc := tls.Client(conn, conf)
+	if t.err = tc.HandshakeContext(ctx); t.err == nil {
+		t.ok, t.state = true, tc.ConnectionState()
+	}
+}
+
+func suiteSupports(s *tls.CipherSuite, v uint16) bool {
+	for _, sv := range s.SupportedVersions {
+		if sv == v {
+			return true
+		}
+	}
+	return false
+}
+
+// shortTLSError drops the layers a refused handshake error comes in.
+func shortTLSError(err error) string {
+	if err == nil {
+		return ""
+	}
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	return err.Error()
+}
+
+func yesNo(ok bool) string {
+	if ok {
+		return "yes"
+	}
+	return "no"
+}
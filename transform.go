@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// streamCapture is how much of a streamed body is kept for the gateway
+// error classifier and -health body checks.
+const streamCapture = 1 << 20
+
+// streaming reports whether the body goes through the -decompress,
+// -grep, -head pipeline instead of being read whole.
+func streaming() bool {
+	return decompress || grep != "" || head > 0
+}
+
+// streamBody runs the response body through decompress, grep and head and
+// writes the result to w line by line, never holding the body in memory.
+// With -head it stops reading once enough lines went out. It returns the
+// first streamCapture bytes before filtering.
+func streamBody(resp *http.Response, w io.Writer) ([]byte, error) {
+	var r io.Reader = resp.Body
+	if decompress && !resp.Uncompressed {
+		dr, err := decoder(resp.Header.Get("Content-Encoding"), r)
+		if err != nil {
+			return nil, err
+		}
+		r = dr
+	}
+	capture := &limitedBuffer{max: streamCapture}
+	r = io.TeeReader(r, capture)
+
+	var re *regexp.Regexp
+	if grep != "" {
+		var err error
+		if re, err = regexp.Compile(grep); err != nil {
+			return nil, fmt.Errorf("-grep: %s", err)
+		}
+	}
+	if re == nil && head == 0 {
+		_, err := io.Copy(w, r)
+		return capture.Bytes(), err
+	}
+
+	br := bufio.NewReaderSize(r, 64<<10)
+	lines := 0
+	for head == 0 || lines < head {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 && (re == nil || re.Match(bytes.TrimRight(line, "\r\n"))) {
+			if !bytes.HasSuffix(line, []byte("\n")) {
+				line = append(line, '\n')
+			}
+			if _, werr := w.Write(line); werr != nil {
+				return capture.Bytes(), werr
+			}
+			lines++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return capture.Bytes(), err
+		}
+	}
+	return capture.Bytes(), nil
+}
+
+// decoder undoes a Content-Encoding. Identity and unknown codings, br
+// among them, pass through unchanged.
+func decoder(encoding string, r io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// deflate is specified as zlib, some servers send it raw
+		br := bufio.NewReader(r)
+		if b, err := br.Peek(2); err == nil && (uint16(b[0])<<8|uint16(b[1]))%31 == 0 && b[0]&0x0f == 8 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	}
+	return r, nil
+}
+
+// limitedBuffer keeps the first max bytes written to it.
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// trustProfile is a set of roots the destination chain is checked
+// against, the system store when pool is nil.
+type trustProfile struct {
+	name string
+	pool *x509.CertPool
+}
+
+// trustList collects repeated -trust flags: "system", or NAME=FILE for
+// the roots of a PEM bundle alone.
+type trustList []trustProfile
+
+var trustProfiles trustList
+
+func (l *trustList) String() string {
+	var names []string
+	for _, p := range *l {
+		names = append(names, p.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func (l *trustList) Set(v string) error {
+	if v == "system" {
+		*l = append(*l, trustProfile{name: v})
+		return nil
+	}
+	name, file, ok := strings.Cut(v, "=")
+	if !ok || name == "" || file == "" {
+		return fmt.Errorf("want system or NAME=FILE, got %q", v)
+	}
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("%s: no PEM certificates", file)
+	}
+	*l = append(*l, trustProfile{name: name, pool: pool})
+	return nil
+}
+
+// reportTrust verifies the chain the destination presented against every
+// -trust profile, for its name, and prints a line each: who would trust
+// it, the system store, a browser's bundle, the corporate CA alone. The
+// handshake has to succeed for a chain to be seen, -insecure lets one
+// through that the run's own roots reject. It returns 1 when no profile
+// trusts the chain.
+func reportTrust(resp *http.Response) int {
+	if resp.TLS == nil || resp.Request.URL.Scheme != "https" || len(resp.TLS.PeerCertificates) == 0 {
+		fmt.Println("trust: not checked, the destination is not https")
+		return 0
+	}
+	cs := resp.TLS
+	name := cs.ServerName
+	if name == "" {
+		name = resp.Request.URL.Hostname()
+	}
+	trusted := 0
+	for _, p := range trustProfiles {
+		chain, err := verifyChain(cs, name, p.pool)
+		if err != nil {
+			fmt.Printf("trust: %s FAIL: %s\n", p.name, err)
+			continue
+		}
+		trusted++
+		fmt.Printf("trust: %s PASS, root %s\n", p.name, chain[len(chain)-1].Subject)
+	}
+	fmt.Printf("trust: %d of %d profiles trust %s for %s\n", trusted, len(trustProfiles), cs.PeerCertificates[0].Subject, name)
+	if trusted == 0 {
+		return 1
+	}
+	return 0
+}
+
+// verifyChain verifies the peer chain of cs for name against roots, the
+// system's when nil, the other certificates presented as intermediates.
+func verifyChain(cs *tls.ConnectionState, name string, roots *x509.CertPool) ([]*x509.Certificate, error) {
+	inter := x509.NewCertPool()
+	for _, c := range cs.PeerCertificates[1:] {
+		inter.AddCert(c)
+	}
+	chains, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{DNSName: name, Roots: roots, Intermediates: inter})
+	if err != nil {
+		return nil, err
+	}
+	return chains[0], nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// runMaxTunnels opens tunnels to -dest one after the other, keeping them
+// all open, until the proxy refuses one or -max-tunnels are up. A tunnel
+// that takes far longer than the ones before counts as queued. Everything
+// is closed before it reports; it returns 1 only when not even the first
+// tunnel came up.
+func runMaxTunnels(client *proxyclient.Client) int {
+	if client.ProxyURL() == nil {
+		fmt.Println("erro: -max-tunnels needs a proxy")
+		return 2
+	}
+	destURL, err := url.Parse(dest)
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return 2
+	}
+	port := destURL.Port()
+	if port == "" {
+		port = "80"
+		if destURL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(destURL.Hostname(), port)
+	timeout := hopTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	var conns []net.Conn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	var took []time.Duration
+	refusal, queued := "", false
+	for len(conns) < maxTunnels {
+		var connectResp *http.Response
+		ctx, cancel := context.WithTimeout(proxyclient.WithConnectResponse(context.Background(), &connectResp), timeout)
+		start := time.Now()
+		conn, err := client.Tunnel(ctx, addr)
+		elapsed := time.Since(start)
+		cancel()
+		if err != nil {
+			refusal = tunnelRefusal(err, connectResp, timeout)
+			break
+		}
+		conns = append(conns, conn)
+		if slow := typicalTunnel(took); slow > 0 && elapsed > 5*slow && elapsed > time.Second {
+			fmt.Printf("tunnels: #%d took %s against %s typically, the proxy queues\n", len(conns), dur(elapsed.Round(time.Millisecond)), dur(slow.Round(time.Millisecond)))
+			queued = true
+			break
+		}
+		took = append(took, elapsed)
+		if len(conns)%50 == 0 {
+			fmt.Printf("tunnels: %d open\n", len(conns))
+		}
+	}
+
+	switch {
+	case len(conns) == 0:
+		fmt.Printf("tunnels: FAIL, the first tunnel did not come up: %s\n", refusal)
+		return 1
+	case refusal != "":
+		fmt.Printf("tunnels: ceiling %d, tunnel #%d refused: %s\n", len(conns), len(conns)+1, refusal)
+	case queued:
+		fmt.Printf("tunnels: ceiling about %d, later tunnels wait for a free slot\n", len(conns)-1)
+	default:
+		fmt.Printf("tunnels: no ceiling, all %d tunnels open at once\n", len(conns))
+	}
+	fmt.Printf("tunnels: closing %d\n", len(conns))
+	return 0
+}
+
+// typicalTunnel is the median setup time so far, 0 for too few samples.
+func typicalTunnel(took []time.Duration) time.Duration {
+	if len(took) < 3 {
+		return 0
+	}
+	sorted := append([]time.Duration{}, took...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
+
+// tunnelRefusal describes how the proxy turned a tunnel down.
+func tunnelRefusal(err error, connectResp *http.Response, timeout time.Duration) string {
+	switch {
+	case connectResp != nil:
+		return fmt.Sprintf("CONNECT answered %s", connectResp.Status)
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Sprintf("no answer within %s, queued or dropped", dur(timeout))
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection reset (RST)"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused, the proxy's listen queue or file descriptors ran out"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "connection closed without an answer"
+	}
+	return err.Error()
+}
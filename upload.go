@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// uploadBytes is -upload-size parsed, 0 for no generated body.
+var uploadBytes int64
+
+// generatedBody is an -upload-size body made as it is read, so no size
+// is held in memory: zeros, or bytes from the run's seed that proxies and
+// links cannot compress, the same on every replay.
+type generatedBody struct {
+	left int64
+	rand *rand.Rand
+}
+
+func newGeneratedBody() *generatedBody {
+	b := &generatedBody{left: uploadBytes}
+	if uploadData == "random" {
+		b.rand = newRand("upload")
+	}
+	return b
+}
+
+func (b *generatedBody) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	if b.rand != nil {
+		b.rand.Read(p)
+	} else {
+		for i := range p {
+			p[i] = 0
+		}
+	}
+	b.left -= int64(len(p))
+	return len(p), nil
+}
+
+func (b *generatedBody) Close() error { return nil }
+
+// checkUpload validates -upload-size and -upload-data against the other
+// body flags, and has the method default to POST with it.
+func checkUpload() error {
+	if uploadSize == "" {
+		return nil
+	}
+	methodSet := false
+	flag.Visit(func(f *flag.Flag) { methodSet = methodSet || f.Name == "method" })
+	n, err := parseSize(uploadSize)
+	if err != nil || n == 0 {
+		return fmt.Errorf("-upload-size wants a positive size, e.g. 100MB")
+	}
+	if data != "" || dataFile != "" {
+		return fmt.Errorf("-upload-size generates the body, it excludes -data and -data-file")
+	}
+	if uploadData != "random" && uploadData != "zero" {
+		return fmt.Errorf("-upload-data is random or zero, not %q", uploadData)
+	}
+	if !methodSet {
+		method = "POST"
+	}
+	if method != "POST" && method != "PUT" && method != "PATCH" {
+		return fmt.Errorf("-upload-size sends a body, use -method POST, PUT or PATCH")
+	}
+	uploadBytes = n
+	return nil
+}
+
+// printUpload reports how fast the body went out, from its first byte
+// read to its last: the upload throughput when the transport sent it
+// whole, how far the proxy let it get otherwise. A 413 is a request size
+// limit on the way.
+func printUpload(s *sentBody, resp *http.Response) {
+	took := s.last.Sub(s.first)
+	rate := ""
+	if took > 0 {
+		rate = fmt.Sprintf(", %s/s (%.1f Mbit/s)", size(int64(float64(s.n)/took.Seconds())), float64(s.n)*8/took.Seconds()/1e6)
+	}
+	fmt.Printf("upload: %s of %s in %s%s\n", size(s.n), size(uploadBytes), dur(took.Round(time.Microsecond)), rate)
+	if resp != nil && resp.StatusCode == http.StatusRequestEntityTooLarge {
+		fmt.Printf("upload: refused as too large, %s is over a request size limit of the proxy or the origin\n", size(uploadBytes))
+	}
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// watchTarget is one watched proxy and destination and what its checks
+// found so far.
+type watchTarget struct {
+	Proxy    string            `json:"proxy"`
+	Dest     string            `json:"dest"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Up       bool              `json:"up"`
+	Checks   int64             `json:"checks"`
+	Failures int64             `json:"failures"`
+	// InARow counts the failures since the last check that passed.
+	InARow    int                 `json:"failures_in_a_row"`
+	LastCheck time.Time           `json:"last_check"`
+	Latency   time.Duration       `json:"latency"`
+	Reason    string              `json:"reason,omitempty"`
+	Last      *proxyclient.Result `json:"last,omitempty"`
+
+	client *proxyclient.Client
+	// discovered is set on the targets -k8s-discover added, those its
+	// next sync may drop
+	discovered bool
+	// priority orders the round, higher first, from the priority tag
+	priority int
+}
+
+// name is how the lines of watch call t: by its proxy, with the
+// destination for one discovery added.
+func (t *watchTarget) name() string {
+	if t.discovered {
+		return t.Dest + " via " + t.Proxy
+	}
+	return t.Proxy
+}
+
+// key is what targets probed once share: the proxy, with its password
+// unlike the name, so two accounts on one proxy are probed apart, and the
+// destination.
+func (t *watchTarget) key() string {
+	return t.client.ProxyURL().String() + " " + t.Dest
+}
+
+// targetPriority is the priority tag of a target, 0 without one.
+func targetPriority(tags map[string]string) (int, error) {
+	v, ok := tags["priority"]
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("priority=%s is not a whole number", v)
+	}
+	return n, nil
+}
+
+// watchProxy is a proxy of watch and its client, shared by the targets
+// that check through it.
+type watchProxy struct {
+	name   string
+	tags   map[string]string
+	client *proxyclient.Client
+}
+
+// watchRecord is one check as the store keeps it, a JSON line each.
+type watchRecord struct {
+	Time    time.Time     `json:"time"`
+	Proxy   string        `json:"proxy"`
+	Dest    string        `json:"dest,omitempty"`
+	Up      bool          `json:"up"`
+	Status  int           `json:"status,omitempty"`
+	Latency time.Duration `json:"latency"`
+	Reason  string        `json:"reason,omitempty"`
+}
+
+// watcher probes every target each -watch-interval until interrupted.
+type watcher struct {
+	mu      sync.Mutex
+	targets []*watchTarget
+	// checks and failures count the whole run, the checks of targets a
+	// sync dropped included
+	checks, failures int64
+	store            checkStore
+	life             *lifecycle
+
+	proxies []*watchProxy
+	k8s     *k8sClient
+
+	// flights are the probes under way by proxy and destination, which
+	// the targets naming the same pair share rather than send again
+	flightMu sync.Mutex
+	flights  map[string]*watchFlight
+}
+
+// watchFlight is one probe and, once done is closed, what it found; out
+// is nil when the interrupt cut it off.
+type watchFlight struct {
+	done chan struct{}
+	out  *watchOutcome
+}
+
+// watchOutcome is the verdict of a probe.
+type watchOutcome struct {
+	up      bool
+	reason  string
+	latency time.Duration
+	res     *proxyclient.Result
+}
+
+// watchStoreFile is -watch-store: the file checks are appended to and
+// `report` reads, under the user config dir by default, nil with "none".
+func watchStoreFile() (string, error) {
+	if watchStore != "" {
+		return watchStore, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "poc-proxy-https", "watch.jsonl"), nil
+}
+
+// runWatch implements `watch [flags] PROXY...`: it checks -dest, and with
+// -k8s-discover the destinations annotated in the cluster, through each
+// proxy, -proxy when none are listed, every -watch-interval and prints a
+// line per check. A check passes on a response below 500 other
+// than 407, or by -health when given, and has to meet -assert-* as well.
+// -watch-listen serves the state as JSON on /status and as Prometheus
+// metrics on /metrics, with /healthz and /readyz for an orchestrator. It
+// runs until SIGINT or SIGTERM, lets the checks in flight finish for up
+// to -watch-drain and returns 0 then, 1 when a check did not meet
+// -assert-*.
+func runWatch(cfg proxyclient.Config) int {
+	var proxies []string
+	for _, arg := range flag.Args() {
+		p, err := splitTags(arg)
+		if err != nil {
+			fmt.Printf("erro: %s\n", err)
+			return 2
+		}
+		proxies = append(proxies, p)
+	}
+	if len(proxies) == 0 && cfg.Proxy != "" {
+		proxies = []string{cfg.Proxy}
+	}
+	if len(proxies) == 0 {
+		fmt.Println("erro: watch needs a proxy, -proxy or listed after the flags")
+		return 2
+	}
+	if !k8sDiscover {
+		// with discovery -filter picks targets, by the tags of the proxy
+		// and of the Kubernetes object together
+		var err error
+		if proxies, err = filterTargets("proxies", proxies); err != nil {
+			fmt.Printf("erro: %s\n", err)
+			return 2
+		}
+	}
+	if watchInterval <= 0 {
+		fmt.Println("erro: -watch-interval must be positive")
+		return 2
+	}
+	if watchWorkers <= 0 {
+		fmt.Println("erro: -watch-workers must be positive")
+		return 2
+	}
+	if k8sDiscover && k8sResync <= 0 {
+		fmt.Println("erro: -k8s-resync must be positive")
+		return 2
+	}
+	w := &watcher{life: &lifecycle{pending: "first checks not done"}}
+	for _, p := range proxies {
+		c := cfg
+		c.Proxy = p
+		// a check that went direct would hide the outage it is watching for
+		c.Fallback = ""
+		c.DenyInternal = !allowInternal
+		tags := targetTags[p]
+		if promReg != nil && len(tags) > 0 {
+			c.Observe = func(o proxyclient.Observation) { promReg.observeTagged(o, tags) }
+		}
+		client, err := proxyclient.New(c)
+		if err != nil {
+			fmt.Printf("erro: %s: %s\n", redactURL(p), err)
+			return 2
+		}
+		w.proxies = append(w.proxies, &watchProxy{name: client.ProxyURL().Redacted(), tags: tags, client: client})
+		if promReg != nil {
+			promReg.watch(client)
+		}
+	}
+	if dest != "" || !k8sDiscover {
+		if u, err := url.Parse(dest); err == nil && !allowInternal {
+			if err := w.proxies[0].client.CheckDestination(context.Background(), u.Hostname()); err != nil {
+				fmt.Printf("erro: %s, -allow-internal watches it anyway\n", err)
+				return 2
+			}
+		}
+		for _, p := range w.proxies {
+			tags := p.tags
+			if k8sDiscover {
+				if tags = mergeTags(p.tags, targetTags[dest]); !filters.selects(tags) {
+					continue
+				}
+			}
+			prio, err := targetPriority(tags)
+			if err != nil {
+				fmt.Printf("erro: %s: %s\n", p.name, err)
+				return 2
+			}
+			w.targets = append(w.targets, &watchTarget{Proxy: p.name, Dest: dest, Tags: tags, client: p.client, priority: prio})
+		}
+	}
+	if k8sDiscover {
+		k, err := inClusterK8s(k8sNamespace)
+		if err != nil {
+			fmt.Printf("erro: -k8s-discover: %s\n", err)
+			return 2
+		}
+		w.k8s = k
+		if err := w.sync(context.Background()); err != nil {
+			fmt.Printf("erro: -k8s-discover: %s\n", err)
+			return 2
+		}
+	}
+	store, where, err := openCheckStore()
+	if err != nil {
+		fmt.Printf("erro: watch store: %s\n", err)
+		return 2
+	}
+	if store != nil {
+		w.store = store
+		defer store.close()
+		fmt.Printf("watch: storing checks in %s\n", where)
+	}
+	var srv *http.Server
+	if watchListen != "" {
+		ln, err := net.Listen("tcp", watchListen)
+		if err != nil {
+			fmt.Printf("erro: %s\n", err)
+			return 2
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/status", w.serveStatus)
+		mux.HandleFunc("/metrics", w.serveWatchMetrics)
+		mux.HandleFunc("/checks", w.serveChecks)
+		w.life.handle(mux)
+		srv = &http.Server{Handler: mux}
+		go srv.Serve(ln)
+		fmt.Printf("watch: http://%s/status, /checks, /metrics, /healthz and /readyz\n", ln.Addr())
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// the checks outlive the signal, they are drained, not cut off
+	checks, cancelChecks := context.WithCancel(context.Background())
+	defer cancelChecks()
+	if w.k8s != nil {
+		fmt.Printf("watch: %d proxies, %d targets every %s, discovery every %s\n", len(w.proxies), len(w.targets), dur(watchInterval), dur(k8sResync))
+	} else {
+		fmt.Printf("watch: %d proxies, %s every %s\n", len(w.targets), dest, dur(watchInterval))
+	}
+	synced := time.Now()
+	// rounds start on a fixed schedule, a slow round does not push the
+	// ones after it back
+	next := time.Now()
+	for ctx.Err() == nil {
+		if w.k8s != nil && time.Since(synced) >= k8sResync {
+			if err := w.sync(ctx); err != nil && ctx.Err() == nil {
+				fmt.Printf("watch: discovery failed, the targets stay as they were: %s\n", err)
+			}
+			synced = time.Now()
+		}
+		start := time.Now()
+		round := w.round(checks, ctx)
+		select {
+		case <-round:
+			w.life.setReady()
+			if next = next.Add(watchInterval); !next.After(time.Now()) {
+				fmt.Printf("watch: the round took %s, longer than -watch-interval; raise -watch-workers or the interval\n", dur(time.Since(start)))
+				for !next.After(time.Now()) {
+					next = next.Add(watchInterval)
+				}
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Until(next)):
+			}
+		case <-ctx.Done():
+			w.life.drain("watch", "the checks in flight", watchDrain, round, cancelChecks)
+			<-round
+		}
+	}
+	shutdown(srv)
+	fmt.Println("watch: stopped")
+	if assertChecks != nil {
+		return reportUnmet("watch", "checks", int(w.failures), int(w.checks))
+	}
+	return 0
+}
+
+// sync brings the discovered targets in line with the cluster: one per
+// proxy for every annotated destination -filter selects, added or
+// dropped as the annotations come and go. The other targets stay.
+func (w *watcher) sync(ctx context.Context) error {
+	found, err := w.k8s.discover(ctx)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	have := map[string]bool{}
+	for _, t := range w.targets {
+		if t.discovered {
+			have[t.Proxy+" "+t.Dest] = true
+		}
+	}
+	w.mu.Unlock()
+
+	want := map[string]bool{}
+	var added []*watchTarget
+	for _, d := range found {
+		refused := false
+		if !allowInternal {
+			u, err := url.Parse(d.url)
+			if err == nil {
+				err = w.proxies[0].client.CheckDestination(ctx, u.Hostname())
+			}
+			if err != nil {
+				fmt.Printf("watch: %s/%s %s: skipped, %s\n", d.tags["k8s_namespace"], d.tags["k8s_name"], d.url, err)
+				refused = true
+			}
+		}
+		for _, p := range w.proxies {
+			tags := mergeTags(p.tags, d.tags)
+			if refused || !filters.selects(tags) {
+				continue
+			}
+			key := p.name + " " + d.url
+			want[key] = true
+			if have[key] {
+				continue
+			}
+			prio, err := targetPriority(tags)
+			if err != nil {
+				fmt.Printf("watch: %s/%s %s: skipped, %s\n", d.tags["k8s_namespace"], d.tags["k8s_name"], d.url, err)
+				delete(want, key)
+				continue
+			}
+			added = append(added, &watchTarget{Proxy: p.name, Dest: d.url, Tags: tags, client: p.client, discovered: true, priority: prio})
+		}
+	}
+
+	w.mu.Lock()
+	// a new slice, the round under way ranges over the old one
+	targets := make([]*watchTarget, 0, len(w.targets)+len(added))
+	for _, t := range w.targets {
+		if t.discovered && !want[t.Proxy+" "+t.Dest] {
+			fmt.Printf("watch: - %s\n", t.name())
+			continue
+		}
+		targets = append(targets, t)
+	}
+	for _, t := range added {
+		fmt.Printf("watch: + %s\n", t.name())
+	}
+	w.targets = append(targets, added...)
+	w.mu.Unlock()
+	return nil
+}
+
+// round checks every target with -watch-workers checks at most under way,
+// those of higher priority first; the channel is closed when all are
+// done. Once stop is done no more checks start, ctx cancels those under
+// way.
+func (w *watcher) round(ctx, stop context.Context) chan struct{} {
+	w.mu.Lock()
+	targets := append([]*watchTarget(nil), w.targets...)
+	w.mu.Unlock()
+	// duplicates side by side are under way together, so they share a probe
+	sort.SliceStable(targets, func(i, j int) bool {
+		if targets[i].priority != targets[j].priority {
+			return targets[i].priority > targets[j].priority
+		}
+		return targets[i].key() < targets[j].key()
+	})
+	queue := make(chan *watchTarget)
+	var wg sync.WaitGroup
+	for i := 0; i < watchWorkers && i < len(targets); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range queue {
+				w.check(ctx, t)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer wg.Wait()
+		defer close(queue)
+		for _, t := range targets {
+			if stop.Err() != nil {
+				return
+			}
+			select {
+			case queue <- t:
+			case <-stop.Done():
+				return
+			}
+		}
+	}()
+	return done
+}
+
+// check probes the destination through t once and records the outcome.
+func (w *watcher) check(ctx context.Context, t *watchTarget) {
+	o := w.probe(ctx, t)
+	if o == nil {
+		return
+	}
+	up, reason, latency, res := o.up, o.reason, o.latency, o.res
+
+	w.mu.Lock()
+	t.Checks++
+	w.checks++
+	t.LastCheck = time.Now()
+	t.Latency = latency
+	t.Last = res
+	t.Up, t.Reason = up, reason
+	if up {
+		t.InARow = 0
+	} else {
+		t.Failures++
+		w.failures++
+		t.InARow++
+	}
+	inARow := t.InARow
+	if w.store != nil {
+		if err := w.store.add(watchRecord{Time: t.LastCheck, Proxy: t.Proxy, Dest: t.Dest, Up: up, Status: res.Status, Latency: latency, Reason: reason}); err != nil {
+			fmt.Printf("erro: watch store: %s\n", err)
+		}
+	}
+	w.mu.Unlock()
+
+	switch {
+	case up && res.Status != 0:
+		fmt.Printf("watch: %s OK %d %s\n", t.name(), res.Status, dur(latency))
+	case up:
+		fmt.Printf("watch: %s OK %s\n", t.name(), dur(latency))
+	default:
+		fmt.Printf("watch: %s FAIL %s (%d in a row)\n", t.name(), reason, inARow)
+	}
+}
+
+// probe sends the check of t, or waits for the one another target with
+// the same proxy and destination has under way and takes its outcome; a
+// proxy listed twice, or a -dest that discovery finds again, is probed once.
+func (w *watcher) probe(ctx context.Context, t *watchTarget) *watchOutcome {
+	key := t.key()
+	w.flightMu.Lock()
+	if f, ok := w.flights[key]; ok {
+		w.flightMu.Unlock()
+		<-f.done
+		return f.out
+	}
+	if w.flights == nil {
+		w.flights = map[string]*watchFlight{}
+	}
+	f := &watchFlight{done: make(chan struct{})}
+	w.flights[key] = f
+	w.flightMu.Unlock()
+
+	f.out = w.probeOnce(ctx, t)
+	w.flightMu.Lock()
+	delete(w.flights, key)
+	w.flightMu.Unlock()
+	close(f.done)
+	return f.out
+}
+
+// probeOnce requests the destination of t through its proxy and judges
+// the answer.
+func (w *watcher) probeOnce(ctx context.Context, t *watchTarget) *watchOutcome {
+	req, err := destRequestTo(t.Dest)
+	if err != nil {
+		fmt.Printf("erro: %s\n", err)
+		return nil
+	}
+	resp, res, err := t.client.Measure(req.WithContext(ctx))
+	var body []byte
+	if err == nil {
+		body, err = readForChecks(resp.Body)
+		resp.Body.Close()
+	}
+	if ctx.Err() != nil {
+		// cut off by the interrupt, it says nothing about the proxy
+		return nil
+	}
+	var latency time.Duration
+	for _, p := range res.Phases {
+		if p.Name == "total" {
+			latency = p.Duration
+		}
+	}
+
+	up, reason := false, ""
+	switch {
+	case err != nil:
+		reason = fmt.Sprintf("%s: %s", res.ErrorClass, err)
+	case healthChecks != nil:
+		up, reason = passesHealth(healthChecks, resp, body, latency)
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusProxyAuthRequired:
+		reason = withPage(resp.Status, resp, body)
+	default:
+		up = true
+	}
+	if up && assertChecks != nil {
+		if up, reason = passesAssertions(assertChecks, resp, body, latency); !up {
+			reason = withPage(reason, resp, body)
+		}
+	}
+	return &watchOutcome{up: up, reason: reason, latency: latency, res: res}
+}
+
+func (w *watcher) serveStatus(rw http.ResponseWriter, r *http.Request) {
+	w.mu.Lock()
+	data, err := json.MarshalIndent(w.targets, "", "  ")
+	w.mu.Unlock()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(append(data, '\n'))
+}
+
+// serveChecks writes the stored checks as JSON, those of ?proxy= and
+// ?dest= only when given.
+func (w *watcher) serveChecks(rw http.ResponseWriter, r *http.Request) {
+	if w.store == nil {
+		http.Error(rw, "no -watch-store", http.StatusNotFound)
+		return
+	}
+	records, err := w.store.records()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	q := r.URL.Query()
+	if p, d := q.Get("proxy"), q.Get("dest"); p != "" || d != "" {
+		only := []watchRecord{}
+		for _, rec := range records {
+			if (p == "" || rec.Proxy == p) && (d == "" || rec.Dest == d) {
+				only = append(only, rec)
+			}
+		}
+		records = only
+	}
+	if records == nil {
+		records = []watchRecord{}
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(append(data, '\n'))
+}
+
+// serveWatchMetrics writes the targets in the Prometheus text format,
+// followed by the request metrics.
+func (w *watcher) serveWatchMetrics(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.writeMetrics(rw)
+	if promReg != nil {
+		promReg.write(rw)
+	}
+}
+
+func (w *watcher) writeMetrics(rw io.Writer) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	metric := func(name, kind, help string, value func(t *watchTarget) string) {
+		fmt.Fprintf(rw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, t := range w.targets {
+			if t.Checks > 0 {
+				fmt.Fprintf(rw, "%s{proxy=\"%s\",dest=\"%s\"} %s\n", name, promLabel.Replace(t.Proxy), promLabel.Replace(t.Dest), value(t))
+			}
+		}
+	}
+	metric("poc_proxy_https_watch_up", "gauge", "Whether the last check through the proxy passed.", func(t *watchTarget) string {
+		if t.Up {
+			return "1"
+		}
+		return "0"
+	})
+	metric("poc_proxy_https_watch_checks_total", "counter", "Checks run through the proxy.", func(t *watchTarget) string {
+		return fmt.Sprint(t.Checks)
+	})
+	metric("poc_proxy_https_watch_failures_total", "counter", "Checks through the proxy that failed.", func(t *watchTarget) string {
+		return fmt.Sprint(t.Failures)
+	})
+	metric("poc_proxy_https_watch_latency_seconds", "gauge", "Duration of the last check.", func(t *watchTarget) string {
+		return fmt.Sprint(t.Latency.Seconds())
+	})
+	metric("poc_proxy_https_watch_last_check_timestamp_seconds", "gauge", "When the last check ran, as a Unix time.", func(t *watchTarget) string {
+		return fmt.Sprintf("%.3f", float64(t.LastCheck.UnixNano())/1e9)
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+func TestWatchSharesProbes(t *testing.T) {
+	var probes int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&probes, 1)
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer proxy.Close()
+	watchWorkers = 8
+	defer func() { watchWorkers = 0 }()
+	w := &watcher{}
+	for _, dest := range []string{"http://a.example/", "http://a.example/", "http://b.example/"} {
+		// a client each, as for a proxy listed twice
+		client, err := proxyclient.New(proxyclient.Config{Proxy: proxy.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.targets = append(w.targets, &watchTarget{Proxy: proxy.URL, Dest: dest, client: client})
+	}
+	<-w.round(context.Background(), context.Background())
+	if n := atomic.LoadInt32(&probes); n != 2 {
+		t.Errorf("3 targets on 2 destinations sent %d probes, want 2", n)
+	}
+	for _, tg := range w.targets {
+		if tg.Checks != 1 || !tg.Up {
+			t.Errorf("%s: %d checks, up %v, want 1 passed", tg.Dest, tg.Checks, tg.Up)
+		}
+	}
+}
+
+func TestWatchRoundOrder(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	var running, most int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		mu.Lock()
+		order = append(order, r.URL.Host)
+		if n > most {
+			most = n
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer proxy.Close()
+	client, err := proxyclient.New(proxyclient.Config{Proxy: proxy.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchWorkers = 1
+	w := &watcher{}
+	for _, tt := range []struct {
+		host     string
+		priority int
+	}{{"low.example", -1}, {"b.example", 0}, {"sla.example", 10}, {"a.example", 0}, {"gold.example", 5}} {
+		w.targets = append(w.targets, &watchTarget{Proxy: proxy.URL, Dest: "http://" + tt.host + "/", client: client, priority: tt.priority})
+	}
+	<-w.round(context.Background(), context.Background())
+	want := []string{"sla.example", "gold.example", "a.example", "b.example", "low.example"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("one worker checked %v, want %v", order, want)
+	}
+
+	watchWorkers = 2
+	defer func() { watchWorkers = 0 }()
+	<-w.round(context.Background(), context.Background())
+	if most != 2 {
+		t.Errorf("2 workers had %d checks under way at most, want 2", most)
+	}
+
+	stop, cancel := context.WithCancel(context.Background())
+	cancel()
+	order = nil
+	<-w.round(context.Background(), stop)
+	if len(order) > 0 {
+		t.Errorf("a stopped round checked %v", order)
+	}
+}
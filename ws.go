@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/LeoCBS/poc-proxy-https/proxyclient"
+)
+
+// WebSocket opcodes (RFC 6455).
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xa
+)
+
+// wsGUID is appended to the key to compute Sec-WebSocket-Accept.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// runWS implements the ws subcommand: it opens a CONNECT tunnel to the
+// ws:// or wss:// -dest, upgrades it, and checks a ping is answered with a
+// pong and a text message comes back. It returns 1 when the upgrade or the
+// ping fails; a missing echo is only reported, not every server echoes.
+func runWS(client *proxyclient.Client) int {
+	u, err := url.Parse(dest)
+	if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") {
+		fmt.Println("erro: ws needs a ws:// or wss:// -dest")
+		return 2
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	start := time.Now()
+	conn, err := client.Tunnel(ctx, addr)
+	if err != nil {
+		fmt.Printf("ws tunnel: FAIL %s\n", err)
+		return 1
+	}
+	defer conn.Close()
+	fmt.Printf("ws tunnel: %s %s\n", addr, dur(time.Since(start)))
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if u.Scheme == "wss" {
+		conf := client.TLSConfig()
+		if conf.ServerName == "" {
+			conf.ServerName = u.Hostname()
+		}
+		// the upgrade is an HTTP/1.1 mechanism
+		conf.NextProtos = []string{"http/1.1"}
+		tc := tls.Client(conn, conf)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			fmt.Printf("ws tls: FAIL %s\n", err)
+			return 1
+		}
+		cs := tc.ConnectionState()
+		printTLS("client<->destination", &cs)
+		conn = tc
+	}
+
+	br := bufio.NewReader(conn)
+	if err := wsHandshake(conn, br, u); err != nil {
+		fmt.Printf("ws upgrade: FAIL %s\n", err)
+		return 1
+	}
+	fmt.Println("ws upgrade: OK, 101 Switching Protocols with a valid Sec-WebSocket-Accept")
+
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	code := 0
+	start = time.Now()
+	if err := wsWriteFrame(conn, wsPing, nonce); err != nil {
+		fmt.Printf("ws ping: FAIL %s\n", err)
+		return 1
+	}
+	echo := []byte("poc-proxy-https " + hex.EncodeToString(nonce))
+	if err := wsWriteFrame(conn, wsText, echo); err != nil {
+		fmt.Printf("ws echo: FAIL %s\n", err)
+		return 1
+	}
+
+	// the pong may arrive before or after the echo
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	gotPong, gotEcho := false, false
+read:
+	for !gotPong || !gotEcho {
+		op, payload, err := wsReadFrame(br)
+		if err != nil {
+			break
+		}
+		switch op {
+		case wsPong:
+			if bytes.Equal(payload, nonce) {
+				gotPong = true
+				fmt.Printf("ws ping: OK, pong in %s\n", dur(time.Since(start)))
+			}
+		case wsText:
+			gotEcho = true
+			if bytes.Equal(payload, echo) {
+				fmt.Printf("ws echo: OK in %s\n", dur(time.Since(start)))
+			} else {
+				fmt.Printf("ws echo: got a different message %q\n", payload)
+			}
+		case wsPing:
+			wsWriteFrame(conn, wsPong, payload)
+		case wsClose:
+			fmt.Println("ws: server closed the connection")
+			break read
+		}
+	}
+	if !gotPong {
+		fmt.Println("ws ping: FAIL, no pong within 5s, the proxy may not relay frames after the upgrade")
+		code = 1
+	}
+	if !gotEcho {
+		fmt.Println("ws echo: no message back within 5s, the server may not be an echo server")
+	}
+	wsWriteFrame(conn, wsClose, []byte{0x03, 0xe8}) // 1000 normal closure
+	return code
+}
+
+// wsHandshake sends the upgrade request and checks the 101 answer.
+func wsHandshake(conn net.Conn, br *bufio.Reader, u *url.URL) error {
+	keyBytes := make([]byte, 16)
+	rand.Read(keyBytes)
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Host:   u.Host,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-WebSocket-Key":     {key},
+			"Sec-WebSocket-Version": {"13"},
+		},
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	setHeaders(req)
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return fmt.Errorf("%s, the proxy or server refused the upgrade", resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		return fmt.Errorf("101 without Upgrade: websocket, got %q", resp.Header.Get("Upgrade"))
+	}
+	sum := sha1.Sum([]byte(key + wsGUID))
+	if want := base64.StdEncoding.EncodeToString(sum[:]); resp.Header.Get("Sec-WebSocket-Accept") != want {
+		return fmt.Errorf("Sec-WebSocket-Accept %q, want %q, the handshake was altered on the way", resp.Header.Get("Sec-WebSocket-Accept"), want)
+	}
+	return nil
+}
+
+// wsWriteFrame writes one final, masked frame, as clients must.
+func wsWriteFrame(w io.Writer, op byte, payload []byte) error {
+	frame := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// wsReadFrame reads one frame, fragments are returned as they come.
+func wsReadFrame(r *bufio.Reader) (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	op := head[0] & 0x0f
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > 1<<20 {
+		return 0, nil, fmt.Errorf("frame of %d bytes", n)
+	}
+	var mask [4]byte
+	masked := head[1]&0x80 != 0
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return op, payload, nil
+}